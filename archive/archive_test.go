@@ -3,6 +3,7 @@ package archive
 import (
 	"archive/tar"
 	"archive/zip"
+	"bytes"
 	"github.com/buppyio/bpy/fs/fsutil"
 	"github.com/buppyio/bpy/testhelp"
 	"io"
@@ -10,6 +11,7 @@ import (
 	"math/rand"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -186,3 +188,73 @@ func TestZip(t *testing.T) {
 	}
 
 }
+
+func TestTarSparse(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "buppytesttar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	sparsed := filepath.Join(tmp, "sparse")
+	err = os.Mkdir(sparsed, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Enough data regions to need extended sparse headers, a name that
+	// needs a long name entry, and a trailing hole.
+	name := strings.Repeat("x", 120)
+	f, err := os.Create(filepath.Join(sparsed, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < 30; i++ {
+		_, err = f.WriteAt([]byte("data"), i*1024*1024+100)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = f.Truncate(32 * 1024 * 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := testhelp.NewMemStore()
+	dirEnt, err := fsutil.CpHostToFs(store, sparsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	err = Tar(store, dirEnt.HTree.Data, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() > 4*1024*1024 {
+		t.Fatalf("sparse tar is %d bytes", buf.Len())
+	}
+	tr := tar.NewReader(&buf)
+	h, err := tr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Name != name || h.Size != 32*1024*1024 {
+		t.Fatalf("bad header %s %d", h.Name, h.Size)
+	}
+	got, err := ioutil.ReadAll(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := ioutil.ReadFile(filepath.Join(sparsed, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, expected) {
+		t.Fatal("data differs")
+	}
+	_, err = tr.Next()
+	if err != io.EOF {
+		t.Fatalf("expected eof, got %v", err)
+	}
+}
@@ -0,0 +1,168 @@
+package archive
+
+import (
+	"archive/tar"
+	"fmt"
+	"github.com/buppyio/bpy/fs"
+	"github.com/buppyio/bpy/htree"
+	"io"
+)
+
+// archive/tar can read but not write sparse files, so they are written
+// as old GNU sparse entries by hand. Headers are laid out as in GNU tar's
+// oldgnu_header, and extended sparse headers hold 21 entries each.
+const (
+	blockSize         = 512
+	gnuMaxName        = 100
+	gnuHeaderSparse   = 4
+	gnuExtendedSparse = 21
+)
+
+func formatNumeric(buf []byte, n int64) {
+	if n >= 0 && n < 1<<uint(3*(len(buf)-1)) {
+		s := fmt.Sprintf("%0*o", len(buf)-1, n)
+		copy(buf, s)
+		buf[len(buf)-1] = 0
+		return
+	}
+	// GNU base-256 encoding for values too large for octal.
+	for i := len(buf) - 1; i > 0; i-- {
+		buf[i] = byte(n)
+		n >>= 8
+	}
+	buf[0] = 0x80
+}
+
+func min(a, b int) int {
+	if a > b {
+		return b
+	}
+	return a
+}
+
+func formatSparse(buf []byte, ext htree.Extent) {
+	formatNumeric(buf[0:12], ext.Offset)
+	formatNumeric(buf[12:24], ext.Size)
+}
+
+func gnuHeader(name string, typeflag byte, size int64, hdr *tar.Header) []byte {
+	block := make([]byte, blockSize)
+	copy(block[0:100], name)
+	formatNumeric(block[100:108], hdr.Mode)
+	formatNumeric(block[108:116], int64(hdr.Uid))
+	formatNumeric(block[116:124], int64(hdr.Gid))
+	formatNumeric(block[124:136], size)
+	formatNumeric(block[136:148], hdr.ModTime.Unix())
+	block[156] = typeflag
+	copy(block[257:265], "ustar  \x00")
+	copy(block[265:297], hdr.Uname)
+	copy(block[297:329], hdr.Gname)
+	return block
+}
+
+func setChecksum(block []byte) {
+	copy(block[148:156], "        ")
+	sum := int64(0)
+	for _, b := range block {
+		sum += int64(b)
+	}
+	copy(block[148:156], fmt.Sprintf("%06o\x00 ", sum))
+}
+
+func writePadding(out io.Writer, n int64) error {
+	var zeros [blockSize]byte
+	if n%blockSize == 0 {
+		return nil
+	}
+	_, err := out.Write(zeros[:blockSize-n%blockSize])
+	return err
+}
+
+// GNU tar reads the data of each extent in whole blocks, so extents are
+// widened to block boundaries for it to agree with other readers.
+func alignExtents(exts []htree.Extent, size int64) []htree.Extent {
+	aligned := make([]htree.Extent, 0, len(exts))
+	for _, ext := range exts {
+		start := ext.Offset &^ (blockSize - 1)
+		end := (ext.Offset + ext.Size + blockSize - 1) &^ (blockSize - 1)
+		if end > size {
+			end = size
+		}
+		n := len(aligned)
+		if n != 0 && aligned[n-1].Offset+aligned[n-1].Size >= start {
+			aligned[n-1].Size = end - aligned[n-1].Offset
+			continue
+		}
+		aligned = append(aligned, htree.Extent{Offset: start, Size: end - start})
+	}
+	return aligned
+}
+
+func writeSparse(out io.Writer, f *fs.FileReader, hdr *tar.Header, exts []htree.Extent) error {
+	exts = alignExtents(exts, hdr.Size)
+	if len(hdr.Name) > gnuMaxName {
+		long := gnuHeader("././@LongLink", 'L', int64(len(hdr.Name)+1), hdr)
+		setChecksum(long)
+		_, err := out.Write(long)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(out, hdr.Name+"\x00")
+		if err != nil {
+			return err
+		}
+		err = writePadding(out, int64(len(hdr.Name)+1))
+		if err != nil {
+			return err
+		}
+	}
+	if len(exts) == 0 || exts[len(exts)-1].Offset+exts[len(exts)-1].Size != hdr.Size {
+		// A trailing empty extent records the size of a final hole.
+		exts = append(exts, htree.Extent{Offset: hdr.Size})
+	}
+	stored := int64(0)
+	for _, ext := range exts {
+		stored += ext.Size
+	}
+	block := gnuHeader(hdr.Name, 'S', stored, hdr)
+	formatNumeric(block[483:495], hdr.Size)
+	n := min(len(exts), gnuHeaderSparse)
+	for i, ext := range exts[:n] {
+		formatSparse(block[386+i*24:], ext)
+	}
+	rest := exts[n:]
+	if len(rest) != 0 {
+		block[482] = 1
+	}
+	setChecksum(block)
+	_, err := out.Write(block)
+	if err != nil {
+		return err
+	}
+	for len(rest) != 0 {
+		block = make([]byte, blockSize)
+		n = min(len(rest), gnuExtendedSparse)
+		for i, ext := range rest[:n] {
+			formatSparse(block[i*24:], ext)
+		}
+		rest = rest[n:]
+		if len(rest) != 0 {
+			block[504] = 1
+		}
+		_, err = out.Write(block)
+		if err != nil {
+			return err
+		}
+	}
+	for _, ext := range exts {
+		_, err = f.Seek(ext.Offset, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		_, err = io.CopyN(out, f, ext.Size)
+		if err != nil {
+			return err
+		}
+	}
+	return writePadding(out, stored)
+}
@@ -4,27 +4,28 @@ import (
 	"archive/tar"
 	"github.com/buppyio/bpy"
 	"github.com/buppyio/bpy/fs"
+	"github.com/buppyio/bpy/htree"
 	"io"
 	"path"
 )
 
 func Tar(store bpy.CStore, dirHash [32]byte, out io.Writer) error {
 	tw := tar.NewWriter(out)
-	err := writeTar(store, "", dirHash, tw)
+	err := writeTar(store, "", dirHash, tw, out)
 	if err != nil {
 		return err
 	}
 	return tw.Close()
 }
 
-func writeTar(store bpy.CStore, curpath string, dirHash [32]byte, out *tar.Writer) error {
+func writeTar(store bpy.CStore, curpath string, dirHash [32]byte, tw *tar.Writer, out io.Writer) error {
 	ents, err := fs.ReadDir(store, dirHash)
 	if err != nil {
 		return err
 	}
 	for _, ent := range ents[1:] {
 		if ent.IsDir() {
-			err = writeTar(store, path.Join(curpath, ent.EntName), ent.HTree.Data, out)
+			err = writeTar(store, path.Join(curpath, ent.EntName), ent.HTree.Data, tw, out)
 			if err != nil {
 				return err
 			}
@@ -39,11 +40,22 @@ func writeTar(store bpy.CStore, curpath string, dirHash [32]byte, out *tar.Write
 			return err
 		}
 		hdr.Name = path.Join(curpath, ent.EntName)
-		err = out.WriteHeader(hdr)
+		exts, err := htree.DataExtents(store, ent.HTree, ent.EntSize)
 		if err != nil {
 			return err
 		}
-		_, err = io.Copy(out, f)
+		if len(exts) == 1 && exts[0].Size == ent.EntSize || ent.EntSize == 0 {
+			err = tw.WriteHeader(hdr)
+			if err == nil {
+				_, err = io.Copy(tw, f)
+			}
+		} else {
+			// Sparse entries bypass tw, so the previous entry is padded first.
+			err = tw.Flush()
+			if err == nil {
+				err = writeSparse(out, f, hdr, exts)
+			}
+		}
 		if err != nil {
 			return err
 		}
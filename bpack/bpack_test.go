@@ -44,7 +44,7 @@ func TestBpack(t *testing.T) {
 	var buf [1024 * 1024 * 10]byte
 
 	bufw := &bufwriter{off: 0, buf: buf[:]}
-	w, err := NewWriter(bufw)
+	w, err := NewWriter(bufw, Header{Codec: CodecNone, HashAlg: HashSHA256})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -79,6 +79,13 @@ func TestBpack(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	hdr, err := r.ReadHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Version != CurrentVersion || hdr.HashAlg != HashSHA256 {
+		t.Fatalf("bad header %v", hdr)
+	}
 	for k, v := range has {
 		gotv, err := r.Get(string(k))
 		if err != nil {
@@ -94,7 +101,7 @@ func TestEncryptedBpack(t *testing.T) {
 	var buf [1024 * 1024 * 10]byte
 
 	bufw := &bufwriter{off: 0, buf: buf[:]}
-	w, err := NewEncryptedWriter(bufw, [32]byte{})
+	w, err := NewEncryptedWriter(bufw, [32]byte{}, Header{Codec: CodecFlate, HashAlg: HashSHA256, CreatedAt: 1234})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -132,6 +139,13 @@ func TestEncryptedBpack(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	hdr, err := r.ReadHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Version != CurrentVersion || hdr.HashAlg != HashSHA256 {
+		t.Fatalf("bad header %v", hdr)
+	}
 	for k, v := range has {
 		gotv, err := r.Get(string(k))
 		if err != nil {
@@ -142,3 +156,91 @@ func TestEncryptedBpack(t *testing.T) {
 		}
 	}
 }
+
+func TestLegacyHeader(t *testing.T) {
+	var buf [4096]byte
+
+	// A pack written without a header.
+	bufw := &bufwriter{off: 0, buf: buf[:]}
+	w := &Writer{w: bufw, keys: make(map[string]struct{})}
+	err := w.Add("key", []byte("0123456789abcdefghijklmnopqrstuvwxyz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(&bufreader{buf: bytes.NewReader(buf[:bufw.off])}, bufw.off)
+	hdr, err := r.ReadHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr != LegacyHeader {
+		t.Fatalf("expected legacy header, got %v", hdr)
+	}
+	err = r.ReadIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := r.Get("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(v) != "0123456789abcdefghijklmnopqrstuvwxyz" {
+		t.Fatal("bad value")
+	}
+}
+
+func TestPadding(t *testing.T) {
+	var buf [1024 * 1024]byte
+
+	bufw := &bufwriter{off: 0, buf: buf[:]}
+	w, err := NewWriter(bufw, Header{Codec: CodecNone, HashAlg: HashSHA256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.SetPadding(Padme)
+	for i := 0; i < 100; i++ {
+		err = w.Add(string([]byte{byte(i)}), bytes.Repeat([]byte{byte(i)}, 1000+i*7))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bufw.off != Padme(bufw.off) {
+		t.Fatalf("pack size %d is not padded", bufw.off)
+	}
+	if w.Padding() == 0 || w.Padding() > bufw.off/8 {
+		t.Fatalf("unexpected padding %d for pack of size %d", w.Padding(), bufw.off)
+	}
+	r := NewReader(&bufreader{buf: bytes.NewReader(buf[:bufw.off])}, bufw.off)
+	err = r.ReadIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		v, err := r.Get(string([]byte{byte(i)}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(v, bytes.Repeat([]byte{byte(i)}, 1000+i*7)) {
+			t.Fatalf("bad value %d", i)
+		}
+	}
+}
+
+func TestPadme(t *testing.T) {
+	for n := uint64(0); n < 1<<20; n += 37 {
+		p := Padme(n)
+		if p < n || p > n+n/8+1 {
+			t.Fatalf("Padme(%d) = %d", n, p)
+		}
+		if Padme(p) != p {
+			t.Fatalf("Padme(%d) = %d is not a fixed point", n, p)
+		}
+	}
+}
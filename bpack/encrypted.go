@@ -6,7 +6,7 @@ import (
 	"io"
 )
 
-func NewEncryptedWriter(w io.WriteCloser, key [32]byte) (*Writer, error) {
+func NewEncryptedWriter(w io.WriteCloser, key [32]byte, hdr Header) (*Writer, error) {
 	block, err := aes.NewCipher(key[:])
 	if err != nil {
 		return nil, err
@@ -15,7 +15,7 @@ func NewEncryptedWriter(w io.WriteCloser, key [32]byte) (*Writer, error) {
 	if err != nil {
 		return nil, err
 	}
-	return NewWriter(w)
+	return NewWriter(w, hdr)
 }
 
 func NewEncryptedReader(r ReadSeekCloser, key [32]byte, fsize int64) (*Reader, error) {
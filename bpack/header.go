@@ -0,0 +1,77 @@
+package bpack
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// The magic can never start a pack written before headers existed, as
+// those begin with either a flate stream or an empty index, and 0x89 followed
+// by "BP" is not a valid flate stored block header.
+const (
+	headerMagic = "\x89BPACK\r\n"
+	HeaderSize  = 24
+)
+
+const (
+	// Packs without a header are reported as version 0.
+	Version0       = 0
+	CurrentVersion = 1
+)
+
+const (
+	CodecNone  = 0
+	CodecFlate = 1
+	// CodecPerEntry means every value begins with a byte naming its codec.
+	CodecPerEntry = 0xff
+)
+
+const (
+	HashSHA256 = 1
+)
+
+var ErrUnsupportedVersion = errors.New("unsupported bpack version")
+
+type Header struct {
+	Version uint8
+	Codec   uint8
+	HashAlg uint8
+	// Unix time in seconds.
+	CreatedAt int64
+}
+
+// Packs written before headers existed always held flate compressed
+// values keyed by sha256 hashes.
+var LegacyHeader = Header{
+	Version: Version0,
+	Codec:   CodecFlate,
+	HashAlg: HashSHA256,
+}
+
+func writeHeader(w io.Writer, hdr Header) error {
+	var buf [HeaderSize]byte
+	copy(buf[0:8], headerMagic)
+	buf[8] = hdr.Version
+	buf[9] = hdr.Codec
+	buf[10] = hdr.HashAlg
+	binary.LittleEndian.PutUint64(buf[16:24], uint64(hdr.CreatedAt))
+	_, err := w.Write(buf[:])
+	return err
+}
+
+func decodeHeader(buf []byte) (Header, bool, error) {
+	if len(buf) < HeaderSize || string(buf[0:8]) != headerMagic {
+		return LegacyHeader, false, nil
+	}
+	hdr := Header{
+		Version:   buf[8],
+		Codec:     buf[9],
+		HashAlg:   buf[10],
+		CreatedAt: int64(binary.LittleEndian.Uint64(buf[16:24])),
+	}
+	if hdr.Version != CurrentVersion {
+		return hdr, true, ErrUnsupportedVersion
+	}
+	return hdr, true, nil
+}
@@ -0,0 +1,22 @@
+package bpack
+
+import (
+	"math/bits"
+)
+
+// Padme returns the size n is padded to under the Padmé scheme, the
+// overhead is at most about 12% and padded sizes only leak O(log log n)
+// bits of the original size.
+func Padme(n uint64) uint64 {
+	if n < 2 {
+		return n
+	}
+	e := bits.Len64(n) - 1
+	s := bits.Len64(uint64(e))
+	lastBits := e - s
+	if lastBits <= 0 {
+		return n
+	}
+	mask := uint64(1)<<uint(lastBits) - 1
+	return (n + mask) &^ mask
+}
@@ -38,13 +38,41 @@ func (r *Reader) Get(key string) ([]byte, error) {
 	return r.GetAt(off, sz)
 }
 
+// GetAt is safe for concurrent use if the underlying reader implements io.ReaderAt.
 func (r *Reader) GetAt(offset uint64, sz uint32) ([]byte, error) {
 	buf := make([]byte, sz, sz)
-	r.r.Seek(int64(offset), io.SeekStart)
-	_, err := io.ReadFull(r.r, buf)
+	ra, ok := r.r.(io.ReaderAt)
+	if ok {
+		n, err := ra.ReadAt(buf, int64(offset))
+		if n == len(buf) {
+			return buf, nil
+		}
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return buf, err
+	}
+	_, err := r.r.Seek(int64(offset), io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.ReadFull(r.r, buf)
 	return buf, err
 }
 
+// ReadHeader returns LegacyHeader for packs written before headers existed.
+func (r *Reader) ReadHeader() (Header, error) {
+	if r.size < HeaderSize+8 {
+		return LegacyHeader, nil
+	}
+	buf, err := r.GetAt(0, HeaderSize)
+	if err != nil {
+		return Header{}, err
+	}
+	hdr, _, err := decodeHeader(buf)
+	return hdr, err
+}
+
 func (r *Reader) Close() error {
 	return r.r.Close()
 }
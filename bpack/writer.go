@@ -10,18 +10,27 @@ import (
 const MaxPackEntrySize = 16777215
 
 type Writer struct {
-	w      io.WriteCloser
-	keys   map[string]struct{}
-	index  Index
-	offset uint64
+	w       io.WriteCloser
+	keys    map[string]struct{}
+	index   Index
+	offset  uint64
+	padTo   func(uint64) uint64
+	padding uint64
 }
 
-func NewWriter(w io.WriteCloser) (*Writer, error) {
+// NewWriter writes hdr at the start of the pack, the version is always
+// set to CurrentVersion.
+func NewWriter(w io.WriteCloser, hdr Header) (*Writer, error) {
+	hdr.Version = CurrentVersion
+	err := writeHeader(w, hdr)
+	if err != nil {
+		return nil, err
+	}
 	return &Writer{
 		w:      w,
 		keys:   make(map[string]struct{}),
 		index:  make(Index, 0, 2048),
-		offset: 0,
+		offset: HeaderSize,
 	}, nil
 }
 
@@ -99,7 +108,55 @@ func WriteIndex(w io.Writer, idx Index) error {
 	return nil
 }
 
+// SetPadding makes Close insert padding before the index so the
+// size of the pack becomes padTo(size).
+func (w *Writer) SetPadding(padTo func(uint64) uint64) {
+	w.padTo = padTo
+}
+
+// Padding returns the number of padding bytes added by Close.
+func (w *Writer) Padding() uint64 {
+	return w.padding
+}
+
+func indexSize(idx Index) uint64 {
+	sz := uint64(8)
+	for i := range idx {
+		sz += 3 + uint64(len(idx[i].Key)) + 3 + 8
+	}
+	return sz
+}
+
+func (w *Writer) writePadding() error {
+	size := w.offset + indexSize(w.index) + 8
+	target := w.padTo(size)
+	if target <= size {
+		return nil
+	}
+	var zeros [4096]byte
+	for pad := target - size; pad != 0; {
+		n := uint64(len(zeros))
+		if pad < n {
+			n = pad
+		}
+		_, err := w.w.Write(zeros[:n])
+		if err != nil {
+			return err
+		}
+		pad -= n
+		w.offset += n
+		w.padding += n
+	}
+	return nil
+}
+
 func (w *Writer) Close() (Index, error) {
+	if w.padTo != nil {
+		err := w.writePadding()
+		if err != nil {
+			return nil, err
+		}
+	}
 	idxoffset := w.offset
 	err := WriteIndex(w.w, w.index)
 	if err != nil {
@@ -19,6 +19,27 @@ type CStore interface {
 	Close() error
 }
 
+// BatchGetter is implemented by stores that can fetch many values
+// more efficiently than with repeated calls to Get. The values are
+// passed to fn in an order chosen by the store.
+type BatchGetter interface {
+	GetMany(hashes [][32]byte, fn func([32]byte, []byte) error) error
+}
+
+// StreamingCStore is implemented by stores that can accept several
+// concurrent writers. Values written to one stream are kept together,
+// closing a stream does not close the store.
+type StreamingCStore interface {
+	CStore
+	NewStream() CStore
+}
+
+// Rewriter is implemented by stores that can store a fresh copy of a
+// value that is already present, so damaged copies can be replaced.
+type Rewriter interface {
+	Rewrite([]byte) ([32]byte, error)
+}
+
 type Key struct {
 	CipherKey [32]byte
 	HmacKey   [32]byte
@@ -11,7 +11,7 @@ import (
 	"github.com/buppyio/bpy/fs"
 	"github.com/buppyio/bpy/refs"
 	"github.com/buppyio/bpy/remote"
-	"github.com/buppyio/bpy/remote/client"
+	"github.com/buppyio/bpy/remote/proto"
 	"github.com/pkg/browser"
 	"log"
 	"mime"
@@ -22,15 +22,17 @@ import (
 	"time"
 )
 
+// getRoot returns the current root as remote.GetRoot does.
+type getRoot func() ([32]byte, string, bool, error)
+
 type rootHandler struct {
-	c     *client.Client
-	k     *bpy.Key
+	root  getRoot
 	store bpy.CStore
 }
 
 func (h *rootHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	walkPath := r.URL.Path[1:]
-	rootHash, _, ok, err := remote.GetRoot(h.c, h.k)
+	rootHash, _, ok, err := h.root()
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, "error: %s", err.Error())
@@ -77,14 +79,13 @@ func (h *rootHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 type archiveHandler struct {
-	c     *client.Client
-	k     *bpy.Key
+	root  getRoot
 	store bpy.CStore
 }
 
 func (h *archiveHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	walkPath := r.URL.Path[1:]
-	rootHash, _, ok, err := remote.GetRoot(h.c, h.k)
+	rootHash, _, ok, err := h.root()
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, "error: %s", err.Error())
@@ -131,15 +132,14 @@ func (h *archiveHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 type httpFs struct {
-	c     *client.Client
-	k     *bpy.Key
+	root  getRoot
 	store bpy.CStore
 }
 
 func (httpFs *httpFs) Open(fullPath string) (http.File, error) {
 	log.Printf("open: %s", fullPath)
 
-	rootHash, _, ok, err := remote.GetRoot(httpFs.c, httpFs.k)
+	rootHash, _, ok, err := httpFs.root()
 	if err != nil {
 		return nil, err
 	}
@@ -251,6 +251,8 @@ func Browse() {
 	static.LoadFiles()
 
 	addrArg := flag.String("addr", "127.0.0.1:8000", "address to listen on ")
+	common.RootFlag()
+	common.LimitFlags()
 	flag.Parse()
 
 	cfg, err := common.GetConfig()
@@ -274,23 +276,33 @@ func Browse() {
 		common.Die("error getting content store: %s\n", err.Error())
 	}
 
+	// Without proto.CapWatch a remote.Root is only polled every
+	// remote.PollInterval, so each request asks for the root instead.
+	root := getRoot(func() ([32]byte, string, bool, error) {
+		return remote.GetRoot(c, &k, cfg.Root)
+	})
+	if c.HasCapability(proto.CapWatch) {
+		watched, err := remote.NewRoot(c, &k, cfg.Root)
+		if err != nil {
+			common.Die("error watching root: %s\n", err.Error())
+		}
+		root = watched.Get
+	}
+
 	http.Handle("/", http.RedirectHandler("/browse/", http.StatusSeeOther))
 
 	http.Handle("/browse/", http.StripPrefix("/browse", &rootHandler{
-		c:     c,
-		k:     &k,
+		root:  root,
 		store: store,
 	}))
 
 	http.Handle("/zip/", http.StripPrefix("/zip", &archiveHandler{
-		c:     c,
-		k:     &k,
+		root:  root,
 		store: store,
 	}))
 
 	http.Handle("/raw/", http.StripPrefix("/raw", http.FileServer(&httpFs{
-		c:     c,
-		k:     &k,
+		root:  root,
 		store: store,
 	})))
 
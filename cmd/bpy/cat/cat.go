@@ -14,6 +14,8 @@ import (
 func Cat() {
 	whenArg := flag.String("when", "", "time query")
 
+	common.RootFlag()
+	common.LimitFlags()
 	flag.Parse()
 
 	if len(flag.Args()) != 1 {
@@ -41,7 +43,7 @@ func Cat() {
 		common.Die("error getting content store: %s\n", err.Error())
 	}
 
-	rootHash, _, ok, err := remote.GetRoot(c, &k)
+	rootHash, _, ok, err := remote.GetRoot(c, &k, cfg.Root)
 	if err != nil {
 		common.Die("error fetching root hash: %s\n", err.Error())
 	}
@@ -4,18 +4,19 @@ import (
 	"encoding/hex"
 	"fmt"
 	"github.com/buppyio/bpy"
+	"github.com/buppyio/bpy/codec"
 	"github.com/buppyio/bpy/cstore"
 	"github.com/buppyio/bpy/cstore/cache"
 	"github.com/buppyio/bpy/fs"
 	"github.com/buppyio/bpy/refs"
 	"github.com/buppyio/bpy/remote"
 	"github.com/buppyio/bpy/remote/client"
+	"github.com/buppyio/bpy/remote/dial"
 	"io"
 	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"strings"
 	"time"
 )
 
@@ -23,52 +24,6 @@ const (
 	IdxCachePermissions = 0700
 )
 
-type slave struct {
-	in  io.ReadCloser
-	out io.WriteCloser
-	cmd *exec.Cmd
-}
-
-func (s *slave) Read(buf []byte) (int, error) {
-	return s.in.Read(buf)
-}
-
-func (s *slave) Write(buf []byte) (int, error) {
-	return s.out.Write(buf)
-}
-
-func (s *slave) Close() error {
-	return s.cmd.Process.Kill()
-}
-
-func dialRemote(cmdstr string) (io.ReadWriteCloser, error) {
-	// XXX strings.Fields doesn't handle quotes correctly
-	spltcmd := strings.Fields(cmdstr)
-	if len(spltcmd) < 2 {
-		return nil, fmt.Errorf("invalid remote command: '%s'", cmdstr)
-	}
-	cmd := exec.Command(spltcmd[0], spltcmd[1:]...)
-	out, err := cmd.StdinPipe()
-	if err != nil {
-		return nil, err
-	}
-	in, err := cmd.StdoutPipe()
-	if err != nil {
-		return nil, err
-	}
-	stderr, err := cmd.StderrPipe()
-	go io.Copy(os.Stderr, stderr)
-	err = cmd.Start()
-	if err != nil {
-		return nil, err
-	}
-	return &slave{
-		in:  in,
-		out: out,
-		cmd: cmd,
-	}, nil
-}
-
 func GetCacheClient(cfg *Config) (*cache.Client, error) {
 	conn, err := net.Dial("tcp", cfg.CacheListenAddr)
 	if err != nil {
@@ -107,16 +62,34 @@ func GetKey(cfg *Config) (bpy.Key, error) {
 }
 
 func GetRemote(cfg *Config, k *bpy.Key) (*client.Client, error) {
-	slv, err := dialRemote(cfg.RemoteCommand)
+	if cfg.Remote == "" {
+		return nil, fmt.Errorf("no remote configured, set BPY_REMOTE")
+	}
+	upload, err := client.ParseSchedule(cfg.UploadLimit)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("error parsing BPY_UPLOAD_LIMIT: %s", err)
+	}
+	download, err := client.ParseSchedule(cfg.DownloadLimit)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing BPY_DOWNLOAD_LIMIT: %s", err)
+	}
+	tlsConfig := &dial.TLSConfig{
+		CertFile: cfg.TLSCert,
+		KeyFile:  cfg.TLSKey,
+		CAFile:   cfg.TLSCA,
 	}
-	c, err := client.Attach(slv, hex.EncodeToString(k.Id[:]))
+	c, err := client.Dial(func() (io.ReadWriteCloser, error) {
+		return dial.Dial(cfg.Remote, tlsConfig)
+	}, hex.EncodeToString(k.Id[:]))
 	if err != nil {
 		return nil, err
 	}
-	_, version, ok, err := remote.GetRoot(c, k)
+	c.SetReadWindow(cfg.ReadWindow)
+	c.SetLimits(client.NewLimiter(upload), client.NewLimiter(download))
+	c.SetSendProofs(cfg.AppendOnly)
+	_, version, ok, err := remote.GetRoot(c, k, cfg.Root)
 	if err != nil {
+		c.Close()
 		return nil, fmt.Errorf("error fetching ref: %s", err.Error())
 	}
 	if !ok {
@@ -142,7 +115,7 @@ func GetRemote(cfg *Config, k *bpy.Key) (*client.Client, error) {
 			Root:      ent.HTree.Data,
 		}
 
-		hash, err := refs.PutRef(store, ref)
+		_, err = refs.PutRef(store, ref)
 		if err != nil {
 			c.Close()
 			return nil, fmt.Errorf("error creating base ref: %s", err.Error())
@@ -154,7 +127,7 @@ func GetRemote(cfg *Config, k *bpy.Key) (*client.Client, error) {
 			return nil, fmt.Errorf("error closing store writer: %s", err.Error())
 		}
 
-		_, err = remote.CasRoot(c, k, hash, bpy.NextRootVersion(version), epoch)
+		_, err = remote.CasRoot(c, k, cfg.Root, ref, bpy.NextRootVersion(version), epoch)
 		if err != nil {
 			c.Close()
 			return nil, fmt.Errorf("error initizializing root: %s", err.Error())
@@ -163,15 +136,41 @@ func GetRemote(cfg *Config, k *bpy.Key) (*client.Client, error) {
 	return c, nil
 }
 
-func GetCStore(cfg *Config, k *bpy.Key, remote *client.Client) (bpy.CStore, error) {
-	var store bpy.CStore
-
+// GetUncachedCStore returns a content store that reads every value from
+// the packs of the remote rather than the cache daemon.
+func GetUncachedCStore(cfg *Config, k *bpy.Key, remote *client.Client) (bpy.CStore, error) {
 	curIdxCache := filepath.Join(cfg.ICachePath, hex.EncodeToString(k.Id[:]))
 	err := os.MkdirAll(curIdxCache, IdxCachePermissions)
 	if err != nil {
 		return nil, err
 	}
-	store, err = cstore.NewWriter(remote, k.CipherKey, curIdxCache)
+	compression, err := codec.Parse(cfg.Compression)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing BPY_COMPRESSION: %s", err)
+	}
+	padding, err := cstore.ParsePadding(cfg.Padding)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing BPY_PADDING: %s", err)
+	}
+	parity, err := cstore.ParseParity(cfg.Parity)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing BPY_PARITY: %s", err)
+	}
+	store, err := cstore.NewWriter(remote, k.CipherKey, curIdxCache, cstore.WriterConfig{
+		PackSize:    uint64(cfg.PackSize),
+		CacheSize:   uint64(cfg.WriteCacheSize),
+		Compression: compression,
+		Padding:     padding,
+		Parity:      parity,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func GetCStore(cfg *Config, k *bpy.Key, remote *client.Client) (bpy.CStore, error) {
+	store, err := GetUncachedCStore(cfg, k, remote)
 	if err != nil {
 		return nil, err
 	}
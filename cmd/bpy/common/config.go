@@ -1,12 +1,18 @@
 package common
 
 import (
+	"flag"
 	"fmt"
+	"github.com/buppyio/bpy/cstore"
+	"github.com/buppyio/bpy/remote/client"
+	"github.com/buppyio/bpy/remote/dial"
+	"github.com/buppyio/bpy/remote/proto"
 	"os"
 	"os/user"
 	"path/filepath"
 	"runtime"
 	"strconv"
+	"strings"
 )
 
 var (
@@ -14,15 +20,49 @@ var (
 	DefaultCacheListenAddr string
 )
 
+var (
+	rootArg          *string
+	uploadLimitArg   *string
+	downloadLimitArg *string
+)
+
+// RootFlag adds the -root flag, which overrides BPY_ROOT. It must be called
+// before flag.Parse.
+func RootFlag() {
+	rootArg = flag.String("root", "", "name of the root to use (defaults to $BPY_ROOT)")
+}
+
+// LimitFlags adds the -limit-upload and -limit-download flags, which
+// override BPY_UPLOAD_LIMIT and BPY_DOWNLOAD_LIMIT. It must be called
+// before flag.Parse.
+func LimitFlags() {
+	uploadLimitArg = flag.String("limit-upload", "", "upload rate limit or schedule, such as 2MiB/s (defaults to $BPY_UPLOAD_LIMIT)")
+	downloadLimitArg = flag.String("limit-download", "", "download rate limit or schedule (defaults to $BPY_DOWNLOAD_LIMIT)")
+}
+
 type Config struct {
 	BuppyPath       string
+	Remote          string
+	Root            string
 	RemoteCommand   string
+	TLSCert         string
+	TLSKey          string
+	TLSCA           string
 	ICachePath      string
 	CacheFile       string
 	CacheSize       int64
 	CacheSocketType string
 	CacheListenAddr string
 	KeyPath         string
+	PackSize        int64
+	WriteCacheSize  int64
+	Compression     string
+	Padding         string
+	Parity          string
+	ReadWindow      int
+	UploadLimit     string
+	DownloadLimit   string
+	AppendOnly      bool
 }
 
 func GetConfig() (*Config, error) {
@@ -43,9 +83,30 @@ func setEnvConfigValues(cfg *Config) error {
 	if cfg.BuppyPath == "" {
 		cfg.BuppyPath = os.Getenv("BPY_PATH")
 	}
+	if cfg.Remote == "" {
+		cfg.Remote = os.Getenv("BPY_REMOTE")
+	}
+	if cfg.Root == "" && rootArg != nil {
+		cfg.Root = *rootArg
+	}
+	if cfg.Root == "" {
+		cfg.Root = os.Getenv("BPY_ROOT")
+	}
+	if cfg.Root != "" && !proto.ValidRootName(cfg.Root) {
+		return fmt.Errorf("invalid root name %q", cfg.Root)
+	}
 	if cfg.RemoteCommand == "" {
 		cfg.RemoteCommand = os.Getenv("BPY_REMOTE_CMD")
 	}
+	if cfg.TLSCert == "" {
+		cfg.TLSCert = os.Getenv("BPY_TLS_CERT")
+	}
+	if cfg.TLSKey == "" {
+		cfg.TLSKey = os.Getenv("BPY_TLS_KEY")
+	}
+	if cfg.TLSCA == "" {
+		cfg.TLSCA = os.Getenv("BPY_TLS_CA")
+	}
 	if cfg.ICachePath == "" {
 		cfg.ICachePath = os.Getenv("BPY_ICACHE_PATH")
 	}
@@ -71,6 +132,67 @@ func setEnvConfigValues(cfg *Config) error {
 	if cfg.KeyPath == "" {
 		cfg.CacheFile = os.Getenv("BPY_KEY_PATH")
 	}
+	if cfg.PackSize == 0 {
+		szStr := os.Getenv("BPY_PACK_SIZE")
+		if szStr != "" {
+			v, err := strconv.ParseInt(szStr, 10, 64)
+			if err != nil {
+				return fmt.Errorf("error parsing BPY_PACK_SIZE (%s): %s", szStr, err)
+			}
+			cfg.PackSize = v
+		}
+	}
+	if cfg.Compression == "" {
+		cfg.Compression = os.Getenv("BPY_COMPRESSION")
+	}
+	if cfg.Padding == "" {
+		cfg.Padding = os.Getenv("BPY_PADDING")
+	}
+	if cfg.Parity == "" {
+		cfg.Parity = os.Getenv("BPY_PARITY")
+	}
+	if cfg.ReadWindow == 0 {
+		nStr := os.Getenv("BPY_READ_WINDOW")
+		if nStr != "" {
+			v, err := strconv.Atoi(nStr)
+			if err != nil {
+				return fmt.Errorf("error parsing BPY_READ_WINDOW (%s): %s", nStr, err)
+			}
+			cfg.ReadWindow = v
+		}
+	}
+	if cfg.UploadLimit == "" && uploadLimitArg != nil {
+		cfg.UploadLimit = *uploadLimitArg
+	}
+	if cfg.UploadLimit == "" {
+		cfg.UploadLimit = os.Getenv("BPY_UPLOAD_LIMIT")
+	}
+	if cfg.DownloadLimit == "" && downloadLimitArg != nil {
+		cfg.DownloadLimit = *downloadLimitArg
+	}
+	if cfg.DownloadLimit == "" {
+		cfg.DownloadLimit = os.Getenv("BPY_DOWNLOAD_LIMIT")
+	}
+	if cfg.WriteCacheSize == 0 {
+		szStr := os.Getenv("BPY_WRITE_CACHE_SIZE")
+		if szStr != "" {
+			v, err := strconv.ParseInt(szStr, 10, 64)
+			if err != nil {
+				return fmt.Errorf("error parsing BPY_WRITE_CACHE_SIZE (%s): %s", szStr, err)
+			}
+			cfg.WriteCacheSize = v
+		}
+	}
+	if !cfg.AppendOnly {
+		bStr := os.Getenv("BPY_APPEND_ONLY")
+		if bStr != "" {
+			v, err := strconv.ParseBool(bStr)
+			if err != nil {
+				return fmt.Errorf("error parsing BPY_APPEND_ONLY (%s): %s", bStr, err)
+			}
+			cfg.AppendOnly = v
+		}
+	}
 	return nil
 }
 
@@ -82,6 +204,20 @@ func setDefaultConfigValues(cfg *Config) error {
 		}
 		cfg.BuppyPath = filepath.Join(u.HomeDir, ".bpy")
 	}
+	if cfg.Remote == "" && cfg.RemoteCommand != "" {
+		// BPY_REMOTE_CMD was split on spaces without quoting or escapes,
+		// so paths with backslashes keep working.
+		cfg.Remote = "cmd:" + dial.QuoteCommand(strings.Fields(cfg.RemoteCommand))
+	}
+	if cfg.TLSCert == "" {
+		cfg.TLSCert = filepath.Join(cfg.BuppyPath, "tls", "client.crt")
+	}
+	if cfg.TLSKey == "" {
+		cfg.TLSKey = filepath.Join(cfg.BuppyPath, "tls", "client.key")
+	}
+	if cfg.TLSCA == "" {
+		cfg.TLSCA = filepath.Join(cfg.BuppyPath, "tls", "ca.crt")
+	}
 	if cfg.ICachePath == "" {
 		cfg.ICachePath = filepath.Join(cfg.BuppyPath, "icache")
 	}
@@ -94,6 +230,30 @@ func setDefaultConfigValues(cfg *Config) error {
 	if cfg.KeyPath == "" {
 		cfg.KeyPath = filepath.Join(cfg.BuppyPath, "bpy.key")
 	}
+	if cfg.PackSize <= 0 {
+		cfg.PackSize = int64(cstore.DefaultWriterConfig.PackSize)
+	}
+	if cfg.WriteCacheSize <= 0 {
+		cfg.WriteCacheSize = int64(cstore.DefaultWriterConfig.CacheSize)
+	}
+	if cfg.Compression == "" {
+		cfg.Compression = cstore.DefaultWriterConfig.Compression.String()
+	}
+	if cfg.Padding == "" {
+		cfg.Padding = cstore.DefaultWriterConfig.Padding.String()
+	}
+	if cfg.Parity == "" {
+		cfg.Parity = cstore.DefaultWriterConfig.Parity.String()
+	}
+	if cfg.ReadWindow <= 0 {
+		cfg.ReadWindow = client.DefaultReadWindow
+	}
+	if cfg.UploadLimit == "" {
+		cfg.UploadLimit = "unlimited"
+	}
+	if cfg.DownloadLimit == "" {
+		cfg.DownloadLimit = "unlimited"
+	}
 	switch runtime.GOOS {
 	case "windows":
 		if cfg.CacheSocketType == "" {
@@ -13,6 +13,8 @@ import (
 
 func Cp() {
 	whenArg := flag.String("when", "", "time spec of the time to copy from")
+	common.RootFlag()
+	common.LimitFlags()
 	flag.Parse()
 
 	if len(flag.Args()) != 2 {
@@ -48,7 +50,7 @@ func Cp() {
 			common.Die("error getting content store: %s\n", err.Error())
 		}
 
-		rootHash, rootVersion, ok, err := remote.GetRoot(c, &k)
+		rootHash, rootVersion, ok, err := remote.GetRoot(c, &k, cfg.Root)
 		if err != nil {
 			common.Die("error fetching root hash: %s\n", err.Error())
 		}
@@ -81,12 +83,13 @@ func Cp() {
 			common.Die("error copying src to dest: %s\n", err.Error())
 		}
 
-		newRefHash, err := refs.PutRef(store, refs.Ref{
+		newRef := refs.Ref{
 			CreatedAt: time.Now().Unix(),
 			Root:      newRoot.HTree.Data,
 			HasPrev:   true,
 			Prev:      rootHash,
-		})
+		}
+		_, err = refs.PutRef(store, newRef)
 		if err != nil {
 			common.Die("error creating new ref: %s\n", err.Error())
 		}
@@ -96,7 +99,7 @@ func Cp() {
 			common.Die("error closing remote: %s\n", err.Error())
 		}
 
-		ok, err = remote.CasRoot(c, &k, newRefHash, bpy.NextRootVersion(rootVersion), epoch)
+		ok, err = remote.CasRoot(c, &k, cfg.Root, newRef, bpy.NextRootVersion(rootVersion), epoch)
 		if err != nil {
 			common.Die("error swapping root: %s\n", err.Error())
 		}
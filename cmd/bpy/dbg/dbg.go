@@ -53,11 +53,19 @@ func inspecthtree() {
 	if err != nil {
 		common.Die("error getting hash: %s", err.Error())
 	}
-	_, err = fmt.Printf("level: %d\n", int(data[0]))
+	holesz, hole, err := htree.HoleSize(data)
+	if err != nil {
+		common.Die("error reading node: %s\n", err.Error())
+	}
+	if hole {
+		_, err = fmt.Printf("hole: %d\n", holesz)
+	} else {
+		_, err = fmt.Printf("level: %d\n", int(data[0]))
+	}
 	if err != nil {
 		common.Die("io error: %s\n", err.Error())
 	}
-	if data[0] == 0 {
+	if htree.IsLeaf(data) {
 		return
 	}
 	data = data[1:]
@@ -7,6 +7,8 @@ import (
 )
 
 func Env() {
+	common.RootFlag()
+	common.LimitFlags()
 	flag.Parse()
 
 	cfg, err := common.GetConfig()
@@ -16,10 +18,30 @@ func Env() {
 
 	errMsg := "error printing env: %s\n"
 
+	_, err = fmt.Printf("BPY_REMOTE=%s\n", cfg.Remote)
+	if err != nil {
+		common.Die(errMsg, err)
+	}
+	_, err = fmt.Printf("BPY_ROOT=%s\n", cfg.Root)
+	if err != nil {
+		common.Die(errMsg, err)
+	}
 	_, err = fmt.Printf("BPY_REMOTE_CMD=%s\n", cfg.RemoteCommand)
 	if err != nil {
 		common.Die(errMsg, err)
 	}
+	_, err = fmt.Printf("BPY_TLS_CERT=%s\n", cfg.TLSCert)
+	if err != nil {
+		common.Die(errMsg, err)
+	}
+	_, err = fmt.Printf("BPY_TLS_KEY=%s\n", cfg.TLSKey)
+	if err != nil {
+		common.Die(errMsg, err)
+	}
+	_, err = fmt.Printf("BPY_TLS_CA=%s\n", cfg.TLSCA)
+	if err != nil {
+		common.Die(errMsg, err)
+	}
 	_, err = fmt.Printf("BPY_PATH=%s\n", cfg.BuppyPath)
 	if err != nil {
 		common.Die(errMsg, err)
@@ -40,4 +62,40 @@ func Env() {
 	if err != nil {
 		common.Die(errMsg, err)
 	}
+	_, err = fmt.Printf("BPY_PACK_SIZE=%d\n", cfg.PackSize)
+	if err != nil {
+		common.Die(errMsg, err)
+	}
+	_, err = fmt.Printf("BPY_WRITE_CACHE_SIZE=%d\n", cfg.WriteCacheSize)
+	if err != nil {
+		common.Die(errMsg, err)
+	}
+	_, err = fmt.Printf("BPY_COMPRESSION=%s\n", cfg.Compression)
+	if err != nil {
+		common.Die(errMsg, err)
+	}
+	_, err = fmt.Printf("BPY_PADDING=%s\n", cfg.Padding)
+	if err != nil {
+		common.Die(errMsg, err)
+	}
+	_, err = fmt.Printf("BPY_PARITY=%s\n", cfg.Parity)
+	if err != nil {
+		common.Die(errMsg, err)
+	}
+	_, err = fmt.Printf("BPY_READ_WINDOW=%d\n", cfg.ReadWindow)
+	if err != nil {
+		common.Die(errMsg, err)
+	}
+	_, err = fmt.Printf("BPY_UPLOAD_LIMIT=%s\n", cfg.UploadLimit)
+	if err != nil {
+		common.Die(errMsg, err)
+	}
+	_, err = fmt.Printf("BPY_DOWNLOAD_LIMIT=%s\n", cfg.DownloadLimit)
+	if err != nil {
+		common.Die(errMsg, err)
+	}
+	_, err = fmt.Printf("BPY_APPEND_ONLY=%t\n", cfg.AppendOnly)
+	if err != nil {
+		common.Die(errMsg, err)
+	}
 }
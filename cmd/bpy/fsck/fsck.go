@@ -0,0 +1,68 @@
+package fsck
+
+import (
+	"flag"
+	"fmt"
+	"github.com/buppyio/bpy/cmd/bpy/common"
+	"github.com/buppyio/bpy/fsck"
+)
+
+func Fsck() {
+	readData := flag.Float64("read-data", 0, "percentage of file data to read and verify")
+
+	common.LimitFlags()
+	flag.Parse()
+
+	if *readData < 0 || *readData > 100 {
+		common.Die("-read-data must be a percentage between 0 and 100\n")
+	}
+
+	cfg, err := common.GetConfig()
+	if err != nil {
+		common.Die("error getting config: %s\n", err)
+	}
+
+	k, err := common.GetKey(cfg)
+	if err != nil {
+		common.Die("error getting bpy key data: %s\n", err.Error())
+	}
+
+	c, err := common.GetRemote(cfg, &k)
+	if err != nil {
+		common.Die("error connecting to remote: %s\n", err.Error())
+	}
+	defer c.Close()
+
+	// Cached values would hide damaged packs.
+	store, err := common.GetUncachedCStore(cfg, &k, c)
+	if err != nil {
+		common.Die("error getting content store: %s\n", err.Error())
+	}
+
+	report, err := fsck.Fsck(c, store, &k, fsck.Options{ReadDataPercent: *readData})
+	if err != nil {
+		common.Die("error checking repository: %s\n", err.Error())
+	}
+
+	for _, p := range report.Problems {
+		fmt.Printf("error: %s\n", p)
+	}
+	for _, name := range report.OrphanPacks {
+		fmt.Printf("orphan pack: %s\n", name)
+	}
+	for _, name := range report.OrphanIndexObjects {
+		fmt.Printf("orphan index object: %s\n", name)
+	}
+	fmt.Printf("refs: %d, directories: %d, files: %d\n", report.Refs, report.Dirs, report.Files)
+	fmt.Printf("packs: %d, chunks: %d, reachable: %d, data chunks verified: %d\n", report.Packs, report.Chunks, report.Reachable, report.DataChecked)
+	fmt.Printf("duplicate chunks: %d (%d bytes)\n", report.Duplicates, report.DuplicateBytes)
+	fmt.Printf("unreferenced chunks: %d (%d bytes)\n", report.Unreferenced, report.UnreferencedBytes)
+
+	err = store.Close()
+	if err != nil {
+		common.Die("error closing content store: %s\n", err.Error())
+	}
+	if len(report.Problems) != 0 {
+		common.Die("%d problems found\n", len(report.Problems))
+	}
+}
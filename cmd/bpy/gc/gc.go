@@ -4,15 +4,22 @@ import (
 	"flag"
 	"github.com/buppyio/bpy"
 	"github.com/buppyio/bpy/cmd/bpy/common"
+	"github.com/buppyio/bpy/cstore"
 	"github.com/buppyio/bpy/gc"
 	"github.com/buppyio/bpy/refs"
 	"github.com/buppyio/bpy/remote"
+	"github.com/buppyio/bpy/remote/client"
+	"github.com/buppyio/bpy/remote/proto"
+	"io/ioutil"
+	"strings"
 )
 
 func GC() {
 	cancel := flag.Bool("cancel", false, "cancel any active garbage collection without starting a new one")
 	keepHistory := flag.Bool("keep-history", false, "do not clear the gc history")
+	adminFile := flag.String("admin", "", "file holding the admin credential, needed for append-only keys")
 
+	common.LimitFlags()
 	flag.Parse()
 
 	cfg, err := common.GetConfig()
@@ -45,44 +52,33 @@ func GC() {
 		return
 	}
 
-	if !*keepHistory {
-		epoch, err := remote.GetEpoch(c)
-		if err != nil {
-			common.Die("error getting current epoch: %s\n", err.Error())
-		}
-
-		rootHash, rootVersion, ok, err := remote.GetRoot(c, &k)
+	credential := ""
+	if *adminFile != "" {
+		data, err := ioutil.ReadFile(*adminFile)
 		if err != nil {
-			common.Die("error fetching root hash: %s\n", err.Error())
-		}
-		if !ok {
-			common.Die("root missing\n")
+			common.Die("error reading admin credential: %s\n", err.Error())
 		}
+		credential = strings.TrimSpace(string(data))
+	}
 
-		ref, err := refs.GetRef(store, rootHash)
-		if err != nil {
-			common.Die("error fetching ref: %s\n", err.Error())
-		}
-
-		newRef := ref
-		newRef.HasPrev = false
-
-		newRefHash, err := refs.PutRef(store, newRef)
-		if err != nil {
-			common.Die("error writing updated ref: %s\n", err.Error())
+	if !*keepHistory {
+		var epoch string
+		if c.HasCapability(proto.CapAppendOnly) {
+			// Append-only servers only let an admin gc drop history.
+			epoch, err = remote.StartGC(c, credential)
+		} else {
+			epoch, err = remote.GetEpoch(c)
 		}
-
-		err = store.Flush()
 		if err != nil {
-			common.Die("error flushing content store: %s\n", err.Error())
+			common.Die("error getting current epoch: %s\n", err.Error())
 		}
 
-		ok, err = remote.CasRoot(c, &k, newRefHash, bpy.NextRootVersion(rootVersion), epoch)
+		names, err := remote.ListRoots(c)
 		if err != nil {
-			common.Die("error swapping root: %s\n", err.Error())
+			common.Die("error listing roots: %s\n", err.Error())
 		}
-		if !ok {
-			common.Die("root concurrently modified, try again\n")
+		for _, name := range names {
+			clearHistory(c, &k, store, name, epoch)
 		}
 	}
 
@@ -91,8 +87,56 @@ func GC() {
 		common.Die("error getting cache connection: %s\n", err.Error())
 	}
 
-	err = gc.GC(c, store, cache, &k)
+	padding, err := cstore.ParsePadding(cfg.Padding)
+	if err != nil {
+		common.Die("error parsing BPY_PADDING: %s\n", err.Error())
+	}
+
+	parity, err := cstore.ParseParity(cfg.Parity)
+	if err != nil {
+		common.Die("error parsing BPY_PARITY: %s\n", err.Error())
+	}
+
+	err = gc.GC(c, store, cache, &k, padding, parity, credential)
 	if err != nil {
 		common.Die("error running gc: %s\n", err.Error())
 	}
 }
+
+// clearHistory points the root called name at a copy of its ref without
+// the previous refs, so gc can free them.
+func clearHistory(c *client.Client, k *bpy.Key, store bpy.CStore, name, epoch string) {
+	rootHash, rootVersion, ok, err := remote.GetRoot(c, k, name)
+	if err != nil {
+		common.Die("error fetching root hash: %s\n", err.Error())
+	}
+	if !ok {
+		return
+	}
+
+	ref, err := refs.GetRef(store, rootHash)
+	if err != nil {
+		common.Die("error fetching ref: %s\n", err.Error())
+	}
+
+	newRef := ref
+	newRef.HasPrev = false
+
+	_, err = refs.PutRef(store, newRef)
+	if err != nil {
+		common.Die("error writing updated ref: %s\n", err.Error())
+	}
+
+	err = store.Flush()
+	if err != nil {
+		common.Die("error flushing content store: %s\n", err.Error())
+	}
+
+	ok, err = remote.CasRoot(c, k, name, newRef, bpy.NextRootVersion(rootVersion), epoch)
+	if err != nil {
+		common.Die("error swapping root: %s\n", err.Error())
+	}
+	if !ok {
+		common.Die("root concurrently modified, try again\n")
+	}
+}
@@ -10,6 +10,8 @@ import (
 
 func Get() {
 	pathArg := flag.String("path", "", "directory to get")
+	common.RootFlag()
+	common.LimitFlags()
 	flag.Parse()
 
 	if len(flag.Args()) != 1 {
@@ -41,7 +43,7 @@ func Get() {
 		common.Die("error getting content store: %s\n", err.Error())
 	}
 
-	rootHash, _, ok, err := remote.GetRoot(c, &k)
+	rootHash, _, ok, err := remote.GetRoot(c, &k, cfg.Root)
 	if err != nil {
 		common.Die("error fetching root hash: %s\n", err.Error())
 	}
@@ -11,6 +11,7 @@ import (
 )
 
 func Hist() {
+	common.RootFlag()
 	flag.Parse()
 
 	cfg, err := common.GetConfig()
@@ -34,7 +35,7 @@ func Hist() {
 		common.Die("error getting content store: %s\n", err.Error())
 	}
 
-	rootHash, _, ok, err := remote.GetRoot(c, &k)
+	rootHash, _, ok, err := remote.GetRoot(c, &k, cfg.Root)
 	if err != nil {
 		common.Die("error fetching root hash: %s\n", err.Error())
 	}
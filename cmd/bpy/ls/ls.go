@@ -14,6 +14,7 @@ func Ls() {
 	whenArg := flag.String("when", "", "time query")
 
 	lsPath := "/"
+	common.RootFlag()
 	flag.Parse()
 
 	if len(flag.Args()) > 1 {
@@ -43,7 +44,7 @@ func Ls() {
 		common.Die("error getting content store: %s\n", err.Error())
 	}
 
-	rootHash, _, ok, err := remote.GetRoot(c, &k)
+	rootHash, _, ok, err := remote.GetRoot(c, &k, cfg.Root)
 	if err != nil {
 		common.Die("error fetching root hash: %s\n", err.Error())
 	}
@@ -8,6 +8,7 @@ import (
 	"github.com/buppyio/bpy/cmd/bpy/cp"
 	"github.com/buppyio/bpy/cmd/bpy/dbg"
 	"github.com/buppyio/bpy/cmd/bpy/env"
+	"github.com/buppyio/bpy/cmd/bpy/fsck"
 	"github.com/buppyio/bpy/cmd/bpy/gc"
 	"github.com/buppyio/bpy/cmd/bpy/get"
 	"github.com/buppyio/bpy/cmd/bpy/hist"
@@ -17,6 +18,7 @@ import (
 	"github.com/buppyio/bpy/cmd/bpy/newkey"
 	"github.com/buppyio/bpy/cmd/bpy/p9"
 	"github.com/buppyio/bpy/cmd/bpy/put"
+	"github.com/buppyio/bpy/cmd/bpy/repair"
 	"github.com/buppyio/bpy/cmd/bpy/revert"
 	"github.com/buppyio/bpy/cmd/bpy/rm"
 	"github.com/buppyio/bpy/cmd/bpy/tar"
@@ -27,7 +29,7 @@ import (
 
 func help() {
 	fmt.Println("Please specify one of the following subcommands:")
-	fmt.Println("browse, cat, cp, env, gc, get, hist, ls, mkdir, mv, new-key, put, rm, tar, version, zip, 9p")
+	fmt.Println("browse, cat, cp, env, fsck, gc, get, hist, ls, mkdir, mv, new-key, put, repair, rm, tar, version, zip, 9p")
 	fmt.Println("")
 	fmt.Println("For more use -h on the sub commands.")
 	fmt.Println("Also check the docs at https://buppy.io/docs")
@@ -50,6 +52,8 @@ func main() {
 			cmd = cp.Cp
 		case "env":
 			cmd = env.Env
+		case "fsck":
+			cmd = fsck.Fsck
 		case "gc":
 			cmd = gc.GC
 		case "get":
@@ -64,6 +68,8 @@ func main() {
 			cmd = mv.Mv
 		case "put":
 			cmd = put.Put
+		case "repair":
+			cmd = repair.Repair
 		case "revert":
 			cmd = revert.Revert
 		case "rm":
@@ -11,6 +11,7 @@ import (
 )
 
 func Mkdir() {
+	common.RootFlag()
 	flag.Parse()
 
 	if len(flag.Args()) != 1 {
@@ -45,7 +46,7 @@ func Mkdir() {
 		common.Die("error getting content store: %s\n", err.Error())
 	}
 
-	rootHash, rootVersion, ok, err := remote.GetRoot(c, &k)
+	rootHash, rootVersion, ok, err := remote.GetRoot(c, &k, cfg.Root)
 	if err != nil {
 		common.Die("error fetching root hash: %s\n", err.Error())
 	}
@@ -68,19 +69,20 @@ func Mkdir() {
 		common.Die("error inserting empty dir into folder: %s\n", err.Error())
 	}
 
-	newRefHash, err := refs.PutRef(store, refs.Ref{
+	newRef := refs.Ref{
 		CreatedAt: time.Now().Unix(),
 		Root:      newRootEnt.HTree.Data,
 		HasPrev:   true,
 		Prev:      rootHash,
-	})
+	}
+	_, err = refs.PutRef(store, newRef)
 
 	err = store.Close()
 	if err != nil {
 		common.Die("error closing remote: %s\n", err.Error())
 	}
 
-	ok, err = remote.CasRoot(c, &k, newRefHash, bpy.NextRootVersion(rootVersion), epoch)
+	ok, err = remote.CasRoot(c, &k, cfg.Root, newRef, bpy.NextRootVersion(rootVersion), epoch)
 	if err != nil {
 		common.Die("swapping root: %s\n", err.Error())
 	}
@@ -11,6 +11,7 @@ import (
 )
 
 func Mv() {
+	common.RootFlag()
 	flag.Parse()
 
 	if len(flag.Args()) != 2 {
@@ -46,7 +47,7 @@ func Mv() {
 			common.Die("error getting content store: %s\n", err.Error())
 		}
 
-		rootHash, rootVersion, ok, err := remote.GetRoot(c, &k)
+		rootHash, rootVersion, ok, err := remote.GetRoot(c, &k, cfg.Root)
 		if err != nil {
 			common.Die("error fetching root hash: %s\n", err.Error())
 		}
@@ -64,12 +65,13 @@ func Mv() {
 			common.Die("error moving folder: %s\n", err.Error())
 		}
 
-		newRefHash, err := refs.PutRef(store, refs.Ref{
+		newRef := refs.Ref{
 			CreatedAt: time.Now().Unix(),
 			Root:      newRoot.HTree.Data,
 			HasPrev:   true,
 			Prev:      rootHash,
-		})
+		}
+		_, err = refs.PutRef(store, newRef)
 		if err != nil {
 			common.Die("error creating new ref: %s\n", err.Error())
 		}
@@ -79,7 +81,7 @@ func Mv() {
 			common.Die("error closing remote: %s\n", err.Error())
 		}
 
-		ok, err = remote.CasRoot(c, &k, newRefHash, bpy.NextRootVersion(rootVersion), epoch)
+		ok, err = remote.CasRoot(c, &k, cfg.Root, newRef, bpy.NextRootVersion(rootVersion), epoch)
 		if err != nil {
 			common.Die("creating ref: %s\n", err.Error())
 		}
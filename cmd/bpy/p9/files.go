@@ -13,7 +13,6 @@ import (
 	"github.com/buppyio/bpy/remote/client"
 	"io"
 	"path"
-	"time"
 )
 
 var (
@@ -27,7 +26,9 @@ type fs9 struct {
 	pathCounter uint64
 	version     uint32
 	file        *file
-	lastUpdated time.Time
+	// root is pushed by the remote, the tree is reread when it changes.
+	root     *remote.Root
+	lastRoot [32]byte
 }
 
 func (fs *fs9) CreateFile(ent fs.DirEnt, parent server9.File, fspath string) (*file, error) {
@@ -72,18 +73,16 @@ func (fs *fs9) CreateFile(ent fs.DirEnt, parent server9.File, fspath string) (*f
 }
 
 func (r *fs9) update() error {
-
-	if r.file != nil && time.Since(r.lastUpdated) < 30*time.Second {
-		return nil
-	}
-
-	root, _, ok, err := remote.GetRoot(r.client, &r.key)
+	root, _, ok, err := r.root.Get()
 	if err != nil {
 		return fmt.Errorf("error getting root: %s", err)
 	}
 	if !ok {
 		return fmt.Errorf("root missing\n")
 	}
+	if r.file != nil && root == r.lastRoot {
+		return nil
+	}
 
 	ref, err := refs.GetRef(r.store, root)
 	if err != nil {
@@ -105,7 +104,7 @@ func (r *fs9) update() error {
 	}
 	r.file = f
 
-	r.lastUpdated = time.Now()
+	r.lastRoot = root
 	r.version++
 
 	return nil
@@ -431,7 +430,7 @@ func (d *dirHandle) Clunk() error {
 
 type fileHandle struct {
 	file *file
-	rdr  *htree.Reader
+	rdr  *htree.ReaderAt
 }
 
 func (f *fileHandle) GetFile() (server9.File, error) {
@@ -451,7 +450,7 @@ func (f *fileHandle) Topen(msg *proto9.Topen) (proto9.Qid, error) {
 		f.rdr = nil
 	}
 	var err error
-	f.rdr, err = htree.NewReader(f.file.fs.store, f.file.ent.HTree.Data)
+	f.rdr, err = htree.NewReaderAt(f.file.fs.store, f.file.ent.HTree.Data)
 	return f.file.qid, err
 }
 
@@ -459,14 +458,11 @@ func (f *fileHandle) Tread(msg *proto9.Tread, buf []byte) (uint32, error) {
 	if f.rdr == nil {
 		return 0, fmt.Errorf("fid for '%s' is not open", f.file.path)
 	}
-	n, err := f.rdr.Read(buf)
-	if n != 0 {
-		return uint32(n), nil
-	}
+	n, err := f.rdr.ReadAt(buf, int64(msg.Offset))
 	if err == io.EOF {
-		return 0, nil
+		err = nil
 	}
-	return 0, err
+	return uint32(n), err
 }
 
 func (f *fileHandle) Twrite(msg *proto9.Twrite) (uint32, error) {
@@ -4,6 +4,7 @@ import (
 	"flag"
 	"github.com/buppyio/bpy/cmd/bpy/common"
 	"github.com/buppyio/bpy/cmd/bpy/p9/server9"
+	"github.com/buppyio/bpy/remote"
 	"log"
 	"net"
 )
@@ -32,12 +33,19 @@ func handleConnection(con net.Conn) {
 	}
 	defer store.Close()
 
+	root, err := remote.NewRoot(c, &k, cfg.Root)
+	if err != nil {
+		common.Die("error watching root: %s\n", err.Error())
+	}
+	defer root.Close()
+
 	attachFunc := func(name string) (server9.File, error) {
 
 		fs := &fs9{
 			key:    k,
 			store:  store,
 			client: c,
+			root:   root,
 		}
 
 		return fs, nil
@@ -48,6 +56,8 @@ func handleConnection(con net.Conn) {
 
 func P9() {
 	addrArg := flag.String("addr", "127.0.0.1:9001", "address to listen on")
+	common.RootFlag()
+	common.LimitFlags()
 	flag.Parse()
 
 	log.Printf("listening on: %s", *addrArg)
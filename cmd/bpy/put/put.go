@@ -13,6 +13,8 @@ import (
 )
 
 func Put() {
+	common.RootFlag()
+	common.LimitFlags()
 	flag.Parse()
 
 	if len(flag.Args()) < 1 {
@@ -60,7 +62,7 @@ func Put() {
 			common.Die("error getting content store: %s\n", err.Error())
 		}
 
-		rootHash, rootVersion, ok, err := remote.GetRoot(c, &k)
+		rootHash, rootVersion, ok, err := remote.GetRoot(c, &k, cfg.Root)
 		if err != nil {
 			common.Die("error fetching root hash: %s\n", err.Error())
 		}
@@ -83,19 +85,20 @@ func Put() {
 			common.Die("error inserting src into folder: %s\n", err.Error())
 		}
 
-		newRefHash, err := refs.PutRef(store, refs.Ref{
+		newRef := refs.Ref{
 			CreatedAt: time.Now().Unix(),
 			Root:      newRootEnt.HTree.Data,
 			HasPrev:   true,
 			Prev:      rootHash,
-		})
+		}
+		_, err = refs.PutRef(store, newRef)
 
 		err = store.Close()
 		if err != nil {
 			common.Die("error closing remote: %s\n", err.Error())
 		}
 
-		ok, err = remote.CasRoot(c, &k, newRefHash, bpy.NextRootVersion(rootVersion), epoch)
+		ok, err = remote.CasRoot(c, &k, cfg.Root, newRef, bpy.NextRootVersion(rootVersion), epoch)
 		if err != nil {
 			common.Die("error swapping root: %s\n", err.Error())
 		}
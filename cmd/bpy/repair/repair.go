@@ -0,0 +1,76 @@
+package repair
+
+import (
+	"flag"
+	"fmt"
+	"github.com/buppyio/bpy"
+	"github.com/buppyio/bpy/cmd/bpy/common"
+	"github.com/buppyio/bpy/fsck"
+	"github.com/buppyio/bpy/repair"
+)
+
+func Repair() {
+	readData := flag.Float64("read-data", 0, "percentage of file data to read and verify when looking for damage")
+
+	common.LimitFlags()
+	flag.Parse()
+
+	if len(flag.Args()) == 0 {
+		common.Die("please specify the local directories or files to repair from\n")
+	}
+	if *readData < 0 || *readData > 100 {
+		common.Die("-read-data must be a percentage between 0 and 100\n")
+	}
+
+	cfg, err := common.GetConfig()
+	if err != nil {
+		common.Die("error getting config: %s\n", err)
+	}
+
+	k, err := common.GetKey(cfg)
+	if err != nil {
+		common.Die("error getting bpy key data: %s\n", err.Error())
+	}
+
+	c, err := common.GetRemote(cfg, &k)
+	if err != nil {
+		common.Die("error connecting to remote: %s\n", err.Error())
+	}
+	defer c.Close()
+
+	store, err := common.GetUncachedCStore(cfg, &k, c)
+	if err != nil {
+		common.Die("error getting content store: %s\n", err.Error())
+	}
+	rewriter, ok := store.(bpy.Rewriter)
+	if !ok {
+		common.Die("content store cannot rewrite values\n")
+	}
+
+	report, err := fsck.Fsck(c, store, &k, fsck.Options{ReadDataPercent: *readData})
+	if err != nil {
+		common.Die("error checking repository: %s\n", err.Error())
+	}
+	if len(report.Problems) == 0 {
+		fmt.Printf("no damage found\n")
+		return
+	}
+
+	result, err := repair.Repair(rewriter, report.Problems, flag.Args())
+	if err != nil {
+		common.Die("error repairing: %s\n", err.Error())
+	}
+
+	err = store.Close()
+	if err != nil {
+		common.Die("error closing content store: %s\n", err.Error())
+	}
+
+	fmt.Printf("repaired %d chunks\n", result.Repaired)
+	for _, p := range result.Unrepaired {
+		fmt.Printf("unrepaired: %s\n", p)
+	}
+	if len(result.Unrepaired) != 0 {
+		common.Die("%d problems could not be repaired\n", len(result.Unrepaired))
+	}
+}
@@ -10,6 +10,7 @@ import (
 )
 
 func Revert() {
+	common.RootFlag()
 	flag.Parse()
 
 	if len(flag.Args()) != 1 {
@@ -47,7 +48,7 @@ func Revert() {
 		common.Die("error getting content store: %s\n", err.Error())
 	}
 
-	rootHash, rootVersion, ok, err := remote.GetRoot(c, &k)
+	rootHash, rootVersion, ok, err := remote.GetRoot(c, &k, cfg.Root)
 	if err != nil {
 		common.Die("error fetching root hash: %s\n", err.Error())
 	}
@@ -64,7 +65,7 @@ func Revert() {
 	revertToRef.HasPrev = true
 	revertToRef.CreatedAt = time.Now().Unix()
 
-	newRefHash, err := refs.PutRef(store, revertToRef)
+	_, err = refs.PutRef(store, revertToRef)
 	if err != nil {
 		common.Die("error writing updated ref: %s\n", err.Error())
 	}
@@ -74,7 +75,7 @@ func Revert() {
 		common.Die("error closing content store: %s\n", err.Error())
 	}
 
-	ok, err = remote.CasRoot(c, &k, newRefHash, bpy.NextRootVersion(rootVersion), epoch)
+	ok, err = remote.CasRoot(c, &k, cfg.Root, revertToRef, bpy.NextRootVersion(rootVersion), epoch)
 	if err != nil {
 		common.Die("error swapping root: %s\n", err.Error())
 	}
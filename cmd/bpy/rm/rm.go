@@ -11,6 +11,7 @@ import (
 )
 
 func Rm() {
+	common.RootFlag()
 	flag.Parse()
 
 	cfg, err := common.GetConfig()
@@ -40,7 +41,7 @@ func Rm() {
 	}
 
 	for {
-		rootHash, rootVersion, ok, err := remote.GetRoot(c, &k)
+		rootHash, rootVersion, ok, err := remote.GetRoot(c, &k, cfg.Root)
 		if err != nil {
 			common.Die("error fetching root hash: %s\n", err.Error())
 		}
@@ -62,19 +63,20 @@ func Rm() {
 			newRoot = newRootEnt.HTree.Data
 		}
 
-		newRefHash, err := refs.PutRef(store, refs.Ref{
+		newRef := refs.Ref{
 			CreatedAt: time.Now().Unix(),
 			Root:      newRoot,
 			HasPrev:   true,
 			Prev:      rootHash,
-		})
+		}
+		_, err = refs.PutRef(store, newRef)
 
 		err = store.Close()
 		if err != nil {
 			common.Die("error closing store: %s\n", err.Error())
 		}
 
-		ok, err = remote.CasRoot(c, &k, newRefHash, bpy.NextRootVersion(rootVersion), epoch)
+		ok, err = remote.CasRoot(c, &k, cfg.Root, newRef, bpy.NextRootVersion(rootVersion), epoch)
 		if err != nil {
 			common.Die("error swapping root: %s\n", err.Error())
 		}
@@ -11,6 +11,8 @@ import (
 )
 
 func Tar() {
+	common.RootFlag()
+	common.LimitFlags()
 	flag.Parse()
 
 	tarPath := ""
@@ -42,7 +44,7 @@ func Tar() {
 		common.Die("error getting content store: %s\n", err.Error())
 	}
 
-	rootHash, _, ok, err := remote.GetRoot(c, &k)
+	rootHash, _, ok, err := remote.GetRoot(c, &k, cfg.Root)
 	if err != nil {
 		common.Die("error fetching root hash: %s\n", err.Error())
 	}
@@ -11,6 +11,8 @@ import (
 )
 
 func Zip() {
+	common.RootFlag()
+	common.LimitFlags()
 	flag.Parse()
 
 	zipPath := ""
@@ -42,7 +44,7 @@ func Zip() {
 		common.Die("error getting content store: %s\n", err.Error())
 	}
 
-	rootHash, _, ok, err := remote.GetRoot(c, &k)
+	rootHash, _, ok, err := remote.GetRoot(c, &k, cfg.Root)
 	if err != nil {
 		common.Die("error fetching root hash: %s\n", err.Error())
 	}
@@ -0,0 +1,233 @@
+// Package codec implements the compression codecs used for values stored in
+// packs. Encoded values begin with a byte naming the codec used.
+package codec
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	None  = 0
+	Flate = 1
+	LZ    = 2
+)
+
+// A padded value has this bit set in its codec byte, the codec byte is
+// followed by the uvarint length of the encoded data and then zero bytes
+// up to the padded size.
+const padded = 0x80
+
+// MaxValueSize is the largest value stored in packs, an htree node. The lz
+// codec refuses longer values so corrupt lengths can't force large
+// allocations.
+const MaxValueSize = 65535
+
+var (
+	ErrUnknownCodec = errors.New("unknown codec")
+	ErrCorrupt      = errors.New("corrupt compressed value")
+)
+
+type codec struct {
+	name         string
+	defaultLevel int
+	compress     func(data []byte, level int) ([]byte, error)
+	decompress   func(data []byte) ([]byte, error)
+}
+
+var registry = map[uint8]*codec{
+	None: {
+		name:       "none",
+		compress:   func(data []byte, level int) ([]byte, error) { return data, nil },
+		decompress: func(data []byte) ([]byte, error) { return data, nil },
+	},
+	Flate: {
+		name:         "flate",
+		defaultLevel: flate.BestSpeed,
+		compress:     flateCompress,
+		decompress:   flateDecompress,
+	},
+	LZ: {
+		name:       "lz",
+		compress:   func(data []byte, level int) ([]byte, error) { return lzCompress(data), nil },
+		decompress: lzDecompress,
+	},
+}
+
+// Compressor encodes values with a codec, values that do not
+// shrink are stored uncompressed.
+type Compressor struct {
+	ID    uint8
+	Level int
+}
+
+var Default = Compressor{ID: Flate, Level: flate.BestSpeed}
+
+// Parse parses a compressor spec of the form "name" or "name:level".
+func Parse(spec string) (Compressor, error) {
+	name := spec
+	levelStr := ""
+	idx := strings.Index(spec, ":")
+	if idx != -1 {
+		name = spec[:idx]
+		levelStr = spec[idx+1:]
+	}
+	for id, c := range registry {
+		if c.name != name {
+			continue
+		}
+		level := c.defaultLevel
+		if levelStr != "" {
+			v, err := strconv.Atoi(levelStr)
+			if err != nil {
+				return Compressor{}, fmt.Errorf("invalid compression level '%s'", levelStr)
+			}
+			level = v
+		}
+		if id == Flate && (level < flate.HuffmanOnly || level > flate.BestCompression) {
+			return Compressor{}, fmt.Errorf("invalid flate compression level %d", level)
+		}
+		return Compressor{ID: id, Level: level}, nil
+	}
+	return Compressor{}, fmt.Errorf("unknown codec '%s'", name)
+}
+
+func (c Compressor) String() string {
+	cd, ok := registry[c.ID]
+	if !ok {
+		return "unknown"
+	}
+	if c.Level != cd.defaultLevel {
+		return fmt.Sprintf("%s:%d", cd.name, c.Level)
+	}
+	return cd.name
+}
+
+func (c Compressor) Encode(data []byte) ([]byte, error) {
+	cd, ok := registry[c.ID]
+	if !ok {
+		return nil, ErrUnknownCodec
+	}
+	compressed, err := cd.compress(data, c.Level)
+	if err != nil {
+		return nil, err
+	}
+	if c.ID == None || len(compressed) >= len(data) || (c.ID == LZ && len(data) > lzMaxLen) {
+		return Wrap(None, data), nil
+	}
+	return Wrap(c.ID, compressed), nil
+}
+
+// Wrap prefixes already encoded data with the id of its codec.
+func Wrap(id uint8, data []byte) []byte {
+	buf := make([]byte, len(data)+1, len(data)+1)
+	buf[0] = id
+	copy(buf[1:], data)
+	return buf
+}
+
+// Pad pads an encoded value to padTo of its size, values that are already
+// padded are returned unchanged.
+func Pad(enc []byte, padTo func(uint64) uint64) []byte {
+	if len(enc) == 0 || enc[0]&padded != 0 {
+		return enc
+	}
+	payload := enc[1:]
+	var lenbuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lenbuf[:], uint64(len(payload)))
+	need := uint64(1 + n + len(payload))
+	size := padTo(need)
+	if size < need {
+		size = need
+	}
+	buf := make([]byte, size, size)
+	buf[0] = enc[0] | padded
+	copy(buf[1:], lenbuf[:n])
+	copy(buf[1+n:], payload)
+	return buf
+}
+
+func unpad(buf []byte) (uint8, []byte, error) {
+	if len(buf) == 0 {
+		return 0, nil, ErrCorrupt
+	}
+	id := buf[0]
+	if id&padded == 0 {
+		return id, buf[1:], nil
+	}
+	l, n := binary.Uvarint(buf[1:])
+	if n <= 0 || l > uint64(len(buf)-1-n) {
+		return 0, nil, ErrCorrupt
+	}
+	return id &^ padded, buf[1+n : 1+n+int(l)], nil
+}
+
+// Overhead returns the number of bytes an encoded value spends on padding.
+func Overhead(buf []byte) (int, error) {
+	_, data, err := unpad(buf)
+	if err != nil {
+		return 0, err
+	}
+	return len(buf) - 1 - len(data), nil
+}
+
+func Decode(buf []byte) ([]byte, error) {
+	id, data, err := unpad(buf)
+	if err != nil {
+		return nil, err
+	}
+	cd, ok := registry[id]
+	if !ok {
+		return nil, ErrUnknownCodec
+	}
+	return cd.decompress(data)
+}
+
+// Flate writers are expensive to create, so they are reused,
+// indexed by level from flate.HuffmanOnly.
+var flateWriters [flate.BestCompression - flate.HuffmanOnly + 1]sync.Pool
+
+func flateCompress(data []byte, level int) ([]byte, error) {
+	var buf bytes.Buffer
+	pool := &flateWriters[level-flate.HuffmanOnly]
+	w, ok := pool.Get().(*flate.Writer)
+	if ok {
+		w.Reset(&buf)
+	} else {
+		var err error
+		w, err = flate.NewWriter(&buf, level)
+		if err != nil {
+			return nil, err
+		}
+	}
+	defer pool.Put(w)
+	_, err := w.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func flateDecompress(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	decompressed, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	err = r.Close()
+	if err != nil {
+		return nil, err
+	}
+	return decompressed, nil
+}
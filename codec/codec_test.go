@@ -0,0 +1,144 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+)
+
+func testValues() [][]byte {
+	rd := rand.New(rand.NewSource(1234))
+	vals := [][]byte{
+		{},
+		[]byte("a"),
+		[]byte("abcdabcdabcdabcdabcdabcdabcd"),
+		bytes.Repeat([]byte{0}, 100000),
+		bytes.Repeat([]byte("hello world "), 5000),
+	}
+	for i := 0; i < 20; i++ {
+		v := make([]byte, rd.Intn(70000))
+		rd.Read(v)
+		if i%2 == 0 {
+			// Partially compressible.
+			for j := 0; j+8 < len(v); j += 16 {
+				copy(v[j:j+8], "repeated")
+			}
+		}
+		vals = append(vals, v)
+	}
+	return vals
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, spec := range []string{"none", "flate", "flate:9", "lz"} {
+		c, err := Parse(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, v := range testValues() {
+			enc, err := c.Encode(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(enc) > len(v)+1 {
+				t.Fatalf("%s: value %d grew from %d to %d", spec, i, len(v), len(enc))
+			}
+			dec, err := Decode(enc)
+			if err != nil {
+				t.Fatalf("%s: value %d: %s", spec, i, err)
+			}
+			if !bytes.Equal(dec, v) {
+				t.Fatalf("%s: value %d corrupted", spec, i)
+			}
+		}
+	}
+}
+
+func TestIncompressibleStoredRaw(t *testing.T) {
+	rd := rand.New(rand.NewSource(4321))
+	v := make([]byte, 4096)
+	rd.Read(v)
+	for _, c := range []Compressor{Default, {ID: LZ}} {
+		enc, err := c.Encode(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if enc[0] != None {
+			t.Fatalf("%s: random data not stored raw", c)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	for _, bad := range []string{"", "zstd", "flate:x", "flate:42"} {
+		_, err := Parse(bad)
+		if err == nil {
+			t.Fatalf("expected error parsing '%s'", bad)
+		}
+	}
+	c, err := Parse("flate:6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ID != Flate || c.Level != 6 || c.String() != "flate:6" {
+		t.Fatalf("bad compressor %v", c)
+	}
+}
+
+func TestCorruptLZ(t *testing.T) {
+	enc := lzCompress(bytes.Repeat([]byte("abcdefgh"), 100))
+	for i := 1; i < len(enc); i++ {
+		// Truncated values must never panic.
+		lzDecompress(enc[:i])
+	}
+	_, err := Decode([]byte{LZ, 10, 0x80, 5})
+	if err == nil {
+		t.Fatal("expected error for a match before any output")
+	}
+	// A length past the largest value is refused before allocating.
+	_, err = Decode(append([]byte{LZ}, binary.AppendUvarint(nil, 1<<27)...))
+	if err != ErrCorrupt {
+		t.Fatalf("expected %v, got %v", ErrCorrupt, err)
+	}
+	big := bytes.Repeat([]byte("abcdefgh"), MaxValueSize)
+	enc, err = Compressor{ID: LZ}.Encode(big)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec, err := Decode(enc)
+	if err != nil || !bytes.Equal(dec, big) {
+		t.Fatal("values larger than MaxValueSize must stay readable")
+	}
+}
+
+func TestPad(t *testing.T) {
+	padTo := func(n uint64) uint64 { return (n + 255) &^ 255 }
+	for i, v := range testValues() {
+		enc, err := Default.Encode(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := Pad(enc, padTo)
+		if len(p)%256 != 0 {
+			t.Fatalf("value %d padded to %d", i, len(p))
+		}
+		if len(Pad(p, padTo)) != len(p) {
+			t.Fatalf("value %d padded twice", i)
+		}
+		overhead, err := Overhead(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if overhead < len(p)-len(enc) {
+			t.Fatalf("value %d: bad overhead %d", i, overhead)
+		}
+		dec, err := Decode(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(dec, v) {
+			t.Fatalf("value %d corrupted by padding", i)
+		}
+	}
+}
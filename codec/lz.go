@@ -0,0 +1,123 @@
+package codec
+
+import (
+	"encoding/binary"
+)
+
+// The lz codec is a byte oriented LZ77 variant that trades ratio for speed.
+// A value is the uvarint length of the decompressed data followed by tokens.
+// A token byte with the high bit clear is followed by a run of (b&0x7f)+1
+// literal bytes, with the high bit set it copies (b&0x7f)+lzMinMatch bytes
+// from the uvarint distance that follows. A length field of 0x7f is followed
+// by a uvarint added to the length.
+const (
+	lzMinMatch    = 4
+	lzHashBits    = 14
+	lzMaxDistance = 1 << 16
+	lzMaxLen      = MaxValueSize
+	lzLenMask     = 0x7f
+)
+
+func lzHash(v uint32) uint32 {
+	return (v * 2654435761) >> (32 - lzHashBits)
+}
+
+func lzAppendLen(dst []byte, tag byte, n int) []byte {
+	if n < lzLenMask {
+		return append(dst, tag|byte(n))
+	}
+	dst = append(dst, tag|lzLenMask)
+	return binary.AppendUvarint(dst, uint64(n-lzLenMask))
+}
+
+func lzAppendLiterals(dst, lit []byte) []byte {
+	if len(lit) == 0 {
+		return dst
+	}
+	dst = lzAppendLen(dst, 0, len(lit)-1)
+	return append(dst, lit...)
+}
+
+func lzCompress(src []byte) []byte {
+	dst := make([]byte, 0, len(src)/2+16)
+	dst = binary.AppendUvarint(dst, uint64(len(src)))
+	var table [1 << lzHashBits]int32
+	for i := range table {
+		table[i] = -1
+	}
+	lit := 0
+	i := 0
+	for i+lzMinMatch <= len(src) {
+		v := binary.LittleEndian.Uint32(src[i:])
+		h := lzHash(v)
+		cand := int(table[h])
+		table[h] = int32(i)
+		if cand < 0 || i-cand > lzMaxDistance || binary.LittleEndian.Uint32(src[cand:]) != v {
+			i++
+			continue
+		}
+		n := lzMinMatch
+		for i+n < len(src) && src[cand+n] == src[i+n] {
+			n++
+		}
+		dst = lzAppendLiterals(dst, src[lit:i])
+		dst = lzAppendLen(dst, 0x80, n-lzMinMatch)
+		dst = binary.AppendUvarint(dst, uint64(i-cand))
+		i += n
+		lit = i
+	}
+	return lzAppendLiterals(dst, src[lit:])
+}
+
+func lzReadLen(src []byte, b byte) (int, []byte, bool) {
+	n := int(b & lzLenMask)
+	if n != lzLenMask {
+		return n, src, true
+	}
+	extra, sz := binary.Uvarint(src)
+	if sz <= 0 || extra > lzMaxLen {
+		return 0, nil, false
+	}
+	return n + int(extra), src[sz:], true
+}
+
+func lzDecompress(src []byte) ([]byte, error) {
+	dlen, sz := binary.Uvarint(src)
+	if sz <= 0 || dlen > lzMaxLen {
+		return nil, ErrCorrupt
+	}
+	src = src[sz:]
+	dst := make([]byte, 0, dlen)
+	for len(src) != 0 {
+		b := src[0]
+		n, rest, ok := lzReadLen(src[1:], b)
+		if !ok {
+			return nil, ErrCorrupt
+		}
+		src = rest
+		if b&0x80 == 0 {
+			n += 1
+			if n > len(src) || uint64(len(dst)+n) > dlen {
+				return nil, ErrCorrupt
+			}
+			dst = append(dst, src[:n]...)
+			src = src[n:]
+			continue
+		}
+		n += lzMinMatch
+		dist, sz := binary.Uvarint(src)
+		if sz <= 0 || dist == 0 || dist > uint64(len(dst)) || uint64(len(dst)+n) > dlen {
+			return nil, ErrCorrupt
+		}
+		src = src[sz:]
+		start := len(dst) - int(dist)
+		// Matches may overlap the bytes they produce.
+		for j := 0; j < n; j++ {
+			dst = append(dst, dst[start+j])
+		}
+	}
+	if uint64(len(dst)) != dlen {
+		return nil, ErrCorrupt
+	}
+	return dst, nil
+}
@@ -111,6 +111,23 @@ func TestReadWrite(t *testing.T) {
 				t.Fatal("expected EOF")
 			}
 
+			for i := 0; i < 5 && len(data) != 0; i++ {
+				off := rand.Int() % len(data)
+				amnt := rand.Int() % (blocksz * 3)
+				expected := data[off:]
+				if amnt < len(expected) {
+					expected = expected[:amnt]
+				}
+				got := make([]byte, amnt, amnt)
+				n, err := rdr.ReadAt(got, int64(off))
+				if n != len(expected) || (n < amnt && err != io.EOF) {
+					t.Fatalf("bad ReadAt at %d: n=%d err=%v", off, n, err)
+				}
+				if !reflect.DeepEqual(expected, got[:n]) {
+					t.Fatalf("ReadAt data differs at %d", off)
+				}
+			}
+
 			err = rdr.Close()
 			if err != nil {
 				t.Fatal(err)
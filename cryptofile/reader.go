@@ -4,6 +4,7 @@ import (
 	"crypto/cipher"
 	"errors"
 	"io"
+	"sync"
 )
 
 type ReadSeekCloser interface {
@@ -13,6 +14,7 @@ type ReadSeekCloser interface {
 }
 
 type Reader struct {
+	lock   sync.Mutex
 	r      ReadSeekCloser
 	block  cipher.Block
 	size   int64
@@ -68,6 +70,32 @@ func (r *Reader) Size() (int64, error) {
 }
 
 func (r *Reader) readBlocks(idx int64, buf []byte) (int, error) {
+	return r.readBlocksAt(idx, buf, r.ctr, r.enc)
+}
+
+func (r *Reader) readCipherText(buf []byte, off int64) error {
+	ra, ok := r.r.(io.ReaderAt)
+	if ok {
+		n, err := ra.ReadAt(buf, off)
+		if n == len(buf) {
+			return nil
+		}
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	_, err := r.r.Seek(off, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	_, err = io.ReadFull(r.r, buf)
+	return err
+}
+
+func (r *Reader) readBlocksAt(idx int64, buf []byte, ctr *ctrState, enc []byte) (int, error) {
 
 	blocksz := int64(r.block.BlockSize())
 
@@ -82,25 +110,21 @@ func (r *Reader) readBlocks(idx int64, buf []byte) (int, error) {
 
 	if r.size < idx*blocksz+int64(len(buf)) {
 		buf = buf[:r.size-idx*blocksz]
+		nblocks = int64(len(buf)) / blocksz
 	}
 
-	_, err := r.r.Seek((1+idx)*blocksz, io.SeekStart)
-	if err != nil {
-		return 0, err
-	}
-
-	_, err = io.ReadFull(r.r, buf)
+	err := r.readCipherText(buf, (1+idx)*blocksz)
 	if err != nil {
 		return 0, err
 	}
 
-	r.ctr.Reset()
-	r.ctr.Add(uint64(idx))
+	ctr.Reset()
+	ctr.Add(uint64(idx))
 	for i := int64(0); i < nblocks; i++ {
 		toDecrypt := buf[i*blocksz : (i+1)*blocksz]
-		r.block.Encrypt(r.enc, r.ctr.Vec)
-		Xor(toDecrypt, r.enc)
-		r.ctr.Add(1)
+		r.block.Encrypt(enc, ctr.Vec)
+		Xor(toDecrypt, enc)
+		ctr.Add(1)
 	}
 
 	if idx*blocksz+int64(len(buf)) == r.size {
@@ -119,6 +143,42 @@ func (r *Reader) readBlocks(idx int64, buf []byte) (int, error) {
 	return len(buf), nil
 }
 
+// ReadAt does not use the reader offset and is safe for concurrent use
+// if the underlying file implements io.ReaderAt.
+func (r *Reader) ReadAt(buf []byte, off int64) (int, error) {
+	if len(buf) == 0 {
+		return 0, nil
+	}
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	blocksz := int64(r.block.BlockSize())
+	aligned := off - (off % blocksz)
+	shiftamnt := off - aligned
+
+	buflen := int64(len(buf)) + shiftamnt
+	if buflen%blocksz != 0 {
+		buflen += blocksz - (buflen % blocksz)
+	}
+
+	ctr := newCtrState(r.ctr.Iv)
+	enc := make([]byte, blocksz, blocksz)
+	buf2 := make([]byte, buflen, buflen)
+	nread, err := r.readBlocksAt(aligned/blocksz, buf2, ctr, enc)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	n := 0
+	if int64(nread) > shiftamnt {
+		n = copy(buf, buf2[shiftamnt:nread])
+	}
+	if n < len(buf) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
 func (r *Reader) Read(buf []byte) (int, error) {
 
 	if len(buf) == 0 {
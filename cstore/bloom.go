@@ -0,0 +1,61 @@
+package cstore
+
+import (
+	"encoding/binary"
+)
+
+const (
+	bloomBitsPerKey = 10
+	bloomProbes     = 7
+)
+
+type bloomFilter struct {
+	bits  []byte
+	nbits uint64
+}
+
+func newBloomFilter(nkeys uint64) *bloomFilter {
+	nbits := nkeys * bloomBitsPerKey
+	if nbits < 64 {
+		nbits = 64
+	}
+	nbits = (nbits + 7) &^ 7
+	return &bloomFilter{
+		bits:  make([]byte, nbits/8),
+		nbits: nbits,
+	}
+}
+
+func loadBloomFilter(bits []byte) *bloomFilter {
+	return &bloomFilter{
+		bits:  bits,
+		nbits: uint64(len(bits)) * 8,
+	}
+}
+
+// Keys are sha256 hashes, so slices of the key are already
+// independent hash functions.
+func bloomHashes(key string) (uint64, uint64) {
+	var buf [16]byte
+	copy(buf[:], key)
+	return binary.LittleEndian.Uint64(buf[0:8]), binary.LittleEndian.Uint64(buf[8:16]) | 1
+}
+
+func (b *bloomFilter) add(key string) {
+	h1, h2 := bloomHashes(key)
+	for i := uint64(0); i < bloomProbes; i++ {
+		bit := (h1 + i*h2) % b.nbits
+		b.bits[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+func (b *bloomFilter) mayContain(key string) bool {
+	h1, h2 := bloomHashes(key)
+	for i := uint64(0); i < bloomProbes; i++ {
+		bit := (h1 + i*h2) % b.nbits
+		if b.bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
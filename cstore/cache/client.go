@@ -6,12 +6,15 @@ import (
 	"io"
 	"io/ioutil"
 	"net/rpc"
+	"sync"
 )
 
 type Client struct {
-	client   *rpc.Client
-	flatebuf bytes.Buffer
-	flatew   *flate.Writer
+	client *rpc.Client
+
+	flateLock sync.Mutex
+	flatebuf  bytes.Buffer
+	flatew    *flate.Writer
 }
 
 func NewClient(rwc io.ReadWriteCloser) (*Client, error) {
@@ -34,13 +37,10 @@ func (c *Client) Get(hash [32]byte) ([]byte, bool, error) {
 		return nil, false, nil
 	}
 	rdr := flate.NewReader(bytes.NewBuffer(val))
-	c.flatebuf.Reset()
-	_, err = io.Copy(&c.flatebuf, rdr)
+	buf, err := ioutil.ReadAll(rdr)
 	if err != nil {
 		return nil, false, err
 	}
-	buf := make([]byte, c.flatebuf.Len(), c.flatebuf.Len())
-	copy(buf, c.flatebuf.Bytes())
 	return buf, true, nil
 }
 
@@ -51,6 +51,8 @@ func (c *Client) GetRaw(hash [32]byte) ([]byte, bool, error) {
 }
 
 func (c *Client) Put(hash [32]byte, val []byte) error {
+	c.flateLock.Lock()
+	defer c.flateLock.Unlock()
 	c.flatebuf.Reset()
 	c.flatew.Reset(&c.flatebuf)
 	_, err := c.flatew.Write(val)
@@ -36,6 +36,45 @@ func (c *CachedCStore) Get(hash [32]byte) ([]byte, error) {
 	return v, nil
 }
 
+func (c *CachedCStore) GetMany(hashes [][32]byte, fn func([32]byte, []byte) error) error {
+	missing := make([][32]byte, 0, len(hashes))
+	for _, hash := range hashes {
+		v, ok, err := c.cache.Get(hash)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			missing = append(missing, hash)
+			continue
+		}
+		err = fn(hash, v)
+		if err != nil {
+			return err
+		}
+	}
+	getter, ok := c.store.(bpy.BatchGetter)
+	if !ok {
+		for _, hash := range missing {
+			v, err := c.Get(hash)
+			if err != nil {
+				return err
+			}
+			err = fn(hash, v)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return getter.GetMany(missing, func(hash [32]byte, v []byte) error {
+		err := c.cache.Put(hash, v)
+		if err != nil {
+			return err
+		}
+		return fn(hash, v)
+	})
+}
+
 func (c *CachedCStore) Put(val []byte) ([32]byte, error) {
 	hash, err := c.store.Put(val)
 	if err != nil {
@@ -48,6 +87,32 @@ func (c *CachedCStore) Put(val []byte) ([32]byte, error) {
 	return hash, nil
 }
 
+// NewStream returns a stream of the underlying store, if the underlying
+// store does not support streams it is shared and must be safe for
+// concurrent use.
+func (c *CachedCStore) NewStream() bpy.CStore {
+	streamer, ok := c.store.(bpy.StreamingCStore)
+	if !ok {
+		return &unclosableCStore{c}
+	}
+	return &CachedCStore{
+		store: streamer.NewStream(),
+		cache: c.cache,
+	}
+}
+
+type unclosableCStore struct {
+	bpy.CStore
+}
+
+func (s *unclosableCStore) Flush() error {
+	return nil
+}
+
+func (s *unclosableCStore) Close() error {
+	return nil
+}
+
 func (c *CachedCStore) Flush() error {
 	return c.store.Flush()
 }
@@ -0,0 +1,147 @@
+package cstore
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"github.com/buppyio/bpy"
+	"github.com/buppyio/bpy/bpack"
+	"github.com/buppyio/bpy/cryptofile"
+	"github.com/buppyio/bpy/remote"
+	"github.com/buppyio/bpy/remote/client"
+	"path"
+	"strings"
+)
+
+// Each pack may have an encrypted copy of its index stored beside it, so
+// the index can be fetched without reading the tail of the pack.
+const (
+	PackSuffix        = ".ebpack"
+	IndexObjectSuffix = ".eidx"
+)
+
+func IsPackName(name string) bool {
+	return strings.HasSuffix(name, PackSuffix)
+}
+
+func IsIndexObjectName(name string) bool {
+	return strings.HasSuffix(name, IndexObjectSuffix)
+}
+
+func IndexObjectName(packname string) string {
+	return strings.TrimSuffix(packname, PackSuffix) + IndexObjectSuffix
+}
+
+func PackNameFromIndexObject(name string) string {
+	return strings.TrimSuffix(name, IndexObjectSuffix) + PackSuffix
+}
+
+// SplitListing separates packs from index objects in a listing of the packs
+// directory, index objects are keyed by the name of their pack.
+func SplitListing(listing []remote.PackListing) ([]remote.PackListing, map[string]remote.PackListing) {
+	packs := make([]remote.PackListing, 0, len(listing))
+	indexes := make(map[string]remote.PackListing)
+	for _, ent := range listing {
+		switch {
+		case IsPackName(ent.Name):
+			packs = append(packs, ent)
+		case IsIndexObjectName(ent.Name):
+			indexes[PackNameFromIndexObject(ent.Name)] = ent
+		}
+	}
+	return packs, indexes
+}
+
+// WriteIndexObject uploads the index of a pack. When padTo is not nil the
+// plaintext is padded to padTo(size) so the size of the object does not
+// reveal the number of entries.
+func WriteIndexObject(c *client.Client, key [32]byte, packname string, idx bpack.Index, padTo func(uint64) uint64) error {
+	buf, err := indexObjectPlaintext(idx, padTo)
+	if err != nil {
+		return err
+	}
+	f, err := c.NewPack(path.Join("packs", IndexObjectName(packname)))
+	if err != nil {
+		return err
+	}
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		f.Cancel()
+		return err
+	}
+	bwc := &bpy.BufferedWriteCloser{
+		W: f,
+		B: bufio.NewWriterSize(f, 65536),
+	}
+	w, err := cryptofile.NewWriter(bwc, block)
+	if err != nil {
+		f.Cancel()
+		return err
+	}
+	_, err = w.Write(buf)
+	if err != nil {
+		f.Cancel()
+		return err
+	}
+	return w.Close()
+}
+
+func indexObjectPlaintext(idx bpack.Index, padTo func(uint64) uint64) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	err := bpack.WriteIndex(buf, idx)
+	if err != nil {
+		return nil, err
+	}
+	// Readers stop after the last entry, so the zeros are ignored.
+	if padTo != nil {
+		size := uint64(buf.Len())
+		if target := padTo(size); target > size {
+			buf.Write(make([]byte, target-size))
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func ReadIndexObject(c *client.Client, key [32]byte, obj remote.PackListing) (bpack.Index, error) {
+	f, err := c.Open(path.Join("packs", obj.Name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	r, err := cryptofile.NewReader(f, block, int64(obj.Size))
+	if err != nil {
+		return nil, err
+	}
+	return bpack.ReadIndex(bufio.NewReaderSize(r, 65536))
+}
+
+// ReadPackIndex reads the index of a pack from its index object if there is
+// one, falling back to the tail of the pack.
+func ReadPackIndex(c *client.Client, key [32]byte, pack remote.PackListing, indexes map[string]remote.PackListing) (bpack.Index, error) {
+	obj, ok := indexes[pack.Name]
+	if ok {
+		idx, err := ReadIndexObject(c, key, obj)
+		if err == nil {
+			return idx, nil
+		}
+	}
+	f, err := c.Open(path.Join("packs", pack.Name))
+	if err != nil {
+		return nil, err
+	}
+	packReader, err := bpack.NewEncryptedReader(f, key, int64(pack.Size))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	defer packReader.Close()
+	err = packReader.ReadIndex()
+	if err != nil {
+		return nil, err
+	}
+	return packReader.Idx, nil
+}
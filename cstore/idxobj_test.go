@@ -0,0 +1,92 @@
+package cstore
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/sha256"
+	"fmt"
+	"github.com/buppyio/bpy/bpack"
+	"github.com/buppyio/bpy/cryptofile"
+	"github.com/buppyio/bpy/remote"
+	"testing"
+)
+
+func TestSplitListing(t *testing.T) {
+	listing := []remote.PackListing{
+		{Name: "a.ebpack", Size: 100},
+		{Name: "a.eidx", Size: 10},
+		{Name: "b.ebpack", Size: 200},
+		{Name: "c.eidx", Size: 20},
+		{Name: "junk", Size: 1},
+	}
+	packs, indexes := SplitListing(listing)
+	if len(packs) != 2 || packs[0].Name != "a.ebpack" || packs[1].Name != "b.ebpack" {
+		t.Fatalf("bad packs: %v", packs)
+	}
+	if len(indexes) != 2 {
+		t.Fatalf("bad indexes: %v", indexes)
+	}
+	if indexes["a.ebpack"].Name != "a.eidx" || indexes["c.ebpack"].Name != "c.eidx" {
+		t.Fatalf("bad indexes: %v", indexes)
+	}
+	if IndexObjectName("b.ebpack") != "b.eidx" {
+		t.Fatal("bad index object name")
+	}
+}
+
+type nopCloser struct{ *bytes.Buffer }
+
+func (nopCloser) Close() error { return nil }
+
+func testIndex(n int) bpack.Index {
+	idx := make(bpack.Index, 0, n)
+	for i := 0; i < n; i++ {
+		h := sha256.Sum256([]byte(fmt.Sprintf("%d", i)))
+		idx = append(idx, bpack.IndexEnt{Key: string(h[:]), Offset: uint64(i * 100), Size: 100})
+	}
+	return idx
+}
+
+func indexObjectSize(t *testing.T, idx bpack.Index, padTo func(uint64) uint64) int {
+	var key [32]byte
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := indexObjectPlaintext(idx, padTo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := bpack.ReadIndex(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(idx) {
+		t.Fatalf("read %d entries, expected %d", len(got), len(idx))
+	}
+	out := nopCloser{&bytes.Buffer{}}
+	w, err := cryptofile.NewWriter(out, block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Write(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out.Len()
+}
+
+func TestIndexObjectPadding(t *testing.T) {
+	small, large := testIndex(101), testIndex(105)
+	if indexObjectSize(t, small, nil) == indexObjectSize(t, large, nil) {
+		t.Fatal("unpadded index objects should differ in size")
+	}
+	padTo := PadPadme.PadTo()
+	if a, b := indexObjectSize(t, small, padTo), indexObjectSize(t, large, padTo); a != b {
+		t.Fatalf("padded index objects are %d and %d bytes", a, b)
+	}
+}
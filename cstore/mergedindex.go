@@ -0,0 +1,377 @@
+package cstore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"github.com/buppyio/bpy/bpack"
+	"io"
+	"os"
+	"sort"
+)
+
+var errCorruptMetaIndex = errors.New("corrupt meta index")
+
+// A merged index file is laid out as:
+//
+//	magic[8] nrecs[8] bloomsize[8] npacks[4]
+//	npacks * (namelen[2] name size[8])
+//	bloom[bloomsize]
+//	nrecs * (hash[32] packno[4] size[4] offset[8])
+//
+// Records are sorted by hash so lookups are a binary search over
+// fixed size records.
+const (
+	mergedIndexMagic  = "BPYMIDX1"
+	mergedHeaderSize  = 28
+	mergedRecordSize  = 48
+	mergedRecordKeyLn = 32
+)
+
+type mergedRecord struct {
+	key    string
+	packno uint32
+	size   uint32
+	offset uint64
+}
+
+type mergedRecords []mergedRecord
+
+func (r mergedRecords) Len() int           { return len(r) }
+func (r mergedRecords) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r mergedRecords) Less(i, j int) bool { return r[i].key < r[j].key }
+
+func decodeMergedRecord(buf []byte) mergedRecord {
+	return mergedRecord{
+		key:    string(buf[0:32]),
+		packno: binary.LittleEndian.Uint32(buf[32:36]),
+		size:   binary.LittleEndian.Uint32(buf[36:40]),
+		offset: binary.LittleEndian.Uint64(buf[40:48]),
+	}
+}
+
+func encodeMergedRecord(buf []byte, rec mergedRecord) {
+	copy(buf[0:32], rec.key)
+	binary.LittleEndian.PutUint32(buf[32:36], rec.packno)
+	binary.LittleEndian.PutUint32(buf[36:40], rec.size)
+	binary.LittleEndian.PutUint64(buf[40:48], rec.offset)
+}
+
+type mergedIndex struct {
+	f      *os.File
+	packs  []*packInfo
+	bloom  *bloomFilter
+	nrecs  uint64
+	recoff int64
+}
+
+// openMergedIndex returns nil if there is no merged index at path.
+func openMergedIndex(path string) (*mergedIndex, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	m, err := readMergedIndexHeader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+func readMergedIndexHeader(f *os.File) (*mergedIndex, error) {
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	fsize := st.Size()
+	rd := bufio.NewReader(f)
+	readFull := func(buf []byte) error {
+		_, err := io.ReadFull(rd, buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return errCorruptMetaIndex
+		}
+		return err
+	}
+	var hdr [mergedHeaderSize]byte
+	err = readFull(hdr[:])
+	if err != nil {
+		return nil, err
+	}
+	if string(hdr[0:8]) != mergedIndexMagic {
+		return nil, errCorruptMetaIndex
+	}
+	nrecs := binary.LittleEndian.Uint64(hdr[8:16])
+	bloomsz := binary.LittleEndian.Uint64(hdr[16:24])
+	npacks := binary.LittleEndian.Uint32(hdr[24:28])
+	if bloomsz == 0 || bloomsz > uint64(fsize) || uint64(npacks) > uint64(fsize) {
+		return nil, errCorruptMetaIndex
+	}
+	off := int64(mergedHeaderSize)
+	packs := make([]*packInfo, 0, npacks)
+	for i := uint32(0); i < npacks; i++ {
+		var namelen [2]byte
+		err = readFull(namelen[:])
+		if err != nil {
+			return nil, err
+		}
+		name := make([]byte, binary.LittleEndian.Uint16(namelen[:]))
+		err = readFull(name)
+		if err != nil {
+			return nil, err
+		}
+		var size [8]byte
+		err = readFull(size[:])
+		if err != nil {
+			return nil, err
+		}
+		packs = append(packs, &packInfo{Name: string(name), Size: binary.LittleEndian.Uint64(size[:])})
+		off += int64(2 + len(name) + 8)
+	}
+	bloom := make([]byte, bloomsz)
+	err = readFull(bloom)
+	if err != nil {
+		return nil, err
+	}
+	off += int64(bloomsz)
+	if fsize-off < 0 || uint64(fsize-off) != nrecs*mergedRecordSize {
+		return nil, errCorruptMetaIndex
+	}
+	return &mergedIndex{
+		f:      f,
+		packs:  packs,
+		bloom:  loadBloomFilter(bloom),
+		nrecs:  nrecs,
+		recoff: off,
+	}, nil
+}
+
+func (m *mergedIndex) readRecord(n uint64, buf []byte) (mergedRecord, error) {
+	_, err := m.f.ReadAt(buf, m.recoff+int64(n*mergedRecordSize))
+	if err != nil {
+		return mergedRecord{}, err
+	}
+	rec := decodeMergedRecord(buf)
+	if int(rec.packno) >= len(m.packs) {
+		return mergedRecord{}, errCorruptMetaIndex
+	}
+	return rec, nil
+}
+
+func (m *mergedIndex) search(key string) (int, bpack.IndexEnt, bool, error) {
+	if !m.bloom.mayContain(key) {
+		return 0, bpack.IndexEnt{}, false, nil
+	}
+	var buf [mergedRecordSize]byte
+	lo := uint64(0)
+	hi := m.nrecs
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		rec, err := m.readRecord(mid, buf[:])
+		if err != nil {
+			return 0, bpack.IndexEnt{}, false, err
+		}
+		switch {
+		case key < rec.key:
+			hi = mid
+		case key > rec.key:
+			lo = mid + 1
+		default:
+			return int(rec.packno), bpack.IndexEnt{Key: key, Size: rec.size, Offset: rec.offset}, true, nil
+		}
+	}
+	return 0, bpack.IndexEnt{}, false, nil
+}
+
+// searchAll returns every record of key, a key is stored more than once
+// when a value was rewritten into a new pack.
+func (m *mergedIndex) searchAll(key string) ([]mergedRecord, error) {
+	if !m.bloom.mayContain(key) {
+		return nil, nil
+	}
+	var buf [mergedRecordSize]byte
+	lo := uint64(0)
+	hi := m.nrecs
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		rec, err := m.readRecord(mid, buf[:])
+		if err != nil {
+			return nil, err
+		}
+		if rec.key < key {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	var recs []mergedRecord
+	for i := lo; i < m.nrecs; i++ {
+		rec, err := m.readRecord(i, buf[:])
+		if err != nil {
+			return nil, err
+		}
+		if rec.key != key {
+			break
+		}
+		recs = append(recs, rec)
+	}
+	return recs, nil
+}
+
+func (m *mergedIndex) close() error {
+	return m.f.Close()
+}
+
+// writeMergedIndex writes the records of src belonging to live packs merged
+// with the entries of deltas to a new file at path.
+func writeMergedIndex(path string, src *mergedIndex, live []*packInfo, deltas []*deltaPack) error {
+	packs := make([]*packInfo, 0, len(live)+len(deltas))
+	remap := make([]uint32, len(live))
+	for i, pack := range live {
+		if pack == nil {
+			continue
+		}
+		remap[i] = uint32(len(packs))
+		packs = append(packs, pack)
+	}
+	deltaRecs := make(mergedRecords, 0, 1024)
+	for _, d := range deltas {
+		packno := uint32(len(packs))
+		packs = append(packs, d.info)
+		for _, ent := range d.idx {
+			if len(ent.Key) != mergedRecordKeyLn {
+				return errCorruptMetaIndex
+			}
+			deltaRecs = append(deltaRecs, mergedRecord{key: ent.Key, packno: packno, size: ent.Size, offset: ent.Offset})
+		}
+	}
+	sort.Sort(deltaRecs)
+
+	maxrecs := uint64(len(deltaRecs))
+	if src != nil {
+		maxrecs += src.nrecs
+	}
+	bloom := newBloomFilter(maxrecs)
+	recoff := int64(mergedHeaderSize) + int64(len(bloom.bits))
+	for _, pack := range packs {
+		recoff += int64(2 + len(pack.Name) + 8)
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Seek(recoff, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriterSize(f, 65536)
+
+	var srcrd *bufio.Reader
+	srcleft := uint64(0)
+	if src != nil {
+		srcrd = bufio.NewReaderSize(io.NewSectionReader(src.f, src.recoff, int64(src.nrecs*mergedRecordSize)), 65536)
+		srcleft = src.nrecs
+	}
+	var srcbuf [mergedRecordSize]byte
+	nextSrc := func() (mergedRecord, bool, error) {
+		for srcleft != 0 {
+			srcleft -= 1
+			_, err := io.ReadFull(srcrd, srcbuf[:])
+			if err != nil {
+				return mergedRecord{}, false, err
+			}
+			rec := decodeMergedRecord(srcbuf[:])
+			if int(rec.packno) >= len(live) {
+				return mergedRecord{}, false, errCorruptMetaIndex
+			}
+			if live[rec.packno] == nil {
+				continue
+			}
+			rec.packno = remap[rec.packno]
+			return rec, true, nil
+		}
+		return mergedRecord{}, false, nil
+	}
+
+	nrecs := uint64(0)
+	var outbuf [mergedRecordSize]byte
+	emit := func(rec mergedRecord) error {
+		encodeMergedRecord(outbuf[:], rec)
+		bloom.add(rec.key)
+		nrecs += 1
+		_, err := w.Write(outbuf[:])
+		return err
+	}
+	srcrec, srcok, err := nextSrc()
+	if err != nil {
+		return err
+	}
+	for srcok || len(deltaRecs) != 0 {
+		if srcok && (len(deltaRecs) == 0 || srcrec.key <= deltaRecs[0].key) {
+			err = emit(srcrec)
+			if err != nil {
+				return err
+			}
+			srcrec, srcok, err = nextSrc()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		err = emit(deltaRecs[0])
+		if err != nil {
+			return err
+		}
+		deltaRecs = deltaRecs[1:]
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	w = bufio.NewWriterSize(f, 65536)
+	var hdr [mergedHeaderSize]byte
+	copy(hdr[0:8], mergedIndexMagic)
+	binary.LittleEndian.PutUint64(hdr[8:16], nrecs)
+	binary.LittleEndian.PutUint64(hdr[16:24], uint64(len(bloom.bits)))
+	binary.LittleEndian.PutUint32(hdr[24:28], uint32(len(packs)))
+	_, err = w.Write(hdr[:])
+	if err != nil {
+		return err
+	}
+	for _, pack := range packs {
+		var buf [8]byte
+		binary.LittleEndian.PutUint16(buf[0:2], uint16(len(pack.Name)))
+		_, err = w.Write(buf[0:2])
+		if err != nil {
+			return err
+		}
+		_, err = w.WriteString(pack.Name)
+		if err != nil {
+			return err
+		}
+		binary.LittleEndian.PutUint64(buf[:], pack.Size)
+		_, err = w.Write(buf[:])
+		if err != nil {
+			return err
+		}
+	}
+	_, err = w.Write(bloom.bits)
+	if err != nil {
+		return err
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
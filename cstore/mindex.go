@@ -7,7 +7,6 @@ import (
 	"github.com/buppyio/bpy/remote/client"
 	"io/ioutil"
 	"os"
-	"path"
 	"path/filepath"
 	"strings"
 )
@@ -15,28 +14,233 @@ import (
 type packInfo struct {
 	Name string
 	Size uint64
-	Idx  bpack.Index
 }
 
-type metaIndex map[string]*packInfo
+type deltaPack struct {
+	info  *packInfo
+	idx   bpack.Index
+	bloom *bloomFilter
+}
+
+// metaIndex maps hashes to the pack containing them. Most entries live in
+// a merged index file in the index cache, packs added since the file was
+// written are held in memory with their own bloom filters. Packs that have
+// been removed since the merge are skipped until the next compaction.
+type metaIndex struct {
+	path   string
+	merged *mergedIndex
+	// live[packno] is nil if that pack of the merged index was removed.
+	live     []*packInfo
+	nremoved int
+	deltas   []*deltaPack
+	ndelta   uint64
+}
+
+const (
+	metaIndexFileName = "metaindex"
+	// Thresholds that trigger rewriting the merged index file.
+	maxDeltaEntries = 1 << 16
+	maxDeltaPacks   = 32
+	maxRemovedPacks = 16
+)
+
+func (midx *metaIndex) search(hash [32]byte) (*packInfo, bpack.IndexEnt, bool, error) {
+	k := string(hash[:])
+	for i := len(midx.deltas) - 1; i >= 0; i-- {
+		d := midx.deltas[i]
+		if !d.bloom.mayContain(k) {
+			continue
+		}
+		packIdx, ok := d.idx.Search(k)
+		if ok {
+			return d.info, d.idx[packIdx], true, nil
+		}
+	}
+	if midx.merged == nil {
+		return nil, bpack.IndexEnt{}, false, nil
+	}
+	packno, ent, ok, err := midx.merged.search(k)
+	if err != nil || !ok {
+		return nil, bpack.IndexEnt{}, false, err
+	}
+	info := midx.live[packno]
+	if info == nil {
+		return nil, bpack.IndexEnt{}, false, nil
+	}
+	return info, ent, true, nil
+}
 
-func searchMetaIndex(midx metaIndex, hash [32]byte) (*packInfo, bpack.IndexEnt, bool) {
+// searchAll returns every stored copy of hash, the most recently added first.
+func (midx *metaIndex) searchAll(hash [32]byte) ([]chunkLocation, error) {
 	k := string(hash[:])
-	info, ok := midx[k]
-	if ok {
-		packIdx, ok := info.Idx.Search(k)
-		if !ok {
-			panic("corrupt meta index")
+	var locs []chunkLocation
+	for i := len(midx.deltas) - 1; i >= 0; i-- {
+		d := midx.deltas[i]
+		if !d.bloom.mayContain(k) {
+			continue
+		}
+		packIdx, ok := d.idx.Search(k)
+		if ok {
+			locs = append(locs, chunkLocation{hash: hash, pack: d.info, ent: d.idx[packIdx]})
+		}
+	}
+	if midx.merged == nil {
+		return locs, nil
+	}
+	recs, err := midx.merged.searchAll(k)
+	if err != nil {
+		return nil, err
+	}
+	for _, rec := range recs {
+		info := midx.live[rec.packno]
+		if info == nil {
+			continue
+		}
+		locs = append(locs, chunkLocation{hash: hash, pack: info, ent: bpack.IndexEnt{Key: k, Size: rec.size, Offset: rec.offset}})
+	}
+	return locs, nil
+}
+
+func (midx *metaIndex) addPack(info *packInfo, idx bpack.Index) {
+	bloom := newBloomFilter(uint64(len(idx)))
+	for i := range idx {
+		bloom.add(idx[i].Key)
+	}
+	midx.deltas = append(midx.deltas, &deltaPack{info: info, idx: idx, bloom: bloom})
+	midx.ndelta += uint64(len(idx))
+}
+
+func (midx *metaIndex) needsCompaction() bool {
+	return midx.ndelta > maxDeltaEntries || len(midx.deltas) > maxDeltaPacks || midx.nremoved > maxRemovedPacks
+}
+
+// compact writes the live entries of the merged index and all deltas to
+// a new merged index file.
+func (midx *metaIndex) compact() error {
+	tmpname, err := bpy.RandomFileName()
+	if err != nil {
+		return err
+	}
+	tmppath := filepath.Join(filepath.Dir(midx.path), tmpname+".tmp")
+	err = writeMergedIndex(tmppath, midx.merged, midx.live, midx.deltas)
+	if err != nil {
+		os.Remove(tmppath)
+		return err
+	}
+	err = os.Rename(tmppath, midx.path)
+	if err != nil {
+		os.Remove(tmppath)
+		return err
+	}
+	merged, err := openMergedIndex(midx.path)
+	if err != nil {
+		return err
+	}
+	err = midx.close()
+	if err != nil {
+		merged.close()
+		return err
+	}
+	midx.merged = merged
+	midx.live = merged.packs
+	midx.nremoved = 0
+	midx.deltas = nil
+	midx.ndelta = 0
+	return nil
+}
+
+func (midx *metaIndex) close() error {
+	if midx.merged == nil {
+		return nil
+	}
+	err := midx.merged.close()
+	midx.merged = nil
+	return err
+}
+
+// updateMetaIndex brings the meta index in cachepath up to date with the
+// packs in listing, fetch is called for packs missing from the merged index.
+func updateMetaIndex(cachepath string, listing []remote.PackListing, fetch func(string, uint64) (bpack.Index, error)) (*metaIndex, error) {
+	midx := &metaIndex{path: filepath.Join(cachepath, metaIndexFileName)}
+	merged, err := openMergedIndex(midx.path)
+	if err == errCorruptMetaIndex {
+		// The merged index is only a cache, so it is rebuilt.
+		merged, err = nil, os.Remove(midx.path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if merged != nil {
+		midx.merged = merged
+		midx.live = make([]*packInfo, len(merged.packs))
+		copy(midx.live, merged.packs)
+	}
+	err = midx.update(listing, fetch)
+	if err != nil {
+		midx.close()
+		return nil, err
+	}
+	return midx, nil
+}
+
+// update drops packs missing from listing and fetches the indexes of
+// packs that are not yet known, existing entries are left in place.
+func (midx *metaIndex) update(listing []remote.PackListing, fetch func(string, uint64) (bpack.Index, error)) error {
+	listed := make(map[string]uint64)
+	for _, pack := range listing {
+		listed[pack.Name] = pack.Size
+	}
+	known := make(map[string]struct{})
+	for i, pack := range midx.live {
+		if pack == nil {
+			continue
+		}
+		size, ok := listed[pack.Name]
+		if !ok || size != pack.Size {
+			midx.live[i] = nil
+			midx.nremoved += 1
+			continue
+		}
+		known[pack.Name] = struct{}{}
+	}
+	deltas := midx.deltas[:0]
+	for _, d := range midx.deltas {
+		size, ok := listed[d.info.Name]
+		if !ok || size != d.info.Size {
+			midx.ndelta -= uint64(len(d.idx))
+			continue
+		}
+		known[d.info.Name] = struct{}{}
+		deltas = append(deltas, d)
+	}
+	for i := len(deltas); i < len(midx.deltas); i++ {
+		midx.deltas[i] = nil
+	}
+	midx.deltas = deltas
+	for _, pack := range listing {
+		_, ok := known[pack.Name]
+		if ok {
+			continue
+		}
+		idx, err := fetch(pack.Name, pack.Size)
+		if err != nil {
+			return err
 		}
-		return info, info.Idx[packIdx], true
+		midx.addPack(&packInfo{Name: pack.Name, Size: pack.Size}, idx)
+	}
+	if midx.needsCompaction() {
+		return midx.compact()
 	}
-	return nil, bpack.IndexEnt{}, false
+	return nil
 }
 
+// cleanOldIndexes removes cached indexes and packs rebuilt from parity
+// that don't belong to any of packs.
 func cleanOldIndexes(packs []remote.PackListing, cachepath string) error {
 	indexSet := make(map[string]struct{})
 	for _, pack := range packs {
 		indexSet[pack.Name+".index"] = struct{}{}
+		indexSet[pack.Name+recoveredSuffix] = struct{}{}
 	}
 
 	dirEnts, err := ioutil.ReadDir(cachepath)
@@ -45,7 +249,7 @@ func cleanOldIndexes(packs []remote.PackListing, cachepath string) error {
 	}
 
 	for _, ent := range dirEnts {
-		if !strings.HasSuffix(ent.Name(), ".index") {
+		if !strings.HasSuffix(ent.Name(), ".index") && !strings.HasSuffix(ent.Name(), recoveredSuffix) {
 			continue
 		}
 		_, ok := indexSet[ent.Name()]
@@ -58,37 +262,47 @@ func cleanOldIndexes(packs []remote.PackListing, cachepath string) error {
 	return nil
 }
 
-func readAndCacheMetaIndex(store *client.Client, key [32]byte, cachepath string) (metaIndex, error) {
+// listAndCleanPacks lists the packs of the remote, extra packs are treated
+// as if they were listed.
+func listAndCleanPacks(store *client.Client, cachepath string, extra []remote.PackListing) ([]remote.PackListing, map[string]remote.PackListing, error) {
 	listing, err := remote.ListPacks(store)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	packs, indexes := SplitListing(listing)
+	packs = append(packs, extra...)
+	err = cleanOldIndexes(packs, cachepath)
+	if err != nil {
+		return nil, nil, err
 	}
+	return packs, indexes, nil
+}
 
-	err = cleanOldIndexes(listing, cachepath)
+func indexFetcher(store *client.Client, key [32]byte, cachepath string, indexes map[string]remote.PackListing) func(string, uint64) (bpack.Index, error) {
+	return func(packname string, packsize uint64) (bpack.Index, error) {
+		pack := remote.PackListing{Name: packname, Size: packsize}
+		return getAndCacheIndex(store, key, pack, indexes, cachepath)
+	}
+}
+
+func readAndCacheMetaIndex(store *client.Client, key [32]byte, cachepath string) (*metaIndex, error) {
+	packs, indexes, err := listAndCleanPacks(store, cachepath, nil)
 	if err != nil {
 		return nil, err
 	}
+	return updateMetaIndex(cachepath, packs, indexFetcher(store, key, cachepath, indexes))
+}
 
-	midx := make(metaIndex)
-	for _, pack := range listing {
-		idx, err := getAndCacheIndex(store, key, pack.Name, pack.Size, cachepath)
-		if err != nil {
-			return nil, err
-		}
-		info := &packInfo{
-			Name: pack.Name,
-			Size: pack.Size,
-			Idx:  idx,
-		}
-		for i := range idx {
-			midx[idx[i].Key] = info
-		}
+func refreshMetaIndex(midx *metaIndex, store *client.Client, key [32]byte, cachepath string, extra []remote.PackListing) error {
+	packs, indexes, err := listAndCleanPacks(store, cachepath, extra)
+	if err != nil {
+		return err
 	}
-	return midx, nil
+	return midx.update(packs, indexFetcher(store, key, cachepath, indexes))
 }
 
-func getAndCacheIndex(store *client.Client, key [32]byte, packname string, packsize uint64, cachepath string) (bpack.Index, error) {
-	idxpath := filepath.Join(cachepath, packname+".index")
+func getAndCacheIndex(store *client.Client, key [32]byte, pack remote.PackListing, indexes map[string]remote.PackListing, cachepath string) (bpack.Index, error) {
+	idxpath := filepath.Join(cachepath, pack.Name+".index")
 	_, err := os.Stat(idxpath)
 	if err == nil {
 		f, err := os.Open(idxpath)
@@ -101,25 +315,15 @@ func getAndCacheIndex(store *client.Client, key [32]byte, packname string, packs
 	if !os.IsNotExist(err) {
 		return nil, err
 	}
-	packPath := path.Join("packs", packname)
-	f, err := store.Open(packPath)
-	if err != nil {
-		return nil, err
-	}
-	pack, err := bpack.NewEncryptedReader(f, key, int64(packsize))
-	if err != nil {
-		return nil, err
-	}
-	defer pack.Close()
-	err = pack.ReadIndex()
+	idx, err := ReadPackIndex(store, key, pack, indexes)
 	if err != nil {
 		return nil, err
 	}
-	err = cacheIndex(idxpath, pack.Idx)
+	err = cacheIndex(idxpath, idx)
 	if err != nil {
 		return nil, err
 	}
-	return pack.Idx, nil
+	return idx, nil
 }
 
 func cacheIndex(idxpath string, index bpack.Index) error {
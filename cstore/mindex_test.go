@@ -0,0 +1,224 @@
+package cstore
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/buppyio/bpy/bpack"
+	"github.com/buppyio/bpy/remote"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+)
+
+func testPackIndex(name string, n int) bpack.Index {
+	idx := make(bpack.Index, 0, n)
+	for i := 0; i < n; i++ {
+		h := sha256.Sum256([]byte(fmt.Sprintf("%s/%d", name, i)))
+		idx = append(idx, bpack.IndexEnt{Key: string(h[:]), Size: uint32(i), Offset: uint64(i * 100)})
+	}
+	sort.Sort(idx)
+	return idx
+}
+
+func checkMetaIndex(t *testing.T, midx *metaIndex, packs map[string]bpack.Index, removed map[string]bpack.Index) {
+	for name, idx := range packs {
+		for _, ent := range idx {
+			var h [32]byte
+			copy(h[:], ent.Key)
+			info, found, ok, err := midx.search(h)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok {
+				t.Fatalf("key from %s missing", name)
+			}
+			if info.Name != name || found != ent {
+				t.Fatalf("bad entry for key from %s: %s %v", name, info.Name, found)
+			}
+		}
+	}
+	for name, idx := range removed {
+		for _, ent := range idx {
+			var h [32]byte
+			copy(h[:], ent.Key)
+			_, _, ok, err := midx.search(h)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok {
+				t.Fatalf("key from removed pack %s found", name)
+			}
+		}
+	}
+}
+
+func TestMetaIndex(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "buppymidxtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	packs := make(map[string]bpack.Index)
+	removed := make(map[string]bpack.Index)
+	fetches := 0
+	fetch := func(name string, size uint64) (bpack.Index, error) {
+		fetches++
+		return packs[name], nil
+	}
+	listing := func() []remote.PackListing {
+		l := []remote.PackListing{}
+		for name := range packs {
+			l = append(l, remote.PackListing{Name: name, Size: 1})
+		}
+		return l
+	}
+
+	for i := 0; i < maxDeltaPacks+2; i++ {
+		name := fmt.Sprintf("pack%d", i)
+		packs[name] = testPackIndex(name, 50+i)
+	}
+	midx, err := updateMetaIndex(tmp, listing(), fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if midx.merged == nil || len(midx.deltas) != 0 {
+		t.Fatal("expected the meta index to be compacted")
+	}
+	checkMetaIndex(t, midx, packs, removed)
+	err = midx.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	removed["pack3"] = packs["pack3"]
+	delete(packs, "pack3")
+	packs["new"] = testPackIndex("new", 20)
+	fetches = 0
+	midx, err = updateMetaIndex(tmp, listing(), fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetches != 1 {
+		t.Fatalf("expected one index fetch, got %d", fetches)
+	}
+	if len(midx.deltas) != 1 || midx.nremoved != 1 {
+		t.Fatal("expected one delta and one removed pack")
+	}
+	checkMetaIndex(t, midx, packs, removed)
+
+	err = midx.compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMetaIndex(t, midx, packs, removed)
+	err = midx.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(midx.path, []byte("garbage"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	midx, err = updateMetaIndex(tmp, listing(), fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMetaIndex(t, midx, packs, removed)
+	err = midx.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMetaIndexUpdate(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "buppymidxtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	packs := make(map[string]bpack.Index)
+	removed := make(map[string]bpack.Index)
+	fetched := []string{}
+	fetch := func(name string, size uint64) (bpack.Index, error) {
+		fetched = append(fetched, name)
+		return packs[name], nil
+	}
+	listing := func() []remote.PackListing {
+		l := []remote.PackListing{}
+		for name := range packs {
+			l = append(l, remote.PackListing{Name: name, Size: 1})
+		}
+		return l
+	}
+
+	packs["a"] = testPackIndex("a", 10)
+	packs["b"] = testPackIndex("b", 10)
+	midx, err := updateMetaIndex(tmp, listing(), fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer midx.close()
+	checkMetaIndex(t, midx, packs, removed)
+
+	removed["a"] = packs["a"]
+	delete(packs, "a")
+	packs["c"] = testPackIndex("c", 10)
+	fetched = fetched[:0]
+	err = midx.update(listing(), fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fetched) != 1 || fetched[0] != "c" {
+		t.Fatalf("expected only the new pack to be fetched, got %v", fetched)
+	}
+	if midx.ndelta != 20 {
+		t.Fatalf("bad delta entry count %d", midx.ndelta)
+	}
+	checkMetaIndex(t, midx, packs, removed)
+}
+
+func TestMetaIndexSearchAll(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "buppymidxtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	dup := testPackIndex("dup", 1)[0]
+	packs := map[string]bpack.Index{
+		"a": append(testPackIndex("a", 10), dup),
+		"b": append(testPackIndex("b", 10), dup),
+	}
+	for _, idx := range packs {
+		sort.Sort(idx)
+	}
+	fetch := func(name string, size uint64) (bpack.Index, error) {
+		return packs[name], nil
+	}
+	listing := []remote.PackListing{{Name: "a", Size: 1}, {Name: "b", Size: 1}}
+	midx, err := updateMetaIndex(tmp, listing, fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer midx.close()
+	var h [32]byte
+	copy(h[:], dup.Key)
+	for i := 0; i < 2; i++ {
+		locs, err := midx.searchAll(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(locs) != 2 || locs[0].pack.Name == locs[1].pack.Name {
+			t.Fatalf("expected a copy in each pack, got %v", locs)
+		}
+		// Search the merged index too.
+		err = midx.compact()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package cstore
+
+import (
+	"fmt"
+	"github.com/buppyio/bpy/bpack"
+)
+
+// Padding selects how values and packs are padded to hide their sizes
+// from the remote.
+type Padding int
+
+const (
+	PadNone Padding = iota
+	PadPadme
+)
+
+func ParsePadding(s string) (Padding, error) {
+	switch s {
+	case "none":
+		return PadNone, nil
+	case "padme":
+		return PadPadme, nil
+	}
+	return PadNone, fmt.Errorf("unknown padding policy '%s'", s)
+}
+
+func (p Padding) String() string {
+	switch p {
+	case PadPadme:
+		return "padme"
+	default:
+		return "none"
+	}
+}
+
+// PadTo returns the function sizes are padded with, or nil if
+// no padding is done.
+func (p Padding) PadTo() func(uint64) uint64 {
+	switch p {
+	case PadPadme:
+		return bpack.Padme
+	default:
+		return nil
+	}
+}
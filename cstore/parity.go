@@ -0,0 +1,340 @@
+package cstore
+
+import (
+	"bufio"
+	"crypto/aes"
+	"fmt"
+	"github.com/buppyio/bpy"
+	"github.com/buppyio/bpy/cryptofile"
+	"github.com/buppyio/bpy/parity"
+	"github.com/buppyio/bpy/remote"
+	"github.com/buppyio/bpy/remote/client"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Groups of packs may be protected by an encrypted parity object stored
+// beside them, any damaged or missing pack of a group can be rebuilt from
+// the other packs and the parity shards.
+const ParityObjectSuffix = ".epar"
+
+func IsParityObjectName(name string) bool {
+	return strings.HasSuffix(name, ParityObjectSuffix)
+}
+
+// Parity selects how many packs are grouped together and how many parity
+// shards protect each group, the zero value disables parity.
+type Parity struct {
+	Data   int
+	Parity int
+}
+
+func ParseParity(s string) (Parity, error) {
+	if s == "none" {
+		return Parity{}, nil
+	}
+	parts := strings.Split(s, "+")
+	if len(parts) != 2 {
+		return Parity{}, fmt.Errorf("invalid parity '%s', expected none or data+parity", s)
+	}
+	k, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return Parity{}, fmt.Errorf("invalid parity '%s': %s", s, err)
+	}
+	m, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return Parity{}, fmt.Errorf("invalid parity '%s': %s", s, err)
+	}
+	_, err = parity.NewCode(k, m)
+	if err != nil {
+		return Parity{}, fmt.Errorf("invalid parity '%s': %s", s, err)
+	}
+	return Parity{Data: k, Parity: m}, nil
+}
+
+func (p Parity) String() string {
+	if p.Data == 0 {
+		return "none"
+	}
+	return fmt.Sprintf("%d+%d", p.Data, p.Parity)
+}
+
+// ParityWriter groups packs as they are written and uploads the parity
+// object of a group once it is full and all its packs are closed.
+type ParityWriter struct {
+	lock  sync.Mutex
+	store *client.Client
+	key   [32]byte
+	code  *parity.Code
+	dir   string
+	cur   *parityGroup
+}
+
+type parityGroup struct {
+	b      *parity.Builder
+	open   int
+	failed bool
+}
+
+type ParityShard struct {
+	g *parityGroup
+	w *parity.ShardWriter
+}
+
+func (s *ParityShard) Write(buf []byte) (int, error) {
+	return s.w.Write(buf)
+}
+
+// NewParityWriter returns nil if cfg disables parity, parity shards are
+// accumulated in temporary files in dir.
+func NewParityWriter(store *client.Client, key [32]byte, dir string, cfg Parity) (*ParityWriter, error) {
+	if cfg.Data == 0 {
+		return nil, nil
+	}
+	code, err := parity.NewCode(cfg.Data, cfg.Parity)
+	if err != nil {
+		return nil, err
+	}
+	return &ParityWriter{store: store, key: key, code: code, dir: dir}, nil
+}
+
+// AddPack adds a pack to the current group, every byte uploaded for the
+// pack must also be written to the returned shard.
+func (pw *ParityWriter) AddPack(name string) (*ParityShard, error) {
+	pw.lock.Lock()
+	defer pw.lock.Unlock()
+	if pw.cur == nil {
+		pw.cur = &parityGroup{b: parity.NewBuilder(pw.code, pw.dir)}
+	}
+	g := pw.cur
+	w, err := g.b.AddShard(name)
+	if err != nil {
+		return nil, err
+	}
+	g.open += 1
+	if g.b.Full() {
+		pw.cur = nil
+	}
+	return &ParityShard{g: g, w: w}, nil
+}
+
+// ClosePack finishes the shard of a pack, failed is true if the pack was
+// not uploaded and the group must be discarded.
+func (pw *ParityWriter) ClosePack(s *ParityShard, failed bool) error {
+	err := s.w.Close()
+	pw.lock.Lock()
+	g := s.g
+	g.open -= 1
+	if err != nil || failed {
+		g.failed = true
+	}
+	done := g.open == 0 && g != pw.cur
+	pw.lock.Unlock()
+	if !done {
+		return err
+	}
+	uerr := pw.finish(g)
+	if err == nil {
+		err = uerr
+	}
+	return err
+}
+
+// Flush uploads the parity object of the current partial group, it must
+// only be called once every pack has been closed.
+func (pw *ParityWriter) Flush() error {
+	pw.lock.Lock()
+	g := pw.cur
+	pw.cur = nil
+	pw.lock.Unlock()
+	if g == nil {
+		return nil
+	}
+	return pw.finish(g)
+}
+
+func (pw *ParityWriter) finish(g *parityGroup) error {
+	var err error
+	if !g.failed {
+		err = WriteParityObject(pw.store, pw.key, g.b)
+	}
+	cerr := g.b.Close()
+	if err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func WriteParityObject(c *client.Client, key [32]byte, b *parity.Builder) error {
+	name, err := bpy.RandomFileName()
+	if err != nil {
+		return err
+	}
+	f, err := c.NewPack(path.Join("packs", name+ParityObjectSuffix))
+	if err != nil {
+		return err
+	}
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		f.Cancel()
+		return err
+	}
+	bwc := &bpy.BufferedWriteCloser{
+		W: f,
+		B: bufio.NewWriterSize(f, 65536),
+	}
+	w, err := cryptofile.NewWriter(bwc, block)
+	if err != nil {
+		f.Cancel()
+		return err
+	}
+	_, err = b.WriteTo(w)
+	if err != nil {
+		f.Cancel()
+		return err
+	}
+	return w.Close()
+}
+
+// openParityObject returns a reader of the plaintext of a parity object.
+func openParityObject(c *client.Client, key [32]byte, obj remote.PackListing) (*cryptofile.Reader, error) {
+	f, err := c.Open(path.Join("packs", obj.Name))
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r, err := cryptofile.NewReader(f, block, int64(obj.Size))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func ReadParityGroup(c *client.Client, key [32]byte, obj remote.PackListing) (*parity.Group, error) {
+	r, err := openParityObject(c, key, obj)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return parity.ReadGroup(bufio.NewReaderSize(r, 65536))
+}
+
+// RecoverPack rebuilds the pack packname of the group stored in the parity
+// object obj into out. Packs of the group are read from the remote if they
+// are in listing with the size recorded in the group.
+func RecoverPack(c *client.Client, key [32]byte, obj remote.PackListing, g *parity.Group, packname string, listing []remote.PackListing, out io.WriterAt) error {
+	target := g.Index(packname)
+	if target == -1 {
+		return fmt.Errorf("pack %s is not in parity group %s", packname, obj.Name)
+	}
+	sizes := make(map[string]uint64)
+	for _, ent := range listing {
+		sizes[ent.Name] = ent.Size
+	}
+	shards := make([]io.ReaderAt, len(g.Members)+g.Code.M)
+	var closers []io.Closer
+	defer func() {
+		for _, c := range closers {
+			c.Close()
+		}
+	}()
+	for i, m := range g.Members {
+		size, ok := sizes[m.Name]
+		if i == target || !ok || size != uint64(m.Size) {
+			continue
+		}
+		f, err := c.Open(path.Join("packs", m.Name))
+		if err != nil {
+			continue
+		}
+		closers = append(closers, f)
+		shards[i] = f
+	}
+	r, err := openParityObject(c, key, obj)
+	if err != nil {
+		return err
+	}
+	closers = append(closers, r)
+	for j := 0; j < g.Code.M; j++ {
+		shards[len(g.Members)+j] = io.NewSectionReader(r, g.ShardOffset(j), g.ShardSize)
+	}
+	return g.Rebuild(target, shards, out)
+}
+
+const recoveredSuffix = ".recovered"
+
+// RecoverPackFile rebuilds a pack into a file in dir, returning its path.
+// A file rebuilt earlier is reused.
+func RecoverPackFile(c *client.Client, key [32]byte, obj remote.PackListing, g *parity.Group, packname string, listing []remote.PackListing, dir string) (string, error) {
+	final := filepath.Join(dir, packname+recoveredSuffix)
+	_, err := os.Stat(final)
+	if err == nil {
+		return final, nil
+	}
+	tmpname, err := bpy.RandomFileName()
+	if err != nil {
+		return "", err
+	}
+	tmppath := filepath.Join(dir, tmpname+".tmp")
+	f, err := os.OpenFile(tmppath, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0600)
+	if err != nil {
+		return "", err
+	}
+	err = RecoverPack(c, key, obj, g, packname, listing, f)
+	if err == nil {
+		err = f.Sync()
+	}
+	cerr := f.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmppath, final)
+	}
+	if err != nil {
+		os.Remove(tmppath)
+		return "", err
+	}
+	return final, nil
+}
+
+type ParityObject struct {
+	Listing remote.PackListing
+	Group   *parity.Group
+}
+
+// ReadParityGroups reads the headers of the parity objects in listing,
+// headers in cache are not read again and cache is updated if it is not
+// nil. Parity objects that can't be read are skipped, they can't be used
+// for recovery.
+func ReadParityGroups(c *client.Client, key [32]byte, listing []remote.PackListing, cache map[string]*parity.Group) []ParityObject {
+	var objs []ParityObject
+	for _, ent := range listing {
+		if !IsParityObjectName(ent.Name) {
+			continue
+		}
+		g, ok := cache[ent.Name]
+		if !ok {
+			var err error
+			g, err = ReadParityGroup(c, key, ent)
+			if err != nil {
+				continue
+			}
+			if cache != nil {
+				cache[ent.Name] = g
+			}
+		}
+		objs = append(objs, ParityObject{Listing: ent, Group: g})
+	}
+	return objs
+}
@@ -0,0 +1,23 @@
+package cstore
+
+import (
+	"testing"
+)
+
+func TestParseParity(t *testing.T) {
+	for _, s := range []string{"none", "4+1", "10+3"} {
+		p, err := ParseParity(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.String() != s {
+			t.Fatalf("%s parsed as %s", s, p)
+		}
+	}
+	for _, s := range []string{"", "4", "4+0", "0+1", "200+100", "a+b"} {
+		_, err := ParseParity(s)
+		if err == nil {
+			t.Fatalf("expected error parsing '%s'", s)
+		}
+	}
+}
@@ -4,29 +4,70 @@ import (
 	"bytes"
 	"compress/flate"
 	"container/list"
+	"crypto/sha256"
 	"errors"
 	"github.com/buppyio/bpy/bpack"
+	"github.com/buppyio/bpy/codec"
+	"github.com/buppyio/bpy/parity"
+	"github.com/buppyio/bpy/remote"
 	"github.com/buppyio/bpy/remote/client"
-	"io"
+	"io/ioutil"
+	"os"
 	"path"
+	"path/filepath"
+	"sort"
 	"sync"
+	"time"
 )
 
 var NotFound = errors.New("hash not in cstore")
 
+const (
+	// Batched reads coalesce values that are close together in a pack
+	// into a single read of at most maxRunSize bytes.
+	maxRunSize = 8 * 1024 * 1024
+	maxRunGap  = 64 * 1024
+
+	minRefreshInterval = 2 * time.Second
+)
+
 type packlruent struct {
 	packname string
 	pack     *bpack.Reader
+	hdr      bpack.Header
+	refs     int
+	evicted  bool
 }
 
 type Reader struct {
 	lock      sync.Mutex
 	store     *client.Client
 	cachepath string
-	midx      metaIndex
+	midx      *metaIndex
 	lru       *list.List
 	key       [32]byte
-	flatebuf  bytes.Buffer
+
+	// refreshLock serializes refreshes, lastRefresh is when the last one
+	// started listing the remote.
+	refreshLock sync.Mutex
+	lastRefresh time.Time
+
+	// Packs rebuilt from parity are read from local files, each pack is
+	// only rebuilt once. recoverLock serializes rebuilds without blocking
+	// other reads.
+	recoverLock     sync.Mutex
+	recovered       map[string]*recoveredPack
+	recoverTried    map[string]bool
+	parityGroups    map[string]*parity.Group
+	lastRecoverScan time.Time
+}
+
+type recoveredPack struct {
+	path string
+	size uint64
+	// missing is true if the pack is not on the remote, it is kept in the
+	// meta index across refreshes.
+	missing bool
 }
 
 func NewReader(store *client.Client, key [32]byte, cachepath string) (*Reader, error) {
@@ -35,53 +76,296 @@ func NewReader(store *client.Client, key [32]byte, cachepath string) (*Reader, e
 		return nil, err
 	}
 	return &Reader{
-		midx:      midx,
-		lru:       list.New(),
-		store:     store,
-		cachepath: cachepath,
-		key:       key,
+		midx:         midx,
+		lru:          list.New(),
+		store:        store,
+		cachepath:    cachepath,
+		key:          key,
+		recovered:    make(map[string]*recoveredPack),
+		recoverTried: make(map[string]bool),
+		parityGroups: make(map[string]*parity.Group),
 	}, nil
 }
 
 func (r *Reader) Has(hash [32]byte) (bool, error) {
 	r.lock.Lock()
 	defer r.lock.Unlock()
-	_, _, ok := searchMetaIndex(r.midx, hash)
-	return ok, nil
+	_, _, ok, err := r.midx.search(hash)
+	return ok, err
 }
 
-func (r *Reader) Get(hash [32]byte) ([]byte, error) {
+func (r *Reader) addPack(name string, size uint64, idx bpack.Index) {
 	r.lock.Lock()
 	defer r.lock.Unlock()
+	r.midx.addPack(&packInfo{Name: name, Size: size}, idx)
+}
+
+// Get is safe for concurrent use, the lock is not held while
+// values are fetched from the remote. If a value is stored more than once,
+// copies that can't be read or don't match their hash are skipped.
+func (r *Reader) Get(hash [32]byte) ([]byte, error) {
+	missed := time.Now()
+	r.lock.Lock()
+	locs, err := r.midx.searchAll(hash)
+	r.lock.Unlock()
+	if err == nil && len(locs) == 0 {
+		err = r.refresh(missed)
+		if err == nil {
+			r.lock.Lock()
+			locs, err = r.midx.searchAll(hash)
+			r.lock.Unlock()
+		}
+	}
+	if err == nil && len(locs) == 0 {
+		locs, err = r.recoverMissing(hash, missed)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(locs) == 0 {
+		return nil, NotFound
+	}
+	for _, loc := range locs {
+		var val []byte
+		val, err = r.getAt(loc)
+		if err == nil {
+			return val, nil
+		}
+	}
+	// Every copy is damaged, try rebuilding their packs from parity.
+	for _, loc := range locs {
+		if !r.recoverDamaged(loc.pack) {
+			continue
+		}
+		val, rerr := r.getAt(loc)
+		if rerr == nil {
+			return val, nil
+		}
+	}
+	return nil, err
+}
 
-	packInfo, packidxent, ok := searchMetaIndex(r.midx, hash)
-	if !ok {
-		midx, err := readAndCacheMetaIndex(r.store, r.key, r.cachepath)
+// scanParity returns the current pack listing and parity groups of the
+// remote. It must be called with r.recoverLock held.
+func (r *Reader) scanParity() ([]remote.PackListing, []ParityObject, error) {
+	listing, err := remote.ListPacks(r.store)
+	if err != nil {
+		return nil, nil, err
+	}
+	objs := ReadParityGroups(r.store, r.key, listing, r.parityGroups)
+	listed := make(map[string]struct{}, len(listing))
+	for _, ent := range listing {
+		listed[ent.Name] = struct{}{}
+	}
+	for name := range r.parityGroups {
+		_, ok := listed[name]
+		if !ok {
+			delete(r.parityGroups, name)
+		}
+	}
+	return listing, objs, nil
+}
+
+// recoverMissing rebuilds packs that are in a parity group but missing
+// from the remote, then searches for hash again. Scans are coalesced and
+// spaced like refreshes.
+func (r *Reader) recoverMissing(hash [32]byte, missed time.Time) ([]chunkLocation, error) {
+	r.recoverLock.Lock()
+	defer r.recoverLock.Unlock()
+	if !r.lastRecoverScan.After(missed) {
+		waitInterval(r.lastRecoverScan)
+		r.lastRecoverScan = time.Now()
+		listing, objs, err := r.scanParity()
 		if err != nil {
 			return nil, err
 		}
-		r.midx = midx
-		packInfo, packidxent, ok = searchMetaIndex(r.midx, hash)
-		if !ok {
-			return nil, NotFound
+		listed := make(map[string]struct{}, len(listing))
+		for _, ent := range listing {
+			listed[ent.Name] = struct{}{}
+		}
+		for _, obj := range objs {
+			for _, m := range obj.Group.Members {
+				_, ok := listed[m.Name]
+				if ok || r.recoverTried[m.Name] {
+					continue
+				}
+				r.recoverTried[m.Name] = true
+				// Packs that can't be rebuilt stay missing.
+				_ = r.recoverMissingPack(obj, m, listing)
+			}
 		}
 	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.midx.searchAll(hash)
+}
 
-	packrdr, err := r.getPackReader(packInfo.Name, packInfo.Size, packInfo.Idx)
+func (r *Reader) recoverMissingPack(obj ParityObject, m parity.Member, listing []remote.PackListing) error {
+	p, err := RecoverPackFile(r.store, r.key, obj.Listing, obj.Group, m.Name, listing, r.cachepath)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	pack, err := bpack.NewEncryptedReader(f, r.key, m.Size)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	defer pack.Close()
+	err = pack.ReadIndex()
+	if err != nil {
+		return err
+	}
+	err = cacheIndex(filepath.Join(r.cachepath, m.Name+".index"), pack.Idx)
+	if err != nil {
+		return err
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.recovered[m.Name] = &recoveredPack{path: p, size: uint64(m.Size), missing: true}
+	r.midx.addPack(&packInfo{Name: m.Name, Size: uint64(m.Size)}, pack.Idx)
+	return nil
+}
+
+// recoverDamaged rebuilds a damaged pack from its parity group, returning
+// true if values should be read again.
+func (r *Reader) recoverDamaged(pack *packInfo) bool {
+	r.recoverLock.Lock()
+	defer r.recoverLock.Unlock()
+	r.lock.Lock()
+	_, recovered := r.recovered[pack.Name]
+	r.lock.Unlock()
+	if recovered {
+		// Rebuilt by a concurrent read.
+		return true
+	}
+	if r.recoverTried[pack.Name] {
+		return false
+	}
+	r.recoverTried[pack.Name] = true
+	listing, objs, err := r.scanParity()
+	if err != nil {
+		return false
+	}
+	for _, obj := range objs {
+		i := obj.Group.Index(pack.Name)
+		if i == -1 || uint64(obj.Group.Members[i].Size) != pack.Size {
+			continue
+		}
+		p, err := RecoverPackFile(r.store, r.key, obj.Listing, obj.Group, pack.Name, listing, r.cachepath)
+		if err != nil {
+			continue
+		}
+		r.lock.Lock()
+		r.recovered[pack.Name] = &recoveredPack{path: p, size: pack.Size}
+		r.evictPackReader(pack.Name)
+		r.lock.Unlock()
+		return true
+	}
+	return false
+}
+
+var ErrCorruptValue = errors.New("value does not match its hash")
+
+func (r *Reader) getAt(loc chunkLocation) ([]byte, error) {
+	r.lock.Lock()
+	ent, err := r.getPackReader(loc.pack.Name, loc.pack.Size)
+	r.lock.Unlock()
 	if err != nil {
 		return nil, err
 	}
-	buf, err := packrdr.GetAt(packidxent.Offset, packidxent.Size)
+	buf, err := ent.pack.GetAt(loc.ent.Offset, loc.ent.Size)
+	r.lock.Lock()
+	closeErr := r.releasePackReader(ent)
+	r.lock.Unlock()
 	if err != nil {
 		return nil, err
 	}
-	bufrdr := bytes.NewReader(buf)
-	compressedr := flate.NewReader(bufrdr)
+	if closeErr != nil {
+		return nil, closeErr
+	}
+	val, err := decodeValue(ent.hdr.Codec, buf)
 	if err != nil {
 		return nil, err
 	}
-	r.flatebuf.Reset()
-	_, err = io.Copy(&r.flatebuf, compressedr)
+	if sha256.Sum256(val) != loc.hash {
+		return nil, ErrCorruptValue
+	}
+	return val, nil
+}
+
+// refresh updates the meta index with packs added or removed by other
+// clients, listings are rate limited so a burst of misses only lists
+// packs once. It must be called with r.lock held.
+// refresh updates the meta index after a search missed. Callers that
+// missed before a refresh started listing share its result, and listings
+// are at least minRefreshInterval apart.
+func (r *Reader) refresh(missed time.Time) error {
+	r.refreshLock.Lock()
+	defer r.refreshLock.Unlock()
+	if r.lastRefresh.After(missed) {
+		return nil
+	}
+	waitInterval(r.lastRefresh)
+	r.lastRefresh = time.Now()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var extra []remote.PackListing
+	for name, rec := range r.recovered {
+		if rec.missing {
+			extra = append(extra, remote.PackListing{Name: name, Size: rec.size})
+		}
+	}
+	return refreshMetaIndex(r.midx, r.store, r.key, r.cachepath, extra)
+}
+
+// waitInterval sleeps until minRefreshInterval has passed since last.
+func waitInterval(last time.Time) {
+	wait := minRefreshInterval - time.Since(last)
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// EncodedValue converts a raw value from a pack with the given header into
+// the form stored in packs with per entry codecs.
+func EncodedValue(hdr bpack.Header, val []byte) ([]byte, error) {
+	switch hdr.Codec {
+	case bpack.CodecNone:
+		return codec.Wrap(codec.None, val), nil
+	case bpack.CodecFlate:
+		return codec.Wrap(codec.Flate, val), nil
+	case bpack.CodecPerEntry:
+		return val, nil
+	default:
+		return nil, ErrUnknownCodec
+	}
+}
+
+var (
+	ErrUnknownCodec   = errors.New("unknown pack codec")
+	ErrUnknownHashAlg = errors.New("unknown pack hash algorithm")
+)
+
+func decodeValue(packCodec uint8, buf []byte) ([]byte, error) {
+	switch packCodec {
+	case bpack.CodecNone:
+		return buf, nil
+	case bpack.CodecFlate:
+		return decompress(buf)
+	case bpack.CodecPerEntry:
+		return codec.Decode(buf)
+	default:
+		return nil, ErrUnknownCodec
+	}
+}
+
+func decompress(buf []byte) ([]byte, error) {
+	compressedr := flate.NewReader(bytes.NewReader(buf))
+	decompressed, err := ioutil.ReadAll(compressedr)
 	if err != nil {
 		return nil, err
 	}
@@ -89,46 +373,232 @@ func (r *Reader) Get(hash [32]byte) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	decompressed := make([]byte, r.flatebuf.Len(), r.flatebuf.Len())
-	copy(decompressed, r.flatebuf.Bytes())
 	return decompressed, nil
 }
 
-func (r *Reader) getPackReader(packname string, packsize uint64, idx bpack.Index) (*bpack.Reader, error) {
+type chunkLocation struct {
+	hash [32]byte
+	pack *packInfo
+	ent  bpack.IndexEnt
+}
+
+type packOrder []chunkLocation
+
+func (l packOrder) Len() int      { return len(l) }
+func (l packOrder) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l packOrder) Less(i, j int) bool {
+	if l[i].pack.Name != l[j].pack.Name {
+		return l[i].pack.Name < l[j].pack.Name
+	}
+	return l[i].ent.Offset < l[j].ent.Offset
+}
+
+// GetMany fetches values in pack and offset order, values that are
+// near each other in a pack are fetched with a single read.
+func (r *Reader) GetMany(hashes [][32]byte, fn func([32]byte, []byte) error) error {
+	missed := time.Now()
+	r.lock.Lock()
+	locs, err := r.locate(hashes)
+	r.lock.Unlock()
+	if err == NotFound {
+		err = r.refresh(missed)
+		if err == nil {
+			// Earlier locations may refer to packs no longer in the index.
+			r.lock.Lock()
+			locs, err = r.locate(hashes)
+			r.lock.Unlock()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	sort.Sort(packOrder(locs))
+
+	for len(locs) != 0 {
+		pack := locs[0].pack
+		end := 1
+		for end < len(locs) && locs[end].pack == pack {
+			end++
+		}
+		err = r.getManyFromPack(pack, locs[:end], fn)
+		if err != nil {
+			return err
+		}
+		locs = locs[end:]
+	}
+	return nil
+}
+
+func (r *Reader) locate(hashes [][32]byte) ([]chunkLocation, error) {
+	seen := make(map[[32]byte]struct{}, len(hashes))
+	locs := make([]chunkLocation, 0, len(hashes))
+	for _, hash := range hashes {
+		_, ok := seen[hash]
+		if ok {
+			continue
+		}
+		seen[hash] = struct{}{}
+		packInfo, packidxent, ok, err := r.midx.search(hash)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, NotFound
+		}
+		locs = append(locs, chunkLocation{hash: hash, pack: packInfo, ent: packidxent})
+	}
+	return locs, nil
+}
+
+func (r *Reader) getManyFromPack(pack *packInfo, locs []chunkLocation, fn func([32]byte, []byte) error) (err error) {
+	r.lock.Lock()
+	ent, err := r.getPackReader(pack.Name, pack.Size)
+	r.lock.Unlock()
+	if err != nil {
+		// The values may be stored elsewhere or recovered from parity.
+		for _, loc := range locs {
+			val, err := r.Get(loc.hash)
+			if err != nil {
+				return err
+			}
+			err = fn(loc.hash, val)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	defer func() {
+		r.lock.Lock()
+		releaseErr := r.releasePackReader(ent)
+		r.lock.Unlock()
+		if err == nil {
+			err = releaseErr
+		}
+	}()
+
+	for len(locs) != 0 {
+		runStart := locs[0].ent.Offset
+		runEnd := runStart + uint64(locs[0].ent.Size)
+		n := 1
+		for n < len(locs) {
+			next := locs[n].ent
+			if next.Offset > runEnd+maxRunGap {
+				break
+			}
+			nextEnd := next.Offset + uint64(next.Size)
+			if nextEnd < runEnd {
+				nextEnd = runEnd
+			}
+			if nextEnd-runStart > maxRunSize {
+				break
+			}
+			runEnd = nextEnd
+			n++
+		}
+		runData, runErr := ent.pack.GetAt(runStart, uint32(runEnd-runStart))
+		for _, loc := range locs[:n] {
+			var val []byte
+			err = runErr
+			if err == nil {
+				off := loc.ent.Offset - runStart
+				val, err = decodeValue(ent.hdr.Codec, runData[off:off+uint64(loc.ent.Size)])
+			}
+			if err != nil || sha256.Sum256(val) != loc.hash {
+				// Other copies may be intact, or the pack may be
+				// rebuilt from parity.
+				val, err = r.Get(loc.hash)
+			}
+			if err != nil {
+				return err
+			}
+			err = fn(loc.hash, val)
+			if err != nil {
+				return err
+			}
+		}
+		locs = locs[n:]
+	}
+	return nil
+}
+
+func (r *Reader) getPackReader(packname string, packsize uint64) (*packlruent, error) {
 	for e := r.lru.Front(); e != nil; e = e.Next() {
-		ent := e.Value.(packlruent)
+		ent := e.Value.(*packlruent)
 		if ent.packname == packname {
 			r.lru.MoveToFront(e)
-			return ent.pack, nil
+			ent.refs += 1
+			return ent, nil
 		}
 	}
-	packPath := path.Join("packs", packname)
-	f, err := r.store.Open(packPath)
+	var f bpack.ReadSeekCloser
+	var err error
+	rec, ok := r.recovered[packname]
+	if ok {
+		f, err = os.Open(rec.path)
+	} else {
+		f, err = r.store.Open(path.Join("packs", packname))
+	}
 	if err != nil {
 		return nil, err
 	}
 	pack, err := bpack.NewEncryptedReader(f, r.key, int64(packsize))
 	if err != nil {
+		f.Close()
 		return nil, err
 	}
-	pack.Idx = idx
-	r.lru.PushFront(packlruent{packname: packname, pack: pack})
+	hdr, err := pack.ReadHeader()
+	if err == nil && hdr.HashAlg != bpack.HashSHA256 {
+		err = ErrUnknownHashAlg
+	}
+	if err != nil {
+		pack.Close()
+		return nil, err
+	}
+	ent := &packlruent{packname: packname, pack: pack, hdr: hdr, refs: 1}
+	r.lru.PushFront(ent)
 	if r.lru.Len() > 5 {
-		ent := r.lru.Remove(r.lru.Back()).(packlruent)
-		ent.pack.Close()
+		evicted := r.lru.Remove(r.lru.Back()).(*packlruent)
+		evicted.evicted = true
+		if evicted.refs == 0 {
+			evicted.pack.Close()
+		}
+	}
+	return ent, nil
+}
+
+// evictPackReader drops the cached reader of a pack so it is reopened.
+func (r *Reader) evictPackReader(packname string) {
+	for e := r.lru.Front(); e != nil; e = e.Next() {
+		ent := e.Value.(*packlruent)
+		if ent.packname == packname {
+			r.lru.Remove(e)
+			ent.evicted = true
+			if ent.refs == 0 {
+				ent.pack.Close()
+			}
+			return
+		}
 	}
-	return pack, nil
+}
+
+func (r *Reader) releasePackReader(ent *packlruent) error {
+	ent.refs -= 1
+	if ent.evicted && ent.refs == 0 {
+		return ent.pack.Close()
+	}
+	return nil
 }
 
 func (r *Reader) Close() error {
 	r.lock.Lock()
 	defer r.lock.Unlock()
 	for e := r.lru.Front(); e != nil; e = e.Next() {
-		ent := e.Value.(packlruent)
+		ent := e.Value.(*packlruent)
 		err := ent.pack.Close()
 		if err != nil {
 			return err
 		}
 	}
-	return nil
+	return r.midx.close()
 }
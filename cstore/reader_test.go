@@ -0,0 +1,146 @@
+package cstore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"github.com/buppyio/bpy/bpack"
+	"github.com/buppyio/bpy/remote"
+	"github.com/buppyio/bpy/remote/client"
+	"github.com/buppyio/bpy/testhelp"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+)
+
+// writeParityValues stores n random values in packs of about a value each,
+// grouped two by two with one parity shard.
+func writeParityValues(t *testing.T, c *client.Client, key [32]byte, tmp string, n int) [][]byte {
+	cfg := DefaultWriterConfig
+	cfg.PackSize = 2048
+	cfg.Parity = Parity{Data: 2, Parity: 1}
+	w, err := NewWriter(c, key, tmp, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rd := rand.New(rand.NewSource(1))
+	var vals [][]byte
+	for i := 0; i < n; i++ {
+		v := make([]byte, 3000)
+		rd.Read(v)
+		_, err = w.Put(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vals = append(vals, v)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return vals
+}
+
+func locateValue(t *testing.T, c *client.Client, key [32]byte, val []byte) (remote.PackListing, bpack.IndexEnt, map[string]remote.PackListing) {
+	hash := sha256.Sum256(val)
+	listing, err := remote.ListPacks(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packs, indexes := SplitListing(listing)
+	for _, pack := range packs {
+		idx, err := ReadPackIndex(c, key, pack, indexes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, ent := range idx {
+			if ent.Key == string(hash[:]) {
+				return pack, ent, indexes
+			}
+		}
+	}
+	t.Fatal("value not found")
+	return remote.PackListing{}, bpack.IndexEnt{}, nil
+}
+
+func newParityTest(t *testing.T) (*testhelp.MemRemote, *client.Client, [32]byte, string) {
+	tmp, err := ioutil.TempDir("", "bpyreadertest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := testhelp.NewMemRemote()
+	c, err := r.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var key [32]byte
+	rand.New(rand.NewSource(2)).Read(key[:])
+	return r, c, key, tmp
+}
+
+func checkGet(t *testing.T, c *client.Client, key [32]byte, tmp string, val []byte) {
+	cachepath, err := ioutil.TempDir(tmp, "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdr, err := NewReader(c, key, cachepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rdr.Close()
+	got, err := rdr.Get(sha256.Sum256(val))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, val) {
+		t.Fatal("recovered value differs")
+	}
+}
+
+func TestReaderRecoversMissingPack(t *testing.T) {
+	r, c, key, tmp := newParityTest(t)
+	defer os.RemoveAll(tmp)
+	defer c.Close()
+	vals := writeParityValues(t, c, key, tmp, 6)
+	pack, _, indexes := locateValue(t, c, key, vals[3])
+	r.RemoveFile(path.Join("packs", pack.Name))
+	r.RemoveFile(path.Join("packs", indexes[pack.Name].Name))
+	checkGet(t, c, key, tmp, vals[3])
+}
+
+func TestReaderRecoversDamagedPack(t *testing.T) {
+	r, c, key, tmp := newParityTest(t)
+	defer os.RemoveAll(tmp)
+	defer c.Close()
+	vals := writeParityValues(t, c, key, tmp, 6)
+	pack, ent, _ := locateValue(t, c, key, vals[4])
+	p := path.Join("packs", pack.Name)
+	data, _ := r.ReadFile(p)
+	// The encrypted pack starts with a 16 byte IV.
+	data[16+ent.Offset+uint64(ent.Size)/2] ^= 0xff
+	r.WriteFile(p, data)
+	checkGet(t, c, key, tmp, vals[4])
+}
+
+func TestReaderFindsNewPacks(t *testing.T) {
+	_, c, key, tmp := newParityTest(t)
+	defer os.RemoveAll(tmp)
+	defer c.Close()
+	rdr, err := NewReader(c, key, tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rdr.Close()
+	// The values are written after the reader listed the remote.
+	vals := writeParityValues(t, c, key, tmp, 2)
+	for _, val := range vals {
+		got, err := rdr.Get(sha256.Sum256(val))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, val) {
+			t.Fatal("value differs")
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package cstore
+
+import (
+	"container/list"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+)
+
+type spoolMemEnt struct {
+	hash string
+	val  []byte
+}
+
+type spoolDiskEnt struct {
+	offset int64
+	size   int
+}
+
+// spool holds values that are not yet readable from a closed pack. The most
+// recently added values are kept in memory up to max bytes, older values are
+// written to a temporary file in dir, reusing the space of removed values.
+// A spool is safe for concurrent use.
+type spool struct {
+	lock sync.Mutex
+	dir  string
+	max  uint64
+	size uint64
+	lru  *list.List
+	mem  map[string]*list.Element
+	disk map[string]spoolDiskEnt
+	f    *os.File
+	end  int64
+	// free holds the extents of removed values before end, sorted by
+	// offset with adjacent extents merged.
+	free []spoolDiskEnt
+}
+
+func newSpool(dir string, max uint64) *spool {
+	return &spool{
+		dir:  dir,
+		max:  max,
+		lru:  list.New(),
+		mem:  make(map[string]*list.Element),
+		disk: make(map[string]spoolDiskEnt),
+	}
+}
+
+func (s *spool) put(hash string, val []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, ok := s.mem[hash]
+	if ok {
+		return nil
+	}
+	s.mem[hash] = s.lru.PushFront(&spoolMemEnt{hash: hash, val: val})
+	s.size += uint64(len(val))
+	for s.size > s.max && s.lru.Len() != 0 {
+		ent := s.lru.Remove(s.lru.Back()).(*spoolMemEnt)
+		delete(s.mem, ent.hash)
+		s.size -= uint64(len(ent.val))
+		err := s.spill(ent)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *spool) spill(ent *spoolMemEnt) error {
+	if s.f == nil {
+		f, err := ioutil.TempFile(s.dir, "spool")
+		if err != nil {
+			return err
+		}
+		s.f = f
+	}
+	ext := s.alloc(len(ent.val))
+	_, err := s.f.WriteAt(ent.val, ext.offset)
+	if err != nil {
+		s.release(ext)
+		return err
+	}
+	s.disk[ent.hash] = ext
+	return nil
+}
+
+// alloc returns the first free extent that fits size bytes, or space
+// at the end of the file.
+func (s *spool) alloc(size int) spoolDiskEnt {
+	for i, ext := range s.free {
+		if ext.size < size {
+			continue
+		}
+		s.free[i].offset += int64(size)
+		s.free[i].size -= size
+		if s.free[i].size == 0 {
+			s.free = append(s.free[:i], s.free[i+1:]...)
+		}
+		return spoolDiskEnt{offset: ext.offset, size: size}
+	}
+	ext := spoolDiskEnt{offset: s.end, size: size}
+	s.end += int64(size)
+	return ext
+}
+
+// release frees an extent, the file is truncated when its tail is free.
+func (s *spool) release(ext spoolDiskEnt) error {
+	if ext.size == 0 {
+		return nil
+	}
+	i := sort.Search(len(s.free), func(i int) bool { return s.free[i].offset > ext.offset })
+	s.free = append(s.free, spoolDiskEnt{})
+	copy(s.free[i+1:], s.free[i:])
+	s.free[i] = ext
+	if i+1 < len(s.free) && ext.offset+int64(ext.size) == s.free[i+1].offset {
+		s.free[i].size += s.free[i+1].size
+		s.free = append(s.free[:i+1], s.free[i+2:]...)
+	}
+	if i > 0 && s.free[i-1].offset+int64(s.free[i-1].size) == s.free[i].offset {
+		s.free[i-1].size += s.free[i].size
+		s.free = append(s.free[:i], s.free[i+1:]...)
+	}
+	last := s.free[len(s.free)-1]
+	if last.offset+int64(last.size) != s.end {
+		return nil
+	}
+	s.free = s.free[:len(s.free)-1]
+	s.end = last.offset
+	return s.f.Truncate(s.end)
+}
+
+func (s *spool) get(hash string) ([]byte, bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	e, ok := s.mem[hash]
+	if ok {
+		s.lru.MoveToFront(e)
+		return e.Value.(*spoolMemEnt).val, true, nil
+	}
+	ent, ok := s.disk[hash]
+	if !ok {
+		return nil, false, nil
+	}
+	buf := make([]byte, ent.size)
+	_, err := s.f.ReadAt(buf, ent.offset)
+	if err != nil {
+		return nil, false, err
+	}
+	return buf, true, nil
+}
+
+// remove forgets a value, its space in the spool file is reused.
+func (s *spool) remove(hash string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	e, ok := s.mem[hash]
+	if ok {
+		s.lru.Remove(e)
+		delete(s.mem, hash)
+		s.size -= uint64(len(e.Value.(*spoolMemEnt).val))
+	}
+	ext, ok := s.disk[hash]
+	if !ok {
+		return nil
+	}
+	delete(s.disk, hash)
+	return s.release(ext)
+}
+
+func (s *spool) close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	removeErr := os.Remove(s.f.Name())
+	s.f = nil
+	if err != nil {
+		return err
+	}
+	return removeErr
+}
@@ -0,0 +1,103 @@
+package cstore
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSpool(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "buppyspooltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	s := newSpool(tmp, 100)
+	for i := 0; i < 20; i++ {
+		err = s.put(fmt.Sprintf("%d", i), bytes.Repeat([]byte{byte(i)}, 30))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s.size > 100 {
+		t.Fatalf("spool memory use %d exceeds limit", s.size)
+	}
+	for i := 0; i < 20; i++ {
+		val, ok, err := s.get(fmt.Sprintf("%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok || !bytes.Equal(val, bytes.Repeat([]byte{byte(i)}, 30)) {
+			t.Fatalf("bad value for %d", i)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		err = s.remove(fmt.Sprintf("%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s.end != 0 || s.size != 0 {
+		t.Fatal("spool not empty after removing all values")
+	}
+	_, ok, err := s.get("0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("removed value still present")
+	}
+	err = s.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSpoolReusesSpace(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "buppyspooltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	// Odd and even values are removed at different rates, as when values
+	// of several packs are spooled at once, so the file never empties.
+	s := newSpool(tmp, 0)
+	val := func(i int) []byte { return bytes.Repeat([]byte{byte(i)}, 10+i%7) }
+	live := make(map[int]bool)
+	for i := 0; i < 1000; i++ {
+		err = s.put(fmt.Sprintf("%d", i), val(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		live[i] = true
+		for _, j := range []int{i - 3, i - 10} {
+			if j >= 0 && live[j] && (j%2 == 1) == (j == i-3) {
+				err = s.remove(fmt.Sprintf("%d", j))
+				if err != nil {
+					t.Fatal(err)
+				}
+				delete(live, j)
+			}
+		}
+	}
+	if s.end > 32*16 {
+		t.Fatalf("spool file grew to %d bytes", s.end)
+	}
+	for i := 0; i < 1000; i++ {
+		v, ok, err := s.get(fmt.Sprintf("%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != live[i] || ok && !bytes.Equal(v, val(i)) {
+			t.Fatalf("bad value for %d", i)
+		}
+	}
+	err = s.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
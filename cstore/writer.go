@@ -2,49 +2,104 @@ package cstore
 
 import (
 	"bufio"
-	"bytes"
-	"compress/flate"
 	"crypto/sha256"
 	"github.com/buppyio/bpy"
 	"github.com/buppyio/bpy/bpack"
+	"github.com/buppyio/bpy/codec"
 	"github.com/buppyio/bpy/remote/client"
-	"io/ioutil"
+	"io"
 	"path/filepath"
 	"sync"
+	"time"
 )
 
+// The number of packs that may be open for writing at once, each is
+// uploaded concurrently over the same remote connection.
+const parallelPacks = 4
+
+type WriterConfig struct {
+	// Packs are closed once they hold PackSize bytes of compressed values.
+	PackSize uint64
+	// CacheSize is the number of bytes of values not yet in a closed pack
+	// that are kept in memory, the rest are spooled to disk.
+	CacheSize uint64
+	// Compression is the codec new values are encoded with.
+	Compression codec.Compressor
+	// Padding is applied to new values and packs.
+	Padding Padding
+	// Parity protects groups of new packs with parity objects.
+	Parity Parity
+}
+
+var DefaultWriterConfig = WriterConfig{
+	PackSize:    128 * 1024 * 1024,
+	CacheSize:   16 * 1024 * 1024,
+	Compression: codec.Default,
+}
+
+type countingWriter struct {
+	w io.Writer
+	n uint64
+}
+
+func (cw *countingWriter) Write(buf []byte) (int, error) {
+	n, err := cw.w.Write(buf)
+	cw.n += uint64(n)
+	return n, err
+}
+
+// packSlot is a pack being written, a slot is owned by a single
+// goroutine between acquireSlot and releaseSlot.
+type packSlot struct {
+	pack    *bpack.Writer
+	name    string
+	size    uint64
+	written *countingWriter
+	shard   *ParityShard
+	hashes  []string
+}
+
 type Writer struct {
-	lock         sync.Mutex
-	store        *client.Client
-	pack         *bpack.Writer
-	cachepath    string
-	name         string
-	workingSet   map[string][]byte
-	workingSetSz uint64
-	key          [32]byte
-	flatebuf     bytes.Buffer
-	flatew       *flate.Writer
-	rdr          *Reader
-}
-
-func NewWriter(store *client.Client, key [32]byte, cachepath string) (*Writer, error) {
+	lock      sync.Mutex
+	store     *client.Client
+	cachepath string
+	cfg       WriterConfig
+	// pending holds the hashes of values that are not yet in a closed pack,
+	// the channel is closed once the value can be read from the spool.
+	pending map[string]chan struct{}
+	spool   *spool
+	key     [32]byte
+	slots   chan *packSlot
+	rdr     *Reader
+	parity  *ParityWriter
+}
+
+func NewWriter(store *client.Client, key [32]byte, cachepath string, cfg WriterConfig) (*Writer, error) {
 	rdr, err := NewReader(store, key, cachepath)
 	if err != nil {
 		return nil, err
 	}
-
-	flatew, err := flate.NewWriter(ioutil.Discard, flate.BestSpeed)
+	pw, err := NewParityWriter(store, key, cachepath, cfg.Parity)
 	if err != nil {
+		rdr.Close()
 		return nil, err
 	}
 
+	slots := make(chan *packSlot, parallelPacks)
+	for i := 0; i < parallelPacks; i++ {
+		slots <- &packSlot{}
+	}
+
 	return &Writer{
-		cachepath:  cachepath,
-		store:      store,
-		key:        key,
-		flatew:     flatew,
-		rdr:        rdr,
-		workingSet: make(map[string][]byte),
+		cachepath: cachepath,
+		cfg:       cfg,
+		store:     store,
+		key:       key,
+		slots:     slots,
+		rdr:       rdr,
+		parity:    pw,
+		pending:   make(map[string]chan struct{}),
+		spool:     newSpool(cachepath, cfg.CacheSize),
 	}, nil
 }
 
@@ -54,140 +109,319 @@ func (kl keyList) Len() int           { return len(kl) }
 func (kl keyList) Swap(i, j int)      { kl[i], kl[j] = kl[j], kl[i] }
 func (kl keyList) Less(i, j int) bool { return bpack.KeyCmp(string(kl[i][:]), string(kl[j][:])) < 0 }
 
-func (w *Writer) flushWorkingSet() error {
-	if w.pack != nil {
-		idx, err := w.pack.Close()
+func (w *Writer) acquireSlot() *packSlot {
+	return <-w.slots
+}
+
+func (w *Writer) releaseSlot(slot *packSlot) {
+	w.slots <- slot
+}
+
+func (w *Writer) openPack(slot *packSlot) error {
+	name, err := bpy.RandomFileName()
+	if err != nil {
+		return err
+	}
+	name = name + PackSuffix
+	f, err := w.store.NewPack("packs/" + name)
+	if err != nil {
+		return err
+	}
+	cw := &countingWriter{w: f}
+	var shard *ParityShard
+	if w.parity != nil {
+		shard, err = w.parity.AddPack(name)
 		if err != nil {
+			f.Cancel()
 			return err
 		}
-		err = cacheIndex(filepath.Join(w.cachepath, w.name+".index"), idx)
-		if err != nil {
-			return err
+		cw.w = io.MultiWriter(f, shard)
+	}
+	bwc := &bpy.BufferedWriteCloser{
+		W: f,
+		B: bufio.NewWriterSize(cw, 65536),
+	}
+	slot.pack, err = bpack.NewEncryptedWriter(bwc, w.key, bpack.Header{
+		Codec:     bpack.CodecPerEntry,
+		HashAlg:   bpack.HashSHA256,
+		CreatedAt: time.Now().Unix(),
+	})
+	if err != nil {
+		f.Cancel()
+		if shard != nil {
+			w.parity.ClosePack(shard, true)
 		}
-		w.pack = nil
-		w.name = ""
-		w.workingSetSz = 0
-		w.workingSet = make(map[string][]byte)
+		return err
 	}
+	padTo := w.cfg.Padding.PadTo()
+	if padTo != nil {
+		slot.pack.SetPadding(padTo)
+	}
+	slot.name = name
+	slot.written = cw
+	slot.shard = shard
 	return nil
 }
 
+// closePack uploads the rest of the pack and makes its values readable
+// through the reader without reloading the meta index.
+func (w *Writer) closePack(slot *packSlot) error {
+	if slot.pack == nil {
+		return nil
+	}
+	idx, err := slot.pack.Close()
+	if slot.shard != nil {
+		perr := w.parity.ClosePack(slot.shard, err != nil)
+		slot.shard = nil
+		if err == nil {
+			err = perr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	err = cacheIndex(filepath.Join(w.cachepath, slot.name+".index"), idx)
+	if err != nil {
+		return err
+	}
+	err = WriteIndexObject(w.store, w.key, slot.name, idx, w.cfg.Padding.PadTo())
+	if err != nil {
+		return err
+	}
+	w.rdr.addPack(slot.name, slot.written.n, idx)
+	// Values leave the spool while still pending, so a rewrite of the same
+	// value can't be spooled and then removed here.
+	for _, h := range slot.hashes {
+		rerr := w.spool.remove(h)
+		if rerr != nil && err == nil {
+			err = rerr
+		}
+	}
+	w.lock.Lock()
+	for _, h := range slot.hashes {
+		delete(w.pending, h)
+	}
+	w.lock.Unlock()
+	slot.pack = nil
+	slot.name = ""
+	slot.size = 0
+	slot.written = nil
+	slot.hashes = nil
+	return err
+}
+
+// closeAllPacks waits for every slot to be released then closes their packs.
+func (w *Writer) closeAllPacks() error {
+	var firstErr error
+	slots := make([]*packSlot, 0, parallelPacks)
+	for i := 0; i < parallelPacks; i++ {
+		slots = append(slots, w.acquireSlot())
+	}
+	for _, slot := range slots {
+		err := w.closePack(slot)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		w.releaseSlot(slot)
+	}
+	if w.parity != nil {
+		err := w.parity.Flush()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
 func (w *Writer) Get(hash [32]byte) ([]byte, error) {
+	k := string(hash[:])
+	for {
+		w.lock.Lock()
+		ready, ok := w.pending[k]
+		if !ok {
+			w.lock.Unlock()
+			return w.rdr.Get(hash)
+		}
+		select {
+		case <-ready:
+		default:
+			w.lock.Unlock()
+			<-ready
+			continue
+		}
+		w.lock.Unlock()
+		val, ok, err := w.spool.get(k)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			// Values are only removed from the spool once their pack
+			// is readable.
+			return w.rdr.Get(hash)
+		}
+		return codec.Decode(val)
+	}
+}
+
+func (w *Writer) GetMany(hashes [][32]byte, fn func([32]byte, []byte) error) error {
 	w.lock.Lock()
-	defer w.lock.Unlock()
-	val, ok := w.workingSet[string(hash[:])]
-	if ok {
-		return val, nil
+	missing := make([][32]byte, 0, len(hashes))
+	pending := make([][32]byte, 0)
+	for _, hash := range hashes {
+		_, ok := w.pending[string(hash[:])]
+		if ok {
+			pending = append(pending, hash)
+		} else {
+			missing = append(missing, hash)
+		}
+	}
+	w.lock.Unlock()
+	for _, hash := range pending {
+		val, err := w.Get(hash)
+		if err != nil {
+			return err
+		}
+		err = fn(hash, val)
+		if err != nil {
+			return err
+		}
 	}
-	return w.rdr.Get(hash)
+	return w.rdr.GetMany(missing, fn)
 }
 
 func (w *Writer) Has(hash [32]byte) (bool, error) {
 	w.lock.Lock()
 	defer w.lock.Unlock()
-	_, ok := w.workingSet[string(hash[:])]
+	_, ok := w.pending[string(hash[:])]
 	if ok {
 		return true, nil
 	}
 	return w.rdr.Has(hash)
 }
 
+// Put is safe for concurrent use, hashing and compression happen
+// without holding the writer lock.
 func (w *Writer) Put(data []byte) ([32]byte, error) {
-	w.lock.Lock()
-	defer w.lock.Unlock()
-	var err error
+	slot := w.acquireSlot()
+	defer w.releaseSlot(slot)
+	return w.put(slot, data, false)
+}
 
-	h := sha256.Sum256(data)
+// Rewrite stores a new copy of data even if it is already stored, so
+// damaged copies can be replaced.
+func (w *Writer) Rewrite(data []byte) ([32]byte, error) {
+	slot := w.acquireSlot()
+	defer w.releaseSlot(slot)
+	return w.put(slot, data, true)
+}
 
-	_, ok := w.workingSet[string(h[:])]
-	if ok {
-		return h, nil
-	}
+func (w *Writer) put(slot *packSlot, data []byte, rewrite bool) ([32]byte, error) {
+	h := sha256.Sum256(data)
+	k := string(h[:])
 
-	ok, err = w.rdr.Has(h)
-	if err != nil {
-		return h, err
-	}
+	w.lock.Lock()
+	_, ok := w.pending[k]
 	if ok {
+		w.lock.Unlock()
 		return h, nil
 	}
-
-	if w.pack == nil {
-		name, err := bpy.RandomFileName()
-		if err != nil {
-			return h, err
-		}
-		name = name + ".ebpack"
-		f, err := w.store.NewPack("packs/" + name)
+	if !rewrite {
+		ok, err := w.rdr.Has(h)
 		if err != nil {
+			w.lock.Unlock()
 			return h, err
 		}
-		bwc := &bpy.BufferedWriteCloser{
-			W: f,
-			B: bufio.NewWriterSize(f, 65536),
+		if ok {
+			w.lock.Unlock()
+			return h, nil
 		}
-		w.pack, err = bpack.NewEncryptedWriter(bwc, w.key)
-		if err != nil {
-			f.Cancel()
-			return h, err
-		}
-		w.name = name
 	}
+	ready := make(chan struct{})
+	w.pending[k] = ready
+	w.lock.Unlock()
 
-	w.flatebuf.Reset()
-	w.flatew.Reset(&w.flatebuf)
-	_, err = w.flatew.Write(data)
-	if err != nil {
-		return h, err
+	compressed, err := w.cfg.Compression.Encode(data)
+	padTo := w.cfg.Padding.PadTo()
+	if err == nil && padTo != nil {
+		compressed = codec.Pad(compressed, padTo)
+	}
+	if err == nil {
+		err = w.spool.put(k, compressed)
 	}
-	err = w.flatew.Close()
 	if err != nil {
+		w.lock.Lock()
+		delete(w.pending, k)
+		w.lock.Unlock()
+		close(ready)
 		return h, err
 	}
-	compressed := w.flatebuf.Bytes()
-	err = w.pack.Add(string(h[:]), compressed)
+	close(ready)
+
+	if slot.pack == nil {
+		err = w.openPack(slot)
+		if err != nil {
+			return h, err
+		}
+	}
+	err = slot.pack.Add(k, compressed)
 	if err != nil {
 		return h, err
 	}
-	w.workingSetSz += uint64(len(compressed))
-	dataCopy := make([]byte, len(data), len(data))
-	copy(dataCopy, data)
-	w.workingSet[string(h[:])] = dataCopy
-	if w.workingSetSz > 1024*1024*128 {
-		return h, w.flushWorkingSet()
-	} else {
-		return h, nil
+	slot.size += uint64(len(compressed))
+	slot.hashes = append(slot.hashes, k)
+	if slot.size > w.cfg.PackSize {
+		return h, w.closePack(slot)
 	}
+	return h, nil
 }
 
-func (w *Writer) Flush() error {
-	w.lock.Lock()
-	defer w.lock.Unlock()
-	err := w.flushWorkingSet()
-	if err != nil {
-		return nil
-	}
-	err = w.rdr.Close()
-	if err != nil {
-		return err
+// NewStream returns a CStore that writes into a pack of its own, so values
+// from one stream are stored contiguously. Closing the stream only releases
+// its pack for reuse, packs are closed by Flush and Close.
+func (w *Writer) NewStream() bpy.CStore {
+	return &writerStream{w: w}
+}
+
+type writerStream struct {
+	w    *Writer
+	slot *packSlot
+}
+
+func (s *writerStream) Get(hash [32]byte) ([]byte, error) {
+	return s.w.Get(hash)
+}
+
+func (s *writerStream) Put(data []byte) ([32]byte, error) {
+	if s.slot == nil {
+		s.slot = s.w.acquireSlot()
 	}
-	w.rdr, err = NewReader(w.store, w.key, w.cachepath)
-	if err != nil {
-		return err
+	return s.w.put(s.slot, data, false)
+}
+
+func (s *writerStream) Flush() error {
+	return nil
+}
+
+func (s *writerStream) Close() error {
+	if s.slot != nil {
+		s.w.releaseSlot(s.slot)
+		s.slot = nil
 	}
 	return nil
 }
 
+func (w *Writer) Flush() error {
+	return w.closeAllPacks()
+}
+
 func (w *Writer) Close() error {
-	w.lock.Lock()
-	defer w.lock.Unlock()
-	err := w.flushWorkingSet()
+	err := w.closeAllPacks()
 	if err != nil {
-		return nil
+		return err
 	}
-	err = w.rdr.Close()
+	err = w.spool.close()
 	if err != nil {
 		return err
 	}
-	return nil
+	return w.rdr.Close()
 }
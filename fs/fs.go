@@ -106,6 +106,11 @@ func WriteDir(store bpy.CStore, indir DirEnts, mode os.FileMode) (DirEnt, error)
 	return ent, nil
 }
 
+var ErrInvalidDir = errors.New("invalid directory")
+
+// Each entry is namelen[2] name size[8] mode[4] modtime[8] depth[1] hash[32].
+const dirEntFixedSize = 2 + 8 + 4 + 8 + 1 + 32
+
 func ReadDir(store bpy.CStore, hash [32]byte) (DirEnts, error) {
 	var dir DirEnts
 	rdr, err := htree.NewReader(store, hash)
@@ -118,7 +123,13 @@ func ReadDir(store bpy.CStore, hash [32]byte) (DirEnts, error) {
 	}
 	for len(dirdata) != 0 {
 		var hash [32]byte
+		if len(dirdata) < dirEntFixedSize {
+			return nil, ErrInvalidDir
+		}
 		namelen := int(binary.LittleEndian.Uint16(dirdata[0:2]))
+		if len(dirdata) < dirEntFixedSize+namelen {
+			return nil, ErrInvalidDir
+		}
 		dirdata = dirdata[2:]
 		name := string(dirdata[0:namelen])
 		dirdata = dirdata[namelen:]
@@ -140,6 +151,9 @@ func ReadDir(store bpy.CStore, hash [32]byte) (DirEnts, error) {
 			HTree:      htree.HTree{Depth: depth, Data: hash},
 		})
 	}
+	if len(dir) == 0 {
+		return nil, ErrInvalidDir
+	}
 	// fill in the hash for "."
 	dir[0].HTree = htree.HTree{Depth: rdr.GetHeight(), Data: hash}
 	return dir, nil
@@ -196,24 +210,47 @@ func Walk(store bpy.CStore, hash [32]byte, fpath string) (DirEnt, error) {
 	return result, nil
 }
 
+// FileReader reads a file stored in a bpy filesystem. Read and Seek share
+// a file offset and must not be used concurrently, ReadAt does not use
+// the file offset and is safe for concurrent use.
 type FileReader struct {
+	store  bpy.CStore
+	hash   [32]byte
 	offset uint64
 	fsize  int64
 	rdr    *htree.Reader
+	rdrAt  *htree.ReaderAt
+}
+
+func (r *FileReader) getReader() (*htree.Reader, error) {
+	if r.rdr != nil {
+		return r.rdr, nil
+	}
+	rdr, err := htree.NewReader(r.store, r.hash)
+	if err != nil {
+		return nil, err
+	}
+	rdr.SetReadahead(htree.DefaultReadahead)
+	r.rdr = rdr
+	return rdr, nil
 }
 
 func (r *FileReader) Seek(off int64, whence int) (int64, error) {
+	rdr, err := r.getReader()
+	if err != nil {
+		return int64(r.offset), err
+	}
 	switch whence {
 	case io.SeekStart:
-		o, err := r.rdr.Seek(uint64(off))
+		o, err := rdr.Seek(uint64(off))
 		r.offset = o
 		return int64(o), err
 	case io.SeekCurrent:
-		o, err := r.rdr.Seek(r.offset + uint64(off))
+		o, err := rdr.Seek(r.offset + uint64(off))
 		r.offset = o
 		return int64(o), err
 	case io.SeekEnd:
-		o, err := r.rdr.Seek(uint64(r.fsize + off))
+		o, err := rdr.Seek(uint64(r.fsize + off))
 		r.offset = o
 		return int64(o), err
 	default:
@@ -222,19 +259,17 @@ func (r *FileReader) Seek(off int64, whence int) (int64, error) {
 }
 
 func (r *FileReader) Read(buf []byte) (int, error) {
-	nread, err := r.rdr.Read(buf)
+	rdr, err := r.getReader()
+	if err != nil {
+		return 0, err
+	}
+	nread, err := rdr.Read(buf)
 	r.offset += uint64(nread)
 	return nread, err
 }
 
 func (r *FileReader) ReadAt(buf []byte, off int64) (int, error) {
-	if r.offset != uint64(off) {
-		_, err := r.Seek(off, io.SeekStart)
-		if err != nil {
-			return 0, err
-		}
-	}
-	return io.ReadFull(r, buf)
+	return r.rdrAt.ReadAt(buf, off)
 }
 
 func (r *FileReader) Close() error {
@@ -251,14 +286,16 @@ func Open(store bpy.CStore, roothash [32]byte, fpath string) (*FileReader, error
 	if dirent.EntMode.IsDir() {
 		return nil, fmt.Errorf("%s is a directory", fpath)
 	}
-	rdr, err := htree.NewReader(store, dirent.HTree.Data)
+	rdrAt, err := htree.NewReaderAt(store, dirent.HTree.Data)
 	if err != nil {
 		return nil, err
 	}
 	return &FileReader{
+		store:  store,
+		hash:   dirent.HTree.Data,
 		offset: 0,
 		fsize:  dirent.EntSize,
-		rdr:    rdr,
+		rdrAt:  rdrAt,
 	}, nil
 }
 
@@ -8,6 +8,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync"
 )
 
 func hostFileToHashTree(store bpy.CStore, path string) (htree.HTree, error) {
@@ -16,11 +17,12 @@ func hostFileToHashTree(store bpy.CStore, path string) (htree.HTree, error) {
 		return htree.HTree{}, err
 	}
 	defer fin.Close()
-	fout := htree.NewWriter(store)
+	st, err := fin.Stat()
 	if err != nil {
 		return htree.HTree{}, err
 	}
-	_, err = io.Copy(fout, fin)
+	fout := htree.NewWriter(store)
+	err = copySparse(fout, fin, st.Size())
 	if err != nil {
 		return htree.HTree{}, err
 	}
@@ -32,6 +34,7 @@ func hashTreeToHostFile(store bpy.CStore, hash [32]byte, dst string, mode os.Fil
 	if err != nil {
 		return err
 	}
+	f.SetReadahead(htree.DefaultReadahead)
 	fout, err := os.OpenFile(dst, os.O_EXCL|os.O_CREATE|os.O_WRONLY, mode)
 	if err != nil {
 		return err
@@ -45,11 +48,77 @@ func hashTreeToHostFile(store bpy.CStore, hash [32]byte, dst string, mode os.Fil
 
 }
 
-func cpHostDirToFs(store bpy.CStore, path string) (fs.DirEnt, error) {
-	path, err := filepath.Abs(path)
-	if err != nil {
-		return fs.DirEnt{}, err
+// The number of files read and stored concurrently when the store
+// supports streams.
+const putWorkers = 4
+
+type putState struct {
+	store  bpy.CStore
+	tokens chan struct{}
+	lock   sync.Mutex
+	err    error
+}
+
+func newPutState(store bpy.CStore) *putState {
+	p := &putState{store: store}
+	_, ok := store.(bpy.StreamingCStore)
+	if ok {
+		p.tokens = make(chan struct{}, putWorkers)
 	}
+	return p
+}
+
+func (p *putState) setErr(err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.err == nil {
+		p.err = err
+	}
+}
+
+func (p *putState) getErr() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.err
+}
+
+// putFile stores the file at path and sets ent.HTree, it may complete
+// asynchronously, callers must wait on wg before using ent.
+func (p *putState) putFile(wg *sync.WaitGroup, path string, ent *fs.DirEnt) {
+	if p.tokens == nil {
+		hash, err := hostFileToHashTree(p.store, path)
+		if err != nil {
+			p.setErr(err)
+			return
+		}
+		ent.HTree = hash
+		return
+	}
+	p.tokens <- struct{}{}
+	wg.Add(1)
+	go func() {
+		defer func() {
+			<-p.tokens
+			wg.Done()
+		}()
+		if p.getErr() != nil {
+			return
+		}
+		stream := p.store.(bpy.StreamingCStore).NewStream()
+		hash, err := hostFileToHashTree(stream, path)
+		closeErr := stream.Close()
+		if err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			p.setErr(err)
+			return
+		}
+		ent.HTree = hash
+	}()
+}
+
+func (p *putState) putDir(path string) (fs.DirEnt, error) {
 	st, err := os.Stat(path)
 	if err != nil {
 		return fs.DirEnt{}, err
@@ -58,62 +127,57 @@ func cpHostDirToFs(store bpy.CStore, path string) (fs.DirEnt, error) {
 	if err != nil {
 		return fs.DirEnt{}, err
 	}
-	dir := make(fs.DirEnts, 0, 16)
+	dir := make(fs.DirEnts, 0, len(ents))
 	for _, e := range ents {
 		switch {
 		case e.Mode().IsRegular():
-			hash, err := hostFileToHashTree(store, filepath.Join(path, e.Name()))
-			if err != nil {
-				return fs.DirEnt{}, err
-			}
 			dir = append(dir, fs.DirEnt{
 				EntName: e.Name(),
-				HTree:   hash,
 				EntSize: e.Size(),
 				EntMode: e.Mode(),
 			})
 		case e.IsDir():
-			newEnt, err := cpHostDirToFs(store, filepath.Join(path, e.Name()))
-			if err != nil {
-				return fs.DirEnt{}, err
-			}
 			dir = append(dir, fs.DirEnt{
 				EntName: e.Name(),
 				EntMode: e.Mode(),
-				HTree:   newEnt.HTree,
 			})
 		}
 	}
-	dirEnt, err := fs.WriteDir(store, dir, st.Mode())
+	// Appending is done, so the entries can be filled in concurrently.
+	var wg sync.WaitGroup
+	for i := range dir {
+		if !dir[i].EntMode.IsRegular() {
+			continue
+		}
+		p.putFile(&wg, filepath.Join(path, dir[i].EntName), &dir[i])
+	}
+	for i := range dir {
+		if !dir[i].EntMode.IsDir() {
+			continue
+		}
+		newEnt, err := p.putDir(filepath.Join(path, dir[i].EntName))
+		if err != nil {
+			wg.Wait()
+			return fs.DirEnt{}, err
+		}
+		dir[i].HTree = newEnt.HTree
+	}
+	wg.Wait()
+	err = p.getErr()
+	if err != nil {
+		return fs.DirEnt{}, err
+	}
+	dirEnt, err := fs.WriteDir(p.store, dir, st.Mode())
 	dirEnt.EntName = filepath.Base(path)
 	return dirEnt, err
 }
 
-func cpFsDirToHost(store bpy.CStore, hash [32]byte, dest string) error {
-	ents, err := fs.ReadDir(store, hash)
-	if err != nil {
-		return err
-	}
-	err = os.Mkdir(dest, ents[0].EntMode)
+func cpHostDirToFs(store bpy.CStore, path string) (fs.DirEnt, error) {
+	path, err := filepath.Abs(path)
 	if err != nil {
-		return err
-	}
-	for _, e := range ents[1:] {
-		subp := filepath.Join(dest, e.EntName)
-		switch {
-		case e.EntMode.IsDir():
-			err = cpFsDirToHost(store, e.HTree.Data, subp)
-			if err != nil {
-				return err
-			}
-		case e.EntMode.IsRegular():
-			err = hashTreeToHostFile(store, e.HTree.Data, subp, e.EntMode)
-			if err != nil {
-				return err
-			}
-		}
+		return fs.DirEnt{}, err
 	}
-	return nil
+	return newPutState(store).putDir(path)
 }
 
 func CpHostToFs(store bpy.CStore, src string) (fs.DirEnt, error) {
@@ -141,8 +205,5 @@ func CpFsToHost(store bpy.CStore, root [32]byte, src, dst string) error {
 	if err != nil {
 		return err
 	}
-	if ent.IsDir() {
-		return cpFsDirToHost(store, ent.HTree.Data, dst)
-	}
-	return hashTreeToHostFile(store, ent.HTree.Data, dst, ent.EntMode)
+	return restore(store, ent, dst)
 }
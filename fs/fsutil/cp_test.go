@@ -3,11 +3,13 @@
 package fsutil
 
 import (
+	"github.com/buppyio/bpy"
 	"github.com/buppyio/bpy/testhelp"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"path"
+	"sync"
 	"testing"
 )
 
@@ -92,3 +94,170 @@ func TestStoreDir(t *testing.T) {
 		}
 	}
 }
+
+type reversingStore struct {
+	*testhelp.MemStore
+	batches int
+}
+
+func (s *reversingStore) GetMany(hashes [][32]byte, fn func([32]byte, []byte) error) error {
+	s.batches++
+	for i := len(hashes) - 1; i >= 0; i-- {
+		v, err := s.Get(hashes[i])
+		if err != nil {
+			return err
+		}
+		err = fn(hashes[i], v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestRestoreBatched(t *testing.T) {
+	rd := rand.New(rand.NewSource(1234))
+	tmp, err := ioutil.TempDir("", "buppytestcpdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	randd := path.Join(tmp, "rand")
+	restored := path.Join(tmp, "restored")
+	err = os.Mkdir(randd, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = testhelp.RandomDirectoryTree(randd, testhelp.RandDirConfig{
+		MaxDepth:    3,
+		MaxSubdirs:  3,
+		MaxFileSize: 1024 * 1024 * 2,
+		MaxFiles:    4,
+	}, rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &reversingStore{MemStore: testhelp.NewMemStore()}
+	dirEnt, err := CpHostToFs(store, randd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = CpFsToHost(store, dirEnt.HTree.Data, "/", restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.batches != 1 {
+		t.Fatalf("expected a single batch, got %d", store.batches)
+	}
+	if !testhelp.DirEqual(randd, restored) {
+		t.Fatalf("%s != %s", randd, restored)
+	}
+}
+
+type streamingStore struct {
+	lock sync.Mutex
+	mem  *testhelp.MemStore
+}
+
+func (s *streamingStore) Get(hash [32]byte) ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.mem.Get(hash)
+}
+
+func (s *streamingStore) Put(val []byte) ([32]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.mem.Put(val)
+}
+
+func (s *streamingStore) Flush() error { return nil }
+func (s *streamingStore) Close() error { return nil }
+
+func (s *streamingStore) NewStream() bpy.CStore {
+	return &unclosable{s}
+}
+
+type unclosable struct {
+	bpy.CStore
+}
+
+func (u *unclosable) Close() error { return nil }
+
+func TestStoreDirParallel(t *testing.T) {
+	rd := rand.New(rand.NewSource(4321))
+	tmp, err := ioutil.TempDir("", "buppytestcpdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	randd := path.Join(tmp, "rand")
+	restored := path.Join(tmp, "restored")
+	err = os.Mkdir(randd, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = testhelp.RandomDirectoryTree(randd, testhelp.RandDirConfig{
+		MaxDepth:    3,
+		MaxSubdirs:  3,
+		MaxFileSize: 1024 * 256,
+		MaxFiles:    6,
+	}, rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &streamingStore{mem: testhelp.NewMemStore()}
+	dirEnt, err := CpHostToFs(store, randd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = CpFsToHost(store, dirEnt.HTree.Data, "/", restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !testhelp.DirEqual(randd, restored) {
+		t.Fatalf("%s != %s", randd, restored)
+	}
+}
+
+func TestRestoreSparse(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "buppytestcpdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	sparsed := path.Join(tmp, "sparse")
+	restored := path.Join(tmp, "restored")
+	err = os.Mkdir(sparsed, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(path.Join(sparsed, "f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt([]byte("data"), 3*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Truncate(8 * 1024 * 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := testhelp.NewMemStore()
+	dirEnt, err := CpHostToFs(store, sparsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = CpFsToHost(store, dirEnt.HTree.Data, "/", restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !testhelp.DirEqual(sparsed, restored) {
+		t.Fatalf("%s != %s", sparsed, restored)
+	}
+}
@@ -0,0 +1,255 @@
+package fsutil
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/buppyio/bpy"
+	"github.com/buppyio/bpy/fs"
+	"github.com/buppyio/bpy/htree"
+	"os"
+	"path/filepath"
+)
+
+const maxOpenRestoreFiles = 64
+
+type restoreTarget struct {
+	file   int
+	offset int64
+}
+
+type restoreEnt struct {
+	path string
+	mode os.FileMode
+}
+
+// restorePlan records where every leaf of the restored files belongs, so
+// leaves can be fetched in whatever order is cheapest for the store.
+type restorePlan struct {
+	store   bpy.CStore
+	dirs    []restoreEnt
+	files   []restoreEnt
+	order   [][32]byte
+	targets map[[32]byte][]restoreTarget
+	open    map[int]*os.File
+}
+
+func newRestorePlan(store bpy.CStore) *restorePlan {
+	return &restorePlan{
+		store:   store,
+		targets: make(map[[32]byte][]restoreTarget),
+		open:    make(map[int]*os.File),
+	}
+}
+
+func (p *restorePlan) addDir(hash [32]byte, dest string) error {
+	ents, err := fs.ReadDir(p.store, hash)
+	if err != nil {
+		return err
+	}
+	err = os.Mkdir(dest, 0700)
+	if err != nil {
+		return err
+	}
+	p.dirs = append(p.dirs, restoreEnt{path: dest, mode: ents[0].EntMode})
+	for _, e := range ents[1:] {
+		subp := filepath.Join(dest, e.EntName)
+		switch {
+		case e.EntMode.IsDir():
+			err = p.addDir(e.HTree.Data, subp)
+			if err != nil {
+				return err
+			}
+		case e.EntMode.IsRegular():
+			err = p.addFile(e.HTree.Data, subp, e.EntMode, e.EntSize)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Files are extended to their full size up front, leaves of zeros are then
+// skipped so they are left as holes on file systems that support them.
+func (p *restorePlan) addFile(hash [32]byte, dest string, mode os.FileMode, size int64) error {
+	f, err := os.OpenFile(dest, os.O_EXCL|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(size)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	p.files = append(p.files, restoreEnt{path: dest, mode: mode})
+	return p.addLeaves(len(p.files)-1, hash, 0)
+}
+
+func (p *restorePlan) addLeaves(file int, hash [32]byte, offset int64) error {
+	buf, err := p.store.Get(hash)
+	if err != nil {
+		return err
+	}
+	if len(buf) == 0 || (!htree.IsLeaf(buf) && (len(buf)-1)%40 != 0) {
+		return htree.ErrCorruptNode
+	}
+	if htree.IsLeaf(buf) {
+		p.addTarget(hash, restoreTarget{file: file, offset: offset})
+		return nil
+	}
+	for i := 1; i < len(buf); i += 40 {
+		var child [32]byte
+		childoff := int64(binary.LittleEndian.Uint64(buf[i : i+8]))
+		copy(child[:], buf[i+8:i+40])
+		if buf[0] == 1 {
+			p.addTarget(child, restoreTarget{file: file, offset: childoff})
+			continue
+		}
+		err = p.addLeaves(file, child, childoff)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *restorePlan) addTarget(hash [32]byte, t restoreTarget) {
+	_, ok := p.targets[hash]
+	if !ok {
+		p.order = append(p.order, hash)
+	}
+	p.targets[hash] = append(p.targets[hash], t)
+}
+
+func (p *restorePlan) getFile(file int) (*os.File, error) {
+	f, ok := p.open[file]
+	if ok {
+		return f, nil
+	}
+	if len(p.open) >= maxOpenRestoreFiles {
+		for idx, f := range p.open {
+			delete(p.open, idx)
+			err := f.Close()
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	f, err := os.OpenFile(p.files[file].path, os.O_WRONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	p.open[file] = f
+	return f, nil
+}
+
+func (p *restorePlan) writeLeaf(hash [32]byte, leaf []byte) error {
+	if !htree.IsLeaf(leaf) {
+		return htree.ErrCorruptNode
+	}
+	_, hole, err := htree.HoleSize(leaf)
+	if err != nil {
+		return err
+	}
+	if hole || isZero(leaf[1:]) {
+		return nil
+	}
+	for _, t := range p.targets[hash] {
+		f, err := p.getFile(t.file)
+		if err != nil {
+			return err
+		}
+		_, err = f.WriteAt(leaf[1:], t.offset)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isZero(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *restorePlan) closeFiles() error {
+	var firstErr error
+	for idx, f := range p.open {
+		delete(p.open, idx)
+		err := f.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (p *restorePlan) execute() error {
+	var err error
+	getter, ok := p.store.(bpy.BatchGetter)
+	if ok {
+		err = getter.GetMany(p.order, p.writeLeaf)
+	} else {
+		for _, hash := range p.order {
+			var leaf []byte
+			leaf, err = p.store.Get(hash)
+			if err != nil {
+				break
+			}
+			err = p.writeLeaf(hash, leaf)
+			if err != nil {
+				break
+			}
+		}
+	}
+	closeErr := p.closeFiles()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	for _, f := range p.files {
+		err = os.Chmod(f.path, f.mode)
+		if err != nil {
+			return err
+		}
+	}
+	// Children were added after their parents, so restrictive directory
+	// modes are applied deepest first.
+	for i := len(p.dirs) - 1; i >= 0; i-- {
+		err = os.Chmod(p.dirs[i].path, p.dirs[i].mode)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var errNotRestorable = errors.New("can only restore files and directories")
+
+func restore(store bpy.CStore, ent fs.DirEnt, dst string) error {
+	p := newRestorePlan(store)
+	var err error
+	switch {
+	case ent.IsDir():
+		err = p.addDir(ent.HTree.Data, dst)
+	case ent.EntMode.IsRegular():
+		err = p.addFile(ent.HTree.Data, dst, ent.EntMode, ent.EntSize)
+	default:
+		err = errNotRestorable
+	}
+	if err != nil {
+		return err
+	}
+	return p.execute()
+}
@@ -0,0 +1,63 @@
+package fsutil
+
+import (
+	"errors"
+	"github.com/buppyio/bpy/htree"
+	"io"
+	"os"
+	"syscall"
+)
+
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// copySparse copies the first size bytes of f to w, holes reported by the
+// file system are written as holes without being read.
+func copySparse(w *htree.Writer, f *os.File, size int64) error {
+	off := int64(0)
+	for off < size {
+		data, err := f.Seek(off, seekData)
+		if errors.Is(err, syscall.ENXIO) {
+			data = size
+		} else if err != nil {
+			if off == 0 && errors.Is(err, syscall.EINVAL) {
+				// The file system can't report holes.
+				_, err = f.Seek(0, io.SeekStart)
+				if err != nil {
+					return err
+				}
+				_, err = io.Copy(w, f)
+			}
+			return err
+		}
+		if data > size {
+			data = size
+		}
+		err = w.WriteHole(data - off)
+		if err != nil {
+			return err
+		}
+		if data == size {
+			break
+		}
+		hole, err := f.Seek(data, seekHole)
+		if err != nil {
+			return err
+		}
+		if hole > size {
+			hole = size
+		}
+		_, err = f.Seek(data, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		_, err = io.CopyN(w, f, hole-data)
+		if err != nil {
+			return err
+		}
+		off = hole
+	}
+	return nil
+}
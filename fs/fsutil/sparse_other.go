@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package fsutil
+
+import (
+	"github.com/buppyio/bpy/htree"
+	"io"
+	"os"
+)
+
+// copySparse copies f to w, zero filled leaves are still stored as holes
+// by the writer.
+func copySparse(w *htree.Writer, f *os.File, size int64) error {
+	_, err := io.Copy(w, f)
+	return err
+}
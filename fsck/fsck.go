@@ -0,0 +1,367 @@
+package fsck
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/buppyio/bpy"
+	"github.com/buppyio/bpy/cstore"
+	"github.com/buppyio/bpy/fs"
+	"github.com/buppyio/bpy/htree"
+	"github.com/buppyio/bpy/refs"
+	"github.com/buppyio/bpy/remote"
+	"github.com/buppyio/bpy/remote/client"
+	"math/rand"
+	"path"
+)
+
+var (
+	ErrMissing      = errors.New("chunk missing")
+	ErrHashMismatch = errors.New("chunk hash mismatch")
+)
+
+type Location struct {
+	Pack string
+	Size uint32
+}
+
+// Inventory lists every pack and the chunks stored in them, as read from
+// the pack indexes.
+type Inventory struct {
+	Packs  []string
+	Chunks map[[32]byte][]Location
+}
+
+func NewInventory() *Inventory {
+	return &Inventory{
+		Chunks: make(map[[32]byte][]Location),
+	}
+}
+
+func (inv *Inventory) Add(pack string, hash [32]byte, size uint32) {
+	inv.Chunks[hash] = append(inv.Chunks[hash], Location{Pack: pack, Size: size})
+}
+
+// Problem is damage found by a check. Hash is zero for problems with
+// packs, Path is empty for problems with history.
+type Problem struct {
+	Hash [32]byte
+	Path string
+	Err  error
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%s %s: %s", hex.EncodeToString(p.Hash[:]), p.Path, p.Err)
+}
+
+type Report struct {
+	Problems []Problem
+
+	Refs  int
+	Dirs  int
+	Files int
+	// Chunks reachable from the root, and how many of them were read
+	// and verified.
+	Reachable   int
+	DataChecked int
+
+	Packs              int
+	Chunks             int
+	OrphanPacks        []string
+	OrphanIndexObjects []string
+	Duplicates         int
+	DuplicateBytes     uint64
+	Unreferenced       int
+	UnreferencedBytes  uint64
+}
+
+func (r *Report) addProblem(hash [32]byte, path string, err error) {
+	r.Problems = append(r.Problems, Problem{Hash: hash, Path: path, Err: err})
+}
+
+type Options struct {
+	// ReadDataPercent is the percentage of reachable file data chunks
+	// that are read and verified, metadata is always verified.
+	ReadDataPercent float64
+}
+
+func Fsck(c *client.Client, store bpy.CStore, k *bpy.Key, opts Options) (*Report, error) {
+	report := &Report{}
+	inv, err := ReadInventory(c, k.CipherKey, report)
+	if err != nil {
+		return nil, err
+	}
+	roots, err := remote.GetRoots(c, k)
+	if err != nil {
+		return nil, err
+	}
+	if len(roots) == 0 {
+		return nil, errors.New("root missing")
+	}
+	hashes := [][32]byte{}
+	for _, hash := range roots {
+		hashes = append(hashes, hash)
+	}
+	Check(store, hashes, inv, opts, report)
+	return report, nil
+}
+
+// ReadInventory reads the index of every pack, packs with unreadable
+// indexes are reported as problems.
+func ReadInventory(c *client.Client, key [32]byte, report *Report) (*Inventory, error) {
+	listing, err := remote.ListPacks(c)
+	if err != nil {
+		return nil, err
+	}
+	packs, indexes := cstore.SplitListing(listing)
+	inv := NewInventory()
+	live := make(map[string]struct{})
+	for _, pack := range packs {
+		live[pack.Name] = struct{}{}
+		inv.Packs = append(inv.Packs, pack.Name)
+		idx, err := cstore.ReadPackIndex(c, key, pack, indexes)
+		if err != nil {
+			report.addProblem([32]byte{}, path.Join("packs", pack.Name), err)
+			continue
+		}
+		for _, ent := range idx {
+			var hash [32]byte
+			copy(hash[:], ent.Key)
+			inv.Add(pack.Name, hash, ent.Size)
+		}
+	}
+	for packName, obj := range indexes {
+		_, ok := live[packName]
+		if !ok {
+			report.OrphanIndexObjects = append(report.OrphanIndexObjects, obj.Name)
+		}
+	}
+	return inv, nil
+}
+
+// errReported is returned by reads of chunks that were already
+// reported as problems.
+var errReported = errors.New("chunk already reported")
+
+type checkState struct {
+	store   bpy.CStore
+	inv     *Inventory
+	opts    Options
+	report  *Report
+	visited map[[32]byte]struct{}
+	bad     map[[32]byte]struct{}
+	// path is the file or directory being read through the CStore methods.
+	path string
+}
+
+// Check walks all history reachable from the refs at roots, the same
+// traversal as gc, verifying every chunk it reads. The totals of report
+// are filled in from inv.
+func Check(store bpy.CStore, roots [][32]byte, inv *Inventory, opts Options, report *Report) {
+	s := &checkState{
+		store:   store,
+		inv:     inv,
+		opts:    opts,
+		report:  report,
+		visited: make(map[[32]byte]struct{}),
+		bad:     make(map[[32]byte]struct{}),
+	}
+	for _, root := range roots {
+		s.checkHistory(root)
+	}
+	s.summarize()
+}
+
+// get returns a chunk after checking it is stored in a pack and hashes
+// correctly, failures are reported once per chunk.
+func (s *checkState) get(hash [32]byte, chunkPath string) ([]byte, error) {
+	_, ok := s.bad[hash]
+	if ok {
+		return nil, errReported
+	}
+	val, err := s.getChecked(hash)
+	if err != nil {
+		s.bad[hash] = struct{}{}
+		s.report.addProblem(hash, chunkPath, err)
+		return nil, errReported
+	}
+	return val, nil
+}
+
+func (s *checkState) getChecked(hash [32]byte) ([]byte, error) {
+	_, ok := s.inv.Chunks[hash]
+	if !ok {
+		return nil, ErrMissing
+	}
+	val, err := s.store.Get(hash)
+	if err != nil {
+		return nil, err
+	}
+	if sha256.Sum256(val) != hash {
+		return nil, ErrHashMismatch
+	}
+	return val, nil
+}
+
+func (s *checkState) Get(hash [32]byte) ([]byte, error) {
+	return s.get(hash, s.path)
+}
+
+func (s *checkState) Put(val []byte) ([32]byte, error) {
+	return [32]byte{}, errors.New("fsck store is read only")
+}
+
+func (s *checkState) Flush() error { return nil }
+func (s *checkState) Close() error { return nil }
+
+func (s *checkState) addProblem(hash [32]byte, problemPath string, err error) {
+	if err != errReported {
+		s.report.addProblem(hash, problemPath, err)
+	}
+}
+
+func (s *checkState) checkHistory(hash [32]byte) {
+	for {
+		_, ok := s.visited[hash]
+		if ok {
+			return
+		}
+		s.report.Refs += 1
+		if !s.walk(hash, "", false) {
+			return
+		}
+		s.path = ""
+		ref, err := refs.GetRef(s, hash)
+		if err != nil {
+			s.addProblem(hash, "", err)
+			return
+		}
+		s.checkDir(ref.Root, "/")
+		if !ref.HasPrev {
+			return
+		}
+		hash = ref.Prev
+	}
+}
+
+func (s *checkState) checkDir(hash [32]byte, dirPath string) {
+	_, ok := s.visited[hash]
+	if ok {
+		return
+	}
+	s.report.Dirs += 1
+	if !s.walk(hash, dirPath, false) {
+		return
+	}
+	s.path = dirPath
+	ents, err := fs.ReadDir(s, hash)
+	if err != nil {
+		s.addProblem(hash, dirPath, err)
+		return
+	}
+	for _, ent := range ents[1:] {
+		entPath := path.Join(dirPath, ent.EntName)
+		switch {
+		case ent.IsDir():
+			s.checkDir(ent.HTree.Data, entPath)
+		case ent.EntMode.IsRegular():
+			s.report.Files += 1
+			if ent.HTree.Depth == 0 {
+				s.checkLeaf(ent.HTree.Data, entPath, true)
+			} else {
+				s.walk(ent.HTree.Data, entPath, true)
+			}
+		}
+	}
+}
+
+// walk checks the hash tree at hash, returning false if its root could
+// not be read. Leaves of file data are only read when sampled, other
+// leaves are read by the caller.
+func (s *checkState) walk(hash [32]byte, treePath string, data bool) bool {
+	_, ok := s.visited[hash]
+	if ok {
+		return true
+	}
+	s.visited[hash] = struct{}{}
+	s.report.Reachable += 1
+	node, err := s.get(hash, treePath)
+	if err != nil {
+		return false
+	}
+	if htree.IsLeaf(node) {
+		_, _, err = htree.HoleSize(node)
+		if err != nil {
+			s.addProblem(hash, treePath, err)
+		}
+		return err == nil
+	}
+	if len(node) < 41 || (len(node)-1)%40 != 0 {
+		s.addProblem(hash, treePath, htree.ErrCorruptNode)
+		return false
+	}
+	for i := 1; i < len(node); i += 40 {
+		var child [32]byte
+		copy(child[:], node[i+8:i+40])
+		if i > 1 && binary.LittleEndian.Uint64(node[i:i+8]) < binary.LittleEndian.Uint64(node[i-40:i-32]) {
+			s.addProblem(hash, treePath, htree.ErrCorruptNode)
+			return false
+		}
+		if node[0] == 1 {
+			s.checkLeaf(child, treePath, data)
+		} else {
+			s.walk(child, treePath, data)
+		}
+	}
+	return true
+}
+
+func (s *checkState) checkLeaf(hash [32]byte, leafPath string, data bool) {
+	_, ok := s.visited[hash]
+	if ok {
+		return
+	}
+	if data && rand.Float64()*100 < s.opts.ReadDataPercent {
+		s.report.DataChecked += 1
+		s.walk(hash, leafPath, data)
+		return
+	}
+	s.visited[hash] = struct{}{}
+	s.report.Reachable += 1
+	_, ok = s.inv.Chunks[hash]
+	if !ok {
+		s.bad[hash] = struct{}{}
+		s.report.addProblem(hash, leafPath, ErrMissing)
+	}
+}
+
+func (s *checkState) summarize() {
+	used := make(map[string]struct{})
+	for hash, locs := range s.inv.Chunks {
+		s.report.Chunks += 1
+		for _, loc := range locs[1:] {
+			s.report.Duplicates += 1
+			s.report.DuplicateBytes += uint64(loc.Size)
+		}
+		_, ok := s.visited[hash]
+		if !ok {
+			s.report.Unreferenced += 1
+			for _, loc := range locs {
+				s.report.UnreferencedBytes += uint64(loc.Size)
+			}
+			continue
+		}
+		for _, loc := range locs {
+			used[loc.Pack] = struct{}{}
+		}
+	}
+	s.report.Packs = len(s.inv.Packs)
+	for _, pack := range s.inv.Packs {
+		_, ok := used[pack]
+		if !ok {
+			s.report.OrphanPacks = append(s.report.OrphanPacks, pack)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package fsck
+
+import (
+	"crypto/sha256"
+	"errors"
+	"github.com/buppyio/bpy/fs"
+	"github.com/buppyio/bpy/htree"
+	"github.com/buppyio/bpy/refs"
+	"math/rand"
+	"testing"
+)
+
+type mapStore map[[32]byte][]byte
+
+func (m mapStore) Get(hash [32]byte) ([]byte, error) {
+	val, ok := m[hash]
+	if !ok {
+		return nil, errors.New("hash not found in store")
+	}
+	return val, nil
+}
+
+func (m mapStore) Put(val []byte) ([32]byte, error) {
+	hash := sha256.Sum256(val)
+	m[hash] = append([]byte{}, val...)
+	return hash, nil
+}
+
+func (m mapStore) Flush() error { return nil }
+func (m mapStore) Close() error { return nil }
+
+type testRepo struct {
+	store mapStore
+	root  [32]byte
+	file  htree.HTree
+	dir   [32]byte
+}
+
+func newTestRepo(t *testing.T) *testRepo {
+	rd := rand.New(rand.NewSource(1))
+	store := make(mapStore)
+	w := htree.NewWriter(store)
+	data := make([]byte, 300*1024)
+	rd.Read(data)
+	_, err := w.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := fs.WriteDir(store, fs.DirEnts{{EntName: "f", EntSize: int64(len(data)), EntMode: 0600, HTree: file}}, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub.EntName = "d"
+	dir, err := fs.WriteDir(store, fs.DirEnts{sub}, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := refs.PutRef(store, refs.Ref{Root: dir.HTree.Data})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := refs.PutRef(store, refs.Ref{Root: dir.HTree.Data, HasPrev: true, Prev: first})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testRepo{store: store, root: root, file: file, dir: sub.HTree.Data}
+}
+
+func (r *testRepo) inventory() *Inventory {
+	inv := NewInventory()
+	inv.Packs = []string{"a.ebpack"}
+	for hash, val := range r.store {
+		inv.Add("a.ebpack", hash, uint32(len(val)))
+	}
+	return inv
+}
+
+func TestCheckClean(t *testing.T) {
+	repo := newTestRepo(t)
+	inv := repo.inventory()
+	var unref [32]byte
+	unref[0] = 1
+	inv.Add("b.ebpack", unref, 10)
+	inv.Packs = append(inv.Packs, "b.ebpack")
+	inv.Add("b.ebpack", repo.dir, 20)
+	report := &Report{}
+	Check(repo.store, [][32]byte{repo.root}, inv, Options{ReadDataPercent: 100}, report)
+	if len(report.Problems) != 0 {
+		t.Fatalf("unexpected problems: %v", report.Problems)
+	}
+	if report.Refs != 2 || report.Dirs != 2 || report.Files != 1 {
+		t.Fatalf("bad counts: %d refs %d dirs %d files", report.Refs, report.Dirs, report.Files)
+	}
+	// Two refs, two directories, and a file of one interior node and
+	// five leaves.
+	if report.Reachable != 10 || report.DataChecked != 5 {
+		t.Fatalf("reached %d chunks, checked %d", report.Reachable, report.DataChecked)
+	}
+	if report.Unreferenced != report.Chunks-10 || report.UnreferencedBytes < 10 {
+		t.Fatalf("bad unreferenced: %d %d", report.Unreferenced, report.UnreferencedBytes)
+	}
+	if report.Duplicates != 1 || report.DuplicateBytes != 20 {
+		t.Fatalf("bad duplicates: %d %d", report.Duplicates, report.DuplicateBytes)
+	}
+	if len(report.OrphanPacks) != 0 {
+		t.Fatalf("unexpected orphan packs: %v", report.OrphanPacks)
+	}
+}
+
+func TestCheckDamage(t *testing.T) {
+	repo := newTestRepo(t)
+	node, err := repo.store.Get(repo.file.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var missing [32]byte
+	copy(missing[:], node[9:41])
+	inv := repo.inventory()
+	delete(inv.Chunks, missing)
+	inv.Packs = append(inv.Packs, "orphan.ebpack")
+	dir := repo.store[repo.dir]
+	repo.store[repo.dir] = []byte("corrupt")
+
+	report := &Report{}
+	Check(repo.store, [][32]byte{repo.root}, inv, Options{}, report)
+	if report.DataChecked != 0 {
+		t.Fatal("data was read without sampling")
+	}
+	if len(report.Problems) != 1 {
+		t.Fatalf("expected one problem, got %v", report.Problems)
+	}
+	if p := report.Problems[0]; p.Hash != repo.dir || p.Path != "/d" || p.Err != ErrHashMismatch {
+		t.Fatalf("bad problem %v", p)
+	}
+	if len(report.OrphanPacks) != 1 || report.OrphanPacks[0] != "orphan.ebpack" {
+		t.Fatalf("bad orphan packs %v", report.OrphanPacks)
+	}
+
+	// With the directory fixed the missing file chunk is found.
+	repo.store[repo.dir] = dir
+	report = &Report{}
+	Check(repo.store, [][32]byte{repo.root}, inv, Options{}, report)
+	if len(report.Problems) != 1 {
+		t.Fatalf("expected one problem, got %v", report.Problems)
+	}
+	if p := report.Problems[0]; p.Hash != missing || p.Path != "/d/f" || p.Err != ErrMissing {
+		t.Fatalf("bad problem %v", p)
+	}
+}
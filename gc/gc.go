@@ -2,19 +2,38 @@ package gc
 
 import (
 	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"github.com/buppyio/bpy"
 	"github.com/buppyio/bpy/bpack"
+	"github.com/buppyio/bpy/codec"
+	"github.com/buppyio/bpy/cstore"
 	"github.com/buppyio/bpy/cstore/cache"
 	"github.com/buppyio/bpy/fs"
+	"github.com/buppyio/bpy/htree"
+	"github.com/buppyio/bpy/parity"
 	"github.com/buppyio/bpy/refs"
 	"github.com/buppyio/bpy/remote"
 	"github.com/buppyio/bpy/remote/client"
+	"io"
+	"io/ioutil"
 	"log"
+	"os"
 	"path"
 	"sort"
+	"time"
 )
 
+// maxPackSize is the size at which the sweep starts a new pack, deleting
+// the packs swept so far.
+var maxPackSize uint64 = 128 * 1024 * 1024
+
+// minKeptPackSize is the size from which a fully reachable pack is left in
+// place instead of being rewritten.
+var minKeptPackSize uint64 = 100 * 1024 * 1024
+
 type gcState struct {
 	epoch   string
 	k       *bpy.Key
@@ -26,12 +45,44 @@ type gcState struct {
 	// Sweeping state
 	newPackSize uint64
 	newPack     *bpack.Writer
+	newPackName string
+	indexes     map[string]remote.PackListing
 	moved       map[[32]byte]struct{}
 	canDelete   []string
+	// kept holds packs the sweep left in place.
+	kept map[string]struct{}
+	// recovered maps packs rebuilt from parity to their local copies.
+	recovered map[string]string
+	tmpdir    string
+	// Swept packs in parity groups are held in held until every pack of
+	// their groups has been swept, groupLeft counts the packs left.
+	groups     []cstore.ParityObject
+	packGroups map[string][]int
+	groupLeft  []int
+	held       map[string][]string
+
+	parity   *cstore.ParityWriter
+	newShard *cstore.ParityShard
+
+	padding cstore.Padding
+	// Bytes of value and pack padding in the packs written by the sweep.
+	paddingOverhead uint64
 }
 
-func GC(c *client.Client, store bpy.CStore, cacheClient *cache.Client, k *bpy.Key) error {
-	epoch, err := remote.StartGC(c)
+// GC collects the packs of the remote, credential is the admin credential
+// needed when the key is append-only.
+func GC(c *client.Client, store bpy.CStore, cacheClient *cache.Client, k *bpy.Key, padding cstore.Padding, parityCfg cstore.Parity, credential string) error {
+	tmpdir, err := ioutil.TempDir("", "bpygc")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpdir)
+	pw, err := cstore.NewParityWriter(c, k.CipherKey, tmpdir, parityCfg)
+	if err != nil {
+		return err
+	}
+
+	epoch, err := remote.StartGC(c, credential)
 	if err != nil {
 		return err
 	}
@@ -47,19 +98,26 @@ func GC(c *client.Client, store bpy.CStore, cacheClient *cache.Client, k *bpy.Ke
 		newPack:     nil,
 		newPackSize: 0,
 		canDelete:   []string{},
+		kept:        make(map[string]struct{}),
+		recovered:   make(map[string]string),
+		tmpdir:      tmpdir,
+		padding:     padding,
+		parity:      pw,
 	}
 
-	hash, _, ok, err := remote.GetRoot(gc.c, gc.k)
+	roots, err := remote.GetRoots(gc.c, gc.k)
 	if err != nil {
 		return err
 	}
-	if !ok {
+	if len(roots) == 0 {
 		return errors.New("root missing")
 	}
 
-	err = gc.markRef(hash)
-	if err != nil {
-		return err
+	for _, hash := range roots {
+		err = gc.markRef(hash)
+		if err != nil {
+			return err
+		}
 	}
 
 	err = store.Close()
@@ -72,6 +130,7 @@ func GC(c *client.Client, store bpy.CStore, cacheClient *cache.Client, k *bpy.Ke
 	if err != nil {
 		return err
 	}
+	log.Printf("padding overhead: %d bytes", gc.paddingOverhead)
 
 	return remote.StopGC(c)
 }
@@ -140,7 +199,7 @@ func (gc *gcState) markHTree(root [32]byte) error {
 		return err
 	}
 
-	if data[0] == 0 {
+	if htree.IsLeaf(data) {
 		gc.visited[root] = struct{}{}
 		return nil
 	}
@@ -166,7 +225,16 @@ func (gc *gcState) putValue(hash [32]byte, val []byte) error {
 		return nil
 	}
 
-	if gc.newPackSize+uint64(len(val))+uint64(len(hash)) > 128*1024*1024 {
+	padTo := gc.padding.PadTo()
+	if padTo != nil {
+		val = codec.Pad(val, padTo)
+	}
+	overhead, err := codec.Overhead(val)
+	if err != nil {
+		return err
+	}
+
+	if gc.newPackSize+uint64(len(val))+uint64(len(hash)) > maxPackSize {
 		err := gc.closeCurrentWriterAndDeleteOldPacks()
 		if err != nil {
 			return err
@@ -178,38 +246,85 @@ func (gc *gcState) putValue(hash [32]byte, val []byte) error {
 		if err != nil {
 			return err
 		}
-		f, err := gc.c.NewPack(path.Join("packs", name) + ".ebpack")
+		name = name + cstore.PackSuffix
+		f, err := gc.c.NewPack(path.Join("packs", name))
 		if err != nil {
 			return err
 		}
+		var w io.Writer = f
+		if gc.parity != nil {
+			gc.newShard, err = gc.parity.AddPack(name)
+			if err != nil {
+				f.Cancel()
+				return err
+			}
+			w = io.MultiWriter(f, gc.newShard)
+		}
 		buffered := &bpy.BufferedWriteCloser{
 			W: f,
-			B: bufio.NewWriterSize(f, 65536),
+			B: bufio.NewWriterSize(w, 65536),
 		}
-		gc.newPack, err = bpack.NewEncryptedWriter(buffered, gc.k.CipherKey)
+		// Values are copied without recompression.
+		gc.newPack, err = bpack.NewEncryptedWriter(buffered, gc.k.CipherKey, bpack.Header{
+			Codec:     bpack.CodecPerEntry,
+			HashAlg:   bpack.HashSHA256,
+			CreatedAt: time.Now().Unix(),
+		})
 		if err != nil {
 			return err
 		}
+		if padTo != nil {
+			gc.newPack.SetPadding(padTo)
+		}
+		gc.newPackName = name
 	}
 
-	err := gc.newPack.Add(string(hash[:]), val)
+	err = gc.newPack.Add(string(hash[:]), val)
 	if err != nil {
 		return err
 	}
+	gc.paddingOverhead += uint64(overhead)
 	// Only approximate, but good enough.
 	gc.newPackSize += uint64(len(hash)) + uint64(len(val))
 	gc.moved[hash] = struct{}{}
 	return nil
 }
 
+func (gc *gcState) cacheValue(hash [32]byte, val []byte) error {
+	if len(val) == 0 {
+		return codec.ErrCorrupt
+	}
+	if val[0] == codec.Flate {
+		return gc.cache.PutRaw(hash, val[1:])
+	}
+	data, err := codec.Decode(val)
+	if err != nil {
+		return err
+	}
+	return gc.cache.Put(hash, data)
+}
+
 func (gc *gcState) closeCurrentWriterAndDeleteOldPacks() error {
 	if gc.newPack != nil {
-		_, err := gc.newPack.Close()
+		idx, err := gc.newPack.Close()
+		if gc.newShard != nil {
+			perr := gc.parity.ClosePack(gc.newShard, err != nil)
+			gc.newShard = nil
+			if err == nil {
+				err = perr
+			}
+		}
+		if err != nil {
+			return err
+		}
+		gc.paddingOverhead += gc.newPack.Padding()
+		err = cstore.WriteIndexObject(gc.c, gc.k.CipherKey, gc.newPackName, idx, gc.padding.PadTo())
 		if err != nil {
 			return err
 		}
 	}
 	gc.newPack = nil
+	gc.newPackName = ""
 	gc.newPackSize = 0
 	for _, toDelete := range gc.canDelete {
 		// log.Printf("deleting: %v", toDelete)
@@ -223,13 +338,88 @@ func (gc *gcState) closeCurrentWriterAndDeleteOldPacks() error {
 }
 
 func (gc *gcState) sweep() error {
-	packs, err := remote.ListPacks(gc.c)
+	listing, err := remote.ListPacks(gc.c)
 	if err != nil {
 		return err
 	}
+	packs, indexes := cstore.SplitListing(listing)
+	gc.indexes = indexes
+	groups := cstore.ReadParityGroups(gc.c, gc.k.CipherKey, listing, nil)
+	// Index objects whose pack no longer exists are removed.
+	live := make(map[string]struct{})
+	for _, pack := range packs {
+		live[pack.Name] = struct{}{}
+	}
+	for packName, obj := range indexes {
+		_, ok := live[packName]
+		if ok {
+			continue
+		}
+		gc.canDelete = append(gc.canDelete, path.Join("packs", obj.Name))
+	}
+	// Values of packs missing from the remote are moved from copies
+	// rebuilt from parity.
+	var missing []remote.PackListing
+	for _, obj := range groups {
+		for _, m := range obj.Group.Members {
+			_, ok := live[m.Name]
+			if ok {
+				continue
+			}
+			_, ok = gc.recovered[m.Name]
+			if ok {
+				continue
+			}
+			p, err := cstore.RecoverPackFile(gc.c, gc.k.CipherKey, obj.Listing, obj.Group, m.Name, listing, gc.tmpdir)
+			if err != nil {
+				log.Printf("unable to recover missing pack %s: %s", m.Name, err)
+				continue
+			}
+			log.Printf("recovered missing pack %s", m.Name)
+			gc.recovered[m.Name] = p
+			missing = append(missing, remote.PackListing{Name: m.Name, Size: uint64(m.Size)})
+		}
+	}
+	gc.holdGroups(packs, groups)
+	// Sweeping the packs of a group together lets them be deleted sooner.
+	sort.SliceStable(packs, func(i, j int) bool {
+		return gc.firstGroup(packs[i].Name) < gc.firstGroup(packs[j].Name)
+	})
+	var damagedPaths []string
 	for _, pack := range packs {
 		log.Printf("sweeping %s", pack.Name)
-		err = gc.sweepPack(pack)
+		damaged, err := gc.sweepPack(pack)
+		if err != nil || damaged {
+			// Group members are only deleted once the whole group is
+			// swept, so the pack can still be rebuilt here.
+			_, recovered := gc.recovered[pack.Name]
+			if !recovered && gc.recoverDamaged(pack, groups, listing) {
+				damaged, err = gc.sweepPack(pack)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		paths := []string{path.Join("packs", pack.Name)}
+		obj, ok := gc.indexes[pack.Name]
+		if ok {
+			paths = append(paths, path.Join("packs", obj.Name))
+		}
+		_, kept := gc.kept[pack.Name]
+		if kept {
+			paths = nil
+		}
+		if damaged {
+			// Damaged packs are only deleted once every reachable
+			// value is known to be stored elsewhere.
+			damagedPaths = append(damagedPaths, paths...)
+			paths = nil
+		}
+		gc.swept(pack.Name, paths)
+	}
+	for _, pack := range missing {
+		log.Printf("sweeping recovered %s", pack.Name)
+		_, err = gc.sweepPack(pack)
 		if err != nil {
 			return err
 		}
@@ -238,36 +428,214 @@ func (gc *gcState) sweep() error {
 	if err != nil {
 		return err
 	}
+	lost := 0
+	for hash := range gc.visited {
+		_, ok := gc.moved[hash]
+		if !ok {
+			lost++
+		}
+	}
+	if lost != 0 {
+		return fmt.Errorf("%d reachable values are damaged or missing and could not be recovered from parity, run bpy fsck and bpy repair", lost)
+	}
+	for _, toDelete := range damagedPaths {
+		err := remote.Remove(gc.c, toDelete, gc.epoch)
+		if err != nil {
+			return err
+		}
+	}
+	return gc.sweepParity(groups)
+}
+
+// holdGroups counts the packs of each parity group that are on the remote,
+// so deleting them can wait until the whole group has been swept.
+func (gc *gcState) holdGroups(packs []remote.PackListing, groups []cstore.ParityObject) {
+	gc.packGroups = make(map[string][]int)
+	gc.groupLeft = make([]int, len(groups))
+	gc.held = make(map[string][]string)
+	live := make(map[string]struct{}, len(packs))
+	for _, pack := range packs {
+		live[pack.Name] = struct{}{}
+	}
+	gc.groups = groups
+	for i, obj := range groups {
+		for _, m := range obj.Group.Members {
+			_, ok := live[m.Name]
+			if !ok {
+				continue
+			}
+			gc.packGroups[m.Name] = append(gc.packGroups[m.Name], i)
+			gc.groupLeft[i]++
+		}
+	}
+}
+
+func (gc *gcState) firstGroup(name string) int {
+	groups := gc.packGroups[name]
+	if len(groups) == 0 {
+		return -1
+	}
+	return groups[0]
+}
+
+// swept records that a pack has been swept, its paths are deleted once
+// every parity group it belongs to has been swept.
+func (gc *gcState) swept(name string, paths []string) {
+	gc.held[name] = paths
+	for _, i := range gc.packGroups[name] {
+		gc.groupLeft[i]--
+	}
+	gc.release(name)
+	for _, i := range gc.packGroups[name] {
+		if gc.groupLeft[i] != 0 {
+			continue
+		}
+		for _, m := range gc.groups[i].Group.Members {
+			gc.release(m.Name)
+		}
+	}
+}
+
+func (gc *gcState) release(name string) {
+	paths, ok := gc.held[name]
+	if !ok {
+		return
+	}
+	for _, i := range gc.packGroups[name] {
+		if gc.groupLeft[i] != 0 {
+			return
+		}
+	}
+	delete(gc.held, name)
+	gc.canDelete = append(gc.canDelete, paths...)
+}
+
+// recoverDamaged rebuilds a pack with damaged values from its parity group
+// so it can be swept again.
+func (gc *gcState) recoverDamaged(pack remote.PackListing, groups []cstore.ParityObject, listing []remote.PackListing) bool {
+	for _, obj := range groups {
+		i := obj.Group.Index(pack.Name)
+		if i == -1 || uint64(obj.Group.Members[i].Size) != pack.Size {
+			continue
+		}
+		p, err := cstore.RecoverPackFile(gc.c, gc.k.CipherKey, obj.Listing, obj.Group, pack.Name, listing, gc.tmpdir)
+		if err != nil {
+			log.Printf("unable to recover damaged pack %s: %s", pack.Name, err)
+			return false
+		}
+		log.Printf("recovered damaged pack %s", pack.Name)
+		gc.recovered[pack.Name] = p
+		return true
+	}
+	return false
+}
+
+// sweepParity removes the parity objects of groups that lost packs during
+// the sweep, the packs left in place are added to new groups.
+func (gc *gcState) sweepParity(groups []cstore.ParityObject) error {
+	var stale []string
+	for _, obj := range groups {
+		var survivors []parity.Member
+		for _, m := range obj.Group.Members {
+			_, ok := gc.kept[m.Name]
+			if ok {
+				survivors = append(survivors, m)
+			}
+		}
+		if len(survivors) == len(obj.Group.Members) {
+			continue
+		}
+		if gc.parity != nil {
+			for _, m := range survivors {
+				err := gc.addParity(m)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		stale = append(stale, path.Join("packs", obj.Listing.Name))
+	}
+	if gc.parity != nil {
+		err := gc.parity.Flush()
+		if err != nil {
+			return err
+		}
+	}
+	for _, toDelete := range stale {
+		err := remote.Remove(gc.c, toDelete, gc.epoch)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+func (gc *gcState) addParity(pack parity.Member) error {
+	f, err := gc.c.Open(path.Join("packs", pack.Name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	shard, err := gc.parity.AddPack(pack.Name)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyBuffer(shard, f, make([]byte, 1024*1024))
+	perr := gc.parity.ClosePack(shard, err != nil)
+	if err == nil {
+		err = perr
+	}
+	return err
+}
+
 type offsetSortedIdx []bpack.IndexEnt
 
 func (idx offsetSortedIdx) Len() int           { return len(idx) }
 func (idx offsetSortedIdx) Swap(i, j int)      { idx[i], idx[j] = idx[j], idx[i] }
 func (idx offsetSortedIdx) Less(i, j int) bool { return idx[i].Offset < idx[j].Offset }
 
-func (gc *gcState) sweepPack(pack remote.PackListing) error {
-	packPath := path.Join("packs/", pack.Name)
-	f, err := gc.c.Open(packPath)
+// sweepPack moves the reachable values of a pack into new packs, it
+// returns true if damaged values were dropped. Packs rebuilt from parity
+// are read from their local copies.
+func (gc *gcState) sweepPack(pack remote.PackListing) (bool, error) {
+	var f bpack.ReadSeekCloser
+	var err error
+	local, recovered := gc.recovered[pack.Name]
+	if recovered {
+		f, err = os.Open(local)
+	} else {
+		f, err = gc.c.Open(path.Join("packs", pack.Name))
+	}
 	if err != nil {
-		return err
+		return false, err
 	}
 	packReader, err := bpack.NewEncryptedReader(f, gc.k.CipherKey, int64(pack.Size))
 	if err != nil {
-		return err
+		f.Close()
+		return false, err
 	}
 	defer packReader.Close()
-	// XXX fetch from local cache if we have it.
-	err = packReader.ReadIndex()
+	var packIdx bpack.Index
+	if recovered {
+		err = packReader.ReadIndex()
+		packIdx = packReader.Idx
+	} else {
+		packIdx, err = cstore.ReadPackIndex(gc.c, gc.k.CipherKey, pack, gc.indexes)
+	}
 	if err != nil {
-		return err
+		return false, err
+	}
+	hdr, err := packReader.ReadHeader()
+	if err != nil {
+		return false, err
 	}
 
-	idx := offsetSortedIdx(packReader.Idx)
+	idx := offsetSortedIdx(packIdx)
 	sort.Sort(idx)
 
-	if pack.Size > 100*1024*1024 {
+	// Packs rebuilt from parity are missing or damaged on the remote, so
+	// they are never left in place.
+	if pack.Size > minKeptPackSize && !recovered {
 		canSkip := true
 		for _, idxEnt := range idx {
 			var hash [32]byte
@@ -293,10 +661,13 @@ func (gc *gcState) sweepPack(pack remote.PackListing) error {
 				copy(hash[:], idxEnt.Key)
 				gc.moved[hash] = struct{}{}
 			}
-			return nil
+			gc.kept[pack.Name] = struct{}{}
+			return false, nil
 		}
 	}
 
+	damaged := false
+
 	for i := 0; i < len(idx); i++ {
 		var hash [32]byte
 		copy(hash[:], idx[i].Key)
@@ -313,12 +684,13 @@ func (gc *gcState) sweepPack(pack remote.PackListing) error {
 		if gc.cache != nil {
 			val, ok, err := gc.cache.GetRaw(hash)
 			if err != nil {
-				return err
+				return false, err
 			}
 			if ok {
-				err = gc.putValue(hash, val)
+				// The cache holds flate compressed values.
+				err = gc.putValue(hash, codec.Wrap(codec.Flate, val))
 				if err != nil {
-					return err
+					return false, err
 				}
 				continue
 			}
@@ -348,26 +720,36 @@ func (gc *gcState) sweepPack(pack remote.PackListing) error {
 		// log.Printf("moving run of values: base=%v, size=%v", runBase, runSize)
 		runData, err := packReader.GetAt(runBase, runSize)
 		if err != nil {
-			return err
+			return false, err
 		}
 
 		for _, idxEnt := range run {
 			var hash [32]byte
 			copy(hash[:], idxEnt.Key)
-			val := runData[0:idxEnt.Size]
+			val, err := cstore.EncodedValue(hdr, runData[0:idxEnt.Size])
+			if err != nil {
+				return false, err
+			}
 			runData = runData[idxEnt.Size:]
+			// Damaged copies are dropped so an intact copy in a
+			// later pack is kept instead.
+			data, err := codec.Decode(val)
+			if err != nil || sha256.Sum256(data) != hash {
+				log.Printf("dropping damaged copy of %s in %s", hex.EncodeToString(hash[:]), pack.Name)
+				damaged = true
+				continue
+			}
 			err = gc.putValue(hash, val)
 			if err != nil {
-				return err
+				return false, err
 			}
 			if gc.cache != nil {
-				err = gc.cache.PutRaw(hash, val)
+				err = gc.cacheValue(hash, val)
 				if err != nil {
-					return err
+					return false, err
 				}
 			}
 		}
 	}
-	gc.canDelete = append(gc.canDelete, packPath)
-	return nil
+	return damaged, nil
 }
@@ -0,0 +1,326 @@
+package gc
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"github.com/buppyio/bpy"
+	"github.com/buppyio/bpy/bpack"
+	"github.com/buppyio/bpy/cstore"
+	"github.com/buppyio/bpy/fs"
+	"github.com/buppyio/bpy/htree"
+	"github.com/buppyio/bpy/refs"
+	"github.com/buppyio/bpy/remote"
+	"github.com/buppyio/bpy/remote/client"
+	"github.com/buppyio/bpy/testhelp"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testRepo struct {
+	t     *testing.T
+	r     *testhelp.MemRemote
+	c     *client.Client
+	k     bpy.Key
+	tmp   string
+	files map[string][]byte
+}
+
+func newTestRepo(t *testing.T) *testRepo {
+	tmp, err := ioutil.TempDir("", "bpygctest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := testhelp.NewMemRemote()
+	c, err := r.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := bpy.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testRepo{t: t, r: r, c: c, k: k, tmp: tmp, files: make(map[string][]byte)}
+}
+
+func (repo *testRepo) Close() {
+	repo.c.Close()
+	os.RemoveAll(repo.tmp)
+}
+
+func (repo *testRepo) newStore(cfg cstore.WriterConfig) *cstore.Writer {
+	cachepath, err := ioutil.TempDir(repo.tmp, "cache")
+	if err != nil {
+		repo.t.Fatal(err)
+	}
+	store, err := cstore.NewWriter(repo.c, repo.k.CipherKey, cachepath, cfg)
+	if err != nil {
+		repo.t.Fatal(err)
+	}
+	return store
+}
+
+// write stores n small files in the root, in packs of about a file each
+// grouped two by two with one parity shard.
+func (repo *testRepo) write(n int, p cstore.Parity) {
+	cfg := cstore.DefaultWriterConfig
+	cfg.PackSize = 2048
+	cfg.Parity = p
+	store := repo.newStore(cfg)
+	rd := rand.New(rand.NewSource(int64(n)))
+	var dir fs.DirEnts
+	for i := 0; i < n; i++ {
+		data := make([]byte, 3000)
+		rd.Read(data)
+		w := htree.NewWriter(store)
+		_, err := w.Write(data)
+		if err != nil {
+			repo.t.Fatal(err)
+		}
+		tree, err := w.Close()
+		if err != nil {
+			repo.t.Fatal(err)
+		}
+		name := fmt.Sprintf("f%d", i)
+		repo.files[name] = data
+		dir = append(dir, fs.DirEnt{EntName: name, EntSize: int64(len(data)), EntMode: 0644, HTree: tree})
+	}
+	repo.publish(store, dir)
+}
+
+// publish writes dir as the new root and closes store.
+func (repo *testRepo) publish(store *cstore.Writer, dir fs.DirEnts) {
+	root, err := fs.WriteDir(store, dir, 0755)
+	if err != nil {
+		repo.t.Fatal(err)
+	}
+	ref := refs.Ref{CreatedAt: time.Now().Unix(), Root: root.HTree.Data}
+	_, err = refs.PutRef(store, ref)
+	if err != nil {
+		repo.t.Fatal(err)
+	}
+	err = store.Close()
+	if err != nil {
+		repo.t.Fatal(err)
+	}
+	_, version, _, err := remote.GetRoot(repo.c, &repo.k, "")
+	if err != nil {
+		repo.t.Fatal(err)
+	}
+	epoch, err := remote.GetEpoch(repo.c)
+	if err != nil {
+		repo.t.Fatal(err)
+	}
+	ok, err := remote.CasRoot(repo.c, &repo.k, "", ref, bpy.NextRootVersion(version), epoch)
+	if err != nil || !ok {
+		repo.t.Fatal(ok, err)
+	}
+}
+
+// drop removes files from the root.
+func (repo *testRepo) drop(p cstore.Parity, names ...string) {
+	cfg := cstore.DefaultWriterConfig
+	cfg.Parity = p
+	store := repo.newStore(cfg)
+	hash, _, _, err := remote.GetRoot(repo.c, &repo.k, "")
+	if err != nil {
+		repo.t.Fatal(err)
+	}
+	ref, err := refs.GetRef(store, hash)
+	if err != nil {
+		repo.t.Fatal(err)
+	}
+	ents, err := fs.ReadDir(store, ref.Root)
+	if err != nil {
+		repo.t.Fatal(err)
+	}
+	for _, name := range names {
+		delete(repo.files, name)
+	}
+	var dir fs.DirEnts
+	for _, ent := range ents[1:] {
+		if _, ok := repo.files[ent.EntName]; ok {
+			dir = append(dir, ent)
+		}
+	}
+	repo.publish(store, dir)
+}
+
+func (repo *testRepo) gc(p cstore.Parity) error {
+	return GC(repo.c, repo.newStore(cstore.DefaultWriterConfig), nil, &repo.k, cstore.PadNone, p, "")
+}
+
+// check reads every file back from a new store.
+func (repo *testRepo) check() {
+	store := repo.newStore(cstore.DefaultWriterConfig)
+	defer store.Close()
+	hash, _, _, err := remote.GetRoot(repo.c, &repo.k, "")
+	if err != nil {
+		repo.t.Fatal(err)
+	}
+	ref, err := refs.GetRef(store, hash)
+	if err != nil {
+		repo.t.Fatal(err)
+	}
+	ents, err := fs.ReadDir(store, ref.Root)
+	if err != nil {
+		repo.t.Fatal(err)
+	}
+	if len(ents)-1 != len(repo.files) {
+		repo.t.Fatalf("%d files, expected %d", len(ents)-1, len(repo.files))
+	}
+	for _, ent := range ents[1:] {
+		rdr, err := htree.NewReader(store, ent.HTree.Data)
+		if err != nil {
+			repo.t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(rdr)
+		if err != nil {
+			repo.t.Fatalf("%s: %s", ent.EntName, err)
+		}
+		if !bytes.Equal(data, repo.files[ent.EntName]) {
+			repo.t.Fatalf("%s corrupted", ent.EntName)
+		}
+	}
+}
+
+// locate returns the pack holding the leaf of a file and its entry.
+func (repo *testRepo) locate(name string) (string, bpack.IndexEnt) {
+	hash := sha256.Sum256(append([]byte{0}, repo.files[name]...))
+	listing, err := remote.ListPacks(repo.c)
+	if err != nil {
+		repo.t.Fatal(err)
+	}
+	packs, indexes := cstore.SplitListing(listing)
+	for _, pack := range packs {
+		idx, err := cstore.ReadPackIndex(repo.c, repo.k.CipherKey, pack, indexes)
+		if err != nil {
+			repo.t.Fatal(err)
+		}
+		for _, ent := range idx {
+			if ent.Key == string(hash[:]) {
+				return pack.Name, ent
+			}
+		}
+	}
+	repo.t.Fatalf("%s not found", name)
+	return "", bpack.IndexEnt{}
+}
+
+// corrupt flips a byte of the leaf holding a file and returns its pack.
+func (repo *testRepo) corrupt(name string) string {
+	pack, ent := repo.locate(name)
+	p := path.Join("packs", pack)
+	data, _ := repo.r.ReadFile(p)
+	// The encrypted pack starts with a 16 byte IV.
+	data[16+ent.Offset+uint64(ent.Size)/2] ^= 0xff
+	repo.r.WriteFile(p, data)
+	return pack
+}
+
+// lateMember returns a file whose pack is swept after another pack of its
+// parity group when packs are swept in name order.
+func (repo *testRepo) lateMember() string {
+	listing, err := remote.ListPacks(repo.c)
+	if err != nil {
+		repo.t.Fatal(err)
+	}
+	groups := cstore.ReadParityGroups(repo.c, repo.k.CipherKey, listing, nil)
+	for name := range repo.files {
+		pack, _ := repo.locate(name)
+		for _, obj := range groups {
+			if obj.Group.Index(pack) == -1 {
+				continue
+			}
+			for _, m := range obj.Group.Members {
+				if m.Name < pack {
+					return name
+				}
+			}
+		}
+	}
+	repo.t.Fatal("no pack with an earlier group member")
+	return ""
+}
+
+func TestGCRecoversDamagedPack(t *testing.T) {
+	repo := newTestRepo(t)
+	defer repo.Close()
+	p := cstore.Parity{Data: 2, Parity: 1}
+	repo.write(8, p)
+	damaged := repo.corrupt(repo.lateMember())
+
+	// Every value gets a pack of its own, so swept packs are deleted
+	// while the rest are still being swept.
+	defer func(sz uint64) { maxPackSize = sz }(maxPackSize)
+	maxPackSize = 1
+	err := repo.gc(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := repo.r.ReadFile(path.Join("packs", damaged)); ok {
+		t.Fatal("damaged pack not deleted")
+	}
+	repo.check()
+}
+
+func TestGCFailsOnLostValues(t *testing.T) {
+	repo := newTestRepo(t)
+	defer repo.Close()
+	repo.write(4, cstore.Parity{})
+	damaged := repo.corrupt("f2")
+	err := repo.gc(cstore.Parity{})
+	if err == nil || !strings.Contains(err.Error(), "1 reachable values") {
+		t.Fatalf("expected lost values to fail the gc, got %v", err)
+	}
+	if _, ok := repo.r.ReadFile(path.Join("packs", damaged)); !ok {
+		t.Fatal("damaged pack deleted")
+	}
+}
+
+func TestGCRewritesStaleParity(t *testing.T) {
+	repo := newTestRepo(t)
+	defer repo.Close()
+	p := cstore.Parity{Data: 2, Parity: 1}
+	repo.write(8, p)
+	// Dropping every other file leaves groups with both live and dead
+	// packs.
+	repo.drop(p, "f0", "f2", "f4", "f6")
+
+	// Packs of the remaining files are kept and need new parity.
+	defer func(sz uint64) { minKeptPackSize = sz }(minKeptPackSize)
+	minKeptPackSize = 0
+	err := repo.gc(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listing, err := remote.ListPacks(repo.c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packs, _ := cstore.SplitListing(listing)
+	live := make(map[string]bool)
+	for _, pack := range packs {
+		live[pack.Name] = true
+	}
+	covered := make(map[string]bool)
+	for _, obj := range cstore.ReadParityGroups(repo.c, repo.k.CipherKey, listing, nil) {
+		for _, m := range obj.Group.Members {
+			if !live[m.Name] {
+				t.Fatalf("%s covers missing pack %s", obj.Listing.Name, m.Name)
+			}
+			covered[m.Name] = true
+		}
+	}
+	for name := range live {
+		if !covered[name] {
+			t.Fatalf("pack %s has no parity", name)
+		}
+	}
+	repo.check()
+}
@@ -0,0 +1,98 @@
+package htree
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"github.com/buppyio/bpy"
+)
+
+// Extent is a region of a stream holding data rather than a hole.
+type Extent struct {
+	Offset int64
+	Size   int64
+}
+
+// Every leaf but the last is full, so all holes written by Writer
+// except a trailing one share the same hash. Values are keyed by their
+// sha256, a store keyed differently only loses hole detection.
+var fullHoleHash = sha256.Sum256(holeLeaf(maxlen - 1))
+
+// DataExtents returns the data regions of a stream of the given size, adjacent
+// data leaves are merged. Only interior nodes and the final leaf are fetched.
+func DataExtents(store bpy.CStore, tree HTree, size int64) ([]Extent, error) {
+	x := &extentWalker{store: store, size: size}
+	var err error
+	if tree.Depth == 0 {
+		err = x.leaf(tree.Data, 0, size)
+	} else {
+		err = x.walk(tree.Data, 0, size)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return x.exts, nil
+}
+
+type extentWalker struct {
+	store bpy.CStore
+	size  int64
+	exts  []Extent
+}
+
+func (x *extentWalker) walk(hash [32]byte, off, end int64) error {
+	node, err := x.store.Get(hash)
+	if err != nil {
+		return err
+	}
+	if len(node) < 41 || node[0] == 0 || int(node[0]) >= nlevels || (len(node)-1)%40 != 0 {
+		return ErrCorruptNode
+	}
+	for i := 1; i < len(node); i += 40 {
+		var child [32]byte
+		childoff := int64(binary.LittleEndian.Uint64(node[i : i+8]))
+		copy(child[:], node[i+8:i+40])
+		childend := end
+		if i+40 < len(node) {
+			childend = int64(binary.LittleEndian.Uint64(node[i+40 : i+48]))
+		}
+		if childoff < off || childend < childoff || childend > end {
+			return ErrCorruptNode
+		}
+		if node[0] == 1 {
+			err = x.leaf(child, childoff, childend)
+		} else {
+			err = x.walk(child, childoff, childend)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (x *extentWalker) leaf(hash [32]byte, off, end int64) error {
+	if off == end {
+		return nil
+	}
+	hole := hash == fullHoleHash && end-off == maxlen-1
+	if !hole && end == x.size {
+		node, err := x.store.Get(hash)
+		if err != nil {
+			return err
+		}
+		_, hole, err = HoleSize(node)
+		if err != nil {
+			return err
+		}
+	}
+	if hole {
+		return nil
+	}
+	n := len(x.exts)
+	if n != 0 && x.exts[n-1].Offset+x.exts[n-1].Size == off {
+		x.exts[n-1].Size += end - off
+		return nil
+	}
+	x.exts = append(x.exts, Extent{Offset: off, Size: end - off})
+	return nil
+}
@@ -1,8 +1,16 @@
 package htree
 
+import (
+	"encoding/binary"
+)
+
 const nlevels = 10
 const maxlen = 65535
 
+// DefaultReadahead is the readahead budget in bytes used for sequential
+// reads of whole files.
+const DefaultReadahead = 8 * 1024 * 1024
+
 func min(a, b int) int {
 	if a > b {
 		return b
@@ -14,3 +22,50 @@ type HTree struct {
 	Depth int
 	Data  [32]byte
 }
+
+// A hole leaf stands for a run of zero bytes, it holds a marker
+// followed by the uvarint length of the run. Runs are never longer than
+// a data leaf, so offsets in interior nodes are unaffected by holes.
+const holeMarker = 0xff
+
+// zeroLeaf is shared by every expanded hole leaf and must never be written.
+var zeroLeaf [maxlen]byte
+
+func holeLeaf(n int) []byte {
+	return binary.AppendUvarint([]byte{holeMarker}, uint64(n))
+}
+
+// IsLeaf reports whether node is a data or hole leaf.
+func IsLeaf(node []byte) bool {
+	return len(node) != 0 && (node[0] == 0 || node[0] == holeMarker)
+}
+
+// HoleSize returns the number of zero bytes a hole leaf stands for.
+func HoleSize(node []byte) (int, bool, error) {
+	if len(node) == 0 || node[0] != holeMarker {
+		return 0, false, nil
+	}
+	n, sz := binary.Uvarint(node[1:])
+	if sz <= 0 || 1+sz != len(node) || n > maxlen-1 {
+		return 0, false, ErrCorruptNode
+	}
+	return int(n), true, nil
+}
+
+// expandLeaf returns hole leaves as data leaves of zeros.
+func expandLeaf(node []byte) ([]byte, error) {
+	n, ok, err := HoleSize(node)
+	if err != nil || !ok {
+		return node, err
+	}
+	return zeroLeaf[:n+1], nil
+}
+
+func isZero(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -2,10 +2,12 @@ package htree
 
 import (
 	"bytes"
+	"fmt"
 	"github.com/buppyio/bpy/testhelp"
 	"io"
 	"io/ioutil"
 	"math/rand"
+	"sync"
 	"testing"
 )
 
@@ -90,6 +92,230 @@ func TestHTree(t *testing.T) {
 	}
 }
 
+func TestReadahead(t *testing.T) {
+	store := testhelp.NewMemStore()
+	rand := rand.New(rand.NewSource(300))
+	expected := make([]byte, 3*1024*1024+rand.Int31()%(1024*1024))
+	_, err := io.ReadFull(rand, expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(store)
+	_, err = w.Write(expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, budget := range []int{0, 1, maxlen, 3 * maxlen, DefaultReadahead} {
+		r, err := NewReader(store, root.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.SetReadahead(budget)
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(expected, got) {
+			t.Fatalf("corrupt read with readahead budget %d", budget)
+		}
+		for i := 0; i < 20; i++ {
+			seekto := uint64(rand.Int31()) % uint64(len(expected))
+			_, err := r.Seek(seekto)
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 4*maxlen)
+			n, err := io.ReadFull(r, buf)
+			if err != nil && err != io.ErrUnexpectedEOF {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf[:n], expected[seekto:seekto+uint64(n)]) {
+				t.Fatalf("corrupt read after seek with readahead budget %d", budget)
+			}
+		}
+	}
+}
+
+func TestReaderAt(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		store := testhelp.NewMemStore()
+		rand := rand.New(rand.NewSource(int64(i + 200)))
+		expected := make([]byte, rand.Int31()%(5*1024*1024))
+		_, err := io.ReadFull(rand, expected)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := NewWriter(store)
+		_, err = w.Write(expected)
+		if err != nil {
+			t.Fatal(err)
+		}
+		root, err := w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := NewReaderAt(store, root.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.GetHeight() != root.Depth {
+			t.Fatal("incorrect depth")
+		}
+
+		n, err := r.ReadAt(make([]byte, 1), int64(len(expected)))
+		if n != 0 || err != io.EOF {
+			t.Fatal("expected eof reading at end")
+		}
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 8)
+		for j := 0; j < 8; j++ {
+			offsets := make([]int64, 50)
+			sizes := make([]int, 50)
+			for k := range offsets {
+				if len(expected) != 0 {
+					offsets[k] = int64(rand.Int31()) % int64(len(expected))
+				}
+				sizes[k] = int(rand.Int31() % (200 * 1024))
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for k := range offsets {
+					off := offsets[k]
+					buf := make([]byte, sizes[k])
+					n, err := r.ReadAt(buf, off)
+					want := expected[off:]
+					if len(want) > len(buf) {
+						want = want[:len(buf)]
+					}
+					if n != len(want) {
+						errs <- fmt.Errorf("short read at %d: %d != %d", off, n, len(want))
+						return
+					}
+					if n < len(buf) && err != io.EOF {
+						errs <- fmt.Errorf("expected eof, got %v", err)
+						return
+					}
+					if n == len(buf) && err != nil {
+						errs <- err
+						return
+					}
+					if !bytes.Equal(buf[:n], want) {
+						errs <- fmt.Errorf("corrupt read at %d", off)
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestHoles(t *testing.T) {
+	rand := rand.New(rand.NewSource(300))
+	for i := 0; i < 10; i++ {
+		store := testhelp.NewMemStore()
+		w := NewWriter(store)
+		var expected []byte
+		var exts []Extent
+		for j := 0; j < 6; j++ {
+			if j%2 == 0 {
+				hole := int64(rand.Int31() % (300 * 1024))
+				err := w.WriteHole(hole)
+				if err != nil {
+					t.Fatal(err)
+				}
+				expected = append(expected, make([]byte, hole)...)
+				continue
+			}
+			data := make([]byte, 1+rand.Int31()%(200*1024))
+			_, err := io.ReadFull(rand, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = w.Write(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			exts = append(exts, Extent{Offset: int64(len(expected)), Size: int64(len(data))})
+			expected = append(expected, data...)
+		}
+		root, err := w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := NewReader(store, root.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, expected) {
+			t.Fatal("data differs")
+		}
+		ra, err := NewReaderAt(store, root.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = make([]byte, len(expected))
+		_, err = ra.ReadAt(got, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, expected) {
+			t.Fatal("data differs reading at offset")
+		}
+		// Extents are leaf aligned, so each must cover the written data
+		// and only leaves holding some of it.
+		got2, err := DataExtents(store, root, int64(len(expected)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, ext := range exts {
+			covered := false
+			for _, e := range got2 {
+				if e.Offset <= ext.Offset && ext.Offset+ext.Size <= e.Offset+e.Size {
+					covered = true
+				}
+			}
+			if !covered {
+				t.Fatalf("extent %v not covered by %v", ext, got2)
+			}
+		}
+		for _, e := range got2 {
+			if e.Offset%(maxlen-1) != 0 || (e.Offset+e.Size)%(maxlen-1) != 0 && e.Offset+e.Size != int64(len(expected)) {
+				t.Fatalf("extent %v is not leaf aligned", e)
+			}
+			first := e.Offset + e.Size - 1
+			last := e.Offset
+			for _, ext := range exts {
+				if ext.Offset < e.Offset+e.Size && ext.Offset+ext.Size > e.Offset {
+					if ext.Offset < first {
+						first = ext.Offset
+					}
+					if ext.Offset+ext.Size > last {
+						last = ext.Offset + ext.Size
+					}
+				}
+			}
+			if first-e.Offset >= maxlen-1 || e.Offset+e.Size-last >= maxlen-1 {
+				t.Fatalf("extent %v covers whole holes", e)
+			}
+		}
+	}
+}
+
 func BenchmarkHTree(b *testing.B) {
 	var randbytes bytes.Buffer
 
@@ -7,14 +7,26 @@ import (
 	"io"
 )
 
+type prefetchResult struct {
+	buf []byte
+	err error
+}
+
+type prefetch struct {
+	hash [32]byte
+	done chan prefetchResult
+}
+
 type Reader struct {
-	root   [32]byte
 	store  bpy.CStore
 	height int
-	lvls   [nlevels][maxlen]byte
+	root   []byte
+	lvls   [nlevels][]byte
 	pos    [nlevels]int
-	length [nlevels]int
 	offset uint64
+
+	maxPrefetch int
+	prefetched  []*prefetch
 }
 
 func NewReader(store bpy.CStore, root [32]byte) (*Reader, error) {
@@ -22,18 +34,81 @@ func NewReader(store bpy.CStore, root [32]byte) (*Reader, error) {
 	if err != nil {
 		return nil, err
 	}
+	buf, err = expandLeaf(buf)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) == 0 || int(buf[0]) >= nlevels {
+		return nil, ErrCorruptNode
+	}
 	r := &Reader{
-		root:  root,
 		store: store,
+		root:  buf,
 	}
-	lvl := int(buf[0])
-	r.length[lvl] = len(buf)
-	r.pos[lvl] = 1
-	r.height = lvl
-	copy(r.lvls[lvl][:], buf)
+	r.resetToRoot()
 	return r, nil
 }
 
+func (r *Reader) resetToRoot() {
+	lvl := int(r.root[0])
+	r.height = lvl
+	r.lvls[lvl] = r.root
+	r.pos[lvl] = 1
+	r.offset = 0
+}
+
+// SetReadahead makes the reader fetch upcoming leaves of the current
+// interior node in the background while sequentially reading.
+// At most budget bytes of leaf data are fetched ahead of the reader,
+// a budget of zero disables readahead. The store must be safe for
+// concurrent use.
+func (r *Reader) SetReadahead(budget int) {
+	r.cancelPrefetch()
+	r.maxPrefetch = budget / maxlen
+	if budget > 0 && r.maxPrefetch == 0 {
+		r.maxPrefetch = 1
+	}
+}
+
+func (r *Reader) cancelPrefetch() {
+	// Prefetches write to a buffered channel, so any
+	// that are still running will exit on their own.
+	r.prefetched = nil
+}
+
+func (r *Reader) fillPrefetch() {
+	if r.height == 0 {
+		return
+	}
+	node := r.lvls[1]
+	pos := r.pos[1] + 40*len(r.prefetched)
+	for len(r.prefetched) < r.maxPrefetch && pos+40 <= len(node) {
+		p := &prefetch{
+			done: make(chan prefetchResult, 1),
+		}
+		copy(p.hash[:], node[pos+8:pos+40])
+		go func(p *prefetch) {
+			buf, err := r.store.Get(p.hash)
+			p.done <- prefetchResult{buf: buf, err: err}
+		}(p)
+		r.prefetched = append(r.prefetched, p)
+		pos += 40
+	}
+}
+
+func (r *Reader) getLeaf(hash [32]byte) ([]byte, error) {
+	if len(r.prefetched) != 0 {
+		p := r.prefetched[0]
+		if p.hash == hash {
+			r.prefetched = r.prefetched[1:]
+			result := <-p.done
+			return result.buf, result.err
+		}
+		r.cancelPrefetch()
+	}
+	return r.store.Get(hash)
+}
+
 func (r *Reader) GetHeight() int {
 	return r.height
 }
@@ -43,53 +118,51 @@ func (r *Reader) Seek(absoff uint64) (uint64, error) {
 		return r.offset, nil
 	}
 
-	buf, err := r.store.Get(r.root)
-	if err != nil {
-		return 0, err
-	}
-	lvl := int(buf[0])
-	r.length[lvl] = len(buf)
-	r.pos[lvl] = 1
-	r.height = lvl
-	copy(r.lvls[lvl][:], buf)
+	r.cancelPrefetch()
+	r.resetToRoot()
+	lvl := r.height
 	curoff := uint64(0)
 	for lvl != 0 {
 		for {
 			var enthash [32]byte
-			curoff = binary.LittleEndian.Uint64(r.lvls[lvl][r.pos[lvl]:])
-			copy(enthash[:], r.lvls[lvl][r.pos[lvl]+8:])
+			node := r.lvls[lvl]
+			curoff = binary.LittleEndian.Uint64(node[r.pos[lvl]:])
+			copy(enthash[:], node[r.pos[lvl]+8:])
 			r.pos[lvl] += 40
 			nextoff := absoff + 1
-			if r.pos[lvl] < r.length[lvl] {
-				nextoff = binary.LittleEndian.Uint64(r.lvls[lvl][r.pos[lvl]:])
+			if r.pos[lvl] < len(node) {
+				nextoff = binary.LittleEndian.Uint64(node[r.pos[lvl]:])
 			}
 			if absoff < nextoff {
 				buf, err := r.store.Get(enthash)
+				if err == nil && lvl == 1 {
+					buf, err = expandLeaf(buf)
+				}
 				if err != nil {
 					// XXX revert seek on error?
 					return 0, err
 				}
 				lvl -= 1
-				r.length[lvl] = len(buf)
+				r.lvls[lvl] = buf
 				r.pos[lvl] = 1
-				copy(r.lvls[lvl][:], buf)
 				break
 			}
 		}
 	}
 	skipamnt := int(absoff - curoff)
-	if skipamnt+r.pos[0] > r.length[0] {
-		absoff -= uint64((skipamnt + r.pos[0]) - r.length[0])
-		r.pos[0] = r.length[0]
+	if skipamnt+r.pos[0] > len(r.lvls[0]) {
+		absoff -= uint64((skipamnt + r.pos[0]) - len(r.lvls[0]))
+		r.pos[0] = len(r.lvls[0])
 	} else {
 		r.pos[0] += int(skipamnt)
 	}
+	r.offset = absoff
 	return absoff, nil
 
 }
 
 func (r *Reader) Read(buf []byte) (int, error) {
-	src := r.lvls[0][r.pos[0]:r.length[0]]
+	src := r.lvls[0][r.pos[0]:]
 	if len(src) == 0 {
 		eof, err := r.next(0)
 		if err != nil {
@@ -98,7 +171,7 @@ func (r *Reader) Read(buf []byte) (int, error) {
 		if eof {
 			return 0, io.EOF
 		}
-		src = r.lvls[0][r.pos[0]:r.length[0]]
+		src = r.lvls[0][r.pos[0]:]
 	}
 	n := copy(buf, src)
 	r.pos[0] += n
@@ -112,10 +185,10 @@ func (r *Reader) next(lvl int) (bool, error) {
 	if lvl > r.height {
 		return false, errors.New("corrupt hash tree: overflowed")
 	}
-	if r.pos[lvl+1] >= r.length[lvl+1] {
-		if lvl+1 > r.height {
-			return true, nil
-		}
+	if lvl+1 > r.height {
+		return true, nil
+	}
+	if r.pos[lvl+1] >= len(r.lvls[lvl+1]) {
 		eof, err := r.next(lvl + 1)
 		if err != nil {
 			return false, err
@@ -124,14 +197,25 @@ func (r *Reader) next(lvl int) (bool, error) {
 			return true, nil
 		}
 	}
-	copy(hash[:], r.lvls[lvl+1][r.pos[lvl+1]+8:maxlen])
-	buf, err := r.store.Get(hash)
+	copy(hash[:], r.lvls[lvl+1][r.pos[lvl+1]+8:])
+	var buf []byte
+	var err error
+	if lvl == 0 && r.maxPrefetch != 0 {
+		buf, err = r.getLeaf(hash)
+	} else {
+		buf, err = r.store.Get(hash)
+	}
+	if err == nil && lvl == 0 {
+		buf, err = expandLeaf(buf)
+	}
 	if err != nil {
 		return false, err
 	}
-	copy(r.lvls[lvl][0:len(buf)], buf)
+	r.lvls[lvl] = buf
 	r.pos[lvl+1] += 40
-	r.length[lvl] = len(buf)
 	r.pos[lvl] = 1
+	if lvl == 0 && r.maxPrefetch != 0 {
+		r.fillPrefetch()
+	}
 	return false, nil
 }
@@ -0,0 +1,173 @@
+package htree
+
+import (
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"github.com/buppyio/bpy"
+	"io"
+	"sort"
+	"sync"
+)
+
+const (
+	maxCachedInteriorNodes = 8
+	maxCachedLeafNodes     = 2
+)
+
+var ErrCorruptNode = errors.New("corrupt hash tree node")
+
+type cachedNode struct {
+	hash [32]byte
+	data []byte
+}
+
+// nodeCache is a small lru of hash tree nodes, it is not safe for concurrent use.
+type nodeCache struct {
+	max   int
+	lru   *list.List
+	nodes map[[32]byte]*list.Element
+}
+
+func newNodeCache(max int) *nodeCache {
+	return &nodeCache{
+		max:   max,
+		lru:   list.New(),
+		nodes: make(map[[32]byte]*list.Element),
+	}
+}
+
+func (c *nodeCache) get(hash [32]byte) ([]byte, bool) {
+	e, ok := c.nodes[hash]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(cachedNode).data, true
+}
+
+func (c *nodeCache) put(hash [32]byte, data []byte) {
+	_, ok := c.nodes[hash]
+	if ok {
+		return
+	}
+	c.nodes[hash] = c.lru.PushFront(cachedNode{hash: hash, data: data})
+	if c.lru.Len() > c.max {
+		ent := c.lru.Remove(c.lru.Back()).(cachedNode)
+		delete(c.nodes, ent.hash)
+	}
+}
+
+// ReaderAt provides random access to the stream stored in a hash tree.
+// Unlike Reader it keeps no read position, so ReadAt is safe for concurrent
+// use as long as the underlying store is. Interior nodes and the most recently
+// used leaves are cached so repeated reads avoid refetching them.
+type ReaderAt struct {
+	store bpy.CStore
+	root  []byte
+
+	lock     sync.Mutex
+	interior *nodeCache
+	leaves   *nodeCache
+}
+
+func NewReaderAt(store bpy.CStore, root [32]byte) (*ReaderAt, error) {
+	buf, err := store.Get(root)
+	if err != nil {
+		return nil, err
+	}
+	buf, err = expandLeaf(buf)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) == 0 || (buf[0] != 0 && (len(buf)-1)%40 != 0) {
+		return nil, ErrCorruptNode
+	}
+	return &ReaderAt{
+		store:    store,
+		root:     buf,
+		interior: newNodeCache(maxCachedInteriorNodes),
+		leaves:   newNodeCache(maxCachedLeafNodes),
+	}, nil
+}
+
+func (r *ReaderAt) GetHeight() int {
+	return int(r.root[0])
+}
+
+func (r *ReaderAt) getNode(hash [32]byte, cache *nodeCache) ([]byte, error) {
+	r.lock.Lock()
+	buf, ok := cache.get(hash)
+	r.lock.Unlock()
+	if ok {
+		return buf, nil
+	}
+	buf, err := r.store.Get(hash)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) == 0 {
+		return nil, ErrCorruptNode
+	}
+	r.lock.Lock()
+	cache.put(hash, buf)
+	r.lock.Unlock()
+	return buf, nil
+}
+
+// findLeaf returns the leaf containing absoff along with the stream offset
+// of the first byte in that leaf. Offsets past the end of the stream
+// resolve to the final leaf.
+func (r *ReaderAt) findLeaf(absoff uint64) ([]byte, uint64, error) {
+	node := r.root
+	curoff := uint64(0)
+	for node[0] != 0 {
+		if (len(node)-1)%40 != 0 || len(node) == 1 {
+			return nil, 0, ErrCorruptNode
+		}
+		nents := (len(node) - 1) / 40
+		i := sort.Search(nents, func(i int) bool {
+			return binary.LittleEndian.Uint64(node[1+i*40:]) > absoff
+		})
+		if i != 0 {
+			i -= 1
+		}
+		var hash [32]byte
+		ent := node[1+i*40 : 1+(i+1)*40]
+		curoff = binary.LittleEndian.Uint64(ent[0:8])
+		copy(hash[:], ent[8:40])
+		var err error
+		if node[0] == 1 {
+			node, err = r.getNode(hash, r.leaves)
+			if err == nil {
+				node, err = expandLeaf(node)
+			}
+		} else {
+			node, err = r.getNode(hash, r.interior)
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	return node, curoff, nil
+}
+
+func (r *ReaderAt) ReadAt(buf []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	n := 0
+	for n < len(buf) {
+		absoff := uint64(off) + uint64(n)
+		leaf, leafoff, err := r.findLeaf(absoff)
+		if err != nil {
+			return n, err
+		}
+		data := leaf[1:]
+		if absoff-leafoff >= uint64(len(data)) {
+			return n, io.EOF
+		}
+		n += copy(buf[n:], data[absoff-leafoff:])
+	}
+	return n, nil
+}
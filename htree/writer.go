@@ -10,6 +10,8 @@ type Writer struct {
 	lvls   [nlevels][maxlen]byte
 	nbytes [nlevels]int
 	offset uint64
+	// zeroLeaf is set when the full leaf at level 0 was filled by WriteHole.
+	zeroLeaf bool
 }
 
 func NewWriter(store bpy.CStore) *Writer {
@@ -40,8 +42,48 @@ func (w *Writer) Write(buf []byte) (int, error) {
 	return nbytes, nil
 }
 
+// WriteHole appends n zero bytes, leaves that are entirely zero are
+// stored as hole leaves without being examined.
+func (w *Writer) WriteHole(n int64) error {
+	for n > 0 {
+		if w.nbytes[0] == maxlen {
+			err := w.flushLvl(0)
+			if err != nil {
+				return err
+			}
+			w.lvls[0][0] = 0
+			w.nbytes[0] = 1
+		}
+		if w.nbytes[0] == 1 && n >= maxlen-1 {
+			w.nbytes[0] = maxlen
+			w.zeroLeaf = true
+			n -= maxlen - 1
+			continue
+		}
+		k := min(int(min64(n, maxlen)), maxlen-w.nbytes[0])
+		copy(w.lvls[0][w.nbytes[0]:w.nbytes[0]+k], zeroLeaf[:])
+		w.nbytes[0] += k
+		n -= int64(k)
+	}
+	return nil
+}
+
+func min64(a, b int64) int64 {
+	if a > b {
+		return b
+	}
+	return a
+}
+
 func (w *Writer) flushLvl(lvl int) error {
-	hash, err := w.store.Put(w.lvls[lvl][0:w.nbytes[lvl]])
+	node := w.lvls[lvl][0:w.nbytes[lvl]]
+	if lvl == 0 {
+		if len(node) > 1 && (w.zeroLeaf || isZero(node[1:])) {
+			node = holeLeaf(len(node) - 1)
+		}
+		w.zeroLeaf = false
+	}
+	hash, err := w.store.Put(node)
 	if err != nil {
 		return err
 	}
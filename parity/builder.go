@@ -0,0 +1,213 @@
+package parity
+
+import (
+	"crypto/sha256"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// Builder accumulates the parity shards of a group in temporary files while
+// the data shards are written, so no shard is held in memory.
+type Builder struct {
+	lock    sync.Mutex
+	code    *Code
+	dir     string
+	files   []*os.File
+	members []Member
+	size    int64
+	scratch [][]byte
+	err     error
+}
+
+func NewBuilder(code *Code, dir string) *Builder {
+	return &Builder{code: code, dir: dir}
+}
+
+// Len returns the number of data shards added to the group.
+func (b *Builder) Len() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return len(b.members)
+}
+
+func (b *Builder) Full() bool {
+	return b.Len() == b.code.K
+}
+
+// AddShard adds a data shard to the group, its contents are written to the
+// returned writer.
+func (b *Builder) AddShard(name string) (*ShardWriter, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if len(b.members) == b.code.K {
+		return nil, errors.New("parity group is full")
+	}
+	if b.files == nil {
+		for j := 0; j < b.code.M; j++ {
+			f, err := ioutil.TempFile(b.dir, "parity")
+			if err != nil {
+				b.closeFiles()
+				return nil, err
+			}
+			b.files = append(b.files, f)
+		}
+	}
+	b.members = append(b.members, Member{Name: name})
+	return &ShardWriter{b: b, idx: len(b.members) - 1, hash: sha256.New()}, nil
+}
+
+func (b *Builder) add(idx int, off int64, data []byte) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.err != nil {
+		return b.err
+	}
+	if b.scratch == nil {
+		b.scratch = make([][]byte, b.code.M)
+		for j := range b.scratch {
+			b.scratch[j] = make([]byte, blockSize)
+		}
+	}
+	for len(data) != 0 {
+		n := len(data)
+		if n > blockSize {
+			n = blockSize
+		}
+		blocks := make([][]byte, b.code.M)
+		for j, f := range b.files {
+			blocks[j] = b.scratch[j][:n]
+			end := min64(b.size-off, int64(n))
+			if end < 0 {
+				end = 0
+			}
+			for k := end; k < int64(n); k++ {
+				blocks[j][k] = 0
+			}
+			if end > 0 {
+				_, err := f.ReadAt(blocks[j][:end], off)
+				if err != nil {
+					b.err = err
+					return err
+				}
+			}
+		}
+		b.code.AddBlock(blocks, idx, data[:n])
+		for j, f := range b.files {
+			_, err := f.WriteAt(blocks[j], off)
+			if err != nil {
+				b.err = err
+				return err
+			}
+		}
+		off += int64(n)
+		if off > b.size {
+			b.size = off
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// WriteTo writes the parity object of the group to w once every shard
+// writer has been closed.
+func (b *Builder) WriteTo(w io.Writer) (int64, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.err != nil {
+		return 0, b.err
+	}
+	g := &Group{
+		Code:       b.code,
+		Members:    b.members,
+		ParitySums: make([][32]byte, b.code.M),
+		ShardSize:  b.size,
+	}
+	for j, f := range b.files {
+		err := f.Truncate(b.size)
+		if err != nil {
+			return 0, err
+		}
+		_, err = f.Seek(0, io.SeekStart)
+		if err != nil {
+			return 0, err
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, f)
+		if err != nil {
+			return 0, err
+		}
+		copy(g.ParitySums[j][:], h.Sum(nil))
+	}
+	hdr := g.marshalHeader()
+	nwritten, err := w.Write(hdr)
+	total := int64(nwritten)
+	if err != nil {
+		return total, err
+	}
+	for _, f := range b.files {
+		_, err := f.Seek(0, io.SeekStart)
+		if err != nil {
+			return total, err
+		}
+		n, err := io.Copy(w, f)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// Close removes the temporary files of the builder.
+func (b *Builder) Close() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.closeFiles()
+}
+
+func (b *Builder) closeFiles() error {
+	var err error
+	for _, f := range b.files {
+		cerr := f.Close()
+		if cerr != nil && err == nil {
+			err = cerr
+		}
+		rerr := os.Remove(f.Name())
+		if rerr != nil && err == nil {
+			err = rerr
+		}
+	}
+	b.files = nil
+	return err
+}
+
+type ShardWriter struct {
+	b    *Builder
+	idx  int
+	off  int64
+	hash hash.Hash
+}
+
+func (s *ShardWriter) Write(buf []byte) (int, error) {
+	err := s.b.add(s.idx, s.off, buf)
+	if err != nil {
+		return 0, err
+	}
+	s.hash.Write(buf)
+	s.off += int64(len(buf))
+	return len(buf), nil
+}
+
+// Close records the size and checksum of the shard.
+func (s *ShardWriter) Close() error {
+	s.b.lock.Lock()
+	defer s.b.lock.Unlock()
+	m := &s.b.members[s.idx]
+	m.Size = s.off
+	copy(m.Sum[:], s.hash.Sum(nil))
+	return nil
+}
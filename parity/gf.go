@@ -0,0 +1,88 @@
+package parity
+
+// Arithmetic in GF(2^8) with the polynomial x^8 + x^4 + x^3 + x^2 + 1.
+const gfPoly = 0x11d
+
+var (
+	gfExp [510]byte
+	gfLog [256]byte
+	// gfMul[a][b] is the product of a and b.
+	gfMul [256][256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfExp[i+255] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= gfPoly
+		}
+	}
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			gfMul[a][b] = gfExp[int(gfLog[a])+int(gfLog[b])]
+		}
+	}
+}
+
+func gfInv(a byte) byte {
+	if a == 0 {
+		panic("inverse of zero")
+	}
+	return gfExp[255-int(gfLog[a])]
+}
+
+// mulAdd sets dst[i] ^= c*src[i].
+func mulAdd(dst, src []byte, c byte) {
+	if c == 0 {
+		return
+	}
+	row := &gfMul[c]
+	dst = dst[:len(src)]
+	for i, v := range src {
+		dst[i] ^= row[v]
+	}
+}
+
+// invertMatrix inverts a square matrix in place with Gauss-Jordan
+// elimination, returning false if it is singular.
+func invertMatrix(a [][]byte) bool {
+	n := len(a)
+	inv := make([][]byte, n)
+	for i := range inv {
+		inv[i] = make([]byte, n)
+		inv[i][i] = 1
+	}
+	for col := 0; col < n; col++ {
+		pivot := -1
+		for row := col; row < n; row++ {
+			if a[row][col] != 0 {
+				pivot = row
+				break
+			}
+		}
+		if pivot == -1 {
+			return false
+		}
+		a[col], a[pivot] = a[pivot], a[col]
+		inv[col], inv[pivot] = inv[pivot], inv[col]
+		scale := gfInv(a[col][col])
+		for i := 0; i < n; i++ {
+			a[col][i] = gfMul[scale][a[col][i]]
+			inv[col][i] = gfMul[scale][inv[col][i]]
+		}
+		for row := 0; row < n; row++ {
+			c := a[row][col]
+			if row == col || c == 0 {
+				continue
+			}
+			mulAdd(a[row], a[col], c)
+			mulAdd(inv[row], inv[col], c)
+		}
+	}
+	copy(a, inv)
+	return true
+}
@@ -0,0 +1,265 @@
+package parity
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+)
+
+const (
+	magic     = "BPYPAR01"
+	blockSize = 1024 * 1024
+)
+
+var ErrInvalidGroup = errors.New("invalid parity group")
+
+type Member struct {
+	Name string
+	Size int64
+	Sum  [32]byte
+}
+
+// Group describes the data shards protected by a parity object and where
+// its parity shards are stored. The object is a header followed by M parity
+// shards of ShardSize bytes each:
+//
+//	magic[8] k[2] m[2] n[2] shardsize[8]
+//	n * (namelen[2] name size[8] sha256[32])
+//	m * sha256[32]
+type Group struct {
+	Code       *Code
+	Members    []Member
+	ParitySums [][32]byte
+	ShardSize  int64
+	HeaderSize int64
+}
+
+func (g *Group) Index(name string) int {
+	for i, m := range g.Members {
+		if m.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// ShardOffset returns the offset of parity shard j in the parity object.
+func (g *Group) ShardOffset(j int) int64 {
+	return g.HeaderSize + int64(j)*g.ShardSize
+}
+
+func (g *Group) marshalHeader() []byte {
+	var buf bytes.Buffer
+	var b [8]byte
+	buf.WriteString(magic)
+	binary.LittleEndian.PutUint16(b[:], uint16(g.Code.K))
+	buf.Write(b[:2])
+	binary.LittleEndian.PutUint16(b[:], uint16(g.Code.M))
+	buf.Write(b[:2])
+	binary.LittleEndian.PutUint16(b[:], uint16(len(g.Members)))
+	buf.Write(b[:2])
+	binary.LittleEndian.PutUint64(b[:], uint64(g.ShardSize))
+	buf.Write(b[:8])
+	for _, m := range g.Members {
+		binary.LittleEndian.PutUint16(b[:], uint16(len(m.Name)))
+		buf.Write(b[:2])
+		buf.WriteString(m.Name)
+		binary.LittleEndian.PutUint64(b[:], uint64(m.Size))
+		buf.Write(b[:8])
+		buf.Write(m.Sum[:])
+	}
+	for _, sum := range g.ParitySums {
+		buf.Write(sum[:])
+	}
+	return buf.Bytes()
+}
+
+// ReadGroup reads the header of a parity object.
+func ReadGroup(r io.Reader) (*Group, error) {
+	var hdr [22]byte
+	_, err := io.ReadFull(r, hdr[:])
+	if err != nil {
+		return nil, err
+	}
+	if string(hdr[:8]) != magic {
+		return nil, ErrInvalidGroup
+	}
+	code, err := NewCode(int(binary.LittleEndian.Uint16(hdr[8:10])), int(binary.LittleEndian.Uint16(hdr[10:12])))
+	if err != nil {
+		return nil, ErrInvalidGroup
+	}
+	n := int(binary.LittleEndian.Uint16(hdr[12:14]))
+	if n < 1 || n > code.K {
+		return nil, ErrInvalidGroup
+	}
+	g := &Group{
+		Code:       code,
+		ShardSize:  int64(binary.LittleEndian.Uint64(hdr[14:22])),
+		HeaderSize: int64(len(hdr)),
+	}
+	var b [8]byte
+	for i := 0; i < n; i++ {
+		_, err = io.ReadFull(r, b[:2])
+		if err != nil {
+			return nil, err
+		}
+		name := make([]byte, binary.LittleEndian.Uint16(b[:2]))
+		_, err = io.ReadFull(r, name)
+		if err != nil {
+			return nil, err
+		}
+		m := Member{Name: string(name)}
+		_, err = io.ReadFull(r, b[:8])
+		if err != nil {
+			return nil, err
+		}
+		m.Size = int64(binary.LittleEndian.Uint64(b[:8]))
+		if m.Size < 0 || m.Size > g.ShardSize {
+			return nil, ErrInvalidGroup
+		}
+		_, err = io.ReadFull(r, m.Sum[:])
+		if err != nil {
+			return nil, err
+		}
+		g.Members = append(g.Members, m)
+		g.HeaderSize += int64(2 + len(name) + 8 + 32)
+	}
+	g.ParitySums = make([][32]byte, code.M)
+	for j := range g.ParitySums {
+		_, err = io.ReadFull(r, g.ParitySums[j][:])
+		if err != nil {
+			return nil, err
+		}
+		g.HeaderSize += 32
+	}
+	return g, nil
+}
+
+// Rebuild writes the data shard target to out. shards holds a reader for
+// each data shard followed by each parity shard, nil if it is not
+// available. Shards that fail their checksum are skipped, and the rebuilt
+// shard is verified against its checksum before Rebuild returns.
+func (g *Group) Rebuild(target int, shards []io.ReaderAt, out io.WriterAt) error {
+	n := len(g.Members)
+	if len(shards) != n+g.Code.M {
+		return ErrInvalidGroup
+	}
+	bad := make(map[int]bool)
+	for {
+		var present []int
+		for i := range shards {
+			if i == target || shards[i] == nil || bad[i] {
+				continue
+			}
+			present = append(present, i)
+			if len(present) == n {
+				break
+			}
+		}
+		if len(present) != n {
+			return ErrTooFewShards
+		}
+		corrupt, err := g.rebuildFrom(target, present, shards, out)
+		if err != nil {
+			return err
+		}
+		if len(corrupt) == 0 {
+			return nil
+		}
+		for _, i := range corrupt {
+			bad[i] = true
+		}
+	}
+}
+
+func (g *Group) shardSize(i int) int64 {
+	if i < len(g.Members) {
+		return g.Members[i].Size
+	}
+	return g.ShardSize
+}
+
+func (g *Group) shardSum(i int) [32]byte {
+	if i < len(g.Members) {
+		return g.Members[i].Sum
+	}
+	return g.ParitySums[i-len(g.Members)]
+}
+
+// rebuildFrom rebuilds target from the present shards, returning the
+// shards that turned out to be corrupt.
+func (g *Group) rebuildFrom(target int, present []int, shards []io.ReaderAt, out io.WriterAt) ([]int, error) {
+	dec, err := g.Code.NewDecoder(len(g.Members), present)
+	if err != nil {
+		return nil, err
+	}
+	blocks := make([][]byte, len(present))
+	hashes := make([]hash.Hash, len(present))
+	for r := range present {
+		blocks[r] = make([]byte, blockSize)
+		hashes[r] = sha256.New()
+	}
+	result := make([]byte, blockSize)
+	targetHash := sha256.New()
+	targetSize := g.Members[target].Size
+	for off := int64(0); off < targetSize; off += blockSize {
+		sz := min64(blockSize, targetSize-off)
+		for r, i := range present {
+			block := blocks[r][:sz]
+			for k := range block {
+				block[k] = 0
+			}
+			end := min64(off+sz, g.shardSize(i))
+			if end > off {
+				_, err := shards[i].ReadAt(block[:end-off], off)
+				if err != nil && err != io.EOF {
+					return nil, err
+				}
+				hashes[r].Write(block[:end-off])
+			}
+		}
+		dec.DecodeBlock(target, blocks, result[:sz])
+		targetHash.Write(result[:sz])
+		_, err = out.WriteAt(result[:sz], off)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// The remainder of the present shards must be hashed to verify them.
+	for r, i := range present {
+		for off := targetSize; off < g.shardSize(i); off += blockSize {
+			block := blocks[r][:min64(blockSize, g.shardSize(i)-off)]
+			_, err := shards[i].ReadAt(block, off)
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
+			hashes[r].Write(block)
+		}
+	}
+	var corrupt []int
+	for r, i := range present {
+		var sum [32]byte
+		copy(sum[:], hashes[r].Sum(nil))
+		if sum != g.shardSum(i) {
+			corrupt = append(corrupt, i)
+		}
+	}
+	if len(corrupt) == 0 {
+		var sum [32]byte
+		copy(sum[:], targetHash.Sum(nil))
+		if sum != g.Members[target].Sum {
+			return nil, ErrInvalidGroup
+		}
+	}
+	return corrupt, nil
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
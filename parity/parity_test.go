@@ -0,0 +1,133 @@
+package parity
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+type memFile struct {
+	buf []byte
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	if int(off)+len(p) > len(f.buf) {
+		f.buf = append(f.buf, make([]byte, int(off)+len(p)-len(f.buf))...)
+	}
+	copy(f.buf[off:], p)
+	return len(p), nil
+}
+
+func TestGF(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		if gfMul[a][gfInv(byte(a))] != 1 {
+			t.Fatalf("bad inverse of %d", a)
+		}
+	}
+}
+
+func buildGroup(t *testing.T, code *Code, shards [][]byte) (*Group, []byte) {
+	tmp, err := ioutil.TempDir("", "bpyparitytest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	b := NewBuilder(code, tmp)
+	for i, data := range shards {
+		w, err := b.AddShard(string('a' + rune(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Write in uneven pieces to exercise partial blocks.
+		for len(data) != 0 {
+			n := rand.Intn(len(data)) + 1
+			_, err = w.Write(data[:n])
+			if err != nil {
+				t.Fatal(err)
+			}
+			data = data[n:]
+		}
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var obj bytes.Buffer
+	_, err = b.WriteTo(&obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := ReadGroup(bytes.NewReader(obj.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g, obj.Bytes()
+}
+
+func TestRebuild(t *testing.T) {
+	rd := rand.New(rand.NewSource(1))
+	code, err := NewCode(4, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int{1, 3, 4} {
+		shards := make([][]byte, n)
+		for i := range shards {
+			shards[i] = make([]byte, rd.Intn(3*blockSize))
+			rd.Read(shards[i])
+		}
+		g, obj := buildGroup(t, code, shards)
+		if len(g.Members) != n {
+			t.Fatal("bad member count")
+		}
+		for i, data := range shards {
+			if g.Members[i].Size != int64(len(data)) || g.Members[i].Sum != sha256.Sum256(data) {
+				t.Fatal("bad member")
+			}
+		}
+		parity := func(j int) io.ReaderAt {
+			return io.NewSectionReader(bytes.NewReader(obj), g.ShardOffset(j), g.ShardSize)
+		}
+
+		for target := 0; target < n; target++ {
+			// Lose the target and, where possible, one other data shard
+			// while corrupting a parity shard.
+			readers := make([]io.ReaderAt, n+code.M)
+			for i := range shards {
+				if i != target && i != (target+1)%n {
+					readers[i] = bytes.NewReader(shards[i])
+				}
+			}
+			for j := 0; j < code.M; j++ {
+				readers[n+j] = parity(j)
+			}
+			if n > 1 {
+				corrupt := append([]byte{}, obj[g.ShardOffset(0):g.ShardOffset(1)]...)
+				corrupt[len(corrupt)/2] ^= 1
+				readers[n] = bytes.NewReader(corrupt)
+				// Two shards lost and a corrupt parity shard is too many.
+				err = g.Rebuild(target, readers, &memFile{})
+				if err != ErrTooFewShards {
+					t.Fatalf("expected too few shards, got %v", err)
+				}
+				readers[(target+1)%n] = bytes.NewReader(shards[(target+1)%n])
+			}
+			out := &memFile{}
+			err = g.Rebuild(target, readers, out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out.buf, shards[target]) {
+				t.Fatalf("shard %d of %d rebuilt incorrectly", target, n)
+			}
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package parity
+
+import (
+	"errors"
+)
+
+var (
+	ErrTooFewShards = errors.New("too few intact shards to reconstruct")
+	ErrBadCode      = errors.New("invalid parity code parameters")
+)
+
+// Code is a systematic Reed-Solomon code over GF(2^8) with up to K data
+// shards and M parity shards. Parity shard j is the sum of every data shard
+// i multiplied by the Cauchy matrix entry 1/((K+j) ^ i), so any K of the
+// shards recover the rest. Groups may have fewer than K data shards, the
+// missing shards are treated as zero.
+type Code struct {
+	K int
+	M int
+}
+
+func NewCode(k, m int) (*Code, error) {
+	if k < 1 || m < 1 || k+m > 256 {
+		return nil, ErrBadCode
+	}
+	return &Code{K: k, M: m}, nil
+}
+
+func (c *Code) coef(j, i int) byte {
+	return gfInv(byte(c.K+j) ^ byte(i))
+}
+
+// AddBlock adds the block of data shard i to the blocks of each parity
+// shard at the same offset.
+func (c *Code) AddBlock(parity [][]byte, i int, data []byte) {
+	for j := range parity {
+		mulAdd(parity[j], data, c.coef(j, i))
+	}
+}
+
+// Decoder rebuilds shards of a group of n data shards from n other shards.
+type Decoder struct {
+	n       int
+	present []int
+	inv     [][]byte
+}
+
+// NewDecoder returns a decoder using the shards listed in present, where
+// shards 0 to n-1 are data shards and n+j is parity shard j.
+func (c *Code) NewDecoder(n int, present []int) (*Decoder, error) {
+	if n > c.K || len(present) != n {
+		return nil, ErrTooFewShards
+	}
+	a := make([][]byte, n)
+	for r, shard := range present {
+		a[r] = make([]byte, n)
+		switch {
+		case shard < n:
+			a[r][shard] = 1
+		case shard-n < c.M:
+			for i := 0; i < n; i++ {
+				a[r][i] = c.coef(shard-n, i)
+			}
+		default:
+			return nil, ErrBadCode
+		}
+	}
+	if !invertMatrix(a) {
+		return nil, ErrTooFewShards
+	}
+	return &Decoder{n: n, present: present, inv: a}, nil
+}
+
+// DecodeBlock computes the block of data shard target from the blocks of
+// the present shards, in the order they were given to NewDecoder.
+func (d *Decoder) DecodeBlock(target int, blocks [][]byte, out []byte) {
+	for i := range out {
+		out[i] = 0
+	}
+	for r, block := range blocks {
+		mulAdd(out, block, d.inv[target][r])
+	}
+}
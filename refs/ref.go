@@ -23,11 +23,28 @@ type Ref struct {
 func GetRef(store bpy.CStore, hash [32]byte) (Ref, error) {
 	rdr, err := htree.NewReader(store, hash)
 	if err != nil {
-		return Ref{}, nil
+		return Ref{}, err
 	}
 	data, err := ioutil.ReadAll(rdr)
 	if err != nil {
-		return Ref{}, nil
+		return Ref{}, err
+	}
+	return unmarshal(data)
+}
+
+func marshal(ref Ref) []byte {
+	data := make([]byte, 8, 72)
+	binary.LittleEndian.PutUint64(data, uint64(ref.CreatedAt))
+	data = append(data, ref.Root[:]...)
+	if ref.HasPrev {
+		data = append(data, ref.Prev[:]...)
+	}
+	return data
+}
+
+func unmarshal(data []byte) (Ref, error) {
+	if len(data) < 8 {
+		return Ref{}, ErrInvalidRef
 	}
 
 	createdAt := int64(binary.LittleEndian.Uint64(data[0:8]))
@@ -51,31 +68,24 @@ func GetRef(store bpy.CStore, hash [32]byte) (Ref, error) {
 	}
 }
 
-func PutRef(store bpy.CStore, ref Ref) ([32]byte, error) {
-	w := htree.NewWriter(store)
-	defer w.Close()
-
-	var t [8]byte
-	binary.LittleEndian.PutUint64(t[:], uint64(ref.CreatedAt))
-	_, err := w.Write(t[:])
-	if err != nil {
-		return [32]byte{}, err
-	}
+// Encode returns the htree leaf PutRef stores for ref, its sha256 is the
+// hash of the ref, so servers can check what a ref points to without the
+// key.
+func Encode(ref Ref) []byte {
+	return append([]byte{0}, marshal(ref)...)
+}
 
-	_, err = w.Write(ref.Root[:])
-	if err != nil {
-		return [32]byte{}, err
+// Decode is the reverse of Encode.
+func Decode(leaf []byte) (Ref, error) {
+	if len(leaf) == 0 || leaf[0] != 0 {
+		return Ref{}, ErrInvalidRef
 	}
+	return unmarshal(leaf[1:])
+}
 
-	if ref.HasPrev {
-		_, err := w.Write(ref.Prev[:])
-		if err != nil {
-			w.Close()
-			return [32]byte{}, err
-		}
-	}
-	tree, err := w.Close()
-	return tree.Data, err
+// PutRef stores ref as a single htree leaf, see Encode.
+func PutRef(store bpy.CStore, ref Ref) ([32]byte, error) {
+	return store.Put(Encode(ref))
 }
 
 func GetAtTime(store bpy.CStore, ref Ref, at time.Time) (Ref, bool, error) {
@@ -2,6 +2,7 @@ package refs
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"github.com/buppyio/bpy/testhelp"
 	"io"
 	"reflect"
@@ -156,3 +157,35 @@ func TestGetNVersionsAgo(t *testing.T) {
 		t.Fatal("incorrect root value", got.Root[0])
 	}
 }
+
+func TestEncodeRef(t *testing.T) {
+	store := testhelp.NewMemStore()
+	for _, ref := range []Ref{{}, {CreatedAt: 1, Root: [32]byte{1}}, {CreatedAt: 2, Root: [32]byte{2}, HasPrev: true, Prev: [32]byte{3}}} {
+		hash, err := PutRef(store, ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf := Encode(ref)
+		if sha256.Sum256(leaf) != hash {
+			t.Fatalf("encoding of %v does not match its hash", ref)
+		}
+		got, err := Decode(leaf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ref, got) {
+			t.Fatalf("%v != %v", ref, got)
+		}
+		got, err = GetRef(store, hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ref, got) {
+			t.Fatalf("%v != %v", ref, got)
+		}
+	}
+	_, err := Decode([]byte{1, 2, 3})
+	if err != ErrInvalidRef {
+		t.Fatalf("expected %v, got %v", ErrInvalidRef, err)
+	}
+}
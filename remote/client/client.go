@@ -4,7 +4,10 @@ import (
 	"errors"
 	"github.com/buppyio/bpy/remote/proto"
 	"io"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
 var (
@@ -15,21 +18,45 @@ var (
 	ErrBadResponse  = errors.New("server sent bad response")
 	ErrDisconnected = errors.New("connection disconnected")
 	ErrNoSuchPid    = errors.New("no such pack id")
+	ErrUnsupported  = errors.New("not supported by server")
+)
+
+// DefaultReadWindow is the number of TReadAt requests a file keeps in
+// flight by default.
+const DefaultReadWindow = 8
+
+const defaultMaxMessageSize = 1024 * 1024
+
+// Clients created with Dial redial up to maxRedials times after the
+// connection drops, waiting redialDelay between attempts, doubled each time.
+var (
+	maxRedials  = 5
+	redialDelay = 250 * time.Millisecond
 )
 
 type Client struct {
-	conn io.ReadWriteCloser
+	dial  func() (io.ReadWriteCloser, error)
+	keyId string
+
+	// connLock serializes reconnects. conn and gen are only changed with
+	// connLock, wLock and midLock held, so holding any of them is enough
+	// to read them.
+	connLock sync.Mutex
+	conn     io.ReadWriteCloser
+	// gen counts reconnects, fids and pids are only valid on the
+	// connection they were opened on.
+	gen uint64
 
 	maxMessageSizeLock sync.RWMutex
 	maxMessageSize     uint32
 
 	wLock sync.Mutex
 	wBuf  []byte
-	rBuf  []byte
 
 	midLock  sync.Mutex
 	mIdCount uint16
 	closed   bool
+	broken   bool
 	calls    map[uint16]chan proto.Message
 
 	fidLock  sync.Mutex
@@ -39,6 +66,21 @@ type Client struct {
 	pidLock  sync.Mutex
 	pidCount uint32
 	pids     map[uint32]error
+
+	readWindow int
+
+	limitLock sync.Mutex
+	upload    *Limiter
+	download  *Limiter
+
+	proofLock  sync.Mutex
+	sendProofs bool
+
+	watchLock sync.Mutex
+	watches   map[*Watch]struct{}
+
+	version string
+	caps    map[string]struct{}
 }
 
 func (c *Client) getMaxMessageSize() uint32 {
@@ -53,80 +95,285 @@ func (c *Client) setMaxMessageSize(sz uint32) {
 	c.wLock.Lock()
 	c.maxMessageSize = sz
 	c.wBuf = make([]byte, sz, sz)
-	c.rBuf = make([]byte, sz, sz)
 	c.wLock.Unlock()
 	c.maxMessageSizeLock.Unlock()
 }
 
-func readMessages(c *Client) {
+func readMessages(c *Client, conn io.ReadWriteCloser, gen uint64) {
+	buf := make([]byte, c.getMaxMessageSize())
 	for {
-		m, err := proto.ReadMessage(c.conn, c.rBuf)
+		m, err := proto.ReadMessage(conn, buf)
 		if err != nil {
 			break
 		}
+		// Data is read into buf, which is reused for the next message.
+		rReadAt, ok := m.(*proto.RReadAt)
+		if ok {
+			rReadAt.Data = append([]byte(nil), rReadAt.Data...)
+		}
+		c.midLock.Lock()
+		if c.gen != gen || c.closed {
+			c.midLock.Unlock()
+			continue
+		}
 		mid := proto.GetMessageId(m)
 		if mid == proto.NOMID {
 			switch m := m.(type) {
 			case *proto.RPackError:
 				c.setPidError(m.Pid, errors.New(m.Message))
-			default:
-				continue
+			case *proto.RRootChanged:
+				c.notify(m)
 			}
+			c.midLock.Unlock()
+			continue
 		}
-		c.midLock.Lock()
 		ch, ok := c.calls[mid]
 		if ok {
 			ch <- m
 		}
 		c.midLock.Unlock()
 	}
-	c.Close()
+	c.disconnected(conn, gen)
+}
+
+// disconnected fails the calls waiting on connection gen, clients that
+// can't redial are closed.
+func (c *Client) disconnected(conn io.ReadWriteCloser, gen uint64) {
+	c.midLock.Lock()
+	if c.gen == gen && !c.broken {
+		c.broken = true
+		if c.dial == nil {
+			c.closed = true
+			c.closeWatches()
+		}
+		for mid, ch := range c.calls {
+			close(ch)
+			delete(c.calls, mid)
+		}
+	}
+	c.midLock.Unlock()
+	conn.Close()
 }
 
+// Attach negotiates the newest protocol version the server supports, the
+// capabilities it offers are available through HasCapability. The client
+// is closed if the connection drops. Without a way to dial again, the
+// Version1 fallback is attempted on conn, which fails with servers that
+// close the connection after rejecting Version2, use Dial for those.
 func Attach(conn io.ReadWriteCloser, keyId string) (*Client, error) {
-	maxsz := uint32(1024 * 1024)
+	return newClient(conn, nil, keyId)
+}
+
+// Dial attaches over a connection made by dial. When the connection drops
+// the client dials again, open files are reopened at their offsets and
+// packs being uploaded resume where the server left off if the server
+// offers proto.CapResume.
+func Dial(dial func() (io.ReadWriteCloser, error), keyId string) (*Client, error) {
+	conn, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	return newClient(conn, dial, keyId)
+}
+
+func newClient(conn io.ReadWriteCloser, dial func() (io.ReadWriteCloser, error), keyId string) (*Client, error) {
+	s, conn, err := negotiate(conn, dial, keyId)
+	if err != nil {
+		if conn != nil {
+			conn.Close()
+		}
+		return nil, err
+	}
 	c := &Client{
-		conn:  conn,
-		calls: make(map[uint16]chan proto.Message),
-		fids:  make(map[uint32]struct{}),
-		pids:  make(map[uint32]error),
+		dial:    dial,
+		keyId:   keyId,
+		conn:    conn,
+		calls:   make(map[uint16]chan proto.Message),
+		watches: make(map[*Watch]struct{}),
+		fids:    make(map[uint32]struct{}),
+		pids:    make(map[uint32]error),
+		version: s.version,
+		caps:    s.caps,
+
+		readWindow: DefaultReadWindow,
 	}
-	c.setMaxMessageSize(maxsz)
-	err := c.WriteMessage(&proto.TAttach{
+	c.setMaxMessageSize(s.maxsz)
+	go readMessages(c, conn, c.gen)
+	return c, nil
+}
+
+type session struct {
+	version string
+	maxsz   uint32
+	caps    map[string]struct{}
+}
+
+// negotiate attaches with Version2, servers that reject it may close the
+// connection, so the Version1 attach is made on a new connection when
+// there is a dial function. It returns the connection the session is on.
+func negotiate(conn io.ReadWriteCloser, dial func() (io.ReadWriteCloser, error), keyId string) (*session, io.ReadWriteCloser, error) {
+	s, err := attach(conn, proto.Version2, keyId)
+	if _, rejected := err.(*attachError); !rejected {
+		return s, conn, err
+	}
+	if dial != nil {
+		conn.Close()
+		conn, err = dial()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	s, err = attach(conn, proto.Version1, keyId)
+	return s, conn, err
+}
+
+// attachError is an RError sent in reply to TAttach.
+type attachError struct {
+	msg string
+}
+
+func (e *attachError) Error() string { return e.msg }
+
+func attach(conn io.ReadWriteCloser, version, keyId string) (*session, error) {
+	buf := make([]byte, defaultMaxMessageSize)
+	err := proto.WriteMessage(conn, &proto.TAttach{
 		Mid:            1,
-		MaxMessageSize: maxsz,
-		Version:        "buppy1",
+		MaxMessageSize: defaultMaxMessageSize,
+		Version:        version,
 		KeyId:          keyId,
-	})
+	}, buf)
 	if err != nil {
-		conn.Close()
 		return nil, err
 	}
-	resp, err := proto.ReadMessage(c.conn, c.rBuf)
+	resp, err := proto.ReadMessage(conn, buf)
 	if err != nil {
-		conn.Close()
 		return nil, err
 	}
-	mid := proto.GetMessageId(resp)
-	if mid != 1 {
-		conn.Close()
+	if proto.GetMessageId(resp) != 1 {
 		return nil, ErrBadResponse
 	}
+	s := &session{caps: make(map[string]struct{})}
 	switch resp := resp.(type) {
 	case *proto.RAttach:
-		if resp.MaxMessageSize > maxsz || resp.Mid != 1 {
+		s.version = proto.Version1
+		s.maxsz = resp.MaxMessageSize
+	case *proto.RAttach2:
+		if version != proto.Version2 {
 			return nil, ErrBadResponse
 		}
-		c.setMaxMessageSize(resp.MaxMessageSize)
-		go readMessages(c)
-		return c, nil
+		s.version = proto.Version2
+		s.maxsz = resp.MaxMessageSize
+		for _, name := range proto.SplitCapabilities(resp.Capabilities) {
+			s.caps[name] = struct{}{}
+		}
 	case *proto.RError:
-		conn.Close()
-		return nil, errors.New(resp.Message)
+		return nil, &attachError{msg: resp.Message}
 	default:
-		conn.Close()
 		return nil, ErrBadResponse
 	}
+	if s.maxsz > defaultMaxMessageSize {
+		return nil, ErrBadResponse
+	}
+	return s, nil
+}
+
+// reconnect replaces connection gen after it dropped, it does nothing if
+// that already happened.
+func (c *Client) reconnect(gen uint64) error {
+	if c.dial == nil {
+		return ErrDisconnected
+	}
+	c.connLock.Lock()
+	defer c.connLock.Unlock()
+
+	c.midLock.Lock()
+	closed, broken, cur := c.closed, c.broken, c.gen
+	c.midLock.Unlock()
+	if closed {
+		return ErrClientClosed
+	}
+	if cur != gen || !broken {
+		return nil
+	}
+
+	var conn io.ReadWriteCloser
+	var err error
+	delay := redialDelay
+	for i := 0; i < maxRedials; i++ {
+		if i != 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		conn, err = c.dial()
+		if err != nil {
+			continue
+		}
+		var s *session
+		s, conn, err = negotiate(conn, c.dial, c.keyId)
+		if err == nil && (s.version != c.version || s.maxsz != c.getMaxMessageSize()) {
+			err = ErrBadResponse
+		}
+		if err == nil {
+			break
+		}
+		if conn != nil {
+			conn.Close()
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	c.wLock.Lock()
+	c.midLock.Lock()
+	if c.closed {
+		c.midLock.Unlock()
+		c.wLock.Unlock()
+		conn.Close()
+		return ErrClientClosed
+	}
+	c.conn = conn
+	c.gen++
+	c.broken = false
+	gen = c.gen
+	c.midLock.Unlock()
+	c.wLock.Unlock()
+	go readMessages(c, conn, gen)
+	// Changes while disconnected were missed, subscribing again sends
+	// the current root.
+	for _, name := range c.watchedRoots() {
+		go c.subscribe(name)
+	}
+	return nil
+}
+
+// connected returns the current connection generation and whether it is
+// usable.
+func (c *Client) connected() (uint64, bool) {
+	c.midLock.Lock()
+	defer c.midLock.Unlock()
+	return c.gen, !c.broken && !c.closed
+}
+
+// Version returns the protocol version negotiated with the server.
+func (c *Client) Version() string {
+	return c.version
+}
+
+// HasCapability reports whether the server offers an optional protocol
+// feature, servers speaking proto.Version1 offer none.
+func (c *Client) HasCapability(name string) bool {
+	_, ok := c.caps[name]
+	return ok
+}
+
+func (c *Client) Capabilities() []string {
+	caps := make([]string, 0, len(c.caps))
+	for name := range c.caps {
+		caps = append(caps, name)
+	}
+	sort.Strings(caps)
+	return caps
 }
 
 func (c *Client) Close() error {
@@ -136,20 +383,22 @@ func (c *Client) Close() error {
 		return nil
 	}
 
-	for _, ch := range c.calls {
+	for mid, ch := range c.calls {
 		close(ch)
+		delete(c.calls, mid)
 	}
 	c.closed = true
+	c.closeWatches()
 	c.conn.Close()
 	return nil
 }
 
-func (c *Client) newCall() (chan proto.Message, uint16, error) {
+func (c *Client) newCall() (chan proto.Message, uint16, uint64, error) {
 	c.midLock.Lock()
 	defer c.midLock.Unlock()
 
-	if c.closed {
-		return nil, 0, ErrDisconnected
+	if c.closed || c.broken {
+		return nil, 0, c.gen, ErrDisconnected
 	}
 
 	mid := c.mIdCount + 1
@@ -158,28 +407,68 @@ func (c *Client) newCall() (chan proto.Message, uint16, error) {
 			mid += 1
 		}
 		if mid == c.mIdCount {
-			return nil, 0, ErrTooManyCalls
+			return nil, 0, c.gen, ErrTooManyCalls
 		}
 		_, ok := c.calls[mid]
 		if !ok {
-			ch := make(chan proto.Message)
+			// Buffered so replies are never blocked behind a caller
+			// waiting for an earlier call.
+			ch := make(chan proto.Message, 1)
 			c.calls[mid] = ch
-			return ch, mid, nil
+			return ch, mid, c.gen, nil
 		}
 		mid += 1
 	}
 }
 
-func (c *Client) Call(m proto.Message, ch chan proto.Message, mid uint16) (proto.Message, error) {
-	defer func() {
-		c.midLock.Lock()
+// endCall frees mid unless a disconnect already did and it was reused.
+func (c *Client) endCall(mid uint16, ch chan proto.Message) {
+	c.midLock.Lock()
+	if c.calls[mid] == ch {
 		delete(c.calls, mid)
-		c.midLock.Unlock()
-	}()
-	err := c.WriteMessage(m)
+	}
+	c.midLock.Unlock()
+}
+
+// callOn sends the message built for a new message id on connection gen
+// and waits for the reply, sent reports whether any of it may have reached
+// the server.
+func (c *Client) callOn(gen uint64, build func(mid uint16) proto.Message) (resp proto.Message, sent bool, err error) {
+	ch, mid, cgen, err := c.newCall()
 	if err != nil {
-		return nil, err
+		return nil, false, err
+	}
+	defer c.endCall(mid, ch)
+	if cgen != gen {
+		return nil, false, ErrDisconnected
+	}
+	sent, err = c.writeOn(gen, build(mid))
+	if err != nil {
+		return nil, sent, err
+	}
+	resp, err = waitReply(ch)
+	return resp, true, err
+}
+
+// rpc makes a call on the current connection. Calls that never reached
+// the server are retried after reconnecting, calls that did are only
+// retried if repeating them is harmless. The connection generation the
+// reply came from is returned.
+func (c *Client) rpc(idempotent bool, build func(mid uint16) proto.Message) (proto.Message, uint64, error) {
+	for i := 0; ; i++ {
+		gen, _ := c.connected()
+		resp, sent, err := c.callOn(gen, build)
+		if err != ErrDisconnected || (sent && !idempotent) || i == maxRedials {
+			return resp, gen, err
+		}
+		err = c.reconnect(gen)
+		if err != nil {
+			return nil, gen, err
+		}
 	}
+}
+
+func waitReply(ch chan proto.Message) (proto.Message, error) {
 	resp, ok := <-ch
 	if !ok {
 		return nil, ErrDisconnected
@@ -192,6 +481,97 @@ func (c *Client) Call(m proto.Message, ch chan proto.Message, mid uint16) (proto
 	}
 }
 
+// SetReadWindow sets the number of TReadAt requests files opened after
+// the call keep in flight.
+func (c *Client) SetReadWindow(n int) {
+	if n < 1 {
+		n = 1
+	}
+	c.fidLock.Lock()
+	c.readWindow = n
+	c.fidLock.Unlock()
+}
+
+// SetLimits limits the rate packs are uploaded and files are downloaded
+// at, nil limiters don't limit.
+func (c *Client) SetLimits(upload, download *Limiter) {
+	c.limitLock.Lock()
+	c.upload, c.download = upload, download
+	c.limitLock.Unlock()
+}
+
+// SetSendProofs allows root changes to be sent with their ancestry proof
+// when the server offers proto.CapAppendOnly. The proof is the new ref in
+// plaintext, so it is only sent when the user asks for it.
+func (c *Client) SetSendProofs(on bool) {
+	c.proofLock.Lock()
+	c.sendProofs = on
+	c.proofLock.Unlock()
+}
+
+// SendsProofs reports whether SetSendProofs allowed ancestry proofs.
+func (c *Client) SendsProofs() bool {
+	c.proofLock.Lock()
+	defer c.proofLock.Unlock()
+	return c.sendProofs
+}
+
+func (c *Client) limits() (*Limiter, *Limiter) {
+	c.limitLock.Lock()
+	defer c.limitLock.Unlock()
+	return c.upload, c.download
+}
+
+// readCall is a TReadAt that has been sent, the reply must be waited for
+// before its message id can be reused.
+type readCall struct {
+	c    *Client
+	ch   chan proto.Message
+	mid  uint16
+	size uint32
+}
+
+func (c *Client) startReadAt(gen uint64, fid uint32, offset uint64, size uint32) (*readCall, error) {
+	ch, mid, cgen, err := c.newCall()
+	if err != nil {
+		return nil, err
+	}
+	if cgen != gen {
+		c.endCall(mid, ch)
+		return nil, ErrDisconnected
+	}
+	_, err = c.writeOn(gen, &proto.TReadAt{
+		Mid:    mid,
+		Fid:    fid,
+		Offset: offset,
+		Size:   size,
+	})
+	if err != nil {
+		c.endCall(mid, ch)
+		return nil, err
+	}
+	return &readCall{c: c, ch: ch, mid: mid, size: size}, nil
+}
+
+func (rc *readCall) wait() ([]byte, error) {
+	defer rc.c.endCall(rc.mid, rc.ch)
+	resp, err := waitReply(rc.ch)
+	if err != nil {
+		return nil, err
+	}
+	switch resp := resp.(type) {
+	case *proto.RReadAt:
+		if uint32(len(resp.Data)) > rc.size {
+			return nil, ErrBadResponse
+		}
+		_, download := rc.c.limits()
+		download.Wait(len(resp.Data))
+		return resp.Data, nil
+	default:
+		return nil, ErrBadResponse
+	}
+}
+
 func (c *Client) nextFid() (uint32, error) {
 	c.fidLock.Lock()
 	defer c.fidLock.Unlock()
@@ -219,23 +599,80 @@ func (c *Client) freeFid(fid uint32) {
 }
 
 func (c *Client) WriteMessage(m proto.Message) error {
+	gen, _ := c.connected()
+	_, err := c.writeOn(gen, m)
+	return err
+}
+
+// writeOn sends m unless connection gen has been replaced, a failed write
+// drops the connection.
+func (c *Client) writeOn(gen uint64, m proto.Message) (sent bool, err error) {
 	c.wLock.Lock()
 	defer c.wLock.Unlock()
-	return proto.WriteMessage(c.conn, m, c.wBuf)
+	if c.gen != gen {
+		return false, ErrDisconnected
+	}
+	n, err := proto.PackMessage(m, c.wBuf)
+	if err != nil {
+		return false, err
+	}
+	_, err = c.conn.Write(c.wBuf[:n])
+	if err != nil {
+		c.disconnected(c.conn, gen)
+		return true, ErrDisconnected
+	}
+	return true, nil
 }
 
 func (c *Client) TCasRoot(newValue, newVersion, signature, epoch string) (*proto.RCasRoot, error) {
-	ch, mid, err := c.newCall()
+	resp, _, err := c.rpc(false, func(mid uint16) proto.Message {
+		return &proto.TCasRoot{
+			Mid:       mid,
+			Value:     newValue,
+			Version:   newVersion,
+			Signature: signature,
+			Epoch:     epoch,
+		}
+	})
 	if err != nil {
 		return nil, err
 	}
-	resp, err := c.Call(&proto.TCasRoot{
-		Mid:       mid,
-		Value:     newValue,
-		Version:   newVersion,
-		Signature: signature,
-		Epoch:     epoch,
-	}, ch, mid)
+	switch resp := resp.(type) {
+	case *proto.RCasRoot:
+		return resp, nil
+	default:
+		return nil, ErrBadResponse
+	}
+}
+
+func (c *Client) TGetRoot() (*proto.RGetRoot, error) {
+	resp, _, err := c.rpc(true, func(mid uint16) proto.Message {
+		return &proto.TGetRoot{
+			Mid: mid,
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	switch resp := resp.(type) {
+	case *proto.RGetRoot:
+		return resp, nil
+	default:
+		return nil, ErrBadResponse
+	}
+}
+
+func (c *Client) TCasNamedRoot(name, newValue, newVersion, signature, epoch string) (*proto.RCasRoot, error) {
+	resp, _, err := c.rpc(false, func(mid uint16) proto.Message {
+		return &proto.TCasNamedRoot{
+			Mid:       mid,
+			Name:      name,
+			Value:     newValue,
+			Version:   newVersion,
+			Signature: signature,
+			Epoch:     epoch,
+		}
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -247,14 +684,36 @@ func (c *Client) TCasRoot(newValue, newVersion, signature, epoch string) (*proto
 	}
 }
 
-func (c *Client) TGetRoot() (*proto.RGetRoot, error) {
-	ch, mid, err := c.newCall()
+func (c *Client) TCasRootProof(name, newValue, newVersion, signature, epoch string, proof []byte) (*proto.RCasRoot, error) {
+	resp, _, err := c.rpc(false, func(mid uint16) proto.Message {
+		return &proto.TCasRootProof{
+			Mid:       mid,
+			Name:      name,
+			Value:     newValue,
+			Version:   newVersion,
+			Signature: signature,
+			Epoch:     epoch,
+			Proof:     proof,
+		}
+	})
 	if err != nil {
 		return nil, err
 	}
-	resp, err := c.Call(&proto.TGetRoot{
-		Mid: mid,
-	}, ch, mid)
+	switch resp := resp.(type) {
+	case *proto.RCasRoot:
+		return resp, nil
+	default:
+		return nil, ErrBadResponse
+	}
+}
+
+func (c *Client) TGetNamedRoot(name string) (*proto.RGetRoot, error) {
+	resp, _, err := c.rpc(true, func(mid uint16) proto.Message {
+		return &proto.TGetNamedRoot{
+			Mid:  mid,
+			Name: name,
+		}
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -266,16 +725,50 @@ func (c *Client) TGetRoot() (*proto.RGetRoot, error) {
 	}
 }
 
-func (c *Client) TRemove(path, epoch string) (*proto.RRemove, error) {
-	ch, mid, err := c.newCall()
+func (c *Client) TListRoots(cursor string) (*proto.RListRoots, error) {
+	resp, _, err := c.rpc(true, func(mid uint16) proto.Message {
+		return &proto.TListRoots{
+			Mid:    mid,
+			Cursor: cursor,
+		}
+	})
 	if err != nil {
 		return nil, err
 	}
-	resp, err := c.Call(&proto.TRemove{
-		Mid:   mid,
-		Path:  path,
-		Epoch: epoch,
-	}, ch, mid)
+	switch resp := resp.(type) {
+	case *proto.RListRoots:
+		return resp, nil
+	default:
+		return nil, ErrBadResponse
+	}
+}
+
+// ListRoots returns a page of the names of the named roots, see List.
+func (c *Client) ListRoots(cursor string) ([]string, string, error) {
+	if !c.HasCapability(proto.CapNamedRoots) {
+		return nil, "", ErrUnsupported
+	}
+	r, err := c.TListRoots(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	if r.Next != "" && r.Next <= cursor {
+		return nil, "", ErrBadResponse
+	}
+	if r.Names == "" {
+		return nil, r.Next, nil
+	}
+	return strings.Split(r.Names, "\n"), r.Next, nil
+}
+
+func (c *Client) TRemove(path, epoch string) (*proto.RRemove, error) {
+	resp, _, err := c.rpc(false, func(mid uint16) proto.Message {
+		return &proto.TRemove{
+			Mid:   mid,
+			Path:  path,
+			Epoch: epoch,
+		}
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -288,15 +781,13 @@ func (c *Client) TRemove(path, epoch string) (*proto.RRemove, error) {
 }
 
 func (c *Client) TOpen(fid uint32, name string) (*proto.ROpen, error) {
-	ch, mid, err := c.newCall()
-	if err != nil {
-		return nil, err
-	}
-	resp, err := c.Call(&proto.TOpen{
-		Mid:  mid,
-		Fid:  fid,
-		Name: name,
-	}, ch, mid)
+	resp, _, err := c.rpc(true, func(mid uint16) proto.Message {
+		return &proto.TOpen{
+			Mid:  mid,
+			Fid:  fid,
+			Name: name,
+		}
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -309,16 +800,14 @@ func (c *Client) TOpen(fid uint32, name string) (*proto.ROpen, error) {
 }
 
 func (c *Client) TReadAt(fid uint32, offset uint64, size uint32) (*proto.RReadAt, error) {
-	ch, mid, err := c.newCall()
-	if err != nil {
-		return nil, err
-	}
-	resp, err := c.Call(&proto.TReadAt{
-		Mid:    mid,
-		Fid:    fid,
-		Offset: offset,
-		Size:   size,
-	}, ch, mid)
+	resp, _, err := c.rpc(true, func(mid uint16) proto.Message {
+		return &proto.TReadAt{
+			Mid:    mid,
+			Fid:    fid,
+			Offset: offset,
+			Size:   size,
+		}
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -331,14 +820,12 @@ func (c *Client) TReadAt(fid uint32, offset uint64, size uint32) (*proto.RReadAt
 }
 
 func (c *Client) TClose(fid uint32) (*proto.RClose, error) {
-	ch, mid, err := c.newCall()
-	if err != nil {
-		return nil, err
-	}
-	resp, err := c.Call(&proto.TClose{
-		Mid: mid,
-		Fid: fid,
-	}, ch, mid)
+	resp, _, err := c.rpc(true, func(mid uint16) proto.Message {
+		return &proto.TClose{
+			Mid: mid,
+			Fid: fid,
+		}
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -351,14 +838,12 @@ func (c *Client) TClose(fid uint32) (*proto.RClose, error) {
 }
 
 func (c *Client) TNewPack(pid uint32) (*proto.RNewPack, error) {
-	ch, mid, err := c.newCall()
-	if err != nil {
-		return nil, err
-	}
-	resp, err := c.Call(&proto.TNewPack{
-		Mid: mid,
-		Pid: pid,
-	}, ch, mid)
+	resp, _, err := c.rpc(false, func(mid uint16) proto.Message {
+		return &proto.TNewPack{
+			Mid: mid,
+			Pid: pid,
+		}
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -378,14 +863,12 @@ func (c *Client) TWritePack(pid uint32, data []byte) error {
 }
 
 func (c *Client) TClosePack(pid uint32) (*proto.RClosePack, error) {
-	ch, mid, err := c.newCall()
-	if err != nil {
-		return nil, err
-	}
-	resp, err := c.Call(&proto.TClosePack{
-		Mid: mid,
-		Pid: pid,
-	}, ch, mid)
+	resp, _, err := c.rpc(false, func(mid uint16) proto.Message {
+		return &proto.TClosePack{
+			Mid: mid,
+			Pid: pid,
+		}
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -398,14 +881,12 @@ func (c *Client) TClosePack(pid uint32) (*proto.RClosePack, error) {
 }
 
 func (c *Client) TCancelPack(pid uint32) (*proto.RCancelPack, error) {
-	ch, mid, err := c.newCall()
-	if err != nil {
-		return nil, err
-	}
-	resp, err := c.Call(&proto.TCancelPack{
-		Mid: mid,
-		Pid: pid,
-	}, ch, mid)
+	resp, _, err := c.rpc(false, func(mid uint16) proto.Message {
+		return &proto.TCancelPack{
+			Mid: mid,
+			Pid: pid,
+		}
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -418,13 +899,11 @@ func (c *Client) TCancelPack(pid uint32) (*proto.RCancelPack, error) {
 }
 
 func (c *Client) TGetEpoch() (*proto.RGetEpoch, error) {
-	ch, mid, err := c.newCall()
-	if err != nil {
-		return nil, err
-	}
-	resp, err := c.Call(&proto.TGetEpoch{
-		Mid: mid,
-	}, ch, mid)
+	resp, _, err := c.rpc(true, func(mid uint16) proto.Message {
+		return &proto.TGetEpoch{
+			Mid: mid,
+		}
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -437,13 +916,29 @@ func (c *Client) TGetEpoch() (*proto.RGetEpoch, error) {
 }
 
 func (c *Client) TStartGC() (*proto.RStartGC, error) {
-	ch, mid, err := c.newCall()
+	resp, _, err := c.rpc(false, func(mid uint16) proto.Message {
+		return &proto.TStartGC{
+			Mid: mid,
+		}
+	})
 	if err != nil {
 		return nil, err
 	}
-	resp, err := c.Call(&proto.TStartGC{
-		Mid: mid,
-	}, ch, mid)
+	switch resp := resp.(type) {
+	case *proto.RStartGC:
+		return resp, nil
+	default:
+		return nil, ErrBadResponse
+	}
+}
+
+func (c *Client) TAdminStartGC(credential string) (*proto.RStartGC, error) {
+	resp, _, err := c.rpc(false, func(mid uint16) proto.Message {
+		return &proto.TAdminStartGC{
+			Mid:        mid,
+			Credential: credential,
+		}
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -456,24 +951,212 @@ func (c *Client) TStartGC() (*proto.RStartGC, error) {
 }
 
 func (c *Client) TStopGC() (*proto.RStopGC, error) {
-	ch, mid, err := c.newCall()
+	resp, _, err := c.rpc(true, func(mid uint16) proto.Message {
+		return &proto.TStopGC{
+			Mid: mid,
+		}
+	})
 	if err != nil {
 		return nil, err
 	}
-	resp, err := c.Call(&proto.TStopGC{
-		Mid: mid,
-	}, ch, mid)
+	switch resp := resp.(type) {
+	case *proto.RStopGC:
+		return resp, nil
+	default:
+		return nil, ErrBadResponse
+	}
+}
+
+func (c *Client) TStat(name string) (*proto.RStat, error) {
+	resp, _, err := c.rpc(true, func(mid uint16) proto.Message {
+		return &proto.TStat{
+			Mid:  mid,
+			Name: name,
+		}
+	})
 	if err != nil {
 		return nil, err
 	}
 	switch resp := resp.(type) {
-	case *proto.RStopGC:
+	case *proto.RStat:
+		return resp, nil
+	default:
+		return nil, ErrBadResponse
+	}
+}
+
+func (c *Client) TList(prefix, cursor string, max uint32) (*proto.RList, error) {
+	resp, _, err := c.rpc(true, func(mid uint16) proto.Message {
+		return &proto.TList{
+			Mid:    mid,
+			Prefix: prefix,
+			Cursor: cursor,
+			Max:    max,
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	switch resp := resp.(type) {
+	case *proto.RList:
 		return resp, nil
 	default:
 		return nil, ErrBadResponse
 	}
 }
 
+// Stat returns the size of a file, ok is false if it doesn't exist.
+func (c *Client) Stat(name string) (proto.ListEntry, bool, error) {
+	if !c.HasCapability(proto.CapStat) {
+		return proto.ListEntry{}, false, ErrUnsupported
+	}
+	r, err := c.TStat(name)
+	if err != nil {
+		return proto.ListEntry{}, false, err
+	}
+	return proto.ListEntry{Name: name, Size: r.Size}, r.Exists, nil
+}
+
+// ListPageSize is the number of files List asks for at a time.
+const ListPageSize = 4096
+
+// List returns a page of the files whose names start with prefix, see
+// proto.TList. The returned cursor is passed to get the next page, it is
+// empty after the last one.
+func (c *Client) List(prefix, cursor string) ([]proto.ListEntry, string, error) {
+	if !c.HasCapability(proto.CapList) {
+		return nil, "", ErrUnsupported
+	}
+	r, err := c.TList(prefix, cursor, ListPageSize)
+	if err != nil {
+		return nil, "", err
+	}
+	entries, err := proto.UnpackListEntries(r.Entries)
+	if err != nil {
+		return nil, "", err
+	}
+	if uint32(len(entries)) > ListPageSize || (r.Next != "" && r.Next <= cursor) {
+		return nil, "", ErrBadResponse
+	}
+	return entries, r.Next, nil
+}
+
+func (c *Client) TWatch(name string) (*proto.RWatch, error) {
+	resp, _, err := c.rpc(true, func(mid uint16) proto.Message {
+		return &proto.TWatch{
+			Mid:  mid,
+			Name: name,
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	switch resp := resp.(type) {
+	case *proto.RWatch:
+		return resp, nil
+	default:
+		return nil, ErrBadResponse
+	}
+}
+
+// Watch receives root changes pushed by the server on C. Only the latest
+// change is kept if the receiver falls behind. C is closed when the watch
+// or the client is closed.
+type Watch struct {
+	C    <-chan *proto.RRootChanged
+	c    *Client
+	ch   chan *proto.RRootChanged
+	name string
+}
+
+// Watch subscribes to changes of the root called name, the current root
+// is sent first if there is one. Clients created with Dial subscribe
+// again after a reconnect and send the current root.
+func (c *Client) Watch(name string) (*Watch, error) {
+	if !c.HasCapability(proto.CapWatch) {
+		return nil, ErrUnsupported
+	}
+	if name != "" && !c.HasCapability(proto.CapNamedRoots) {
+		return nil, ErrUnsupported
+	}
+	ch := make(chan *proto.RRootChanged, 1)
+	w := &Watch{C: ch, c: c, ch: ch, name: name}
+	c.watchLock.Lock()
+	c.watches[w] = struct{}{}
+	c.watchLock.Unlock()
+	err := c.subscribe(name)
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// watchedRoots returns the names of the roots being watched.
+func (c *Client) watchedRoots() []string {
+	c.watchLock.Lock()
+	defer c.watchLock.Unlock()
+	seen := make(map[string]bool)
+	names := []string{}
+	for w := range c.watches {
+		if !seen[w.name] {
+			seen[w.name] = true
+			names = append(names, w.name)
+		}
+	}
+	return names
+}
+
+func (c *Client) subscribe(name string) error {
+	r, err := c.TWatch(name)
+	if err != nil {
+		return err
+	}
+	if r.Ok {
+		c.notify(&proto.RRootChanged{
+			Name:      name,
+			Value:     r.Value,
+			Version:   r.Version,
+			Signature: r.Signature,
+		})
+	}
+	return nil
+}
+
+func (c *Client) notify(m *proto.RRootChanged) {
+	c.watchLock.Lock()
+	defer c.watchLock.Unlock()
+	for w := range c.watches {
+		if w.name != m.Name {
+			continue
+		}
+		select {
+		case <-w.ch:
+		default:
+		}
+		w.ch <- m
+	}
+}
+
+func (c *Client) closeWatches() {
+	c.watchLock.Lock()
+	defer c.watchLock.Unlock()
+	for w := range c.watches {
+		close(w.ch)
+		delete(c.watches, w)
+	}
+}
+
+func (w *Watch) Close() {
+	w.c.watchLock.Lock()
+	defer w.c.watchLock.Unlock()
+	_, ok := w.c.watches[w]
+	if ok {
+		close(w.ch)
+		delete(w.c.watches, w)
+	}
+}
+
 func (c *Client) nextPid() (uint32, error) {
 	c.pidLock.Lock()
 	defer c.pidLock.Unlock()
@@ -504,7 +1187,7 @@ func (c *Client) checkPidError(pid uint32) error {
 func (c *Client) setPidError(pid uint32, err error) {
 	c.pidLock.Lock()
 	defer c.pidLock.Unlock()
-	err, ok := c.pids[pid]
+	_, ok := c.pids[pid]
 	if !ok {
 		return
 	}
@@ -525,15 +1208,13 @@ func (c *Client) NewPack(name string) (*Pack, error) {
 	if err != nil {
 		return nil, err
 	}
-	ch, mid, err := c.newCall()
-	if err != nil {
-		return nil, err
-	}
-	resp, err := c.Call(&proto.TNewPack{
-		Mid:  mid,
-		Pid:  pid,
-		Name: name,
-	}, ch, mid)
+	resp, gen, err := c.rpc(false, func(mid uint16) proto.Message {
+		return &proto.TNewPack{
+			Mid:  mid,
+			Pid:  pid,
+			Name: name,
+		}
+	})
 	if err != nil {
 		c.freePid(pid)
 		return nil, err
@@ -541,8 +1222,11 @@ func (c *Client) NewPack(name string) (*Pack, error) {
 	switch resp.(type) {
 	case *proto.RNewPack:
 		return &Pack{
-			c:   c,
-			pid: pid,
+			c:         c,
+			pid:       pid,
+			name:      name,
+			gen:       gen,
+			resumable: c.dial != nil && c.HasCapability(proto.CapResume),
 		}, nil
 	default:
 		c.freePid(pid)
@@ -555,13 +1239,31 @@ func (c *Client) Open(name string) (*File, error) {
 	if err != nil {
 		return nil, err
 	}
-	_, err = c.TOpen(fid, name)
+	resp, gen, err := c.rpc(true, func(mid uint16) proto.Message {
+		return &proto.TOpen{
+			Mid:  mid,
+			Fid:  fid,
+			Name: name,
+		}
+	})
+	if err == nil {
+		if _, ok := resp.(*proto.ROpen); !ok {
+			err = ErrBadResponse
+		}
+	}
 	if err != nil {
 		c.freeFid(fid)
 		return nil, err
 	}
+	c.fidLock.Lock()
+	window := c.readWindow
+	c.fidLock.Unlock()
 	return &File{
-		c:   c,
-		fid: fid,
+		c:      c,
+		fid:    fid,
+		name:   name,
+		gen:    gen,
+		window: window,
+		ramp:   1,
 	}, nil
 }
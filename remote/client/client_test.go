@@ -0,0 +1,390 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/buppyio/bpy/remote/proto"
+	"io/ioutil"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAttachCapabilities(t *testing.T) {
+	c, _ := newTestClient(t, nil, proto.CapWatch, proto.CapStat)
+	defer c.Close()
+	if c.Version() != proto.Version2 {
+		t.Fatalf("negotiated %s", c.Version())
+	}
+	if !c.HasCapability(proto.CapStat) || c.HasCapability(proto.CapList) {
+		t.Fatal("bad capabilities")
+	}
+	if !reflect.DeepEqual(c.Capabilities(), []string{proto.CapStat, proto.CapWatch}) {
+		t.Fatalf("bad capabilities %v", c.Capabilities())
+	}
+}
+
+func TestAttachOldServer(t *testing.T) {
+	c, _ := newTestClient(t, []byte("data"))
+	defer c.Close()
+	if c.Version() != proto.Version1 || len(c.Capabilities()) != 0 {
+		t.Fatalf("negotiated %s with %v", c.Version(), c.Capabilities())
+	}
+	f, err := c.Open("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAttachOldServerRedial(t *testing.T) {
+	d := &testDialer{data: []byte("data"), packs: newTestPacks(), closeOnReject: true}
+	c, err := Dial(d.dial, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.Version() != proto.Version1 || d.dials != 2 {
+		t.Fatalf("negotiated %s after %d dials", c.Version(), d.dials)
+	}
+	f, err := c.Open("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// dropAfter returns a drop function for the n+1th message of type t.
+func dropAfter(n int, t proto.Message) func(proto.Message) bool {
+	return func(m proto.Message) bool {
+		if proto.GetMessageType(m) == proto.GetMessageType(t) {
+			n--
+		}
+		return n < 0
+	}
+}
+
+func TestReconnectRead(t *testing.T) {
+	data := make([]byte, 100*1024+17)
+	rand.New(rand.NewSource(2)).Read(data)
+	d := &testDialer{data: data, packs: newTestPacks(), drop: dropAfter(5, &proto.TReadAt{})}
+	c, err := Dial(d.dial, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	f, err := c.Open("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("read mismatch after reconnect")
+	}
+	if d.dials != 2 {
+		t.Fatalf("expected two dials, got %d", d.dials)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writePack(c *Client, data []byte) error {
+	p, err := c.NewPack("p")
+	if err != nil {
+		return err
+	}
+	for len(data) != 0 {
+		n := 3000
+		if n > len(data) {
+			n = len(data)
+		}
+		_, err = p.Write(data[:n])
+		if err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return p.Close()
+}
+
+func TestResumePack(t *testing.T) {
+	defer func(n int) { packSyncInterval = n }(packSyncInterval)
+	packSyncInterval = 10000
+
+	data := make([]byte, 60000)
+	rand.New(rand.NewSource(3)).Read(data)
+	d := &testDialer{caps: []string{proto.CapResume}, packs: newTestPacks(), drop: dropAfter(10, &proto.TWritePack{})}
+	c, err := Dial(d.dial, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	err = writePack(c, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.packs.lock.Lock()
+	defer d.packs.lock.Unlock()
+	if !d.packs.closed["p"] || !bytes.Equal(d.packs.data["p"], data) {
+		t.Fatal("resumed pack mismatch")
+	}
+	if d.dials != 2 {
+		t.Fatalf("expected two dials, got %d", d.dials)
+	}
+}
+
+func TestPackNoResume(t *testing.T) {
+	data := make([]byte, 60000)
+	d := &testDialer{caps: []string{}, packs: newTestPacks(), drop: dropAfter(10, &proto.TWritePack{})}
+	c, err := Dial(d.dial, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	err = writePack(c, data)
+	if err != ErrDisconnected {
+		t.Fatalf("expected %v, got %v", ErrDisconnected, err)
+	}
+	// The client itself is still usable.
+	f, err := c.Open("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+}
+
+func TestStatList(t *testing.T) {
+	c, s := newTestClient(t, nil, proto.CapStat, proto.CapList)
+	defer c.Close()
+	var names []string
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("packs/%02d.ebpack", i)
+		s.packs.data[name] = make([]byte, i)
+		names = append(names, name)
+	}
+	s.packs.data["other"] = nil
+
+	e, ok, err := c.Stat("packs/05.ebpack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || e.Size != 5 {
+		t.Fatalf("bad stat %v %v", e, ok)
+	}
+	_, ok, err = c.Stat("packs/missing")
+	if err != nil || ok {
+		t.Fatalf("stat of missing file: %v %v", ok, err)
+	}
+
+	var listed []string
+	cursor := ""
+	pages := 0
+	for {
+		entries, next, err := c.List("packs/", cursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages++
+		for _, e := range entries {
+			if uint64(len(s.packs.data[e.Name])) != e.Size {
+				t.Fatalf("bad size for %s", e.Name)
+			}
+			listed = append(listed, e.Name)
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if !reflect.DeepEqual(listed, names) {
+		t.Fatalf("listed %v", listed)
+	}
+	if pages != 4 {
+		t.Fatalf("expected 4 pages, got %d", pages)
+	}
+}
+
+func TestStatUnsupported(t *testing.T) {
+	c, _ := newTestClient(t, nil)
+	defer c.Close()
+	_, _, err := c.Stat("packs")
+	if err != ErrUnsupported {
+		t.Fatalf("expected %v, got %v", ErrUnsupported, err)
+	}
+	_, _, err = c.List("", "")
+	if err != ErrUnsupported {
+		t.Fatalf("expected %v, got %v", ErrUnsupported, err)
+	}
+}
+
+func nextRoot(t *testing.T, w *Watch) *proto.RRootChanged {
+	select {
+	case m, ok := <-w.C:
+		if !ok {
+			t.Fatal("watch closed")
+		}
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for root")
+	}
+	return nil
+}
+
+func TestWatch(t *testing.T) {
+	c, s := newTestClient(t, nil, proto.CapWatch)
+	defer c.Close()
+	s.packs.root = &proto.RRootChanged{Value: "a", Version: "1", Signature: "s1"}
+	w, err := c.Watch("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := nextRoot(t, w); m.Version != "1" {
+		t.Fatalf("initial root has version %s", m.Version)
+	}
+	s.send(&proto.RRootChanged{Value: "b", Version: "2", Signature: "s2"})
+	s.send(&proto.RRootChanged{Value: "c", Version: "3", Signature: "s3"})
+	// Only the latest change is kept.
+	for {
+		m := nextRoot(t, w)
+		if m.Version == "3" {
+			break
+		}
+		if m.Version != "2" {
+			t.Fatalf("unexpected root version %s", m.Version)
+		}
+	}
+	w.Close()
+	_, ok := <-w.C
+	if ok {
+		t.Fatal("expected closed watch")
+	}
+}
+
+func TestWatchReconnect(t *testing.T) {
+	d := &testDialer{caps: []string{proto.CapWatch, proto.CapStat}, packs: newTestPacks(), drop: dropAfter(0, &proto.TStat{})}
+	d.packs.root = &proto.RRootChanged{Value: "a", Version: "1", Signature: "s1"}
+	c, err := Dial(d.dial, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	w, err := c.Watch("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nextRoot(t, w)
+	d.packs.lock.Lock()
+	d.packs.root = &proto.RRootChanged{Value: "b", Version: "2", Signature: "s2"}
+	d.packs.lock.Unlock()
+	// Dropped, the root change is only seen after subscribing again.
+	_, _, err = c.Stat("x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := nextRoot(t, w); m.Version != "2" {
+		t.Fatalf("root after reconnect has version %s", m.Version)
+	}
+	c.Close()
+	_, ok := <-w.C
+	if ok {
+		t.Fatal("expected watch to be closed with the client")
+	}
+}
+
+func TestNamedRoots(t *testing.T) {
+	c, s := newTestClient(t, nil, proto.CapNamedRoots, proto.CapWatch)
+	defer c.Close()
+	r, err := c.TGetNamedRoot("host1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Ok {
+		t.Fatal("expected missing root")
+	}
+	names := []string{"host1", "host2", "host3", "host4", "host5"}
+	for i, name := range names {
+		cas, err := c.TCasNamedRoot(name, "v", fmt.Sprintf("%d", i), "s", "e")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cas.Ok {
+			t.Fatalf("cas of %s failed", name)
+		}
+	}
+	r, err = c.TGetNamedRoot("host2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Ok || r.Version != "1" {
+		t.Fatalf("bad root %#v", r)
+	}
+	var listed []string
+	pages := 0
+	cursor := ""
+	for {
+		page, next, err := c.ListRoots(cursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages++
+		listed = append(listed, page...)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if !reflect.DeepEqual(listed, names) || pages != 2 {
+		t.Fatalf("listed %v in %d pages", listed, pages)
+	}
+
+	w1, err := c.Watch("host1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w1.Close()
+	w2, err := c.Watch("host2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w2.Close()
+	if m := nextRoot(t, w1); m.Name != "host1" || m.Version != "0" {
+		t.Fatalf("bad initial root %#v", m)
+	}
+	if m := nextRoot(t, w2); m.Name != "host2" || m.Version != "1" {
+		t.Fatalf("bad initial root %#v", m)
+	}
+	s.send(&proto.RRootChanged{Name: "host2", Value: "w", Version: "6", Signature: "s"})
+	if m := nextRoot(t, w2); m.Version != "6" {
+		t.Fatalf("bad root change %#v", m)
+	}
+	select {
+	case m := <-w1.C:
+		t.Fatalf("watch of host1 got %#v", m)
+	default:
+	}
+}
+
+func TestNamedRootsUnsupported(t *testing.T) {
+	c, _ := newTestClient(t, nil, proto.CapWatch)
+	defer c.Close()
+	_, _, err := c.ListRoots("")
+	if err != ErrUnsupported {
+		t.Fatalf("expected %v, got %v", ErrUnsupported, err)
+	}
+	_, err = c.Watch("host1")
+	if err != ErrUnsupported {
+		t.Fatalf("expected %v, got %v", ErrUnsupported, err)
+	}
+}
@@ -4,36 +4,227 @@ import (
 	"errors"
 	"github.com/buppyio/bpy/remote/proto"
 	"io"
+	"sync"
 )
 
 type File struct {
-	c      *Client
-	fid    uint32
+	c    *Client
+	fid  uint32
+	name string
+	// lock guards gen, the connection the file is open on.
+	lock   sync.Mutex
+	gen    uint64
 	offset uint64
+	// Sequential reads keep up to window TReadAt requests in flight past
+	// the offset, starting with one and doubling as full replies arrive so
+	// small files don't waste requests.
+	window int
+	ramp   int
+	ahead  []*readCall
+	next   uint64
+	// buf holds received data not yet returned by Read.
+	buf []byte
 }
 
 func (f *File) Read(buf []byte) (int, error) {
+	if len(f.buf) == 0 {
+		err := f.fill()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(buf, f.buf)
+	f.buf = f.buf[n:]
+	f.offset += uint64(n)
+	return n, nil
+}
+
+// open returns the connection the file is open on, after the client lost
+// the connection the file is opened again on a new one.
+func (f *File) open() (uint64, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for i := 0; ; i++ {
+		if i > 2*maxRedials {
+			return 0, ErrDisconnected
+		}
+		gen, ok := f.c.connected()
+		if ok && gen == f.gen {
+			return gen, nil
+		}
+		if !ok {
+			err := f.c.reconnect(gen)
+			if err != nil {
+				return 0, err
+			}
+			continue
+		}
+		resp, _, err := f.c.callOn(gen, func(mid uint16) proto.Message {
+			return &proto.TOpen{
+				Mid:  mid,
+				Fid:  f.fid,
+				Name: f.name,
+			}
+		})
+		if err == nil {
+			if _, ok := resp.(*proto.ROpen); !ok {
+				return 0, ErrBadResponse
+			}
+			f.gen = gen
+			return gen, nil
+		}
+		if err != ErrDisconnected {
+			return 0, err
+		}
+	}
+}
+
+// retry reports whether an operation that failed with err should be
+// retried once the file is reopened.
+func (f *File) retry(err error, attempt int) bool {
+	return err == ErrDisconnected && f.c.dial != nil && attempt < maxRedials
+}
+
+func (f *File) fill() error {
+	for i := 0; ; i++ {
+		err := f.fillWindow()
+		if !f.retry(err, i) {
+			return err
+		}
+	}
+}
+
+// fillWindow waits for the next reply of the read ahead window, sending
+// more requests to keep the window full.
+func (f *File) fillWindow() error {
+	gen, err := f.open()
+	if err != nil {
+		return err
+	}
 	maxn := f.c.getMaxMessageSize() - proto.READOVERHEAD
-	n := uint32(len(buf))
-	if n > maxn {
-		n = maxn
+	if len(f.ahead) == 0 {
+		f.next = f.offset
+	}
+	for len(f.ahead) < f.ramp {
+		rc, err := f.c.startReadAt(gen, f.fid, f.next, maxn)
+		if err != nil {
+			if len(f.ahead) == 0 {
+				return err
+			}
+			break
+		}
+		f.ahead = append(f.ahead, rc)
+		f.next += uint64(maxn)
+	}
+	rc := f.ahead[0]
+	f.ahead = f.ahead[1:]
+	data, err := rc.wait()
+	if err != nil {
+		f.drain()
+		return err
 	}
-	resp, err := f.c.TReadAt(f.fid, f.offset, n)
+	if uint32(len(data)) < rc.size {
+		// Later requests were sent past the end of the data, they are
+		// resent from the new offset if the file continues.
+		f.drain()
+	} else if f.ramp < f.window {
+		f.ramp *= 2
+		if f.ramp > f.window {
+			f.ramp = f.window
+		}
+	}
+	if len(data) == 0 {
+		return io.EOF
+	}
+	f.buf = data
+	return nil
+}
+
+// drain waits for every outstanding read ahead request.
+func (f *File) drain() {
+	for _, rc := range f.ahead {
+		rc.wait()
+	}
+	f.ahead = nil
+	f.ramp = 1
+}
+
+// ReadAt does not use the file offset and is safe for concurrent use, large
+// reads are split into requests that are sent in parallel.
+func (f *File) ReadAt(buf []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	nread := 0
+	for i := 0; ; i++ {
+		n, err := f.readAt(buf[nread:], off+int64(nread))
+		nread += n
+		if !f.retry(err, i) {
+			return nread, err
+		}
+	}
+}
+
+func (f *File) readAt(buf []byte, off int64) (int, error) {
+	gen, err := f.open()
 	if err != nil {
 		return 0, err
 	}
-	if len(resp.Data) == 0 {
-		return 0, io.EOF
+	maxn := f.c.getMaxMessageSize() - proto.READOVERHEAD
+	var calls []*readCall
+	defer func() {
+		for _, rc := range calls {
+			rc.wait()
+		}
+	}()
+	nread := 0
+	nsent := 0
+	for nread != len(buf) {
+		for len(calls) < f.window && nsent != len(buf) {
+			n := uint32(len(buf) - nsent)
+			if n > maxn {
+				n = maxn
+			}
+			rc, err := f.c.startReadAt(gen, f.fid, uint64(off)+uint64(nsent), n)
+			if err != nil {
+				if len(calls) == 0 {
+					return nread, err
+				}
+				break
+			}
+			calls = append(calls, rc)
+			nsent += int(n)
+		}
+		rc := calls[0]
+		calls = calls[1:]
+		data, err := rc.wait()
+		if err != nil {
+			return nread, err
+		}
+		if len(data) == 0 {
+			return nread, io.EOF
+		}
+		nread += copy(buf[nread:], data)
+		if uint32(len(data)) < rc.size {
+			// Resend everything after a short read.
+			for _, rc := range calls {
+				rc.wait()
+			}
+			calls = nil
+			nsent = nread
+		}
 	}
-	ncopied := copy(buf, resp.Data)
-	f.offset += uint64(ncopied)
-	return ncopied, nil
+	return nread, nil
 }
 
 func (f *File) Seek(offset int64, whence int) (int64, error) {
 	switch whence {
 	case io.SeekStart:
-		f.offset = uint64(offset)
+		if uint64(offset) != f.offset {
+			f.drain()
+			f.buf = nil
+			f.offset = uint64(offset)
+		}
 		return int64(f.offset), nil
 	default:
 		return int64(f.offset), errors.New("seek unsupported")
@@ -41,7 +232,26 @@ func (f *File) Seek(offset int64, whence int) (int64, error) {
 }
 
 func (f *File) Close() error {
+	f.drain()
 	f.c.freeFid(f.fid)
-	_, err := f.c.TClose(f.fid)
-	return err
+	f.lock.Lock()
+	gen := f.gen
+	f.lock.Unlock()
+	resp, _, err := f.c.callOn(gen, func(mid uint16) proto.Message {
+		return &proto.TClose{
+			Mid: mid,
+			Fid: f.fid,
+		}
+	})
+	if err == ErrDisconnected && f.c.dial != nil {
+		// The file was only open on the lost connection.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, ok := resp.(*proto.RClose); !ok {
+		return ErrBadResponse
+	}
+	return nil
 }
@@ -0,0 +1,365 @@
+package client
+
+import (
+	"bytes"
+	"github.com/buppyio/bpy/remote/proto"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testPacks holds uploaded packs, shared by the connections of a testDialer.
+type testPacks struct {
+	lock   sync.Mutex
+	data   map[string][]byte
+	closed map[string]bool
+	root   *proto.RRootChanged
+	named  map[string]*proto.RRootChanged
+}
+
+// testServer serves a single file, replying to reads out of order after a
+// delay so pipelining is exercised.
+type testServer struct {
+	conn  net.Conn
+	data  []byte
+	maxsz uint32
+	// caps is nil for servers that only speak proto.Version1.
+	caps []string
+	// closeOnReject closes the connection after rejecting a version.
+	closeOnReject bool
+	// drop closes the connection instead of handling a message when it
+	// returns true.
+	drop    func(m proto.Message) bool
+	packs   *testPacks
+	pids    map[uint32]string
+	wLock   sync.Mutex
+	wBuf    []byte
+	lock    sync.Mutex
+	pending int
+	maxSeen int
+	reads   int
+}
+
+func (s *testServer) send(m proto.Message) {
+	s.wLock.Lock()
+	defer s.wLock.Unlock()
+	proto.WriteMessage(s.conn, m, s.wBuf)
+}
+
+func (s *testServer) serve() {
+	buf := make([]byte, 1024*1024)
+	s.wBuf = make([]byte, 1024*1024)
+	for {
+		m, err := proto.ReadMessage(s.conn, buf)
+		if err != nil {
+			return
+		}
+		if s.drop != nil && s.drop(m) {
+			s.conn.Close()
+			return
+		}
+		switch m := m.(type) {
+		case *proto.TAttach:
+			switch {
+			case m.Version == proto.Version1:
+				s.send(&proto.RAttach{Mid: m.Mid, MaxMessageSize: s.maxsz})
+			case m.Version == proto.Version2 && s.caps != nil:
+				s.send(&proto.RAttach2{Mid: m.Mid, MaxMessageSize: s.maxsz, Capabilities: proto.JoinCapabilities(s.caps)})
+			default:
+				s.send(&proto.RError{Mid: m.Mid, Message: "unsupported version"})
+				if s.closeOnReject {
+					s.conn.Close()
+					return
+				}
+			}
+		case *proto.TOpen:
+			s.send(&proto.ROpen{Mid: m.Mid})
+		case *proto.TClose:
+			s.send(&proto.RClose{Mid: m.Mid})
+		case *proto.TReadAt:
+			s.lock.Lock()
+			s.pending++
+			s.reads++
+			if s.pending > s.maxSeen {
+				s.maxSeen = s.pending
+			}
+			s.lock.Unlock()
+			go func(m proto.TReadAt) {
+				time.Sleep(time.Duration(rand.Intn(2000)) * time.Microsecond)
+				s.lock.Lock()
+				s.pending--
+				s.lock.Unlock()
+				data := []byte{}
+				if m.Offset < uint64(len(s.data)) {
+					end := m.Offset + uint64(m.Size)
+					if end > uint64(len(s.data)) {
+						end = uint64(len(s.data))
+					}
+					data = s.data[m.Offset:end]
+				}
+				s.send(&proto.RReadAt{Mid: m.Mid, Data: data})
+			}(*m)
+		default:
+			s.servePack(m)
+		}
+	}
+}
+
+func (s *testServer) servePack(m proto.Message) {
+	s.packs.lock.Lock()
+	defer s.packs.lock.Unlock()
+	switch m := m.(type) {
+	case *proto.TNewPack:
+		s.packs.data[m.Name] = []byte{}
+		s.pids[m.Pid] = m.Name
+		s.send(&proto.RNewPack{Mid: m.Mid})
+	case *proto.TWritePack:
+		name := s.pids[m.Pid]
+		s.packs.data[name] = append(s.packs.data[name], m.Data...)
+	case *proto.TClosePack:
+		s.packs.closed[s.pids[m.Pid]] = true
+		delete(s.pids, m.Pid)
+		s.send(&proto.RClosePack{Mid: m.Mid})
+	case *proto.TCancelPack:
+		delete(s.packs.data, s.pids[m.Pid])
+		delete(s.pids, m.Pid)
+		s.send(&proto.RCancelPack{Mid: m.Mid})
+	case *proto.TSyncPack:
+		s.send(&proto.RSyncPack{Mid: m.Mid, Offset: uint64(len(s.packs.data[s.pids[m.Pid]]))})
+	case *proto.TResumePack:
+		data, ok := s.packs.data[m.Name]
+		if !ok || s.packs.closed[m.Name] {
+			s.send(&proto.RError{Mid: m.Mid, Message: "no such upload"})
+			return
+		}
+		s.pids[m.Pid] = m.Name
+		s.send(&proto.RResumePack{Mid: m.Mid, Offset: uint64(len(data))})
+	case *proto.TStat:
+		data, ok := s.packs.data[m.Name]
+		s.send(&proto.RStat{Mid: m.Mid, Exists: ok, Size: uint64(len(data))})
+	case *proto.TList:
+		s.send(s.list(m))
+	case *proto.TWatch:
+		r := &proto.RWatch{Mid: m.Mid}
+		root := s.packs.root
+		if m.Name != "" {
+			root = s.packs.named[m.Name]
+		}
+		if root != nil {
+			r.Value, r.Version, r.Signature, r.Ok = root.Value, root.Version, root.Signature, true
+		}
+		s.send(r)
+	case *proto.TGetNamedRoot:
+		r := &proto.RGetRoot{Mid: m.Mid}
+		root, ok := s.packs.named[m.Name]
+		if ok {
+			r.Value, r.Version, r.Signature, r.Ok = root.Value, root.Version, root.Signature, true
+		}
+		s.send(r)
+	case *proto.TCasNamedRoot:
+		// Real servers check the version follows the current one, any
+		// new version is enough here.
+		root, ok := s.packs.named[m.Name]
+		if ok && root.Version == m.Version {
+			s.send(&proto.RCasRoot{Mid: m.Mid})
+			return
+		}
+		s.packs.named[m.Name] = &proto.RRootChanged{Name: m.Name, Value: m.Value, Version: m.Version, Signature: m.Signature}
+		s.send(&proto.RCasRoot{Mid: m.Mid, Ok: true})
+	case *proto.TListRoots:
+		var names []string
+		for name := range s.packs.named {
+			if name > m.Cursor {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		r := &proto.RListRoots{Mid: m.Mid}
+		if len(names) > listPage {
+			names = names[:listPage]
+			r.Next = names[listPage-1]
+		}
+		r.Names = strings.Join(names, "\n")
+		s.send(r)
+	default:
+		s.send(&proto.RError{Mid: proto.GetMessageId(m), Message: "unsupported"})
+	}
+}
+
+// listPage is the most files the test server lists at once, so clients
+// have to page.
+const listPage = 3
+
+func (s *testServer) list(m *proto.TList) *proto.RList {
+	var names []string
+	for name := range s.packs.data {
+		if strings.HasPrefix(name, m.Prefix) && name > m.Cursor {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	max := int(m.Max)
+	if max > listPage {
+		max = listPage
+	}
+	r := &proto.RList{Mid: m.Mid}
+	if len(names) > max {
+		names = names[:max]
+		r.Next = names[max-1]
+	}
+	var entries []proto.ListEntry
+	for _, name := range names {
+		entries = append(entries, proto.ListEntry{Name: name, Size: uint64(len(s.packs.data[name]))})
+	}
+	r.Entries = proto.PackListEntries(entries)
+	return r
+}
+
+func newTestServer(conn net.Conn, data []byte, caps []string, packs *testPacks) *testServer {
+	return &testServer{
+		conn:  conn,
+		data:  data,
+		maxsz: 4096 + proto.READOVERHEAD,
+		caps:  caps,
+		packs: packs,
+		pids:  make(map[uint32]string),
+	}
+}
+
+func newTestPacks() *testPacks {
+	return &testPacks{
+		data:   make(map[string][]byte),
+		closed: make(map[string]bool),
+		named:  make(map[string]*proto.RRootChanged),
+	}
+}
+
+// testDialer connects to a new testServer each time, drop is used for the
+// first connection only.
+type testDialer struct {
+	data  []byte
+	caps  []string
+	packs *testPacks
+	drop  func(m proto.Message) bool
+	dials int
+	// closeOnReject is passed on to every testServer.
+	closeOnReject bool
+}
+
+func (d *testDialer) dial() (io.ReadWriteCloser, error) {
+	d.dials++
+	cconn, sconn := net.Pipe()
+	s := newTestServer(sconn, d.data, d.caps, d.packs)
+	s.closeOnReject = d.closeOnReject
+	if d.dials == 1 {
+		s.drop = d.drop
+	}
+	go s.serve()
+	return cconn, nil
+}
+
+func newTestClient(t *testing.T, data []byte, caps ...string) (*Client, *testServer) {
+	cconn, sconn := net.Pipe()
+	s := newTestServer(sconn, data, caps, newTestPacks())
+	go s.serve()
+	c, err := Attach(cconn, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, s
+}
+
+func TestPipelinedReads(t *testing.T) {
+	data := make([]byte, 100*1024+17)
+	rand.New(rand.NewSource(1)).Read(data)
+	c, s := newTestClient(t, data)
+	defer c.Close()
+
+	f, err := c.Open("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("sequential read mismatch")
+	}
+	if s.maxSeen < 2 {
+		t.Fatal("reads were not pipelined")
+	}
+
+	_, err = f.Seek(5000, io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = make([]byte, 10)
+	_, err = io.ReadFull(f, got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data[5000:5010]) {
+		t.Fatal("read after seek mismatch")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(off int) {
+			defer wg.Done()
+			buf := make([]byte, 50*1024)
+			n, err := f.ReadAt(buf, int64(off))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if n != len(buf) || !bytes.Equal(buf, data[off:off+len(buf)]) {
+				t.Error("ReadAt mismatch")
+			}
+		}(i * 10000)
+	}
+	wg.Wait()
+
+	buf := make([]byte, 10000)
+	n, err := f.ReadAt(buf, int64(len(data)-100))
+	if err != io.EOF || n != 100 || !bytes.Equal(buf[:n], data[len(data)-100:]) {
+		t.Fatalf("bad read past the end: %d %v", n, err)
+	}
+
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSmallFileRead(t *testing.T) {
+	data := []byte("hello")
+	c, s := newTestClient(t, data)
+	defer c.Close()
+	f, err := c.Open("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("read mismatch")
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// One short read and one empty read at the end.
+	if s.reads != 2 {
+		t.Fatalf("expected two reads, got %d", s.reads)
+	}
+}
@@ -0,0 +1,174 @@
+package client
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrBadRate     = errors.New("bad rate, expected a size per second like 2MiB/s")
+	ErrBadSchedule = errors.New("bad schedule, expected entries like 08:00-18:00=1MiB/s")
+)
+
+var rateUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30},
+	{"KB", 1000}, {"MB", 1000 * 1000}, {"GB", 1000 * 1000 * 1000},
+	{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30},
+	{"B", 1},
+}
+
+// ParseRate parses a rate in bytes per second such as 512KiB/s or 2MB, the
+// /s is optional. 0 and unlimited mean no limit.
+func ParseRate(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "unlimited" {
+		return 0, nil
+	}
+	s = strings.TrimSuffix(s, "/s")
+	mult := int64(1)
+	for _, u := range rateUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			s = strings.TrimSuffix(s, u.suffix)
+			mult = u.size
+			break
+		}
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || v < 0 {
+		return 0, ErrBadRate
+	}
+	return int64(v * float64(mult)), nil
+}
+
+// Period applies Rate from Start until End, both measured from midnight.
+// Periods with End before Start continue past midnight.
+type Period struct {
+	Start time.Duration
+	End   time.Duration
+	Rate  int64
+}
+
+func (p Period) contains(t time.Duration) bool {
+	if p.Start <= p.End {
+		return t >= p.Start && t < p.End
+	}
+	return t >= p.Start || t < p.End
+}
+
+// Schedule is a rate limit in bytes per second that depends on the local
+// time of day, 0 means no limit.
+type Schedule struct {
+	Default int64
+	Periods []Period
+}
+
+// ParseSchedule parses comma separated entries, either a rate that applies
+// outside of the periods or a period like 08:00-18:00=1MiB/s. A single rate
+// applies all day.
+func ParseSchedule(s string) (Schedule, error) {
+	sched := Schedule{}
+	if strings.TrimSpace(s) == "" {
+		return sched, nil
+	}
+	for _, entry := range strings.Split(s, ",") {
+		eq := strings.Index(entry, "=")
+		if eq == -1 {
+			rate, err := ParseRate(entry)
+			if err != nil {
+				return Schedule{}, err
+			}
+			sched.Default = rate
+			continue
+		}
+		rate, err := ParseRate(entry[eq+1:])
+		if err != nil {
+			return Schedule{}, err
+		}
+		times := strings.Split(strings.TrimSpace(entry[:eq]), "-")
+		if len(times) != 2 {
+			return Schedule{}, ErrBadSchedule
+		}
+		start, err := parseTimeOfDay(times[0])
+		if err != nil {
+			return Schedule{}, err
+		}
+		end, err := parseTimeOfDay(times[1])
+		if err != nil {
+			return Schedule{}, err
+		}
+		sched.Periods = append(sched.Periods, Period{Start: start, End: end, Rate: rate})
+	}
+	return sched, nil
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, ErrBadSchedule
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Rate returns the limit at t, from the first period containing it.
+func (s Schedule) Rate(t time.Time) int64 {
+	sinceMidnight := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	for _, p := range s.Periods {
+		if p.contains(sinceMidnight) {
+			return p.Rate
+		}
+	}
+	return s.Default
+}
+
+// Limiter is a token bucket holding up to a second of transfer at the
+// rate of its schedule. The schedule is checked on each transfer, so long
+// running clients follow it through the day.
+type Limiter struct {
+	schedule Schedule
+
+	lock   sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func NewLimiter(s Schedule) *Limiter {
+	return &Limiter{schedule: s}
+}
+
+// Wait blocks until n bytes may be transferred, waiters are served in
+// turn. A nil Limiter never blocks.
+func (l *Limiter) Wait(n int) {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	rate := float64(l.schedule.Rate(now))
+	if rate <= 0 {
+		l.tokens = 0
+		l.last = now
+		return
+	}
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * rate
+	} else {
+		l.tokens = rate
+	}
+	if l.tokens > rate {
+		l.tokens = rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens < 0 {
+		// The debt is paid off by the time that passes before the next
+		// call, which includes this sleep.
+		time.Sleep(time.Duration(-l.tokens / rate * float64(time.Second)))
+	}
+}
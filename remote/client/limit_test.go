@@ -0,0 +1,127 @@
+package client
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	for s, want := range map[string]int64{
+		"0":         0,
+		"unlimited": 0,
+		"100":       100,
+		"2MiB/s":    2 << 20,
+		"512KiB":    512 << 10,
+		"1.5M/s":    3 << 19,
+		"2MB/s":     2000000,
+		"10 KB/s":   10000,
+		"1GiB":      1 << 30,
+	} {
+		got, err := ParseRate(s)
+		if err != nil {
+			t.Fatalf("%q: %s", s, err)
+		}
+		if got != want {
+			t.Fatalf("%q: got %d, expected %d", s, got, want)
+		}
+	}
+	for _, s := range []string{"", "fast", "-1", "2TiB", "MiB"} {
+		_, err := ParseRate(s)
+		if err != ErrBadRate {
+			t.Fatalf("%q: expected %v, got %v", s, ErrBadRate, err)
+		}
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	s, err := ParseSchedule("08:00-18:00=1MiB/s, 22:00-06:00=unlimited, 4MiB/s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Schedule{
+		Default: 4 << 20,
+		Periods: []Period{
+			{Start: 8 * time.Hour, End: 18 * time.Hour, Rate: 1 << 20},
+			{Start: 22 * time.Hour, End: 6 * time.Hour, Rate: 0},
+		},
+	}
+	if !reflect.DeepEqual(s, want) {
+		t.Fatalf("%#v != %#v", s, want)
+	}
+	for hour, rate := range map[int]int64{0: 0, 5: 0, 6: 4 << 20, 8: 1 << 20, 17: 1 << 20, 18: 4 << 20, 23: 0} {
+		at := time.Date(2016, 1, 1, hour, 30, 0, 0, time.Local)
+		if got := s.Rate(at); got != rate {
+			t.Fatalf("rate at %d:30 is %d, expected %d", hour, got, rate)
+		}
+	}
+	s, err = ParseSchedule("")
+	if err != nil || s.Rate(time.Now()) != 0 {
+		t.Fatal("empty schedule should be unlimited")
+	}
+	for _, bad := range []string{"08:00=1M", "8-18=1M", "08:00-25:00=1M", "08:00-18:00=x"} {
+		_, err := ParseSchedule(bad)
+		if err == nil {
+			t.Fatalf("%q should not parse", bad)
+		}
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	var nilLimiter *Limiter
+	nilLimiter.Wait(1 << 30)
+
+	const rate = 100 * 1024
+	l := NewLimiter(Schedule{Default: rate})
+	start := time.Now()
+	// The first second is allowed at once, the rest has to wait.
+	for i := 0; i < 15; i++ {
+		l.Wait(rate / 10)
+	}
+	elapsed := time.Since(start)
+	if elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatalf("1.5s of data at the limit took %s", elapsed)
+	}
+
+	unlimited := NewLimiter(Schedule{})
+	start = time.Now()
+	unlimited.Wait(1 << 30)
+	if time.Since(start) > 100*time.Millisecond {
+		t.Fatal("unlimited limiter blocked")
+	}
+}
+
+func TestLimitTransfers(t *testing.T) {
+	const rate = 256 * 1024
+	data := make([]byte, rate*3/2)
+	c, _ := newTestClient(t, data)
+	defer c.Close()
+	c.SetLimits(NewLimiter(Schedule{Default: rate}), NewLimiter(Schedule{Default: rate}))
+
+	start := time.Now()
+	err := writePack(c, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Fatalf("upload at %d bytes/s took %s", rate, elapsed)
+	}
+
+	start = time.Now()
+	f, err := c.Open("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	got, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(data) {
+		t.Fatalf("read %d bytes, expected %d", len(got), len(data))
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Fatalf("download at %d bytes/s took %s", rate, elapsed)
+	}
+}
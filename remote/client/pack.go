@@ -4,9 +4,21 @@ import (
 	"github.com/buppyio/bpy/remote/proto"
 )
 
+// Resumable packs ask the server how much it has received after every
+// packSyncInterval bytes, so that much less has to be kept for resending.
+var packSyncInterval = 8 * 1024 * 1024
+
 type Pack struct {
-	c   *Client
-	pid uint32
+	c    *Client
+	pid  uint32
+	name string
+	gen  uint64
+	// resumable packs keep the data the server may not have received in
+	// unacked, acked is the offset of its first byte.
+	resumable bool
+	acked     uint64
+	unacked   []byte
+	unsynced  int
 }
 
 func (p *Pack) Write(buf []byte) (int, error) {
@@ -14,14 +26,41 @@ func (p *Pack) Write(buf []byte) (int, error) {
 	if err != nil {
 		return 0, err
 	}
+	if !p.resumable {
+		return p.send(buf)
+	}
+	p.unacked = append(p.unacked, buf...)
+	_, err = p.send(buf)
+	if err == ErrDisconnected {
+		err = p.resume()
+	}
+	if err != nil {
+		return 0, err
+	}
+	p.unsynced += len(buf)
+	if p.unsynced >= packSyncInterval {
+		err = p.sync()
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(buf), nil
+}
+
+func (p *Pack) send(buf []byte) (int, error) {
 	maxn := p.c.getMaxMessageSize() - proto.WRITEOVERHEAD
+	upload, _ := p.c.limits()
 	nsent := 0
 	for len(buf) != 0 {
 		n := maxn
 		if uint32(len(buf)) < n {
 			n = uint32(len(buf))
 		}
-		err := p.c.TWritePack(p.pid, buf[:n])
+		upload.Wait(int(n))
+		_, err := p.c.writeOn(p.gen, &proto.TWritePack{
+			Pid:  p.pid,
+			Data: buf[:n],
+		})
 		if err != nil {
 			return nsent, err
 		}
@@ -31,14 +70,114 @@ func (p *Pack) Write(buf []byte) (int, error) {
 	return nsent, nil
 }
 
+// ack drops the data before offset, which the server has received.
+func (p *Pack) ack(offset uint64) error {
+	if offset < p.acked || offset-p.acked > uint64(len(p.unacked)) {
+		return ErrBadResponse
+	}
+	p.unacked = append(p.unacked[:0], p.unacked[offset-p.acked:]...)
+	p.acked = offset
+	return nil
+}
+
+func (p *Pack) sync() error {
+	resp, _, err := p.c.callOn(p.gen, func(mid uint16) proto.Message {
+		return &proto.TSyncPack{
+			Mid: mid,
+			Pid: p.pid,
+		}
+	})
+	if err == ErrDisconnected {
+		return p.resume()
+	}
+	if err != nil {
+		return err
+	}
+	rSyncPack, ok := resp.(*proto.RSyncPack)
+	if !ok {
+		return ErrBadResponse
+	}
+	p.unsynced = 0
+	return p.ack(rSyncPack.Offset)
+}
+
+// resume reconnects and continues the upload from where the server lost it.
+func (p *Pack) resume() error {
+	for i := 0; ; i++ {
+		err := p.c.reconnect(p.gen)
+		if err != nil {
+			return err
+		}
+		gen, _ := p.c.connected()
+		resp, _, err := p.c.callOn(gen, func(mid uint16) proto.Message {
+			return &proto.TResumePack{
+				Mid:  mid,
+				Pid:  p.pid,
+				Name: p.name,
+			}
+		})
+		p.gen = gen
+		if err == nil {
+			rResumePack, ok := resp.(*proto.RResumePack)
+			if !ok {
+				return ErrBadResponse
+			}
+			err = p.ack(rResumePack.Offset)
+			if err != nil {
+				return err
+			}
+			p.c.setPidError(p.pid, nil)
+			_, err = p.send(p.unacked)
+		}
+		if err != ErrDisconnected || i == maxRedials {
+			return err
+		}
+	}
+}
+
 func (p *Pack) Close() error {
-	p.c.freePid(p.pid)
-	_, err := p.c.TClosePack(p.pid)
-	return err
+	defer p.c.freePid(p.pid)
+	for i := 0; ; i++ {
+		resp, _, err := p.c.callOn(p.gen, func(mid uint16) proto.Message {
+			return &proto.TClosePack{
+				Mid: mid,
+				Pid: p.pid,
+			}
+		})
+		if err == ErrDisconnected && p.resumable && i < maxRedials {
+			err = p.resume()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if _, ok := resp.(*proto.RClosePack); !ok {
+			return ErrBadResponse
+		}
+		return nil
+	}
 }
 
 func (p *Pack) Cancel() error {
 	p.c.freePid(p.pid)
-	_, err := p.c.TCancelPack(p.pid)
-	return err
+	resp, _, err := p.c.callOn(p.gen, func(mid uint16) proto.Message {
+		return &proto.TCancelPack{
+			Mid: mid,
+			Pid: p.pid,
+		}
+	})
+	if err == ErrDisconnected && p.resumable {
+		// The server discards uploads that are never resumed.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, ok := resp.(*proto.RCancelPack); !ok {
+		return ErrBadResponse
+	}
+	return nil
 }
@@ -0,0 +1,233 @@
+// Package dial connects to remotes named by a spec:
+//
+//	tls://host:port          TCP with mutual certificate authentication
+//	https://host/path        an HTTP connection upgraded to the protocol
+//	unix:///path/to/sock     a unix socket
+//	cmd:ssh host bpy remote  a command piped to the remote protocol
+//
+// Specs without a scheme are commands, as BPY_REMOTE_CMD used to be.
+package dial
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+var (
+	ErrBadSpec  = errors.New("bad remote spec")
+	ErrNoTLS    = errors.New("tls remote needs a certificate configuration")
+	ErrBadQuote = errors.New("unterminated quote")
+)
+
+const (
+	SchemeTLS   = "tls"
+	SchemeHTTPS = "https"
+	SchemeHTTP  = "http"
+	SchemeUnix  = "unix"
+	SchemeCmd   = "cmd"
+)
+
+// Parse splits a spec into its scheme and address, the address of a
+// command is the command line.
+func Parse(spec string) (string, string, error) {
+	switch {
+	case strings.HasPrefix(spec, "tls://"):
+		addr := strings.TrimPrefix(spec, "tls://")
+		_, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return "", "", fmt.Errorf("%s: %s", ErrBadSpec, err)
+		}
+		return SchemeTLS, addr, nil
+	case strings.HasPrefix(spec, "https://") || strings.HasPrefix(spec, "http://"):
+		u, err := url.Parse(spec)
+		if err != nil {
+			return "", "", fmt.Errorf("%s: %s", ErrBadSpec, err)
+		}
+		if u.Host == "" {
+			return "", "", ErrBadSpec
+		}
+		return u.Scheme, spec, nil
+	case strings.HasPrefix(spec, "unix://"):
+		path := strings.TrimPrefix(spec, "unix://")
+		if path == "" {
+			return "", "", ErrBadSpec
+		}
+		return SchemeUnix, path, nil
+	case strings.HasPrefix(spec, "cmd:"):
+		return SchemeCmd, strings.TrimPrefix(spec, "cmd:"), nil
+	case strings.Contains(spec, "://"):
+		return "", "", ErrBadSpec
+	default:
+		return SchemeCmd, spec, nil
+	}
+}
+
+// Dial connects to the remote named by spec. tlsConfig is only needed for
+// tls:// remotes, https:// remotes are verified with the system roots and
+// reached through the proxy named by HTTPS_PROXY if set.
+func Dial(spec string, tlsConfig *TLSConfig) (io.ReadWriteCloser, error) {
+	scheme, addr, err := Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	switch scheme {
+	case SchemeTLS:
+		if tlsConfig == nil {
+			return nil, ErrNoTLS
+		}
+		return dialTLS(addr, tlsConfig)
+	case SchemeHTTPS, SchemeHTTP:
+		return dialHTTP(addr, nil, http.ProxyFromEnvironment)
+	case SchemeUnix:
+		return net.Dial("unix", addr)
+	default:
+		return dialCommand(addr)
+	}
+}
+
+// Listen accepts connections for tls:// and unix:// specs, so the remote
+// protocol can be served as a long lived network service. Clients of a
+// tls:// listener must present a certificate signed by the configured CA.
+// https:// remotes are served by an HTTP server using HTTPHandler.
+func Listen(spec string, tlsConfig *TLSConfig) (net.Listener, error) {
+	scheme, addr, err := Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	switch scheme {
+	case SchemeTLS:
+		if tlsConfig == nil {
+			return nil, ErrNoTLS
+		}
+		return listenTLS(addr, tlsConfig)
+	case SchemeUnix:
+		return net.Listen("unix", addr)
+	default:
+		return nil, fmt.Errorf("cannot listen on %s remotes", scheme)
+	}
+}
+
+type command struct {
+	in  io.ReadCloser
+	out io.WriteCloser
+	cmd *exec.Cmd
+}
+
+func (c *command) Read(buf []byte) (int, error) {
+	return c.in.Read(buf)
+}
+
+func (c *command) Write(buf []byte) (int, error) {
+	return c.out.Write(buf)
+}
+
+func (c *command) Close() error {
+	err := c.cmd.Process.Kill()
+	c.cmd.Wait()
+	return err
+}
+
+func dialCommand(cmdline string) (io.ReadWriteCloser, error) {
+	args, err := SplitCommand(cmdline)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) < 2 {
+		return nil, fmt.Errorf("invalid remote command: '%s'", cmdline)
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	out, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	in, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stderr = os.Stderr
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	return &command{
+		in:  in,
+		out: out,
+		cmd: cmd,
+	}, nil
+}
+
+// SplitCommand splits a command line into arguments like a posix shell,
+// handling single quotes, double quotes and backslash escapes. Variables
+// and globs are not expanded.
+func SplitCommand(s string) ([]string, error) {
+	var args []string
+	var arg []byte
+	inArg := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			if inArg {
+				args = append(args, string(arg))
+				arg = arg[:0]
+				inArg = false
+			}
+		case c == '\\':
+			inArg = true
+			i++
+			if i == len(s) {
+				return nil, ErrBadQuote
+			}
+			if s[i] != '\n' {
+				arg = append(arg, s[i])
+			}
+		case c == '\'':
+			inArg = true
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end == -1 {
+				return nil, ErrBadQuote
+			}
+			arg = append(arg, s[i+1:i+1+end]...)
+			i += end + 1
+		case c == '"':
+			inArg = true
+			i++
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) && strings.IndexByte("\\\"$`\n", s[i+1]) != -1 {
+					i++
+					if s[i] == '\n' {
+						continue
+					}
+				}
+				arg = append(arg, s[i])
+			}
+			if i == len(s) {
+				return nil, ErrBadQuote
+			}
+		default:
+			inArg = true
+			arg = append(arg, c)
+		}
+	}
+	if inArg {
+		args = append(args, string(arg))
+	}
+	return args, nil
+}
+
+// QuoteCommand joins arguments into a command line that SplitCommand
+// splits back into the same arguments.
+func QuoteCommand(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
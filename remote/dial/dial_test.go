@@ -0,0 +1,357 @@
+package dial
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSplitCommand(t *testing.T) {
+	tests := []struct {
+		in  string
+		out []string
+	}{
+		{"ssh host bpy remote", []string{"ssh", "host", "bpy", "remote"}},
+		{"  ssh\t host  ", []string{"ssh", "host"}},
+		{`ssh -i 'my key' host`, []string{"ssh", "-i", "my key", "host"}},
+		{`ssh "a \"b\" \c" d`, []string{"ssh", `a "b" \c`, "d"}},
+		{`a\ b c''d ""`, []string{"a b", "cd", ""}},
+	}
+	for _, tc := range tests {
+		args, err := SplitCommand(tc.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(args, tc.out) {
+			t.Fatalf("%q: got %q expected %q", tc.in, args, tc.out)
+		}
+	}
+	for _, bad := range []string{`a 'b`, `a "b`, `a\`} {
+		_, err := SplitCommand(bad)
+		if err != ErrBadQuote {
+			t.Fatalf("%q: expected an error", bad)
+		}
+	}
+}
+
+func TestQuoteCommand(t *testing.T) {
+	for _, args := range [][]string{
+		{`C:\bpy\bpy.exe`, "remote"},
+		{"it's", `"a b"`, "", `\`},
+	} {
+		out, err := SplitCommand(QuoteCommand(args))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(out, args) {
+			t.Fatalf("got %q expected %q", out, args)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		spec, scheme, addr string
+	}{
+		{"tls://example.com:4321", SchemeTLS, "example.com:4321"},
+		{"unix:///tmp/bpy.sock", SchemeUnix, "/tmp/bpy.sock"},
+		{"https://example.com/bpy", SchemeHTTPS, "https://example.com/bpy"},
+		{"cmd:ssh host bpy remote", SchemeCmd, "ssh host bpy remote"},
+		{"ssh host bpy remote", SchemeCmd, "ssh host bpy remote"},
+	}
+	for _, tc := range tests {
+		scheme, addr, err := Parse(tc.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if scheme != tc.scheme || addr != tc.addr {
+			t.Fatalf("%s: got %s %s", tc.spec, scheme, addr)
+		}
+	}
+	for _, bad := range []string{"tls://example.com", "unix://", "https:///path", "ftp://example.com"} {
+		_, _, err := Parse(bad)
+		if err == nil {
+			t.Fatalf("%s: expected an error", bad)
+		}
+	}
+}
+
+type testCA struct {
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func writePEM(path, typ string, der []byte) error {
+	return ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600)
+}
+
+func newTestCA(t *testing.T, dir string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writePEM(filepath.Join(dir, "ca.crt"), "CERTIFICATE", der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{dir: dir, cert: cert, key: key}
+}
+
+// issue writes a certificate and key signed by the CA named name.crt and
+// name.key.
+func (ca *testCA) issue(t *testing.T, name string, serial int64) *TLSConfig {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &TLSConfig{
+		CertFile: filepath.Join(ca.dir, name+".crt"),
+		KeyFile:  filepath.Join(ca.dir, name+".key"),
+		CAFile:   filepath.Join(ca.dir, "ca.crt"),
+	}
+	err = writePEM(cfg.CertFile, "CERTIFICATE", der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writePEM(cfg.KeyFile, "EC PRIVATE KEY", keyDer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func echo(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			io.Copy(conn, conn)
+			conn.Close()
+		}()
+	}
+}
+
+func roundTrip(conn io.ReadWriteCloser) error {
+	defer conn.Close()
+	_, err := conn.Write([]byte("hello"))
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	return err
+}
+
+func TestTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bpydialtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := newTestCA(t, dir)
+	server := ca.issue(t, "server", 2)
+	client := ca.issue(t, "client", 3)
+
+	l, err := Listen("tls://127.0.0.1:0", server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go echo(l)
+	spec := "tls://" + l.Addr().String()
+
+	conn, err := Dial(spec, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = roundTrip(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A client certificate from another CA is rejected.
+	otherDir := filepath.Join(dir, "other")
+	err = os.Mkdir(otherDir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stranger := newTestCA(t, otherDir).issue(t, "stranger", 4)
+	stranger.CAFile = client.CAFile
+	conn, err = Dial(spec, stranger)
+	if err == nil {
+		err = roundTrip(conn)
+	}
+	if err == nil {
+		t.Fatal("expected the server to reject the client certificate")
+	}
+
+	_, err = Dial(spec, nil)
+	if err != ErrNoTLS {
+		t.Fatalf("expected %v, got %v", ErrNoTLS, err)
+	}
+}
+
+func TestUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bpydialtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	spec := "unix://" + filepath.Join(dir, "sock")
+	l, err := Listen(spec, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go echo(l)
+	conn, err := Dial(spec, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = roundTrip(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func echoServe(conn io.ReadWriteCloser) {
+	io.Copy(conn, conn)
+}
+
+func TestHTTP(t *testing.T) {
+	srv := httptest.NewServer(HTTPHandler(echoServe))
+	defer srv.Close()
+	conn, err := Dial(srv.URL+"/remote", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = roundTrip(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUpgradeRequired {
+		t.Fatalf("plain request got %s", resp.Status)
+	}
+}
+
+// connectProxy tunnels CONNECT requests, counting them.
+func connectProxy(l net.Listener, n *int32) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+			req, err := http.ReadRequest(r)
+			if err != nil || req.Method != "CONNECT" {
+				return
+			}
+			atomic.AddInt32(n, 1)
+			target, err := net.Dial("tcp", req.Host)
+			if err != nil {
+				return
+			}
+			defer target.Close()
+			io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+			go io.Copy(target, r)
+			io.Copy(conn, target)
+		}()
+	}
+}
+
+func TestHTTPSProxy(t *testing.T) {
+	srv := httptest.NewTLSServer(HTTPHandler(echoServe))
+	defer srv.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var tunnels int32
+	go connectProxy(l, &tunnels)
+
+	proxyURL := &url.URL{Scheme: "http", Host: l.Addr().String()}
+	proxy := func(*http.Request) (*url.URL, error) { return proxyURL, nil }
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	conn, err := dialHTTP(srv.URL, &tls.Config{RootCAs: roots}, proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = roundTrip(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&tunnels) != 1 {
+		t.Fatal("connection did not use the proxy")
+	}
+
+	// The server certificate is checked against the system roots by default.
+	_, err = dialHTTP(srv.URL, nil, proxy)
+	if err == nil {
+		t.Fatal("expected certificate verification to fail")
+	}
+}
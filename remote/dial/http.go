@@ -0,0 +1,172 @@
+package dial
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// UpgradeProtocol is the Upgrade header value used to switch an HTTP
+// connection to the remote protocol.
+const UpgradeProtocol = "bpy-remote"
+
+// bufferedConn reads through the reader used to parse the HTTP response,
+// which may hold the first bytes of the stream.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(buf []byte) (int, error) {
+	return c.r.Read(buf)
+}
+
+func httpAddr(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	if u.Scheme == SchemeHTTPS {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
+
+// dialHTTP connects to an https:// or http:// remote, through the proxy
+// given by the environment, and upgrades the connection.
+func dialHTTP(rawurl string, tlsConfig *tls.Config, proxy func(*http.Request) (*url.URL, error)) (io.ReadWriteCloser, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", UpgradeProtocol)
+
+	addr := httpAddr(u)
+	proxyURL, err := proxy(req)
+	if err != nil {
+		return nil, err
+	}
+	var conn net.Conn
+	if proxyURL != nil {
+		conn, err = dialProxy(proxyURL, addr)
+	} else {
+		conn, err = net.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == SchemeHTTPS {
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		} else {
+			tlsConfig = tlsConfig.Clone()
+		}
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = u.Hostname()
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		err = tlsConn.Handshake()
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	err = req.Write(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || !strings.EqualFold(resp.Header.Get("Upgrade"), UpgradeProtocol) {
+		resp.Body.Close()
+		conn.Close()
+		return nil, fmt.Errorf("remote did not upgrade connection: %s", resp.Status)
+	}
+	return &bufferedConn{Conn: conn, r: r}, nil
+}
+
+// dialProxy opens a tunnel to addr with an HTTP CONNECT request.
+func dialProxy(proxyURL *url.URL, addr string) (net.Conn, error) {
+	if proxyURL.Scheme != "http" {
+		return nil, fmt.Errorf("unsupported proxy scheme: %s", proxyURL.Scheme)
+	}
+	conn, err := net.Dial("tcp", httpAddr(proxyURL))
+	if err != nil {
+		return nil, err
+	}
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		auth := proxyURL.User.Username() + ":" + password
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(auth)))
+	}
+	err = req.Write(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy refused connection: %s", resp.Status)
+	}
+	return &bufferedConn{Conn: conn, r: r}, nil
+}
+
+// HTTPHandler serves the remote protocol to https:// clients, each upgraded
+// connection is passed to serve and closed when it returns.
+func HTTPHandler(serve func(io.ReadWriteCloser)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.EqualFold(r.Header.Get("Upgrade"), UpgradeProtocol) {
+			w.Header().Set("Upgrade", UpgradeProtocol)
+			http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			http.Error(w, "connection cannot be upgraded", http.StatusInternalServerError)
+			return
+		}
+		conn, rw, err := hj.Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, err = fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: %s\r\nConnection: Upgrade\r\n\r\n", UpgradeProtocol)
+		if err == nil {
+			err = rw.Flush()
+		}
+		if err != nil {
+			return
+		}
+		serve(&bufferedConn{Conn: conn, r: rw.Reader})
+	})
+}
@@ -0,0 +1,82 @@
+package dial
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+)
+
+var ErrBadCA = errors.New("no certificates found in CA file")
+
+// TLSConfig holds the PEM files used for mutual authentication, both sides
+// present a certificate signed by CA.
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+	CAFile   string
+}
+
+func (cfg *TLSConfig) load() (tls.Certificate, *x509.CertPool, error) {
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	pem, err := ioutil.ReadFile(cfg.CAFile)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return tls.Certificate{}, nil, ErrBadCA
+	}
+	return cert, pool, nil
+}
+
+// ClientConfig returns the configuration for connecting to serverName.
+func (cfg *TLSConfig) ClientConfig(serverName string) (*tls.Config, error) {
+	cert, pool, err := cfg.load()
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ServerName:   serverName,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+func (cfg *TLSConfig) ServerConfig() (*tls.Config, error) {
+	cert, pool, err := cfg.load()
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+func dialTLS(addr string, cfg *TLSConfig) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := cfg.ClientConfig(host)
+	if err != nil {
+		return nil, err
+	}
+	return tls.Dial("tcp", addr, tlsConfig)
+}
+
+func listenTLS(addr string, cfg *TLSConfig) (net.Listener, error) {
+	tlsConfig, err := cfg.ServerConfig()
+	if err != nil {
+		return nil, err
+	}
+	return tls.Listen("tcp", addr, tlsConfig)
+}
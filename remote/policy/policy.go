@@ -0,0 +1,211 @@
+// Package policy holds the checks a server makes for each key id. Keys can
+// be made append-only, so a stolen key can add backups but not destroy
+// them: packs are only removed by a gc started with a separate admin
+// credential, over the connection that presented it, and roots only move
+// to refs whose previous ref is the current root. See proto.CapAppendOnly.
+//
+// This is a library for servers to call while handling messages, no server
+// in this repository uses it, so it enforces nothing on its own.
+package policy
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/buppyio/bpy/refs"
+	"github.com/buppyio/bpy/remote/proto"
+	"io"
+	"log"
+	"sync"
+)
+
+var (
+	ErrRemoveRefused  = errors.New("append-only key, remove outside of an admin gc")
+	ErrGCRefused      = errors.New("append-only key, gc needs the admin credential")
+	ErrBadCredential  = errors.New("bad admin credential")
+	ErrNoProof        = errors.New("append-only key, root change without ancestry proof")
+	ErrBadProof       = errors.New("ancestry proof does not match the new root")
+	ErrHistoryDropped = errors.New("append-only key, root change drops history")
+)
+
+type Policy struct {
+	AppendOnly bool
+	// AdminCredential is the HashCredential of the credential that starts
+	// gcs of an append-only key.
+	AdminCredential string
+}
+
+// Load reads a JSON object of policies keyed by key id.
+func Load(r io.Reader) (map[string]Policy, error) {
+	policies := make(map[string]Policy)
+	err := json.NewDecoder(r).Decode(&policies)
+	if err != nil {
+		return nil, err
+	}
+	return policies, nil
+}
+
+// HashCredential is what policies store instead of the admin credential.
+func HashCredential(credential string) string {
+	sum := sha256.Sum256([]byte(credential))
+	return hex.EncodeToString(sum[:])
+}
+
+// VerifyProof checks that proof is the ref with the hash newValue and
+// that its previous ref is oldValue, as sent in proto.TCasRootProof.
+func VerifyProof(oldValue, newValue string, proof []byte) error {
+	sum := sha256.Sum256(proof)
+	if hex.EncodeToString(sum[:]) != newValue {
+		return ErrBadProof
+	}
+	ref, err := refs.Decode(proof)
+	if err != nil {
+		return ErrBadProof
+	}
+	if !ref.HasPrev || hex.EncodeToString(ref.Prev[:]) != oldValue {
+		return ErrHistoryDropped
+	}
+	return nil
+}
+
+// Enforcer checks the requests made with one key id against its policy
+// and logs violations. Connections attached with the same key id must
+// share an Enforcer, each with its own Session.
+type Enforcer struct {
+	keyId  string
+	policy Policy
+	log    *log.Logger
+
+	lock sync.Mutex
+	// admin is the session that started the running admin gc, only it
+	// may remove packs or drop history, and only with adminEpoch.
+	admin      *Session
+	adminEpoch string
+}
+
+// NewEnforcer returns an Enforcer logging to l, or to the standard logger
+// if l is nil.
+func NewEnforcer(keyId string, p Policy, l *log.Logger) *Enforcer {
+	return &Enforcer{
+		keyId:  keyId,
+		policy: p,
+		log:    l,
+	}
+}
+
+// Capabilities returns the capabilities to offer in addition to the
+// usual ones.
+func (e *Enforcer) Capabilities() []string {
+	if e.policy.AppendOnly {
+		return []string{proto.CapAppendOnly}
+	}
+	return nil
+}
+
+func (e *Enforcer) violation(op string, err error) error {
+	if e.log != nil {
+		e.log.Printf("policy violation by key %s: %s: %s", e.keyId, op, err)
+	} else {
+		log.Printf("policy violation by key %s: %s: %s", e.keyId, op, err)
+	}
+	return err
+}
+
+// GCStopped ends the admin rights of the running gc, whichever
+// connection stopped it.
+func (e *Enforcer) GCStopped() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.admin = nil
+	e.adminEpoch = ""
+}
+
+// Session checks the requests of one connection. The admin rights of a
+// gc belong to the connection that presented the credential, the epoch
+// alone is not enough since any client can fetch it with TGetEpoch.
+type Session struct {
+	e *Enforcer
+}
+
+// NewSession is called for each connection attached with the key id.
+func (e *Enforcer) NewSession() *Session {
+	return &Session{e: e}
+}
+
+// Close ends the admin rights of the session when its connection closes.
+func (s *Session) Close() {
+	s.e.lock.Lock()
+	defer s.e.lock.Unlock()
+	if s.e.admin == s {
+		s.e.admin = nil
+		s.e.adminEpoch = ""
+	}
+}
+
+// StartGC checks whether a gc may be started, credential is empty for
+// TStartGC. admin is passed on to GCStarted.
+func (s *Session) StartGC(credential string) (bool, error) {
+	e := s.e
+	if !e.policy.AppendOnly {
+		return false, nil
+	}
+	if credential == "" {
+		return false, e.violation("start gc", ErrGCRefused)
+	}
+	want := []byte(e.policy.AdminCredential)
+	got := []byte(HashCredential(credential))
+	if e.policy.AdminCredential == "" || subtle.ConstantTimeCompare(want, got) != 1 {
+		return false, e.violation("start gc", ErrBadCredential)
+	}
+	return true, nil
+}
+
+// GCStarted records the epoch of a gc allowed by StartGC. Starting a gc
+// cancels the previous one, so its epoch no longer allows removes.
+func (s *Session) GCStarted(epoch string, admin bool) {
+	s.e.lock.Lock()
+	defer s.e.lock.Unlock()
+	s.e.admin = nil
+	s.e.adminEpoch = ""
+	if admin {
+		s.e.admin = s
+		s.e.adminEpoch = epoch
+	}
+}
+
+func (s *Session) adminGC(epoch string) bool {
+	s.e.lock.Lock()
+	defer s.e.lock.Unlock()
+	return s.e.admin == s && s.e.adminEpoch != "" && epoch == s.e.adminEpoch
+}
+
+func (s *Session) Remove(path, epoch string) error {
+	if !s.e.policy.AppendOnly || s.adminGC(epoch) {
+		return nil
+	}
+	return s.e.violation("remove "+path, ErrRemoveRefused)
+}
+
+// CasRoot checks a change of the root called name from oldValue, which is
+// empty if the root has no value yet. proof is nil for TCasRoot and
+// TCasNamedRoot.
+func (s *Session) CasRoot(name, oldValue, newValue string, proof []byte, epoch string) error {
+	e := s.e
+	if !e.policy.AppendOnly || oldValue == "" || s.adminGC(epoch) {
+		return nil
+	}
+	op := "change root"
+	if name != "" {
+		op += " " + name
+	}
+	if proof == nil {
+		return e.violation(op, ErrNoProof)
+	}
+	err := VerifyProof(oldValue, newValue, proof)
+	if err != nil {
+		return e.violation(op, err)
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package policy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/buppyio/bpy/refs"
+	"log"
+	"strings"
+	"testing"
+)
+
+func refValue(ref refs.Ref) string {
+	sum := sha256.Sum256(refs.Encode(ref))
+	return hex.EncodeToString(sum[:])
+}
+
+func newTestSession(appendOnly bool) (*Session, *bytes.Buffer) {
+	buf := &bytes.Buffer{}
+	p := Policy{AppendOnly: appendOnly, AdminCredential: HashCredential("secret")}
+	return NewEnforcer("key1", p, log.New(buf, "", 0)).NewSession(), buf
+}
+
+func TestLoad(t *testing.T) {
+	policies, err := Load(strings.NewReader(`{"key1": {"AppendOnly": true, "AdminCredential": "abc"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := policies["key1"]; !p.AppendOnly || p.AdminCredential != "abc" {
+		t.Fatalf("bad policy %#v", p)
+	}
+	if policies["key2"].AppendOnly {
+		t.Fatal("unlisted keys should not be append-only")
+	}
+}
+
+func TestNotAppendOnly(t *testing.T) {
+	e, buf := newTestSession(false)
+	if e.e.Capabilities() != nil {
+		t.Fatal("unexpected capabilities")
+	}
+	admin, err := e.StartGC("")
+	if err != nil || admin {
+		t.Fatal(admin, err)
+	}
+	e.GCStarted("e1", admin)
+	if err := e.Remove("packs/a.ebpack", "e0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.CasRoot("", "aa", "bb", nil, "e1"); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("unexpected log %q", buf.String())
+	}
+}
+
+func TestAppendOnlyGC(t *testing.T) {
+	e, buf := newTestSession(true)
+	_, err := e.StartGC("")
+	if err != ErrGCRefused {
+		t.Fatalf("expected %v, got %v", ErrGCRefused, err)
+	}
+	_, err = e.StartGC("wrong")
+	if err != ErrBadCredential {
+		t.Fatalf("expected %v, got %v", ErrBadCredential, err)
+	}
+	err = e.Remove("packs/a.ebpack", "")
+	if err != ErrRemoveRefused {
+		t.Fatalf("expected %v, got %v", ErrRemoveRefused, err)
+	}
+	if n := strings.Count(buf.String(), "policy violation by key key1"); n != 3 {
+		t.Fatalf("%d violations logged:\n%s", n, buf.String())
+	}
+
+	admin, err := e.StartGC("secret")
+	if err != nil || !admin {
+		t.Fatal(admin, err)
+	}
+	e.GCStarted("e1", admin)
+	if err := e.Remove("packs/a.ebpack", "e1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Remove("packs/a.ebpack", "e0"); err != ErrRemoveRefused {
+		t.Fatalf("expected %v, got %v", ErrRemoveRefused, err)
+	}
+	// A history clearing root change is allowed during the admin gc.
+	if err := e.CasRoot("", "aa", "bb", nil, "e1"); err != nil {
+		t.Fatal(err)
+	}
+	e.e.GCStopped()
+	if err := e.Remove("packs/a.ebpack", "e1"); err != ErrRemoveRefused {
+		t.Fatalf("expected %v, got %v", ErrRemoveRefused, err)
+	}
+}
+
+func TestAppendOnlyReplayedEpoch(t *testing.T) {
+	admin, _ := newTestSession(true)
+	other := admin.e.NewSession()
+	ok, err := admin.StartGC("secret")
+	if err != nil || !ok {
+		t.Fatal(ok, err)
+	}
+	admin.GCStarted("e1", ok)
+	// Anyone can read the epoch, only the admin connection may use it.
+	if err := other.Remove("packs/a.ebpack", "e1"); err != ErrRemoveRefused {
+		t.Fatalf("expected %v, got %v", ErrRemoveRefused, err)
+	}
+	if err := other.CasRoot("", "aa", "bb", nil, "e1"); err != ErrNoProof {
+		t.Fatalf("expected %v, got %v", ErrNoProof, err)
+	}
+	if err := admin.Remove("packs/a.ebpack", "e1"); err != nil {
+		t.Fatal(err)
+	}
+	admin.Close()
+	if err := admin.Remove("packs/a.ebpack", "e1"); err != ErrRemoveRefused {
+		t.Fatalf("expected %v, got %v", ErrRemoveRefused, err)
+	}
+}
+
+func TestAppendOnlyCasRoot(t *testing.T) {
+	e, buf := newTestSession(true)
+	if caps := e.e.Capabilities(); len(caps) != 1 {
+		t.Fatalf("bad capabilities %v", caps)
+	}
+	first := refs.Ref{CreatedAt: 1, Root: [32]byte{1}}
+	oldValue := refValue(first)
+	if err := e.CasRoot("", "", oldValue, nil, "e0"); err != nil {
+		t.Fatal(err)
+	}
+	var prev [32]byte
+	hex.Decode(prev[:], []byte(oldValue))
+
+	next := refs.Ref{CreatedAt: 2, Root: [32]byte{2}, HasPrev: true, Prev: prev}
+	if err := e.CasRoot("host1", oldValue, refValue(next), refs.Encode(next), "e0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.CasRoot("host1", oldValue, refValue(next), nil, "e0"); err != ErrNoProof {
+		t.Fatalf("expected %v, got %v", ErrNoProof, err)
+	}
+	// The proof must be the new root.
+	if err := e.CasRoot("host1", oldValue, refValue(first), refs.Encode(next), "e0"); err != ErrBadProof {
+		t.Fatalf("expected %v, got %v", ErrBadProof, err)
+	}
+	empty := refs.Ref{CreatedAt: 3, Root: [32]byte{3}}
+	if err := e.CasRoot("host1", oldValue, refValue(empty), refs.Encode(empty), "e0"); err != ErrHistoryDropped {
+		t.Fatalf("expected %v, got %v", ErrHistoryDropped, err)
+	}
+	other := refs.Ref{CreatedAt: 3, Root: [32]byte{3}, HasPrev: true, Prev: [32]byte{4}}
+	if err := e.CasRoot("host1", oldValue, refValue(other), refs.Encode(other), "e0"); err != ErrHistoryDropped {
+		t.Fatalf("expected %v, got %v", ErrHistoryDropped, err)
+	}
+	if n := strings.Count(buf.String(), "change root host1"); n != 4 {
+		t.Fatalf("%d violations logged:\n%s", n, buf.String())
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"reflect"
+	"strings"
 )
 
 const (
@@ -40,8 +41,57 @@ const (
 	RSTOPGC
 	TGETEPOCH
 	RGETEPOCH
+	RATTACH2
+	TRESUMEPACK
+	RRESUMEPACK
+	TSYNCPACK
+	RSYNCPACK
+	TLIST
+	RLIST
+	TWATCH
+	RWATCH
+	RROOTCHANGED
+	TGETNAMEDROOT
+	TCASNAMEDROOT
+	TLISTROOTS
+	RLISTROOTS
+	TCASROOTPROOF
+	TADMINSTARTGC
 )
 
+const (
+	Version1 = "buppy1"
+	// Servers speaking Version2 reply to TAttach with RAttach2 listing
+	// their capabilities. Old servers reject the version with an RError,
+	// and clients then attach again with Version1 and no capabilities on
+	// a new connection, as old servers may close the rejected one.
+	Version2 = "buppy2"
+)
+
+// Capabilities are optional protocol features a Version2 server may offer.
+const (
+	CapCompression     = "compression"
+	CapPipelinedWrites = "pipelined-writes"
+	CapStat            = "stat"
+	CapList            = "list"
+	CapNamedRoots      = "named-roots"
+	CapWatch           = "watch"
+	CapResume          = "resume"
+	CapAppendOnly      = "append-only"
+)
+
+// JoinCapabilities encodes capabilities for RAttach2.
+func JoinCapabilities(caps []string) string {
+	return strings.Join(caps, ",")
+}
+
+func SplitCapabilities(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
 const (
 	NOMID = 0
 )
@@ -90,6 +140,106 @@ type RCasRoot struct {
 	Ok  bool
 }
 
+// TWatch needs CapWatch. It subscribes the connection to changes of the
+// root called Name, RWatch holds its current value and every later change
+// is sent as an RRootChanged, which has no message id. Name is empty for
+// the default root, other names need CapNamedRoots.
+type TWatch struct {
+	Mid  uint16
+	Name string
+}
+
+type RWatch struct {
+	Mid       uint16
+	Value     string
+	Version   string
+	Signature string
+	Ok        bool
+}
+
+type RRootChanged struct {
+	Name      string
+	Value     string
+	Version   string
+	Signature string
+}
+
+// Servers offering CapNamedRoots keep any number of roots besides the
+// default one, each with its own version. TGetNamedRoot is answered with
+// an RGetRoot and TCasNamedRoot with an RCasRoot.
+type TGetNamedRoot struct {
+	Mid  uint16
+	Name string
+}
+
+type TCasNamedRoot struct {
+	Mid       uint16
+	Name      string
+	Version   string
+	Value     string
+	Signature string
+	Epoch     string
+}
+
+// TListRoots lists the names of the named roots in lexical order after
+// Cursor, like TList. RListRoots has them separated by newlines.
+type TListRoots struct {
+	Mid    uint16
+	Cursor string
+}
+
+type RListRoots struct {
+	Mid   uint16
+	Names string
+	Next  string
+}
+
+// Servers offer CapAppendOnly when the key attached with is append-only.
+// They then refuse TRemove unless it is sent over the connection that
+// started a gc with TAdminStartGC, with the epoch of that gc, and refuse
+// TStartGC. Root changes must be sent as TCasRootProof, Name is empty for
+// the default root. Proof is the refs.Encode of the new ref, which the
+// server hashes to check it is Value and whose previous ref must be the
+// current value of the root. Only changes made the same way as admin
+// removes may drop history. Violations are
+// answered with an RError. The proof discloses the ref, so clients only
+// send it when the user opted in.
+type TCasRootProof struct {
+	Mid       uint16
+	Name      string
+	Version   string
+	Value     string
+	Signature string
+	Epoch     string
+	Proof     []byte
+}
+
+// TAdminStartGC is TStartGC with the admin credential of an append-only
+// key, it is replied to with an RStartGC.
+type TAdminStartGC struct {
+	Mid        uint16
+	Credential string
+}
+
+const MaxRootNameLen = 255
+
+// ValidRootName reports whether name can be used for a named root, the
+// default root has the empty name.
+func ValidRootName(name string) bool {
+	if name == "" || len(name) > MaxRootNameLen || name == "." || name == ".." {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-' || c == '_' || c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
 type TAttach struct {
 	Mid            uint16
 	MaxMessageSize uint32
@@ -102,6 +252,90 @@ type RAttach struct {
 	MaxMessageSize uint32
 }
 
+type RAttach2 struct {
+	Mid            uint16
+	MaxMessageSize uint32
+	Capabilities   string
+}
+
+// TStat needs CapStat, RStat has Exists false if there is no such file.
+type TStat struct {
+	Mid  uint16
+	Name string
+}
+
+type RStat struct {
+	Mid    uint16
+	Exists bool
+	Size   uint64
+}
+
+// TList needs CapList. It lists at most Max files whose names start with
+// Prefix and sort after Cursor, in lexical order. Cursor is empty for the
+// first page, later pages pass the Next of the previous reply, the name of
+// its last file. Next is empty once the listing is complete. Entries holds
+// the files encoded with PackListEntries, servers may return fewer than
+// Max files so the reply fits in a message.
+type TList struct {
+	Mid    uint16
+	Prefix string
+	Cursor string
+	Max    uint32
+}
+
+type RList struct {
+	Mid     uint16
+	Entries []byte
+	Next    string
+}
+
+type ListEntry struct {
+	Name string
+	Size uint64
+}
+
+// ListEntrySize is the encoded size of an entry.
+func ListEntrySize(e ListEntry) int {
+	return 2 + len(e.Name) + 8
+}
+
+func PackListEntries(entries []ListEntry) []byte {
+	n := 0
+	for _, e := range entries {
+		n += ListEntrySize(e)
+	}
+	buf := make([]byte, 0, n)
+	for _, e := range entries {
+		var hdr [2]byte
+		var sz [8]byte
+		binary.BigEndian.PutUint16(hdr[:], uint16(len(e.Name)))
+		binary.BigEndian.PutUint64(sz[:], e.Size)
+		buf = append(buf, hdr[:]...)
+		buf = append(buf, e.Name...)
+		buf = append(buf, sz[:]...)
+	}
+	return buf
+}
+
+func UnpackListEntries(buf []byte) ([]ListEntry, error) {
+	entries := []ListEntry{}
+	for len(buf) != 0 {
+		if len(buf) < 2 {
+			return nil, ErrMsgCorrupt
+		}
+		namesz := int(binary.BigEndian.Uint16(buf[0:2]))
+		if len(buf) < namesz+10 {
+			return nil, ErrMsgCorrupt
+		}
+		entries = append(entries, ListEntry{
+			Name: string(buf[2 : 2+namesz]),
+			Size: binary.BigEndian.Uint64(buf[2+namesz : 10+namesz]),
+		})
+		buf = buf[10+namesz:]
+	}
+	return entries, nil
+}
+
 type TOpen struct {
 	Mid  uint16
 	Fid  uint32
@@ -171,6 +405,34 @@ type RCancelPack struct {
 	Mid uint16
 }
 
+// Servers offering CapResume keep the partial upload of a pack when the
+// connection drops, addressed by its name. TResumePack attaches it to Pid
+// on the new connection and the reply holds the number of bytes received,
+// the client resends the rest. Uploads that are never resumed are
+// cancelled by the server after a while.
+type TResumePack struct {
+	Mid  uint16
+	Pid  uint32
+	Name string
+}
+
+type RResumePack struct {
+	Mid    uint16
+	Offset uint64
+}
+
+// TSyncPack returns the number of bytes of the pack the server has received
+// so far, data before that offset never needs to be resent.
+type TSyncPack struct {
+	Mid uint16
+	Pid uint32
+}
+
+type RSyncPack struct {
+	Mid    uint16
+	Offset uint64
+}
+
 type TRemove struct {
 	Mid   uint16
 	Path  string
@@ -230,7 +492,7 @@ func ReadMessage(r io.Reader, buf []byte) (Message, error) {
 func WriteMessage(w io.Writer, m Message, buf []byte) error {
 	n, err := PackMessage(m, buf)
 	if err != nil {
-		return nil
+		return err
 	}
 	_, err = w.Write(buf[:n])
 	return err
@@ -246,6 +508,8 @@ func UnpackMessage(buf []byte) (Message, error) {
 		m = &TAttach{}
 	case RATTACH:
 		m = &RAttach{}
+	case RATTACH2:
+		m = &RAttach2{}
 	case TOPEN:
 		m = &TOpen{}
 	case ROPEN:
@@ -298,6 +562,40 @@ func UnpackMessage(buf []byte) (Message, error) {
 		m = &TGetEpoch{}
 	case RGETEPOCH:
 		m = &RGetEpoch{}
+	case TRESUMEPACK:
+		m = &TResumePack{}
+	case RRESUMEPACK:
+		m = &RResumePack{}
+	case TSYNCPACK:
+		m = &TSyncPack{}
+	case RSYNCPACK:
+		m = &RSyncPack{}
+	case TSTAT:
+		m = &TStat{}
+	case RSTAT:
+		m = &RStat{}
+	case TLIST:
+		m = &TList{}
+	case RLIST:
+		m = &RList{}
+	case TWATCH:
+		m = &TWatch{}
+	case RWATCH:
+		m = &RWatch{}
+	case RROOTCHANGED:
+		m = &RRootChanged{}
+	case TGETNAMEDROOT:
+		m = &TGetNamedRoot{}
+	case TCASNAMEDROOT:
+		m = &TCasNamedRoot{}
+	case TLISTROOTS:
+		m = &TListRoots{}
+	case RLISTROOTS:
+		m = &RListRoots{}
+	case TCASROOTPROOF:
+		m = &TCasRootProof{}
+	case TADMINSTARTGC:
+		m = &TAdminStartGC{}
 	default:
 		return nil, ErrMsgCorrupt
 	}
@@ -312,6 +610,8 @@ func GetMessageType(m Message) byte {
 		return TATTACH
 	case *RAttach:
 		return RATTACH
+	case *RAttach2:
+		return RATTACH2
 	case *TOpen:
 		return TOPEN
 	case *ROpen:
@@ -364,6 +664,40 @@ func GetMessageType(m Message) byte {
 		return TGETEPOCH
 	case *RGetEpoch:
 		return RGETEPOCH
+	case *TResumePack:
+		return TRESUMEPACK
+	case *RResumePack:
+		return RRESUMEPACK
+	case *TSyncPack:
+		return TSYNCPACK
+	case *RSyncPack:
+		return RSYNCPACK
+	case *TStat:
+		return TSTAT
+	case *RStat:
+		return RSTAT
+	case *TList:
+		return TLIST
+	case *RList:
+		return RLIST
+	case *TWatch:
+		return TWATCH
+	case *RWatch:
+		return RWATCH
+	case *RRootChanged:
+		return RROOTCHANGED
+	case *TGetNamedRoot:
+		return TGETNAMEDROOT
+	case *TCasNamedRoot:
+		return TCASNAMEDROOT
+	case *TListRoots:
+		return TLISTROOTS
+	case *RListRoots:
+		return RLISTROOTS
+	case *TCasRootProof:
+		return TCASROOTPROOF
+	case *TAdminStartGC:
+		return TADMINSTARTGC
 	}
 	panic(fmt.Sprintf("GetMessageType: internal error (%s)", m))
 }
@@ -376,6 +710,8 @@ func GetMessageId(m Message) uint16 {
 		return m.Mid
 	case *RAttach:
 		return m.Mid
+	case *RAttach2:
+		return m.Mid
 	case *TOpen:
 		return m.Mid
 	case *ROpen:
@@ -428,6 +764,40 @@ func GetMessageId(m Message) uint16 {
 		return m.Mid
 	case *RGetEpoch:
 		return m.Mid
+	case *TResumePack:
+		return m.Mid
+	case *RResumePack:
+		return m.Mid
+	case *TSyncPack:
+		return m.Mid
+	case *RSyncPack:
+		return m.Mid
+	case *TStat:
+		return m.Mid
+	case *RStat:
+		return m.Mid
+	case *TList:
+		return m.Mid
+	case *RList:
+		return m.Mid
+	case *TWatch:
+		return m.Mid
+	case *RWatch:
+		return m.Mid
+	case *RRootChanged:
+		return NOMID
+	case *TGetNamedRoot:
+		return m.Mid
+	case *TCasNamedRoot:
+		return m.Mid
+	case *TListRoots:
+		return m.Mid
+	case *RListRoots:
+		return m.Mid
+	case *TCasRootProof:
+		return m.Mid
+	case *TAdminStartGC:
+		return m.Mid
 	}
 	panic(fmt.Sprintf("GetMessageId: internal error (%s)", m))
 }
@@ -549,7 +919,7 @@ func PackMessage(m Message, buf []byte) (int, error) {
 			copy(buf, []byte(str))
 			buf = buf[sz:]
 		case reflect.Slice:
-			if len(buf) < 2 {
+			if len(buf) < 4 {
 				return 0, ErrMsgTooLarge
 			}
 			data := v.Bytes()
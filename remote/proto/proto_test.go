@@ -2,36 +2,23 @@ package proto
 
 import (
 	"reflect"
+	"strings"
 	"testing"
 )
 
 func TestEncDec(t *testing.T) {
 	buf := make([]byte, 1024, 1024)
 
-	messages := []Message{
-		&RError{
-			Mid:     1,
-			Message: "Error Message",
-		},
-		&TAttach{
-			Mid:            2,
-			Version:        "...",
-			MaxMessageSize: 1234,
-			KeyId:          "aaaaaaaaaaaaaaaaaaaaa",
-		},
-		&RAttach{
-			Mid:            3,
-			MaxMessageSize: 1234,
-		},
-		&TReadAt{
-			Mid:    4,
-			Fid:    5,
-			Offset: 0xffffffffffffffff,
-		},
-		&RReadAt{
-			Mid:  6,
-			Data: []byte{1, 2, 3},
-		},
+	messages := allMessages()
+	if len(messages) != TADMINSTARTGC+1 {
+		t.Fatalf("%d messages, expected one for each type", len(messages))
+	}
+	seen := make(map[byte]bool)
+	for _, m := range messages {
+		seen[GetMessageType(m)] = true
+	}
+	if len(seen) != len(messages) {
+		t.Fatal("message types repeated")
 	}
 
 	for _, mIn := range messages {
@@ -49,6 +36,112 @@ func TestEncDec(t *testing.T) {
 	}
 }
 
+func allMessages() []Message {
+	return []Message{
+		&RError{Mid: 1, Message: "Error Message"},
+		&TAttach{Mid: 2, Version: "...", MaxMessageSize: 1234, KeyId: "aaaaaaaaaaaaaaaaaaaaa"},
+		&RAttach{Mid: 3, MaxMessageSize: 1234},
+		&RAttach2{Mid: 4, MaxMessageSize: 1234, Capabilities: JoinCapabilities([]string{CapStat, CapWatch})},
+		&TOpen{Mid: 5, Fid: 6, Name: "packs/a.ebpack"},
+		&ROpen{Mid: 7},
+		&TReadAt{Mid: 8, Fid: 9, Offset: 0xffffffffffffffff, Size: 10},
+		&RReadAt{Mid: 11, Data: []byte{1, 2, 3}},
+		&TClose{Mid: 12, Fid: 13},
+		&RClose{Mid: 14},
+		&TNewPack{Mid: 15, Pid: 16, Name: "packs/b.ebpack"},
+		&RNewPack{Mid: 17},
+		&TWritePack{Pid: 18, Data: []byte{4, 5}},
+		&RPackError{Pid: 19, Message: "disk full"},
+		&TClosePack{Mid: 20, Pid: 21},
+		&RClosePack{Mid: 22},
+		&TCancelPack{Mid: 23, Pid: 24},
+		&RCancelPack{Mid: 25},
+		&TRemove{Mid: 26, Path: "packs/c.ebpack", Epoch: "e"},
+		&RRemove{Mid: 27},
+		&TGetRoot{Mid: 28},
+		&RGetRoot{Mid: 29, Value: "v", Version: "1", Signature: "s", Ok: true},
+		&TCasRoot{Mid: 30, Version: "2", Value: "v", Signature: "s", Epoch: "e"},
+		&RCasRoot{Mid: 31, Ok: true},
+		&TStartGC{Mid: 32},
+		&RStartGC{Mid: 33, Epoch: "e"},
+		&TStopGC{Mid: 34},
+		&RStopGC{Mid: 35},
+		&TGetEpoch{Mid: 36},
+		&RGetEpoch{Mid: 37, Epoch: "e"},
+		&TResumePack{Mid: 38, Pid: 39, Name: "packs/d.ebpack"},
+		&RResumePack{Mid: 40, Offset: 41},
+		&TSyncPack{Mid: 42, Pid: 43},
+		&RSyncPack{Mid: 44, Offset: 45},
+		&TStat{Mid: 46, Name: "packs/e.ebpack"},
+		&RStat{Mid: 47, Exists: true, Size: 48},
+		&TList{Mid: 49, Prefix: "packs/", Cursor: "packs/f.ebpack", Max: 50},
+		&RList{Mid: 51, Entries: PackListEntries([]ListEntry{{"packs/g.ebpack", 52}}), Next: "packs/g.ebpack"},
+		&TWatch{Mid: 53, Name: "host1"},
+		&RWatch{Mid: 54, Value: "v", Version: "3", Signature: "s", Ok: true},
+		&RRootChanged{Name: "host1", Value: "v", Version: "4", Signature: "s"},
+		&TGetNamedRoot{Mid: 55, Name: "host1"},
+		&TCasNamedRoot{Mid: 56, Name: "host1", Version: "5", Value: "v", Signature: "s", Epoch: "e"},
+		&TListRoots{Mid: 57, Cursor: "host0"},
+		&RListRoots{Mid: 58, Names: "host1\nhost2", Next: "host2"},
+		&TCasRootProof{Mid: 59, Name: "host1", Version: "6", Value: "v", Signature: "s", Epoch: "e", Proof: []byte{0, 1, 2}},
+		&TAdminStartGC{Mid: 60, Credential: "c"},
+	}
+}
+
+func TestMessageIds(t *testing.T) {
+	for _, m := range allMessages() {
+		mid := GetMessageId(m)
+		switch m.(type) {
+		case *TWritePack, *RPackError, *RRootChanged:
+			if mid != NOMID {
+				t.Fatalf("%#v has a message id", m)
+			}
+		default:
+			if mid == NOMID {
+				t.Fatalf("%#v has no message id", m)
+			}
+		}
+	}
+}
+
+func TestCorruptMessages(t *testing.T) {
+	buf := make([]byte, 1024, 1024)
+	for _, m := range allMessages() {
+		n, err := PackMessage(m, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = UnpackMessage(buf[:n-1])
+		if err != ErrMsgCorrupt {
+			t.Fatalf("truncated %#v: %v", m, err)
+		}
+		_, err = PackMessage(m, buf[:n-1])
+		if err != ErrMsgTooLarge {
+			t.Fatalf("packing %#v into a short buffer: %v", m, err)
+		}
+	}
+	// A well formed message with a type past the last one defined.
+	n, err := PackMessage(&TStat{Mid: 1, Name: "x"}, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf[4] = 255
+	_, err = UnpackMessage(buf[:n])
+	if err != ErrMsgCorrupt {
+		t.Fatal("unknown message type accepted")
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	if SplitCapabilities("") != nil {
+		t.Fatal("empty capabilities")
+	}
+	caps := SplitCapabilities(JoinCapabilities([]string{CapStat, CapList}))
+	if !reflect.DeepEqual(caps, []string{CapStat, CapList}) {
+		t.Fatalf("bad capabilities %v", caps)
+	}
+}
+
 func TestOverheadConstants(t *testing.T) {
 	buf := make([]byte, 1024, 1024)
 	rReadAt := &RReadAt{}
@@ -68,3 +161,39 @@ func TestOverheadConstants(t *testing.T) {
 		t.Fatalf("%d != WRITEOVERHEAD(%d)", n, WRITEOVERHEAD)
 	}
 }
+
+func TestListEntries(t *testing.T) {
+	entries := []ListEntry{{"packs/a.ebpack", 1}, {"", 0}, {"packs/b.ebpack.index", 1 << 40}}
+	buf := PackListEntries(entries)
+	n := 0
+	for _, e := range entries {
+		n += ListEntrySize(e)
+	}
+	if len(buf) != n {
+		t.Fatalf("encoded %d bytes, expected %d", len(buf), n)
+	}
+	got, err := UnpackListEntries(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, entries) {
+		t.Fatalf("%v != %v", got, entries)
+	}
+	_, err = UnpackListEntries(buf[:len(buf)-1])
+	if err != ErrMsgCorrupt {
+		t.Fatal("expected truncated entries to be corrupt")
+	}
+}
+
+func TestValidRootName(t *testing.T) {
+	for _, name := range []string{"host1", "web-01.example.com", "a_b", "A"} {
+		if !ValidRootName(name) {
+			t.Fatalf("%q should be valid", name)
+		}
+	}
+	for _, name := range []string{"", ".", "..", "a/b", "a\nb", "a:b", "caf\u00e9", strings.Repeat("a", MaxRootNameLen+1)} {
+		if ValidRootName(name) {
+			t.Fatalf("%q should be invalid", name)
+		}
+	}
+}
@@ -1,13 +1,17 @@
 package remote
 
 import (
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"github.com/buppyio/bpy"
+	"github.com/buppyio/bpy/refs"
 	"github.com/buppyio/bpy/remote/client"
+	"github.com/buppyio/bpy/remote/proto"
 	"github.com/buppyio/bpy/sig"
 	"io/ioutil"
+	"strings"
 )
 
 var (
@@ -16,6 +20,7 @@ var (
 	ErrCorruptPackListing  = errors.New("corrupt pack listing")
 	ErrCorruptRefListing   = errors.New("corrupt ref listing")
 	ErrRootSignatureFailed = errors.New("root signature failed! corruption or tampering detected!")
+	ErrBadRootName         = errors.New("bad root name")
 )
 
 type PackListing struct {
@@ -23,7 +28,43 @@ type PackListing struct {
 	Size uint64
 }
 
+// Walk calls fn for each file whose name starts with prefix, fetching the
+// listing a page at a time. The server must offer proto.CapList.
+func Walk(c *client.Client, prefix string, fn func(proto.ListEntry) error) error {
+	cursor := ""
+	for {
+		entries, next, err := c.List(prefix, cursor)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			err = fn(e)
+			if err != nil {
+				return err
+			}
+		}
+		if next == "" {
+			return nil
+		}
+		cursor = next
+	}
+}
+
 func ListPacks(c *client.Client) ([]PackListing, error) {
+	if c.HasCapability(proto.CapList) {
+		listing := []PackListing{}
+		err := Walk(c, "packs/", func(e proto.ListEntry) error {
+			listing = append(listing, PackListing{
+				Name: strings.TrimPrefix(e.Name, "packs/"),
+				Size: e.Size,
+			})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return listing, nil
+	}
 	f, err := c.Open("packs")
 	if err != nil {
 		return nil, err
@@ -51,8 +92,23 @@ func ListPacks(c *client.Client) ([]PackListing, error) {
 	return listing, nil
 }
 
-func GetRoot(c *client.Client, k *bpy.Key) ([32]byte, string, bool, error) {
-	r, err := c.TGetRoot()
+func getRoot(c *client.Client, name string) (*proto.RGetRoot, error) {
+	if name == "" {
+		return c.TGetRoot()
+	}
+	if !proto.ValidRootName(name) {
+		return nil, ErrBadRootName
+	}
+	if !c.HasCapability(proto.CapNamedRoots) {
+		return nil, client.ErrUnsupported
+	}
+	return c.TGetNamedRoot(name)
+}
+
+// GetRoot fetches the root called name, the default root has the empty
+// name.
+func GetRoot(c *client.Client, k *bpy.Key, name string) ([32]byte, string, bool, error) {
+	r, err := getRoot(c, name)
 	if err != nil {
 		return [32]byte{}, "", false, err
 	}
@@ -60,10 +116,7 @@ func GetRoot(c *client.Client, k *bpy.Key) ([32]byte, string, bool, error) {
 	if !r.Ok {
 		return [32]byte{}, r.Version, false, nil
 	}
-	signature := sig.SignValue(k, r.Value, r.Version)
-	if err != nil {
-		return [32]byte{}, "", false, err
-	}
+	signature := sig.SignValue(k, name, r.Value, r.Version)
 	if signature != r.Signature {
 		return [32]byte{}, "", false, ErrRootSignatureFailed
 	}
@@ -74,11 +127,30 @@ func GetRoot(c *client.Client, k *bpy.Key) ([32]byte, string, bool, error) {
 	return h, r.Version, true, nil
 }
 
-func CasRoot(c *client.Client, k *bpy.Key, newHash [32]byte, newVersion, epoch string) (bool, error) {
+// CasRoot points the root called name at ref, which must already be
+// stored. When the client sends proofs and the server offers
+// proto.CapAppendOnly, ref is sent in plaintext so the server can check it
+// keeps the history of the root.
+func CasRoot(c *client.Client, k *bpy.Key, name string, ref refs.Ref, newVersion, epoch string) (bool, error) {
+	proof := refs.Encode(ref)
+	newHash := sha256.Sum256(proof)
 	newValue := hex.EncodeToString(newHash[:])
-	newSignature := sig.SignValue(k, newValue, newVersion)
+	newSignature := sig.SignValue(k, name, newValue, newVersion)
 
-	r, err := c.TCasRoot(newValue, newVersion, newSignature, epoch)
+	var r *proto.RCasRoot
+	var err error
+	switch {
+	case name != "" && !proto.ValidRootName(name):
+		return false, ErrBadRootName
+	case name != "" && !c.HasCapability(proto.CapNamedRoots):
+		return false, client.ErrUnsupported
+	case c.HasCapability(proto.CapAppendOnly) && c.SendsProofs():
+		r, err = c.TCasRootProof(name, newValue, newVersion, newSignature, epoch, proof)
+	case name == "":
+		r, err = c.TCasRoot(newValue, newVersion, newSignature, epoch)
+	default:
+		r, err = c.TCasNamedRoot(name, newValue, newVersion, newSignature, epoch)
+	}
 	if err != nil {
 		return false, err
 	}
@@ -86,6 +158,46 @@ func CasRoot(c *client.Client, k *bpy.Key, newHash [32]byte, newVersion, epoch s
 	return r.Ok, nil
 }
 
+// ListRoots returns the names of all roots, starting with the empty name
+// of the default root.
+func ListRoots(c *client.Client) ([]string, error) {
+	names := []string{""}
+	if !c.HasCapability(proto.CapNamedRoots) {
+		return names, nil
+	}
+	cursor := ""
+	for {
+		page, next, err := c.ListRoots(cursor)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, page...)
+		if next == "" {
+			return names, nil
+		}
+		cursor = next
+	}
+}
+
+// GetRoots fetches every root that has a value, keyed by name.
+func GetRoots(c *client.Client, k *bpy.Key) (map[string][32]byte, error) {
+	names, err := ListRoots(c)
+	if err != nil {
+		return nil, err
+	}
+	roots := make(map[string][32]byte)
+	for _, name := range names {
+		hash, _, ok, err := GetRoot(c, k, name)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			roots[name] = hash
+		}
+	}
+	return roots, nil
+}
+
 func Remove(c *client.Client, path, epoch string) error {
 	_, err := c.TRemove(path, epoch)
 	return err
@@ -99,8 +211,16 @@ func GetEpoch(c *client.Client) (string, error) {
 	return r.Epoch, nil
 }
 
-func StartGC(c *client.Client) (string, error) {
-	r, err := c.TStartGC()
+// StartGC starts a gc, credential is needed for append-only keys and is
+// empty otherwise.
+func StartGC(c *client.Client, credential string) (string, error) {
+	var r *proto.RStartGC
+	var err error
+	if credential != "" {
+		r, err = c.TAdminStartGC(credential)
+	} else {
+		r, err = c.TStartGC()
+	}
 	if err != nil {
 		return "", err
 	}
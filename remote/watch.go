@@ -0,0 +1,154 @@
+package remote
+
+import (
+	"github.com/buppyio/bpy"
+	"github.com/buppyio/bpy/remote/client"
+	"github.com/buppyio/bpy/remote/proto"
+	"github.com/buppyio/bpy/sig"
+	"sync"
+	"time"
+)
+
+// PollInterval is how often WatchRoot asks servers without
+// proto.CapWatch for the root.
+var PollInterval = 30 * time.Second
+
+type RootUpdate struct {
+	Root    [32]byte
+	Version string
+	// Err is ErrRootSignatureFailed if the server sent a root that isn't
+	// signed by the key.
+	Err error
+}
+
+// WatchRoot sends the current value of the root called name and then every
+// new one on the returned channel, until stop is called or the client is
+// closed. Only the latest update is kept if the receiver falls behind.
+func WatchRoot(c *client.Client, k *bpy.Key, name string) (<-chan RootUpdate, func(), error) {
+	updates := make(chan RootUpdate, 1)
+	done := make(chan struct{})
+	var once sync.Once
+	stop := func() { once.Do(func() { close(done) }) }
+
+	send := func(u RootUpdate) {
+		select {
+		case <-updates:
+		default:
+		}
+		updates <- u
+	}
+
+	w, err := c.Watch(name)
+	if err == client.ErrUnsupported {
+		go pollRoot(c, k, name, send, done, updates)
+		return updates, stop, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	go func() {
+		defer close(updates)
+		defer w.Close()
+		for {
+			select {
+			case <-done:
+				return
+			case m, ok := <-w.C:
+				if !ok {
+					return
+				}
+				send(checkRoot(k, m))
+			}
+		}
+	}()
+	return updates, stop, nil
+}
+
+func checkRoot(k *bpy.Key, m *proto.RRootChanged) RootUpdate {
+	if sig.SignValue(k, m.Name, m.Value, m.Version) != m.Signature {
+		return RootUpdate{Err: ErrRootSignatureFailed}
+	}
+	h, err := bpy.ParseHash(m.Value)
+	if err != nil {
+		return RootUpdate{Err: err}
+	}
+	return RootUpdate{Root: h, Version: m.Version}
+}
+
+func pollRoot(c *client.Client, k *bpy.Key, name string, send func(RootUpdate), done chan struct{}, updates chan RootUpdate) {
+	defer close(updates)
+	ticker := time.NewTicker(PollInterval)
+	defer ticker.Stop()
+	lastVersion := ""
+	for {
+		root, version, ok, err := GetRoot(c, k, name)
+		switch {
+		case err == client.ErrClientClosed:
+			return
+		case err == ErrRootSignatureFailed:
+			send(RootUpdate{Err: err})
+		case err == nil && ok && version != lastVersion:
+			lastVersion = version
+			send(RootUpdate{Root: root, Version: version})
+		}
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Root keeps track of the latest value of a root, so callers needing it
+// don't have to ask the server each time.
+type Root struct {
+	lock    sync.Mutex
+	root    [32]byte
+	version string
+	ok      bool
+	err     error
+	stop    func()
+}
+
+func NewRoot(c *client.Client, k *bpy.Key, name string) (*Root, error) {
+	root, version, ok, err := GetRoot(c, k, name)
+	if err != nil {
+		return nil, err
+	}
+	updates, stop, err := WatchRoot(c, k, name)
+	if err != nil {
+		return nil, err
+	}
+	r := &Root{
+		root:    root,
+		version: version,
+		ok:      ok,
+		stop:    stop,
+	}
+	go func() {
+		for u := range updates {
+			r.lock.Lock()
+			if u.Err != nil {
+				r.err = u.Err
+			} else {
+				r.root, r.version, r.ok, r.err = u.Root, u.Version, true, nil
+			}
+			r.lock.Unlock()
+		}
+	}()
+	return r, nil
+}
+
+// Get returns the same values as GetRoot would.
+func (r *Root) Get() ([32]byte, string, bool, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.err != nil {
+		return [32]byte{}, "", false, r.err
+	}
+	return r.root, r.version, r.ok, nil
+}
+
+func (r *Root) Close() {
+	r.stop()
+}
@@ -0,0 +1,83 @@
+package repair
+
+import (
+	"crypto/sha256"
+	"errors"
+	"github.com/buppyio/bpy"
+	"github.com/buppyio/bpy/fs/fsutil"
+	"github.com/buppyio/bpy/fsck"
+)
+
+type Result struct {
+	// Repaired is the number of damaged chunks that were stored again.
+	Repaired int
+	// Unrepaired holds the problems no local file could fix.
+	Unrepaired []fsck.Problem
+}
+
+// matchStore finds damaged chunks while local files are chunked, nothing
+// else is stored.
+type matchStore struct {
+	store    bpy.Rewriter
+	damaged  map[[32]byte]struct{}
+	repaired map[[32]byte]struct{}
+}
+
+func (m *matchStore) Get(hash [32]byte) ([]byte, error) {
+	return nil, errors.New("repair store is write only")
+}
+
+func (m *matchStore) Put(val []byte) ([32]byte, error) {
+	hash := sha256.Sum256(val)
+	_, ok := m.damaged[hash]
+	if !ok {
+		return hash, nil
+	}
+	_, ok = m.repaired[hash]
+	if ok {
+		return hash, nil
+	}
+	_, err := m.store.Rewrite(val)
+	if err != nil {
+		return hash, err
+	}
+	m.repaired[hash] = struct{}{}
+	return hash, nil
+}
+
+func (m *matchStore) Flush() error { return nil }
+func (m *matchStore) Close() error { return nil }
+
+// Repair chunks the files and directories at each path exactly as put
+// does, any chunk matching the hash of a damaged chunk in problems is
+// rewritten into store. The store must be flushed to upload the repaired
+// chunks.
+func Repair(store bpy.Rewriter, problems []fsck.Problem, paths []string) (*Result, error) {
+	m := &matchStore{
+		store:    store,
+		damaged:  make(map[[32]byte]struct{}),
+		repaired: make(map[[32]byte]struct{}),
+	}
+	for _, p := range problems {
+		if p.Hash != [32]byte{} {
+			m.damaged[p.Hash] = struct{}{}
+		}
+	}
+	for _, path := range paths {
+		if len(m.repaired) == len(m.damaged) {
+			break
+		}
+		_, err := fsutil.CpHostToFs(m, path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	result := &Result{Repaired: len(m.repaired)}
+	for _, p := range problems {
+		_, ok := m.repaired[p.Hash]
+		if !ok {
+			result.Unrepaired = append(result.Unrepaired, p)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,85 @@
+package repair
+
+import (
+	"crypto/sha256"
+	"github.com/buppyio/bpy/fs"
+	"github.com/buppyio/bpy/fs/fsutil"
+	"github.com/buppyio/bpy/fsck"
+	"github.com/buppyio/bpy/testhelp"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type rewriteRecorder map[[32]byte][]byte
+
+func (r rewriteRecorder) Rewrite(val []byte) ([32]byte, error) {
+	hash := sha256.Sum256(val)
+	r[hash] = append([]byte{}, val...)
+	return hash, nil
+}
+
+func TestRepair(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "buppytestrepair")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	randd := filepath.Join(tmp, "rand")
+	err = os.Mkdir(randd, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 200*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	err = ioutil.WriteFile(filepath.Join(randd, "f"), data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := testhelp.NewMemStore()
+	dirEnt, err := fsutil.CpHostToFs(store, randd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node, err := store.Get(dirEnt.HTree.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirLeaf := sha256.Sum256(node)
+	ents, err := fs.ReadDir(store, dirEnt.HTree.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node, err = store.Get(ents[1].HTree.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fileLeaf, lost [32]byte
+	copy(fileLeaf[:], node[9:41])
+	lost[0] = 1
+	problems := []fsck.Problem{
+		{Hash: dirLeaf, Path: "/rand", Err: fsck.ErrHashMismatch},
+		{Hash: fileLeaf, Path: "/rand/f", Err: fsck.ErrMissing},
+		{Hash: lost, Path: "/rand/g", Err: fsck.ErrMissing},
+		{Path: "packs/x.ebpack", Err: fsck.ErrMissing},
+	}
+
+	rec := make(rewriteRecorder)
+	result, err := Repair(rec, problems, []string{randd})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Repaired != 2 || len(rec) != 2 {
+		t.Fatalf("expected two repaired chunks, got %d", result.Repaired)
+	}
+	for _, hash := range [][32]byte{dirLeaf, fileLeaf} {
+		if _, ok := rec[hash]; !ok {
+			t.Fatal("damaged chunk not rewritten")
+		}
+	}
+	if len(result.Unrepaired) != 2 || result.Unrepaired[0].Path != "/rand/g" || result.Unrepaired[1].Path != "packs/x.ebpack" {
+		t.Fatalf("bad unrepaired problems %v", result.Unrepaired)
+	}
+}
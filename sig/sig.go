@@ -8,8 +8,15 @@ import (
 	"github.com/buppyio/bpy"
 )
 
-func SignValue(k *bpy.Key, value, version string) string {
+// SignValue signs the value of the root called name. The default root has
+// an empty name and keeps the signature it had before roots were named, so
+// existing repositories stay valid. Named roots sign a distinct prefix so
+// no named root signature is valid for the default root.
+func SignValue(k *bpy.Key, name, value, version string) string {
 	toSign := fmt.Sprintf("%s:%s", value, version)
+	if name != "" {
+		toSign = fmt.Sprintf("root\x00%s\x00%s\x00%s", name, value, version)
+	}
 	mac := hmac.New(sha256.New, k.HmacKey[:])
 	mac.Write([]byte(toSign))
 	hashMac := mac.Sum(nil)
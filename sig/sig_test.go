@@ -20,16 +20,24 @@ func TestSigs(t *testing.T) {
 	val1 := "a"
 	val2 := "b"
 
-	signed := SignValue(&k1, val1, ver1)
+	signed := SignValue(&k1, "", val1, ver1)
 
-	if SignValue(&k1, val1, ver2) == signed {
+	if SignValue(&k1, "", val1, ver2) == signed {
 		t.Fatal("signatures shouldn't match")
 	}
-	if SignValue(&k1, val2, ver1) == signed {
+	if SignValue(&k1, "", val2, ver1) == signed {
 		t.Fatal("signatures shouldn't match")
 	}
-	if SignValue(&k2, val1, ver1) == signed {
+	if SignValue(&k2, "", val1, ver1) == signed {
 		t.Fatal("signatures shouldn't match")
 	}
-
+	if SignValue(&k1, "host1", val1, ver1) == signed {
+		t.Fatal("signatures shouldn't match")
+	}
+	if SignValue(&k1, "host1", val1, ver1) == SignValue(&k1, "host2", val1, ver1) {
+		t.Fatal("signatures shouldn't match")
+	}
+	if SignValue(&k1, "host1", val1, ver1) == SignValue(&k1, "", "host1:"+val1, ver1) {
+		t.Fatal("named root signature valid for the default root")
+	}
 }
@@ -0,0 +1,203 @@
+package testhelp
+
+import (
+	"fmt"
+	"github.com/buppyio/bpy/remote/client"
+	"github.com/buppyio/bpy/remote/proto"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MemRemote is an in memory remote speaking proto.Version2 with
+// proto.CapList and proto.CapStat, for tests of code using a client.
+type MemRemote struct {
+	lock   sync.Mutex
+	files  map[string][]byte
+	root   *proto.RGetRoot
+	epoch  int
+	gcLive bool
+}
+
+func NewMemRemote() *MemRemote {
+	return &MemRemote{
+		files: make(map[string][]byte),
+		root:  &proto.RGetRoot{},
+	}
+}
+
+// Client returns a client attached to the remote.
+func (r *MemRemote) Client() (*client.Client, error) {
+	return client.Dial(func() (io.ReadWriteCloser, error) {
+		cconn, sconn := net.Pipe()
+		go r.serve(sconn)
+		return cconn, nil
+	}, "key")
+}
+
+// ReadFile returns the contents of a file, or false if there is none.
+func (r *MemRemote) ReadFile(name string) ([]byte, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	data, ok := r.files[name]
+	return append([]byte{}, data...), ok
+}
+
+func (r *MemRemote) WriteFile(name string, data []byte) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.files[name] = append([]byte{}, data...)
+}
+
+func (r *MemRemote) RemoveFile(name string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.files, name)
+}
+
+// Files returns the sorted names of the files starting with prefix.
+func (r *MemRemote) Files(prefix string) []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var names []string
+	for name := range r.files {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (r *MemRemote) serve(conn net.Conn) {
+	defer conn.Close()
+	buf := make([]byte, 1024*1024)
+	wbuf := make([]byte, 1024*1024)
+	fids := make(map[uint32][]byte)
+	pids := make(map[uint32]string)
+	uploads := make(map[string][]byte)
+	for {
+		m, err := proto.ReadMessage(conn, buf)
+		if err != nil {
+			return
+		}
+		var resp proto.Message
+		r.lock.Lock()
+		switch m := m.(type) {
+		case *proto.TAttach:
+			resp = &proto.RAttach2{Mid: m.Mid, MaxMessageSize: 1024 * 1024, Capabilities: proto.JoinCapabilities([]string{proto.CapList, proto.CapStat})}
+		case *proto.TOpen:
+			data, ok := r.files[m.Name]
+			if !ok {
+				resp = &proto.RError{Mid: m.Mid, Message: "no such file"}
+				break
+			}
+			fids[m.Fid] = data
+			resp = &proto.ROpen{Mid: m.Mid}
+		case *proto.TReadAt:
+			data := fids[m.Fid]
+			if m.Offset > uint64(len(data)) {
+				resp = &proto.RError{Mid: m.Mid, Message: "bad offset"}
+				break
+			}
+			data = data[m.Offset:]
+			if uint64(len(data)) > uint64(m.Size) {
+				data = data[:m.Size]
+			}
+			resp = &proto.RReadAt{Mid: m.Mid, Data: data}
+		case *proto.TClose:
+			delete(fids, m.Fid)
+			resp = &proto.RClose{Mid: m.Mid}
+		case *proto.TNewPack:
+			pids[m.Pid] = m.Name
+			uploads[m.Name] = []byte{}
+			resp = &proto.RNewPack{Mid: m.Mid}
+		case *proto.TWritePack:
+			uploads[pids[m.Pid]] = append(uploads[pids[m.Pid]], m.Data...)
+		case *proto.TClosePack:
+			r.files[pids[m.Pid]] = uploads[pids[m.Pid]]
+			delete(uploads, pids[m.Pid])
+			delete(pids, m.Pid)
+			resp = &proto.RClosePack{Mid: m.Mid}
+		case *proto.TCancelPack:
+			delete(uploads, pids[m.Pid])
+			delete(pids, m.Pid)
+			resp = &proto.RCancelPack{Mid: m.Mid}
+		case *proto.TSyncPack:
+			resp = &proto.RSyncPack{Mid: m.Mid, Offset: uint64(len(uploads[pids[m.Pid]]))}
+		case *proto.TRemove:
+			if m.Epoch != r.epochString() {
+				resp = &proto.RError{Mid: m.Mid, Message: "bad epoch"}
+				break
+			}
+			delete(r.files, m.Path)
+			resp = &proto.RRemove{Mid: m.Mid}
+		case *proto.TStat:
+			data, ok := r.files[m.Name]
+			resp = &proto.RStat{Mid: m.Mid, Exists: ok, Size: uint64(len(data))}
+		case *proto.TList:
+			resp = r.list(m)
+		case *proto.TGetRoot:
+			root := *r.root
+			root.Mid = m.Mid
+			resp = &root
+		case *proto.TCasRoot:
+			if m.Epoch != r.epochString() || m.Version == r.root.Version {
+				resp = &proto.RCasRoot{Mid: m.Mid}
+				break
+			}
+			r.root = &proto.RGetRoot{Value: m.Value, Version: m.Version, Signature: m.Signature, Ok: true}
+			resp = &proto.RCasRoot{Mid: m.Mid, Ok: true}
+		case *proto.TGetEpoch:
+			resp = &proto.RGetEpoch{Mid: m.Mid, Epoch: r.epochString()}
+		case *proto.TStartGC:
+			if r.gcLive {
+				resp = &proto.RError{Mid: m.Mid, Message: "gc already running"}
+				break
+			}
+			r.gcLive = true
+			r.epoch++
+			resp = &proto.RStartGC{Mid: m.Mid, Epoch: r.epochString()}
+		case *proto.TStopGC:
+			r.gcLive = false
+			resp = &proto.RStopGC{Mid: m.Mid}
+		default:
+			resp = &proto.RError{Mid: proto.GetMessageId(m), Message: "unsupported"}
+		}
+		r.lock.Unlock()
+		if resp == nil {
+			continue
+		}
+		err = proto.WriteMessage(conn, resp, wbuf)
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (r *MemRemote) epochString() string {
+	return fmt.Sprintf("%d", r.epoch)
+}
+
+func (r *MemRemote) list(m *proto.TList) *proto.RList {
+	var names []string
+	for name := range r.files {
+		if strings.HasPrefix(name, m.Prefix) && name > m.Cursor {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	resp := &proto.RList{Mid: m.Mid}
+	if len(names) > int(m.Max) {
+		names = names[:m.Max]
+		resp.Next = names[len(names)-1]
+	}
+	var entries []proto.ListEntry
+	for _, name := range names {
+		entries = append(entries, proto.ListEntry{Name: name, Size: uint64(len(r.files[name]))})
+	}
+	resp.Entries = proto.PackListEntries(entries)
+	return resp
+}